@@ -0,0 +1,118 @@
+//    Copyright 2017 Red Hat, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	jsonAccessLogFormat     = "json"
+	combinedAccessLogFormat = "combined"
+	noAccessLogFormat       = "none"
+)
+
+// requestInfo collects details about a request while it is handled, for
+// the access log.
+type requestInfo struct {
+	// path is the path as requested by the client, before any rewriting.
+	path          string
+	clientIP      string
+	subject       string
+	providerAlias string
+	upstream      string
+}
+
+type requestInfoKey struct{}
+
+func contextWithRequestInfo(ctx context.Context, info *requestInfo) context.Context {
+	return context.WithValue(ctx, requestInfoKey{}, info)
+}
+
+// requestInfoFromContext returns the request info of ctx. It never returns
+// nil so callers can set fields unconditionally.
+func requestInfoFromContext(ctx context.Context) *requestInfo {
+	if info, ok := ctx.Value(requestInfoKey{}).(*requestInfo); ok {
+		return info
+	}
+	return &requestInfo{}
+}
+
+// accessLogger writes one line per handled request.
+type accessLogger struct {
+	format string
+	logger *zap.SugaredLogger
+
+	mu  sync.Mutex
+	out io.Writer
+}
+
+func newAccessLogger(format string, logger *zap.SugaredLogger, out io.Writer) (*accessLogger, error) {
+	switch format {
+	case jsonAccessLogFormat, combinedAccessLogFormat, noAccessLogFormat:
+	default:
+		return nil, fmt.Errorf("unknown access log format %q", format)
+	}
+	return &accessLogger{format: format, logger: logger, out: out}, nil
+}
+
+func (a *accessLogger) Log(req *http.Request, rec *statusRecorder, start time.Time, info *requestInfo) {
+	switch a.format {
+	case jsonAccessLogFormat:
+		a.logger.Infow(
+			"Request handled",
+			"remoteAddr", req.RemoteAddr,
+			"clientIP", info.clientIP,
+			"method", req.Method,
+			"path", info.path,
+			"status", rec.Status(),
+			"duration", time.Since(start),
+			"bytes", rec.Bytes(),
+			"subject", info.subject,
+			"providerAlias", info.providerAlias,
+			"upstream", info.upstream,
+			"userAgent", req.UserAgent(),
+		)
+	case combinedAccessLogFormat:
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		fmt.Fprintf(a.out, "%s - %s [%s] \"%s %s %s\" %d %d %q %q\n",
+			info.clientIP,
+			orDash(info.subject),
+			start.Format("02/Jan/2006:15:04:05 -0700"),
+			req.Method,
+			req.RequestURI,
+			req.Proto,
+			rec.Status(),
+			rec.Bytes(),
+			orDash(req.Referer()),
+			orDash(req.UserAgent()),
+		)
+	}
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,289 @@
+//    Copyright 2017 Red Hat, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/syslog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+// Audit event outcomes.
+const (
+	acceptAuditOutcome = "accept"
+	rejectAuditOutcome = "reject"
+)
+
+type auditRecord struct {
+	Seq           uint64 `json:"seq"`
+	Time          string `json:"time"`
+	Event         string `json:"event"`
+	Outcome       string `json:"outcome"`
+	Reason        string `json:"reason,omitempty"`
+	Detail        string `json:"detail,omitempty"`
+	Subject       string `json:"subject,omitempty"`
+	ProviderAlias string `json:"providerAlias,omitempty"`
+	RemoteAddr    string `json:"remoteAddr"`
+	ClientIP      string `json:"clientIP"`
+	Method        string `json:"method"`
+	Path          string `json:"path"`
+	// PrevHash is the hash of the previous record, chaining records so that
+	// removing or altering one is detectable. Hashes are HMAC-SHA256 keyed
+	// with the audit log key, so only its holders can forge a chain.
+	PrevHash string `json:"prevHash"`
+	Hash     string `json:"hash,omitempty"`
+}
+
+// auditLog records security relevant decisions as hash-chained JSON lines.
+// A nil auditLog discards all records.
+type auditLog struct {
+	key      []byte
+	logger   *zap.SugaredLogger
+	failures prometheus.Counter
+
+	mu       sync.Mutex
+	w        io.Writer
+	seq      uint64
+	prevHash string
+}
+
+// newAuditLog opens the audit sink: stdout, syslog or a file path to append
+// to, chaining records with the key in keyFile. Records appended to a file
+// continue the chain of its last record. Records that can't be written are
+// logged and counted in failures.
+func newAuditLog(target, keyFile string, logger *zap.SugaredLogger, failures prometheus.Counter) (*auditLog, error) {
+	if len(target) == 0 {
+		return nil, nil
+	}
+	if len(keyFile) == 0 {
+		return nil, errors.New("audit-log requires audit-log-key-file")
+	}
+	b, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	a := &auditLog{
+		key:      bytes.TrimSpace(b),
+		logger:   logger,
+		failures: failures,
+		prevHash: hex.EncodeToString(make([]byte, sha256.Size)),
+	}
+	if len(a.key) == 0 {
+		return nil, fmt.Errorf("audit log key %s is empty", keyFile)
+	}
+
+	switch target {
+	case "stdout":
+		a.w = os.Stdout
+	case "syslog":
+		sw, err := syslog.New(syslog.LOG_AUTHPRIV|syslog.LOG_INFO, "token-rp")
+		if err != nil {
+			return nil, err
+		}
+		a.w = sw
+	default:
+		f, err := os.OpenFile(target, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return nil, err
+		}
+		if err = a.resume(f); err != nil {
+			_ = f.Close()
+			return nil, fmt.Errorf("audit log %s: %v", target, err)
+		}
+		a.w = f
+	}
+	return a, nil
+}
+
+// resume continues the chain of the last record in f, which must have been
+// written with the same key. A partial record left by an interrupted write
+// is truncated first, as it can't be verified.
+func (a *auditLog) resume(f *os.File) error {
+	partial, err := truncatePartialLine(f)
+	if err != nil {
+		return err
+	}
+	if partial > 0 {
+		a.logger.Warnw(
+			"Truncated partial audit record",
+			"file", f.Name(),
+			"bytes", partial,
+		)
+	}
+	line, err := lastLine(f)
+	if err != nil || len(line) == 0 {
+		return err
+	}
+	var last auditRecord
+	if err = json.Unmarshal(line, &last); err != nil {
+		return fmt.Errorf("last record is malformed: %v", err)
+	}
+	hash := last.Hash
+	last.Hash = ""
+	unhashed, err := json.Marshal(last)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal([]byte(a.sum(unhashed)), []byte(hash)) {
+		return errors.New("hash of last record doesn't match, was it written with another key or altered?")
+	}
+	a.seq = last.Seq
+	a.prevHash = hash
+	return nil
+}
+
+// sum returns the hex encoded HMAC of b.
+func (a *auditLog) sum(b []byte) string {
+	mac := hmac.New(sha256.New, a.key)
+	mac.Write(b)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// truncatePartialLine removes the bytes following the last newline of f and
+// returns their number.
+func truncatePartialLine(f *os.File) (int64, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	size := fi.Size()
+	const chunk = 4096
+	for end := size; end > 0; {
+		start := end - chunk
+		if start < 0 {
+			start = 0
+		}
+		buf := make([]byte, end-start)
+		if _, err = f.ReadAt(buf, start); err != nil {
+			return 0, err
+		}
+		if i := bytes.LastIndexByte(buf, '\n'); i >= 0 {
+			end = start + int64(i) + 1
+			if end == size {
+				return 0, nil
+			}
+			return size - end, f.Truncate(end)
+		}
+		end = start
+	}
+	if size == 0 {
+		return 0, nil
+	}
+	return size, f.Truncate(0)
+}
+
+// lastLine returns the last non-empty line of f, reading backwards from
+// its end.
+func lastLine(f *os.File) ([]byte, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	const chunk = 4096
+	var tail []byte
+	for end := fi.Size(); end > 0; {
+		start := end - chunk
+		if start < 0 {
+			start = 0
+		}
+		buf := make([]byte, end-start)
+		if _, err = f.ReadAt(buf, start); err != nil {
+			return nil, err
+		}
+		tail = append(buf, tail...)
+		trimmed := bytes.TrimRight(tail, "\n")
+		if i := bytes.LastIndexByte(trimmed, '\n'); i >= 0 {
+			return trimmed[i+1:], nil
+		}
+		end = start
+	}
+	return bytes.TrimRight(tail, "\n"), nil
+}
+
+// Record writes an audit record for req.
+func (a *auditLog) Record(req *http.Request, event, outcome, reason, detail string) {
+	if a == nil {
+		return
+	}
+
+	info := requestInfoFromContext(req.Context())
+	r := auditRecord{
+		Time:          time.Now().UTC().Format(time.RFC3339Nano),
+		Event:         event,
+		Outcome:       outcome,
+		Reason:        reason,
+		Detail:        redact(detail),
+		Subject:       info.subject,
+		ProviderAlias: info.providerAlias,
+		RemoteAddr:    req.RemoteAddr,
+		ClientIP:      info.clientIP,
+		Method:        req.Method,
+		Path:          info.path,
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	// The chain only advances once a record is written, so that the records
+	// in the sink keep verifying after a failed one.
+	if err := a.write(&r); err != nil {
+		a.failures.Inc()
+		a.logger.Errorw(
+			"Failed to write audit record",
+			"event", event,
+			"outcome", outcome,
+			"reason", reason,
+			"error", err,
+		)
+	}
+}
+
+// write chains r to the last record and writes it. a.mu must be held.
+func (a *auditLog) write(r *auditRecord) error {
+	r.Seq = a.seq + 1
+	r.PrevHash = a.prevHash
+
+	// The hash covers the record as serialized without the hash itself.
+	unhashed, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	r.Hash = a.sum(unhashed)
+
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	if _, err = a.w.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	a.seq = r.Seq
+	a.prevHash = r.Hash
+	return nil
+}
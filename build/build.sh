@@ -37,6 +37,8 @@ fi
 
 export CGO_ENABLED=0
 export GOARCH="${ARCH}"
+export GO111MODULE=off
+export GOCACHE=/go/.cache
 
 export PKGS=$(go list ./... | grep -v /vendor/)
 
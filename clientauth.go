@@ -0,0 +1,198 @@
+//    Copyright 2017 Red Hat, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+)
+
+// clientVerifier verifies the certificates of inbound callers against the
+// client-ca bundle, the trust bundles of the Workload API and the revocation
+// lists in client-crl, re-reading the files whenever they change.
+type clientVerifier struct {
+	caFile  string
+	crlFile string
+
+	mu      sync.Mutex
+	roots   *x509.CertPool
+	revoked map[string]bool
+	version string
+}
+
+// newClientVerifier returns a verifier of client-ca and client-crl, which
+// must be readable if set.
+func newClientVerifier(caFile, crlFile string) (*clientVerifier, error) {
+	v := &clientVerifier{caFile: caFile, crlFile: crlFile}
+	if _, _, err := v.load(); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// load returns the trusted roots and revoked serials, reading the files
+// again if they were modified. If they can't be read, the previous ones are
+// kept.
+func (v *clientVerifier) load() (*x509.CertPool, map[string]bool, error) {
+	var files []string
+	for _, f := range []string{v.caFile, v.crlFile} {
+		if len(f) > 0 {
+			files = append(files, f)
+		}
+	}
+	version := filesVersion(files...)
+	if workloadID != nil {
+		version += fmt.Sprintf("bundles@%d", workloadID.bundlesVersion.Load())
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if v.roots != nil && version == v.version {
+		return v.roots, v.revoked, nil
+	}
+	roots, revoked, err := loadClientCAs(v.caFile, v.crlFile)
+	if err != nil {
+		if v.roots != nil {
+			return v.roots, v.revoked, nil
+		}
+		return nil, nil, err
+	}
+	if workloadID != nil {
+		for _, root := range workloadID.Roots() {
+			roots.AddCert(root)
+		}
+	}
+	v.roots, v.revoked, v.version = roots, revoked, version
+	return roots, revoked, nil
+}
+
+// VerifyConnection verifies the chain presented by a client, if any, for use
+// with tls.RequestClientCert. Unlike VerifyPeerCertificate, it also runs on
+// resumed sessions, whose certificate may have been revoked meanwhile.
+// Clients without certificate are left to the handler.
+func (v *clientVerifier) VerifyConnection(cs tls.ConnectionState) error {
+	certs := cs.PeerCertificates
+	if len(certs) == 0 {
+		return nil
+	}
+	roots, revoked, err := v.load()
+	if err != nil {
+		return err
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, c := range certs[1:] {
+		intermediates.AddCert(c)
+	}
+	chains, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		return err
+	}
+	for _, c := range chains[0] {
+		if revoked[revocationKey(c.RawIssuer, c.SerialNumber.String())] {
+			return fmt.Errorf("client certificate %s is revoked", c.Subject)
+		}
+	}
+	return nil
+}
+
+// revocationKey identifies a certificate by issuer and serial number.
+func revocationKey(rawIssuer []byte, serial string) string {
+	return string(rawIssuer) + "/" + serial
+}
+
+// loadClientCAs reads the PEM-encoded certificates of caFile and the PEM or
+// DER-encoded revocation lists of crlFile, each of which must be signed by
+// one of the certificates.
+func loadClientCAs(caFile, crlFile string) (*x509.CertPool, map[string]bool, error) {
+	if len(caFile) == 0 {
+		return x509.NewCertPool(), make(map[string]bool), nil
+	}
+	b, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read client CA: %v", err)
+	}
+	var cas []*x509.Certificate
+	for block, rest := pem.Decode(b); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		ca, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid client CA: %v", err)
+		}
+		cas = append(cas, ca)
+	}
+	if len(cas) == 0 {
+		return nil, nil, fmt.Errorf("no certificates in client CA %s", caFile)
+	}
+	roots := x509.NewCertPool()
+	for _, ca := range cas {
+		roots.AddCert(ca)
+	}
+
+	revoked := make(map[string]bool)
+	if len(crlFile) == 0 {
+		return roots, revoked, nil
+	}
+	if b, err = ioutil.ReadFile(crlFile); err != nil {
+		return nil, nil, fmt.Errorf("failed to read client CRL: %v", err)
+	}
+	var ders [][]byte
+	for block, rest := pem.Decode(b); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type == "X509 CRL" {
+			ders = append(ders, block.Bytes)
+		}
+	}
+	if len(ders) == 0 {
+		ders = append(ders, b)
+	}
+	for _, der := range ders {
+		crl, err := x509.ParseRevocationList(der)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid client CRL: %v", err)
+		}
+		if err = checkCRLSignature(crl, cas); err != nil {
+			return nil, nil, err
+		}
+		if !crl.NextUpdate.IsZero() && time.Now().After(crl.NextUpdate) {
+			return nil, nil, fmt.Errorf("client CRL of %s expired at %v", crl.Issuer, crl.NextUpdate)
+		}
+		for _, e := range crl.RevokedCertificateEntries {
+			revoked[revocationKey(crl.RawIssuer, e.SerialNumber.String())] = true
+		}
+	}
+	return roots, revoked, nil
+}
+
+// checkCRLSignature checks that crl is signed by one of cas.
+func checkCRLSignature(crl *x509.RevocationList, cas []*x509.Certificate) error {
+	for _, ca := range cas {
+		if string(ca.RawSubject) == string(crl.RawIssuer) && crl.CheckSignatureFrom(ca) == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("client CRL of %s isn't signed by a client CA", crl.Issuer)
+}
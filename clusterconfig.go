@@ -0,0 +1,200 @@
+//    Copyright 2017 Red Hat, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/syndesisio/token-rp/pkg/config"
+	"github.com/syndesisio/token-rp/pkg/kube"
+	"go.uber.org/zap"
+)
+
+// caBundleKey is the ConfigMap or Secret key holding PEM encoded root
+// certificates, which are written to a file added to ca-cert.
+const caBundleKey = "ca-bundle"
+
+var (
+	clusterOnce   sync.Once
+	clusterClient *kube.Client
+	clusterErr    error
+
+	caBundleMu  sync.Mutex
+	caBundleDir string
+)
+
+// initClusterClient sets up clusterClient on first use.
+func initClusterClient() error {
+	clusterOnce.Do(func() {
+		clusterClient, clusterErr = kube.InCluster()
+	})
+	return clusterErr
+}
+
+// applyConfig sets the flags of fs not given on the command line from the
+// environment, the vault-secret, the config-secret and config-map and
+// configFile.
+func applyConfig(fs *flag.FlagSet, configFile string) error {
+	sources, _, err := configSources()
+	if err != nil {
+		return err
+	}
+	return config.Apply(fs, configFile, sources...)
+}
+
+// configSources returns the vault-secret followed by the config-secret and
+// config-map as sources, along with their versions.
+func configSources() ([]config.Source, string, error) {
+	sources, versions, err := vaultConfigSources()
+	if err != nil {
+		return nil, "", err
+	}
+	cluster, clusterVersions, err := clusterConfigSources()
+	if err != nil {
+		return nil, "", err
+	}
+	return append(sources, cluster...), versions + clusterVersions, nil
+}
+
+// clusterConfigNames returns the names of the Secret and ConfigMap options
+// are read from, which may also be given by the environment.
+func clusterConfigNames() (secret, configMap string) {
+	secret, configMap = configSecretName, configMapName
+	if len(secret) == 0 {
+		secret = os.Getenv(config.EnvName("config-secret"))
+	}
+	if len(configMap) == 0 {
+		configMap = os.Getenv(config.EnvName("config-map"))
+	}
+	return secret, configMap
+}
+
+// clusterConfigSources reads the config-secret and config-map, returning them
+// as sources along with their resource versions.
+func clusterConfigSources() ([]config.Source, string, error) {
+	secret, configMap := clusterConfigNames()
+	if len(secret) == 0 && len(configMap) == 0 {
+		return nil, "", nil
+	}
+
+	if err := initClusterClient(); err != nil {
+		return nil, "", err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var sources []config.Source
+	var versions string
+	add := func(name string, get func(context.Context) (map[string]string, string, error)) error {
+		values, version, err := get(ctx)
+		if err != nil {
+			return err
+		}
+		if err = extractCABundle(name, values); err != nil {
+			return err
+		}
+		sources = append(sources, config.Source{Name: name, Values: values})
+		versions += name + "@" + version + " "
+		return nil
+	}
+	if len(secret) > 0 {
+		if err := add("secret/"+secret, func(ctx context.Context) (map[string]string, string, error) {
+			return clusterClient.Secret(ctx, clusterClient.Namespace, secret)
+		}); err != nil {
+			return nil, "", err
+		}
+	}
+	if len(configMap) > 0 {
+		if err := add("configmap/"+configMap, func(ctx context.Context) (map[string]string, string, error) {
+			return clusterClient.ConfigMap(ctx, configMap)
+		}); err != nil {
+			return nil, "", err
+		}
+	}
+	return sources, versions, nil
+}
+
+// extractCABundle replaces the caBundleKey of values read from source by the
+// path of a file holding it, added to ca-cert.
+func extractCABundle(source string, values map[string]string) error {
+	bundle, ok := values[caBundleKey]
+	if !ok {
+		return nil
+	}
+	path, err := writeCABundle(source, bundle)
+	if err != nil {
+		return err
+	}
+	delete(values, caBundleKey)
+	if caCerts, ok := values["ca-cert"]; ok {
+		path = caCerts + "," + path
+	}
+	values["ca-cert"] = path
+	return nil
+}
+
+// writeCABundle writes the CA bundle of source to a file in a private
+// directory, leaving it untouched if unchanged so watchFiles doesn't trigger
+// a reload, and returns its path.
+func writeCABundle(source, bundle string) (string, error) {
+	caBundleMu.Lock()
+	defer caBundleMu.Unlock()
+
+	if len(caBundleDir) == 0 {
+		dir, err := ioutil.TempDir("", "token-rp-ca")
+		if err != nil {
+			return "", err
+		}
+		caBundleDir = dir
+	}
+	path := filepath.Join(caBundleDir, filepath.Base(source)+"-"+filepath.Dir(source)+".crt")
+	if current, err := ioutil.ReadFile(path); err == nil && bytes.Equal(current, []byte(bundle)) {
+		return path, nil
+	}
+	return path, ioutil.WriteFile(path, []byte(bundle), 0600)
+}
+
+// watchConfigSources calls onChange whenever the version of the
+// vault-secret, config-secret or config-map changes.
+func watchConfigSources(onChange func(), logger *zap.SugaredLogger) {
+	secret, configMap := clusterConfigNames()
+	if _, vaultSecret := vaultSettings(); len(secret) == 0 && len(configMap) == 0 && len(vaultSecret) == 0 {
+		return
+	}
+
+	_, last, _ := configSources()
+	for range time.Tick(configWatchInterval) {
+		_, cur, err := configSources()
+		if err != nil {
+			logger.Warnw(
+				"Failed to read configuration sources",
+				"error", err,
+			)
+			continue
+		}
+		if cur != last {
+			last = cur
+			onChange()
+		}
+	}
+}
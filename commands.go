@@ -0,0 +1,84 @@
+//    Copyright 2017 Red Hat, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/syndesisio/token-rp/pkg/version"
+)
+
+// command is a token-rp subcommand. run receives the arguments following
+// the command name and returns the process exit code.
+type command struct {
+	name    string
+	summary string
+	run     func(args []string) int
+}
+
+// commands lists the subcommands; the first one is run when none is given.
+var commands []command
+
+func init() {
+	commands = []command{
+		{"serve", "Run the proxy (default)", serve},
+		{"exchange", "Verify a token and exchange it at the broker as the proxy would", runExchange},
+		{"mock-idp", "Serve a minimal OpenID Connect provider for local development", runMockIDP},
+		{"validate", "Check the configuration and reachability of issuers and upstream", runValidate},
+		{"version", "Output version and exit", runVersion},
+	}
+}
+
+func main() {
+	args := os.Args[1:]
+	cmd := commands[0]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		found := false
+		for _, c := range commands {
+			if c.name == args[0] {
+				cmd, found = c, true
+				break
+			}
+		}
+		if !found {
+			fmt.Fprintf(os.Stderr, "unknown command %q\n\n", args[0])
+			printCommands()
+			os.Exit(2)
+		}
+		args = args[1:]
+	}
+
+	os.Exit(cmd.run(args))
+}
+
+func printCommands() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [command] [options]\n\nCommands:\n", filepath.Base(os.Args[0]))
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", c.name, c.summary)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun '%s <command> -h' for the options of a command.\n", filepath.Base(os.Args[0]))
+}
+
+func runVersion(args []string) int {
+	if len(args) > 0 {
+		fmt.Fprint(os.Stderr, "version takes no arguments\n")
+		return 2
+	}
+	fmt.Printf("%s %s (%s)\n", filepath.Base(os.Args[0]), version.AppVersion, version.BuildDate)
+	return 0
+}
@@ -0,0 +1,159 @@
+//    Copyright 2017 Red Hat, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/syndesisio/token-rp/pkg/config"
+	"github.com/syndesisio/token-rp/pkg/exchange"
+	"github.com/syndesisio/token-rp/pkg/proxy"
+	"github.com/syndesisio/token-rp/pkg/verify"
+)
+
+// runExchange verifies a token and exchanges it at the broker the same way
+// the proxy does for a request, printing each step with its duration.
+func runExchange(args []string) int {
+	var token string
+	flagSet.StringVar(&token, "token", "", "Token to verify and exchange, as sent by clients (required)")
+	if err := flagSet.Parse(args); err != nil {
+		return 2
+	}
+	if len(configFile) == 0 {
+		configFile = os.Getenv(config.EnvName("config"))
+	}
+	if err := applyConfig(flagSet, configFile); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 2
+	}
+	if len(token) == 0 {
+		fmt.Fprint(os.Stderr, "no token specified\n")
+		return 2
+	}
+	if len(issuerURLsFlag) == 0 {
+		fmt.Fprint(os.Stderr, "no issuer-url specified\n")
+		return 2
+	}
+	if err := validateOptions(); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 2
+	}
+	cfg, err := newHandlerConfig(&reloadable, configFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 2
+	}
+	tr, err := newIssuerTransport(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 2
+	}
+	hc := &http.Client{Transport: tr}
+
+	prodLogger, _ := zap.NewDevelopment()
+	logger := prodLogger.Sugar()
+
+	step := func(name string, start time.Time, err error) bool {
+		d := time.Since(start).Round(time.Millisecond)
+		if err != nil {
+			fmt.Printf("[-]%s failed after %v: %s\n", name, d, redact(err.Error()))
+			return false
+		}
+		fmt.Printf("[+]%s ok (%v)\n", name, d)
+		return true
+	}
+
+	start := time.Now()
+	creds, _ := loadClientCredentials()
+	issuers := loadTrustedIssuers(hc, strings.Split(allowedAlgs, ","), creds, logger)
+	step("provider config", start, nil)
+
+	verified := token
+	if len(tokenDecryptionKeysFlag) > 0 && verify.IsEncrypted(token) {
+		start = time.Now()
+		decrypter, err := newTokenDecrypter(tokenDecryptionKeysFlag)
+		if err == nil {
+			verified, err = decrypter.Decrypt(token)
+		}
+		if !step("decryption", start, err) {
+			return 1
+		}
+	}
+
+	start = time.Now()
+	issuer, err := issuers.ForToken(verified)
+	if !step("issuer", start, err) {
+		return 1
+	}
+	fmt.Printf("    issuer: %s\n", issuer.ID)
+
+	start = time.Now()
+	claims, err := issuer.Verifier.Verify(verified)
+	if !step("verification", start, err) {
+		return 1
+	}
+	if b, err := json.MarshalIndent(claims, "    ", "  "); err == nil {
+		fmt.Printf("    claims: %s\n", b)
+	}
+
+	if err = cfg.Requirements.Check(claims); !step("authorization", time.Now(), err) {
+		return 1
+	}
+
+	h := http.Header{}
+	cfg.Headers.Apply(h, claims)
+	for name, vals := range h {
+		fmt.Printf("    header %s: %s\n", name, strings.Join(vals, ","))
+	}
+
+	start = time.Now()
+	retriever, err := exchange.New(idpType, exchange.Options{
+		Client:             hc,
+		AWSRegion:          awsRegion,
+		AWSService:         awsService,
+		AWSCredentialsFile: awsCredentialsFile,
+		AWSSessionDuration: awsSessionDuration,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 2
+	}
+	retrievedToken, err := retriever.ExchangeToken(context.Background(), issuer.URL, cfg.ProviderAlias, token)
+	if !step("exchange at "+issuer.URL+"/broker/"+cfg.ProviderAlias+"/token", start, err) {
+		return 1
+	}
+	fmt.Printf("    %s token: %s\n", idpType, proxy.MaskToken(retrievedToken))
+
+	if len(cfg.HeaderTemplates) > 0 {
+		h = http.Header{}
+		if !step("header templates", time.Now(), cfg.HeaderTemplates.Apply(h, claims, retrievedToken)) {
+			return 1
+		}
+		for name, vals := range h {
+			val := strings.Replace(strings.Join(vals, ","), retrievedToken, proxy.MaskToken(retrievedToken), -1)
+			fmt.Printf("    header %s: %s\n", name, val)
+		}
+	}
+
+	return 0
+}
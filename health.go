@@ -0,0 +1,206 @@
+//    Copyright 2017 Red Hat, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/syndesisio/token-rp/pkg/proxy"
+)
+
+// upstreamDialTimeout bounds the reachability check of the upstream.
+const upstreamDialTimeout = 2 * time.Second
+
+// healthChecker serves the liveness and readiness endpoints and actively
+// checks the upstream endpoints.
+type healthChecker struct {
+	// endpoints returns the upstream endpoints of the current configuration.
+	endpoints func() []url.URL
+	// client requests path of each endpoint if path is set, otherwise a TCP
+	// connection is established.
+	client *http.Client
+	path   string
+	// onResult is called with the result of every active check.
+	onResult func(endpoint url.URL, healthy bool)
+
+	providerConfigLoaded int32 // accessed atomically
+
+	mu      sync.Mutex
+	results map[string]error // of the active checks, nil if not running
+}
+
+// SetProviderConfigLoaded marks the provider config(s) as fetched.
+func (h *healthChecker) SetProviderConfigLoaded() {
+	atomic.StoreInt32(&h.providerConfigLoaded, 1)
+}
+
+// Register adds the health endpoints to mux.
+func (h *healthChecker) Register(mux *http.ServeMux) {
+	mux.HandleFunc("/livez", h.livez)
+	mux.HandleFunc("/readyz", h.readyz)
+	mux.HandleFunc("/healthz", h.readyz)
+}
+
+func (h *healthChecker) livez(w http.ResponseWriter, req *http.Request) {
+	fmt.Fprint(w, "ok")
+}
+
+func (h *healthChecker) readyz(w http.ResponseWriter, req *http.Request) {
+	var buf bytes.Buffer
+	ready := true
+	check := func(name string, err error) bool {
+		if err != nil {
+			fmt.Fprintf(&buf, "[-]%s failed: %v\n", name, err)
+			return false
+		}
+		fmt.Fprintf(&buf, "[+]%s ok\n", name)
+		return true
+	}
+
+	ready = check("providerConfig", h.checkProviderConfig()) && ready
+
+	// One healthy endpoint is enough to serve requests.
+	endpoints := h.endpoints()
+	upstreamReady := false
+	for _, e := range endpoints {
+		upstreamReady = check("upstream "+e.String(), h.endpointStatus(e)) || upstreamReady
+	}
+	if len(endpoints) == 0 {
+		check("upstream", errors.New("no proxy-url"))
+	}
+	ready = ready && upstreamReady
+
+	if !ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_, _ = buf.WriteTo(w)
+}
+
+func (h *healthChecker) checkProviderConfig() error {
+	if atomic.LoadInt32(&h.providerConfigLoaded) == 0 {
+		return errors.New("not yet fetched")
+	}
+	return nil
+}
+
+// endpointStatus returns the result of the last active check of endpoint,
+// or checks it now if active checks aren't running.
+func (h *healthChecker) endpointStatus(endpoint url.URL) error {
+	h.mu.Lock()
+	results := h.results
+	err, checked := results[endpoint.String()]
+	h.mu.Unlock()
+	if results == nil {
+		return h.checkEndpoint(endpoint)
+	}
+	if !checked {
+		return errors.New("not yet checked")
+	}
+	return err
+}
+
+// watchUpstreams checks every endpoint each interval, taking unhealthy ones
+// out of rotation until they recover.
+func (h *healthChecker) watchUpstreams(interval time.Duration) {
+	h.mu.Lock()
+	h.results = make(map[string]error)
+	h.mu.Unlock()
+
+	for {
+		results := make(map[string]error)
+		for _, e := range h.endpoints() {
+			if _, dup := results[e.String()]; dup {
+				continue
+			}
+			err := h.checkEndpoint(e)
+			results[e.String()] = err
+			proxy.SetEndpointHealthy(e, err == nil)
+			if h.onResult != nil {
+				h.onResult(e, err == nil)
+			}
+		}
+		h.mu.Lock()
+		h.results = results
+		h.mu.Unlock()
+
+		time.Sleep(interval)
+	}
+}
+
+// checkEndpoint requests path of endpoint, expecting a 2xx or 3xx response,
+// or without path verifies that a TCP connection to it can be established.
+func (h *healthChecker) checkEndpoint(endpoint url.URL) error {
+	if len(h.path) > 0 {
+		u := endpoint
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + strings.TrimPrefix(h.path, "/")
+		u.RawPath = ""
+		resp, err := h.client.Get(u.String())
+		if err != nil {
+			return err
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+			return fmt.Errorf("unexpected status %s", resp.Status)
+		}
+		return nil
+	}
+
+	host := endpoint.Host
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		port := "80"
+		if endpoint.Scheme == "https" {
+			port = "443"
+		}
+		host = net.JoinHostPort(host, port)
+	}
+
+	conn, err := net.DialTimeout("tcp", host, upstreamDialTimeout)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// upstreamEndpoints returns the endpoints of cfg and its routes.
+func upstreamEndpoints(cfg *proxy.Config) []url.URL {
+	var endpoints []url.URL
+	seen := map[string]bool{}
+	add := func(c *proxy.Config) {
+		eps := []url.URL{c.ProxyURL}
+		if c.Upstreams != nil {
+			eps = c.Upstreams.Endpoints()
+		}
+		for _, e := range eps {
+			if len(e.Host) > 0 && !seen[e.String()] {
+				seen[e.String()] = true
+				endpoints = append(endpoints, e)
+			}
+		}
+	}
+	add(cfg)
+	for _, r := range cfg.Routes {
+		add(r.Config)
+	}
+	return endpoints
+}
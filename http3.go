@@ -0,0 +1,74 @@
+//    Copyright 2017 Red Hat, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// http3Listener serves HTTP/3 over QUIC on a UDP socket next to the TCP
+// listeners.
+type http3Listener struct {
+	server *http3.Server
+	conn   net.PacketConn
+}
+
+// listenHTTP3 binds addr for HTTP/3 requests to handler. QUIC always uses
+// TLS 1.3, with the certificates and client authentication of tlsConfig.
+func listenHTTP3(addr string, handler http.Handler, tlsConfig *tls.Config) (*http3Listener, error) {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &http3Listener{
+		server: &http3.Server{
+			Handler:        handler,
+			TLSConfig:      tlsConfig,
+			IdleTimeout:    idleTimeout,
+			MaxHeaderBytes: maxHeaderBytes,
+		},
+		conn: conn,
+	}, nil
+}
+
+func (l *http3Listener) Serve() error {
+	return l.server.Serve(l.conn)
+}
+
+// AdvertiseTo adds an Alt-Svc header to the responses of next to requests
+// over TLS, so that clients switch to HTTP/3 for later requests.
+func (l *http3Listener) AdvertiseTo(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.TLS != nil && req.ProtoMajor < 3 {
+			_ = l.server.SetQUICHeaders(w.Header())
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// Shutdown stops accepting connections and waits for the active requests
+// until ctx is done.
+func (l *http3Listener) Shutdown(ctx context.Context) error {
+	err := l.server.Shutdown(ctx)
+	if cerr := l.conn.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
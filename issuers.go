@@ -0,0 +1,142 @@
+//    Copyright 2017 Red Hat, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/syndesisio/token-rp/pkg/verify"
+	"go.uber.org/zap"
+)
+
+// loadTrustedIssuers fetches the provider config of every configured issuer
+// and sets up verification of its tokens according to verify-mode.
+func loadTrustedIssuers(hc *http.Client, algs []string, creds *verify.ClientCredentials, logger *zap.SugaredLogger) verify.Issuers {
+	var tokenReviewer *verify.TokenReviewVerifier
+	if verifyMode == verify.TokenReviewMode {
+		var err error
+		if tokenReviewer, err = verify.NewInClusterTokenReviewVerifier(tokenReviewAudiencesFlag); err != nil {
+			logger.Fatalw(
+				"Failed to set up token reviews",
+				"error", err,
+			)
+		}
+	}
+
+	var issuers verify.Issuers
+	for _, u := range issuerURLsFlag {
+		issuerURL := strings.TrimSuffix(strings.TrimSuffix(u.String(), discoveryPath), "/")
+		providerConfig := fetchProviderConfig(hc, issuerURL, logger)
+
+		var verifier verify.Verifier = &verify.JWTVerifier{
+			Issuer:      providerConfig.Issuer.String(),
+			Audiences:   append([]string{clientID}, audiencesFlag...),
+			AllowedAZP:  allowedAZPFlag,
+			Keys:        verify.NewKeySet(hc, providerConfig.KeysEndpoint.String()),
+			AllowedAlgs: algs,
+			Leeway:      tokenLeeway,
+		}
+		if verifyMode == verify.UserInfoMode {
+			if providerConfig.UserInfoEndpoint == nil {
+				logger.Fatalw(
+					"Provider does not advertise a UserInfo endpoint",
+					"issuerURL", issuerURL,
+				)
+			}
+			verifier = &verify.UserInfoVerifier{
+				Client:      hc,
+				UserInfoURL: providerConfig.UserInfoEndpoint.String(),
+			}
+		}
+		if verifyMode == verify.IntrospectionMode {
+			introspectionURL, err := verify.IntrospectionEndpoint(hc, issuerURL, providerConfig.TokenEndpoint.String())
+			if err != nil {
+				logger.Fatalw(
+					"Failed to discover introspection endpoint",
+					"error", err,
+					"issuerURL", issuerURL,
+				)
+			}
+			verifier = &verify.IntrospectionVerifier{
+				Client:           hc,
+				IntrospectionURL: introspectionURL,
+				Issuer:           providerConfig.Issuer.String(),
+				Credentials:      creds,
+			}
+		}
+		if tokenReviewer != nil {
+			verifier = tokenReviewer
+		}
+
+		issuers = append(issuers, &verify.Issuer{
+			URL:       issuerURL,
+			ID:        providerConfig.Issuer.String(),
+			Verifier:  verifier,
+			AnyIssuer: tokenReviewer != nil,
+		})
+	}
+	return issuers
+}
+
+// loadClientCredentials returns the credentials of client-id given by
+// client-secret or client-key, or nil if there are none.
+func loadClientCredentials() (*verify.ClientCredentials, error) {
+	if len(clientSecret) > 0 && len(clientKeyFile) > 0 {
+		return nil, errors.New("client-secret can't be combined with client-key")
+	}
+	if len(clientSecret) == 0 && len(clientKeyFile) == 0 {
+		if len(clientAuthMethod) > 0 {
+			return nil, errors.New("client-auth-method specified with no client-secret or client-key")
+		}
+		if verifyMode == verify.IntrospectionMode {
+			return nil, errors.New("verify-mode introspection requires client-secret or client-key")
+		}
+		return nil, nil
+	}
+	if len(clientID) == 0 {
+		return nil, errors.New("client credentials specified with no client-id")
+	}
+
+	creds := &verify.ClientCredentials{
+		ClientID: clientID,
+		Method:   clientAuthMethod,
+		Secret:   clientSecret,
+		KeyID:    clientKeyID,
+	}
+	if len(clientKeyFile) > 0 {
+		if len(creds.Method) == 0 {
+			creds.Method = verify.PrivateKeyJWT
+		}
+		if creds.Method != verify.PrivateKeyJWT {
+			return nil, fmt.Errorf("client-key requires client-auth-method %s", verify.PrivateKeyJWT)
+		}
+		key, err := verify.LoadClientKey(clientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("invalid client-key: %v", err)
+		}
+		creds.Key = key
+		return creds, nil
+	}
+	if len(creds.Method) == 0 {
+		creds.Method = verify.ClientSecretBasic
+	}
+	if creds.Method != verify.ClientSecretBasic && creds.Method != verify.ClientSecretPost {
+		return nil, fmt.Errorf("client-secret requires client-auth-method %s or %s", verify.ClientSecretBasic, verify.ClientSecretPost)
+	}
+	return creds, nil
+}
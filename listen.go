@@ -0,0 +1,93 @@
+//    Copyright 2017 Red Hat, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+const defaultListenAddr = ":8080"
+
+// listenAddr is a parsed -listen value.
+type listenAddr struct {
+	network string
+	address string
+	tls     bool
+}
+
+func (la listenAddr) String() string {
+	if la.network == "unix" {
+		return "unix://" + la.address
+	}
+	scheme := "http"
+	if la.tls {
+		scheme = "https"
+	}
+	return scheme + "://" + la.address
+}
+
+// parseListenAddr parses a listen address of the form [scheme://]host:port
+// or unix:///path/to/socket. TCP addresses without a scheme are served over
+// TLS if defaultTLS is set.
+func parseListenAddr(s string, defaultTLS bool) (listenAddr, error) {
+	la := listenAddr{network: "tcp", tls: defaultTLS}
+
+	switch {
+	case strings.HasPrefix(s, "unix://"):
+		path := strings.TrimPrefix(s, "unix://")
+		if path == "" {
+			return listenAddr{}, fmt.Errorf("invalid listen address %q: socket path is empty", s)
+		}
+		return listenAddr{network: "unix", address: path}, nil
+	case strings.HasPrefix(s, "http://"):
+		la.tls = false
+		s = strings.TrimPrefix(s, "http://")
+	case strings.HasPrefix(s, "https://"):
+		la.tls = true
+		s = strings.TrimPrefix(s, "https://")
+	case strings.Contains(s, "://"):
+		return listenAddr{}, fmt.Errorf("unsupported listen address scheme in %q", s)
+	}
+
+	if _, _, err := net.SplitHostPort(s); err != nil {
+		return listenAddr{}, fmt.Errorf("invalid listen address %q: %v", s, err)
+	}
+	la.address = s
+
+	return la, nil
+}
+
+// listen binds the address, setting SO_REUSEPORT on TCP sockets if reusePort
+// is set.
+func (la listenAddr) listen(reusePort bool) (net.Listener, error) {
+	if la.network == "unix" {
+		// Remove a stale socket left behind by a previous instance.
+		if fi, err := os.Stat(la.address); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			if err := os.Remove(la.address); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	var lc net.ListenConfig
+	if reusePort && la.network == "tcp" {
+		lc.Control = reusePortControl
+	}
+	return lc.Listen(context.Background(), la.network, la.address)
+}
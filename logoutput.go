@@ -0,0 +1,160 @@
+//    Copyright 2017 Red Hat, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/syslog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// backupTimeFormat is the suffix of rotated log files.
+const backupTimeFormat = "20060102T150405.000"
+
+// rotateRetryInterval is how long a log file whose rotation failed is
+// written to before rotating it is tried again.
+const rotateRetryInterval = time.Minute
+
+// openLogOutput opens the application log destination: stderr, syslog (which
+// ends up in the journal on systemd hosts) or a file path rotated once it
+// exceeds maxSize bytes or maxAge, keeping maxBackups rotated files.
+func openLogOutput(target string, maxSize int64, maxAge time.Duration, maxBackups int) (io.Writer, error) {
+	switch target {
+	case "", "stderr":
+		return os.Stderr, nil
+	case "syslog":
+		return syslog.New(syslog.LOG_DAEMON|syslog.LOG_INFO, "token-rp")
+	default:
+		return newRotatingFile(target, maxSize, maxAge, maxBackups)
+	}
+}
+
+// rotatingFile is a log file that is renamed aside with a timestamp suffix
+// and reopened when it grows too large or too old. Zero limits disable the
+// respective rotation trigger, zero maxBackups keeps all rotated files.
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxAge     time.Duration
+	maxBackups int
+
+	mu          sync.Mutex
+	f           *os.File
+	size        int64
+	opened      time.Time
+	rotateAfter time.Time
+}
+
+func newRotatingFile(path string, maxSize int64, maxAge time.Duration, maxBackups int) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxSize: maxSize, maxAge: maxAge, maxBackups: maxBackups}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if r.f != nil {
+		r.f.Close()
+	}
+	r.f = f
+	r.size = fi.Size()
+	r.opened = time.Now()
+	return nil
+}
+
+// rotate renames the file aside and opens a new one. The current file stays
+// open until then, so if either step fails logging goes on in the original
+// file.
+func (r *rotatingFile) rotate() error {
+	backup := fmt.Sprintf("%s.%s", r.path, time.Now().UTC().Format(backupTimeFormat))
+	renamed := true
+	if err := os.Rename(r.path, backup); os.IsNotExist(err) {
+		// Moved away by someone else, just open a new file.
+		renamed = false
+	} else if err != nil {
+		return err
+	}
+	if err := r.open(); err != nil {
+		if renamed {
+			_ = os.Rename(backup, r.path)
+		}
+		return err
+	}
+	r.prune()
+	return nil
+}
+
+// prune removes the oldest rotated files beyond maxBackups.
+func (r *rotatingFile) prune() {
+	if r.maxBackups <= 0 {
+		return
+	}
+	matches, err := filepath.Glob(r.path + ".*")
+	if err != nil {
+		return
+	}
+	var backups []string
+	for _, m := range matches {
+		if _, err := time.Parse(backupTimeFormat, strings.TrimPrefix(m, r.path+".")); err == nil {
+			backups = append(backups, m)
+		}
+	}
+	// The timestamps sort chronologically.
+	sort.Strings(backups)
+	for len(backups) > r.maxBackups {
+		_ = os.Remove(backups[0])
+		backups = backups[1:]
+	}
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.size > 0 && time.Now().After(r.rotateAfter) &&
+		((r.maxSize > 0 && r.size+int64(len(p)) > r.maxSize) ||
+			(r.maxAge > 0 && time.Since(r.opened) > r.maxAge)) {
+		if err := r.rotate(); err != nil {
+			r.rotateAfter = time.Now().Add(rotateRetryInterval)
+			fmt.Fprintf(os.Stderr, "Failed to rotate log file %s: %v\n", r.path, err)
+		}
+	}
+
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *rotatingFile) Sync() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.f.Sync()
+}
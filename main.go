@@ -17,102 +17,398 @@ package main
 import (
 	"context"
 	"crypto/tls"
-	"crypto/x509"
-	"encoding/json"
+	"errors"
+	"expvar"
 	"flag"
 	"fmt"
-	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
+	"net/http/httputil"
+	"net/http/pprof"
 	"net/url"
 	"os"
-	"path/filepath"
-	"regexp"
+	"os/signal"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 
-	jwtmiddleware "github.com/auth0/go-jwt-middleware"
-	"github.com/coreos/go-oidc/jose"
 	"github.com/coreos/go-oidc/oidc"
-	"github.com/google/go-github/github"
+	"github.com/sirupsen/logrus"
+	"github.com/syndesisio/token-rp/pkg/config"
+	"github.com/syndesisio/token-rp/pkg/exchange"
+	"github.com/syndesisio/token-rp/pkg/proxy"
+	"github.com/syndesisio/token-rp/pkg/verify"
 	"github.com/vulcand/oxy/forward"
+	"github.com/vulcand/oxy/utils"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
-	"golang.org/x/oauth2"
-
-	"github.com/syndesisio/token-rp/pkg/version"
+	"golang.org/x/crypto/acme"
 )
 
 const (
 	discoveryPath = "/.well-known/openid-configuration"
-
-	githubIDPType    = "github"
-	openshiftIDPType = "openshift"
 )
 
 var (
-	issuerURLFlag               urlFlag
-	proxyURLFlag                urlFlag
+	issuerURLsFlag              config.URLSliceFlag
 	clientID                    string
-	idpAlias                    string
+	clientSecret                string
+	clientKeyFile               string
+	clientKeyID                 string
+	clientAuthMethod            string
 	idpType                     string
 	serverCertFile              string
 	serverKeyFile               string
+	sniCertsFlag                config.StringSliceFlag
+	tokenDecryptionKeysFlag     config.StringSliceFlag
+	tlsMinVersion               string
+	tlsMaxVersion               string
+	tlsCipherSuitesFlag         config.StringSliceFlag
+	tlsCurvesFlag               config.StringSliceFlag
+	tlsSecretName               string
+	acmeDomainsFlag             config.StringSliceFlag
+	acmeCacheDir                string
+	acmeDirectoryURL            string
+	tlsVaultSecret              string
+	upstreamClientCertFile      string
+	upstreamClientKeyFile       string
+	clientCAFile                string
+	clientCRLFile               string
+	spiffeEndpointSocket        string
 	insecureSkipVerify          bool
+	upstreamInsecureSkipVerify  bool
+	issuerInsecureSkipVerify    bool
+	identityInsecureSkipVerify  bool
 	versionFlag                 bool
-	caCerts                     stringSliceFlag
-	identityServerFlag          urlFlag
-	verbose                     bool
+	identityServerFlag          config.URLFlag
+	loginCacheTTL               time.Duration
+	logLevel                    = zapcore.InfoLevel
+	logFormat                   string
+	configFile                  string
+	configSecretName            string
+	configMapName               string
+	vaultAddr                   string
+	vaultCACert                 string
+	vaultAuthMethod             string
+	vaultAuthMount              string
+	vaultRole                   string
+	vaultRoleID                 string
+	vaultSecretIDFile           string
+	vaultSecretPath             string
+	logOutput                   string
+	logMaxSize                  int64
+	logMaxAge                   time.Duration
+	logMaxBackups               int
 	providerConfigRetryInterval time.Duration
 	providerConfigRetryMax      int
+	verifyMode                  string
+	allowedAlgs                 string
+	tokenLeeway                 time.Duration
+	audiencesFlag               config.StringSliceFlag
+	allowedAZPFlag              config.StringSliceFlag
+	tokenReviewAudiencesFlag    config.StringSliceFlag
+	kubeTokenAudiencesFlag      config.StringSliceFlag
+	kubeTokenExpiration         time.Duration
+	awsRegion                   string
+	awsService                  string
+	awsCredentialsFile          string
+	awsSessionDuration          time.Duration
+	authzWebhookURLFlag         config.URLFlag
+	authzWebhookCacheTTL        time.Duration
+	authzWebhookTimeout         time.Duration
+	authzWebhookFormat          string
+	policyBundle                string
+	policyQuery                 string
+	decoratorPlugin             string
+	decoratorWASM               string
+	decoratorWASMTimeout        time.Duration
+	decoratorWASMMaxMemory      int64
+	listenAddrsFlag             config.StringSliceFlag
+	shutdownTimeout             time.Duration
+	readTimeout                 time.Duration
+	readHeaderTimeout           time.Duration
+	writeTimeout                time.Duration
+	idleTimeout                 time.Duration
+	maxHeaderBytes              int
+	h2c                         bool
+	http3ListenAddr             string
+	enableHTTP2                 bool
+	upstreamHTTP2               bool
+	expectContinueTimeout       time.Duration
+	http2MaxConcurrentStreams   int
+	http2MaxReadFrameSize       int
+	maxHeaderCount              int
+	rateLimit                   float64
+	rateLimitBurst              int
+	exchangeQuotaHourly         int
+	exchangeQuotaDaily          int
+	notLinkedCacheTTL           time.Duration
+	maxConcurrentRequests       int
+	maxQueuedRequests           int
+	queueTimeout                time.Duration
+	lockoutThreshold            int
+	lockoutWindow               time.Duration
+	lockoutDuration             time.Duration
+	trustedProxiesFlag          config.StringSliceFlag
+	parseForwarded              bool
+	forwardedMode               string
+	xForwardedMode              string
+	reusePort                   bool
+	tracePropagationFlag        string
+	enablePprof                 bool
+	accessLogFormat             string
+	auditLogTarget              string
+	auditLogKeyFile             string
+	dryRunMode                  string
+	adminListenAddr             string
+	upstreamHealthInterval      time.Duration
+	upstreamHealthPath          string
+	breakerThreshold            int
+	breakerOpenDuration         time.Duration
+	upstreamRetries             int
+	upstreamRetryBackoff        time.Duration
+	upstreamRetryStatus         string
 
-	flagSet = flag.NewFlagSet("token-rp", flag.ContinueOnError)
+	reloadable reloadableOptions
 
-	gitRequestRegexp = regexp.MustCompile(`/(git-upload-pack|git-receive-pack|info/refs|HEAD|objects/info/alternates|objects/info/http-alternates|objects/info/packs|objects/info/[^/]*|objects/[0-9a-f]{2}/[0-9a-f]{38}|objects/pack/pack-[0-9a-f]{40}\\.pack|objects/pack/pack-[0-9a-f]{40}\\.idx)$`)
+	flagSet = flag.NewFlagSet("token-rp", flag.ContinueOnError)
 )
 
 func init() {
-	flagSet.Var(&issuerURLFlag, "issuer-url", "URL to OpenID Connect discovery document")
-	flagSet.Var(&proxyURLFlag, "proxy-url", "URL to proxy requests to")
+	flagSet.Var(&issuerURLsFlag, "issuer-url", "URL(s) to OpenID Connect discovery document of trusted issuer(s)")
 	flagSet.StringVar(&clientID, "client-id", "", "OpenID Connect client ID to verify")
-	flagSet.StringVar(&idpAlias, "provider-alias", "", "Keycloak provider alias to replace authorization token with")
-	flagSet.StringVar(&idpType, "provider-type", "", "Type of Keycloak IDP (currently supports openshift and github only)")
-	flagSet.StringVar(&serverCertFile, "tls-cert", "", "Path to PEM-encoded certificate to use to serve over TLS")
-	flagSet.StringVar(&serverKeyFile, "tls-key", "", "Path to PEM-encoded key to use to serve over TLS")
+	flagSet.StringVar(&clientSecret, "client-secret", "", "Secret of client-id, authenticating token-rp as confidential client to provider endpoints such as token introspection; best given by environment, config-secret or vault-secret")
+	flagSet.StringVar(&clientKeyFile, "client-key", "", "Path to the PEM-encoded RSA or ECDSA private key of client-id, signing client assertions for private_key_jwt authentication instead of client-secret")
+	flagSet.StringVar(&clientKeyID, "client-key-id", "", "Key ID sent as kid of the client assertions signed with client-key, as registered with the provider")
+	flagSet.StringVar(&clientAuthMethod, "client-auth-method", "", "How to authenticate as client-id: client_secret_basic or client_secret_post with client-secret, or private_key_jwt with client-key (client_secret_basic or private_key_jwt if empty)")
+	registerReloadableFlags(flagSet, &reloadable)
+	flagSet.StringVar(&idpType, "provider-type", "", "Type of Keycloak IDP: "+strings.Join(exchange.ProviderTypes(), ", "))
+	flagSet.StringVar(&serverCertFile, "tls-cert", "", "Path to PEM-encoded certificate to use to serve over TLS, reloaded when it changes")
+	flagSet.StringVar(&serverKeyFile, "tls-key", "", "Path to PEM-encoded key to use to serve over TLS, reloaded when it changes")
+	flagSet.StringVar(&tlsMinVersion, "tls-min-version", "1.2", "Lowest TLS version accepted from clients and spoken to upstreams, issuers and other destinations: 1.0, 1.1, 1.2 or 1.3")
+	flagSet.StringVar(&tlsMaxVersion, "tls-max-version", "", "Highest TLS version accepted from clients and spoken to destinations (the highest supported if empty)")
+	flagSet.Var(&tlsCipherSuitesFlag, "tls-cipher-suite", "Cipher suite(s) allowed up to TLS 1.2 with clients and destinations, by IANA name such as TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 (Go's defaults if empty; TLS 1.3 suites aren't configurable)")
+	flagSet.Var(&tlsCurvesFlag, "tls-curve", "Key exchange curve(s) in order of preference with clients and destinations: X25519, X25519MLKEM768, P256, P384 or P521 (Go's defaults if empty)")
+	flagSet.Var(&sniCertsFlag, "tls-sni-cert", "Additional certificate and key, as cert.pem:key.pem, served to clients requesting one of its names via SNI (requires tls-cert, tls-secret or tls-vault-secret)")
+	flagSet.StringVar(&upstreamClientCertFile, "upstream-client-cert", "", "Path to PEM-encoded client certificate presented to upstreams that request one, reloaded when it changes")
+	flagSet.StringVar(&upstreamClientKeyFile, "upstream-client-key", "", "Path to PEM-encoded key of upstream-client-cert")
+	flagSet.StringVar(&clientCAFile, "client-ca", "", "Path to PEM-encoded CA certificate(s) that client certificates are verified against, reloaded when it changes; clients presenting none are still accepted unless client-cert-auth is required (requires tls-cert, tls-secret or tls-vault-secret)")
+	flagSet.StringVar(&clientCRLFile, "client-crl", "", "Path to PEM or DER-encoded certificate revocation list(s), each signed by a client-ca certificate, that client certificates are checked against, reloaded when it changes")
+	flagSet.StringVar(&spiffeEndpointSocket, "spiffe-endpoint-socket", "", "Address of the SPIFFE Workload API, as unix:///path or tcp://host:port, providing an SVID served over TLS unless tls-cert, tls-secret or tls-vault-secret is set and presented to upstreams unless upstream-client-cert is, and trust bundles, including federated ones, trusted for client certificates and destinations; rotated as the API pushes updates (disabled if empty)")
+	flagSet.StringVar(&tlsSecretName, "tls-secret", "", "kubernetes.io/tls Secret, as namespace/name or name in the namespace of the pod, holding the certificate and key to serve over TLS instead of tls-cert and tls-key, read from the Kubernetes API and reloaded when it changes")
+	flagSet.Var(&acmeDomainsFlag, "acme-domain", "Domain name(s) to obtain the certificate served over TLS for from an ACME CA such as Let's Encrypt instead of tls-cert and tls-key, validated with TLS-ALPN-01 on the TLS listeners or HTTP-01 on the plain ones and renewed before it expires (accepts the CA's terms of service)")
+	flagSet.StringVar(&acmeCacheDir, "acme-cache-dir", "", "Directory keeping the ACME account key and certificates across restarts (required with acme-domain)")
+	flagSet.StringVar(&acmeDirectoryURL, "acme-directory-url", acme.LetsEncryptURL, "Directory URL of the ACME CA, e.g. the staging environment for testing")
+	flagSet.StringVar(&tlsVaultSecret, "tls-vault-secret", "", "Path of a Vault secret holding the certificate and key to serve over TLS as tls.crt and tls.key instead of tls-cert and tls-key, read from vault-addr and reloaded when it changes")
 	flagSet.BoolVar(&versionFlag, "version", false, "Output version and exit")
 	flagSet.BoolVar(&insecureSkipVerify, "insecure-skip-verify", false, "If insecureSkipVerify is true, TLS accepts any certificate presented by the server and any host name in that certificate. In this mode, TLS is susceptible to man-in-the-middle attacks. This should be used only for testing.")
-	flagSet.Var(&caCerts, "ca-cert", "Extra root certificate(s) that clients use when verifying server certificates")
-	flagSet.Var(&identityServerFlag, "identity-server-url", "URL to identity server")
-	flagSet.BoolVar(&verbose, "verbose", false, "Verbose logging.")
+	flagSet.BoolVar(&upstreamInsecureSkipVerify, "upstream-insecure-skip-verify", false, "Like insecure-skip-verify, but only for upstreams, e.g. internal ones with self-signed certificates")
+	flagSet.BoolVar(&issuerInsecureSkipVerify, "issuer-insecure-skip-verify", false, "Like insecure-skip-verify, but only for issuers and their token broker")
+	flagSet.BoolVar(&identityInsecureSkipVerify, "identity-server-insecure-skip-verify", false, "Like insecure-skip-verify, but only for the identity-server-url or the provider's API")
+	flagSet.Var(&identityServerFlag, "identity-server-url", "URL to identity server, the API of the provider looked up for users of Git requests")
+	flagSet.Var(&kubeTokenAudiencesFlag, "kubernetes-token-audience", "Audience(s) of the service account tokens minted for the upstream with provider-type kubernetes (the API server's if unset)")
+	flagSet.DurationVar(&kubeTokenExpiration, "kubernetes-token-expiration", time.Hour, "Lifetime of the service account tokens minted for the upstream with provider-type kubernetes, at least 10m; they are renewed after 80% of it")
+	flagSet.StringVar(&awsRegion, "aws-region", "", "AWS region, e.g. eu-west-1, of the STS endpoint and the upstreams signed for with provider-type aws")
+	flagSet.StringVar(&awsService, "aws-service", "execute-api", "AWS service, e.g. execute-api for API Gateway, that requests are signed for with provider-type aws; Git requests are always signed for CodeCommit")
+	flagSet.StringVar(&awsCredentialsFile, "aws-credentials-file", "", "AWS shared credentials file holding the profiles named by provider aliases that are no IAM role ARN, with provider-type aws")
+	flagSet.DurationVar(&awsSessionDuration, "aws-session-duration", time.Hour, "Lifetime of the credentials of IAM roles assumed with provider-type aws, between 15m and 12h")
+	flagSet.DurationVar(&loginCacheTTL, "github-login-cache-ttl", 10*time.Minute, "How long to cache the GitHub or OpenShift user of an exchanged token, looked up for Git requests (0 disables caching)")
+	flagSet.Var(&logLevel, "log-level", "Minimum log level: debug, info, warn, error, dpanic, panic or fatal (adjustable at runtime under /log-level on the admin listener)")
+	flagSet.StringVar(&logFormat, "log-format", "json", "Log encoding: json or console")
+	flagSet.StringVar(&logOutput, "log-output", "stderr", "Where to write logs: stderr, syslog or a file path")
+	flagSet.Int64Var(&logMaxSize, "log-max-size", 100, "Size in megabytes after which a -log-output file is rotated (0 disables size-based rotation)")
+	flagSet.DurationVar(&logMaxAge, "log-max-age", 24*time.Hour, "Age after which a -log-output file is rotated (0 disables age-based rotation)")
+	flagSet.IntVar(&logMaxBackups, "log-max-backups", 10, "Number of rotated -log-output files to keep, removing the oldest (all are kept if 0)")
 	flagSet.DurationVar(&providerConfigRetryInterval, "provider-config-retry-interval", 10*time.Second, "retry interval if provider config is unavailable")
 	flagSet.IntVar(&providerConfigRetryMax, "provider-config-retry-max", -1, "max retries if provider config is unavailable")
+	flagSet.StringVar(&allowedAlgs, "allowed-algs", "RS256", "Comma-separated list of accepted JWT signing algorithms (RS256, RS384, RS512, PS256, PS384, PS512, ES256, ES384, ES512)")
+	flagSet.DurationVar(&tokenLeeway, "token-leeway", 0, "Acceptable clock skew when validating the exp, iat and nbf claims of incoming tokens")
+	flagSet.Var(&audiencesFlag, "audience", "Additional audience(s) accepted in the aud claim of incoming tokens besides client-id")
+	flagSet.Var(&allowedAZPFlag, "allowed-azp", "Client ID(s) whose tokens are accepted based on the azp claim regardless of audience")
+	flagSet.Var(&authzWebhookURLFlag, "authz-webhook-url", "URL to POST request metadata and claims to for an allow/deny decision after token verification")
+	flagSet.DurationVar(&authzWebhookCacheTTL, "authz-webhook-cache-ttl", time.Minute, "How long to cache authorization webhook decisions (0 disables caching)")
+	flagSet.DurationVar(&authzWebhookTimeout, "authz-webhook-timeout", 5*time.Second, "Timeout for authorization webhook requests")
+	flagSet.StringVar(&decoratorPlugin, "decorator-plugin", "", "Path to a Go plugin exporting Decorate, called after the token exchange to modify request headers or reject the request (requires a cgo enabled build)")
+	flagSet.StringVar(&decoratorWASM, "decorator-wasm", "", "Path to a WebAssembly module exporting alloc and decorate, called like decorator-plugin but sandboxed and in any build")
+	flagSet.DurationVar(&decoratorWASMTimeout, "decorator-wasm-timeout", time.Second, "Time after which a call of the decorator-wasm module is aborted and the request rejected")
+	flagSet.Int64Var(&decoratorWASMMaxMemory, "decorator-wasm-max-memory", 64, "Size in megabytes the memory of a decorator-wasm instance can't grow beyond")
+	flagSet.StringVar(&authzWebhookFormat, "authz-webhook-format", proxy.DefaultWebhookFormat, "Authorization webhook protocol: default or opa (Open Policy Agent Data API, for evaluating Rego policies)")
+	flagSet.StringVar(&policyBundle, "policy-bundle", "", "Rego policy bundle, as a directory or .tar.gz file, evaluated for an allow/deny decision after token verification (disabled if empty)")
+	flagSet.StringVar(&policyQuery, "policy-query", proxy.DefaultPolicyQuery, "Document of policy-bundle holding the decision")
+	flagSet.Var(&listenAddrsFlag, "listen", "Address(es) to listen on as [http://|https://]host:port or unix:///path/to/socket; without scheme TLS is used if tls-cert, tls-secret or tls-vault-secret is set (default :8080)")
+	flagSet.DurationVar(&shutdownTimeout, "shutdown-timeout", 30*time.Second, "How long to wait for in-flight requests to complete on SIGTERM/SIGINT")
+	flagSet.DurationVar(&readTimeout, "read-timeout", 0, "Maximum duration for reading an entire request including the body (none if 0)")
+	flagSet.DurationVar(&readHeaderTimeout, "read-header-timeout", 10*time.Second, "Maximum duration for reading the request headers (none if 0)")
+	flagSet.DurationVar(&writeTimeout, "write-timeout", 0, "Maximum duration from the end of reading the request headers until the response is written (none if 0; limits long Git transfers)")
+	flagSet.DurationVar(&idleTimeout, "idle-timeout", 2*time.Minute, "Maximum duration to wait for the next request on a keep-alive connection (read-timeout if 0)")
+	flagSet.BoolVar(&enableHTTP2, "http2", true, "Offer HTTP/2 to clients over TLS")
+	flagSet.BoolVar(&upstreamHTTP2, "upstream-http2", false, "Negotiate HTTP/2 with TLS upstreams, multiplexing concurrent requests such as parallel git fetches over one connection")
+	flagSet.DurationVar(&expectContinueTimeout, "upstream-expect-continue-timeout", time.Second, "Maximum duration to wait for the upstream to accept the body of a request sent with Expect: 100-continue before sending it anyway (sent right away if 0)")
+	flagSet.IntVar(&http2MaxConcurrentStreams, "http2-max-concurrent-streams", 250, "Maximum number of concurrent HTTP/2 streams per client connection")
+	flagSet.IntVar(&http2MaxReadFrameSize, "http2-max-read-frame-size", 0, "Largest HTTP/2 frame in bytes read from clients and upstreams, between 16384 and 16777216 (1048576 if 0)")
+	flagSet.BoolVar(&h2c, "h2c", false, "Accept HTTP/2 without TLS (h2c) on plain listeners, as gRPC clients without TLS use")
+	flagSet.StringVar(&http3ListenAddr, "http3-listen", "", "UDP address to serve HTTP/3 over QUIC on as host:port, advertised with Alt-Svc on the TLS listeners (experimental; disabled if empty)")
+	flagSet.IntVar(&maxHeaderBytes, "max-header-bytes", http.DefaultMaxHeaderBytes, "Maximum size in bytes of the request line and headers, answered with 431 if exceeded")
+	flagSet.IntVar(&maxHeaderCount, "max-header-count", 100, "Maximum number of request header fields, answered with 400 if exceeded (unlimited if 0)")
+	flagSet.Float64Var(&rateLimit, "rate-limit", 0, "Requests per second allowed per token subject, or per client IP without token, answered with 429 if exceeded (unlimited if 0)")
+	flagSet.IntVar(&rateLimitBurst, "rate-limit-burst", 20, "Requests per subject or client IP allowed in a burst above rate-limit")
+	flagSet.IntVar(&exchangeQuotaHourly, "exchange-quota-hourly", 0, "Broker token exchanges allowed per token subject and UTC hour, answered with 429 if exceeded (unlimited if 0)")
+	flagSet.IntVar(&exchangeQuotaDaily, "exchange-quota-daily", 0, "Broker token exchanges allowed per token subject and UTC day, answered with 429 if exceeded (unlimited if 0)")
+	flagSet.DurationVar(&notLinkedCacheTTL, "not-linked-cache-ttl", 30*time.Second, "How long to answer requests of a subject without linked identity provider account with 403 before asking the broker again (not cached if 0)")
+	flagSet.IntVar(&maxConcurrentRequests, "max-concurrent-requests", 0, "Maximum number of requests handled concurrently, further requests are queued or answered with 503 (unlimited if 0)")
+	flagSet.IntVar(&maxQueuedRequests, "max-queued-requests", 100, "Maximum number of requests waiting for one of max-concurrent-requests")
+	flagSet.DurationVar(&queueTimeout, "queue-timeout", 5*time.Second, "How long a queued request waits before it is answered with 503")
+	flagSet.IntVar(&lockoutThreshold, "lockout-threshold", 0, "Consecutive failed authentications or token exchanges from a client IP or subject within lockout-window after which its attempts are answered with 429 for lockout-duration (disabled if 0)")
+	flagSet.DurationVar(&lockoutWindow, "lockout-window", 5*time.Minute, "Window in which failed attempts count towards lockout-threshold")
+	flagSet.DurationVar(&lockoutDuration, "lockout-duration", 5*time.Minute, "How long a client IP or subject is locked out")
+	flagSet.Var(&trustedProxiesFlag, "trusted-proxy", "Network(s) of proxies in front of token-rp, in CIDR notation or as single IP, whose X-Forwarded-For, X-Real-IP and other forwarded headers are honored; they are removed from requests of other clients")
+	flagSet.BoolVar(&parseForwarded, "parse-forwarded", false, "Take the client IP of requests from trusted-proxy from the RFC 7239 Forwarded header instead of X-Forwarded-For")
+	flagSet.StringVar(&forwardedMode, "forwarded", proxy.AppendForwarded, "How to set the RFC 7239 Forwarded header of forwarded requests: append (to the one received from a trusted-proxy), set (to the client only) or strip")
+	flagSet.StringVar(&xForwardedMode, "x-forwarded", proxy.AppendForwarded, "How to set the X-Forwarded-For, -Proto, -Host and -Server headers of forwarded requests: append (to those received from a trusted-proxy), set (to the client only) or strip")
+	flagSet.BoolVar(&reusePort, "reuse-port", false, "Bind TCP listeners with SO_REUSEPORT so a new instance can start alongside the old one during upgrades")
+	flagSet.StringVar(&adminListenAddr, "admin-listen", "", "Address to serve the admin endpoints (/healthz, /readyz, /livez, /metrics, /log-level, /debug/vars) on as host:port or unix:///path/to/socket (disabled if empty)")
+	flagSet.DurationVar(&upstreamHealthInterval, "upstream-health-interval", 0, "Interval to actively health-check the upstream endpoints at, taking failing ones out of rotation (disabled if 0)")
+	flagSet.StringVar(&upstreamHealthPath, "upstream-health-path", "", "Path to request from each upstream endpoint to check its health, expecting a 2xx or 3xx response (a TCP connection is established if empty)")
+	flagSet.IntVar(&breakerThreshold, "breaker-threshold", 0, "Consecutive failures (transport errors or 5xx responses) after which requests to an upstream endpoint or the broker fail immediately for breaker-open-duration (disabled if 0)")
+	flagSet.DurationVar(&breakerOpenDuration, "breaker-open-duration", 30*time.Second, "How long an open circuit breaker fails requests before letting a single probe request through")
+	flagSet.IntVar(&upstreamRetries, "upstream-retries", 0, "How often to retry GET and HEAD upstream requests failing with a connection error or an upstream-retry-status (disabled if 0)")
+	flagSet.DurationVar(&upstreamRetryBackoff, "upstream-retry-backoff", 100*time.Millisecond, "Delay before the first upstream retry, doubled for each further retry")
+	flagSet.StringVar(&upstreamRetryStatus, "upstream-retry-status", "502,503", "Comma-separated upstream response status codes to retry")
+	flagSet.StringVar(&tracePropagationFlag, "trace-propagation", "w3c", "Comma-separated trace context formats propagated to the upstream, generating a trace if none was received: w3c, b3, b3multi or none")
+	flagSet.BoolVar(&enablePprof, "enable-pprof", false, "Serve net/http/pprof profiling endpoints under /debug/pprof/ on the admin listener")
+	flagSet.StringVar(&accessLogFormat, "access-log-format", jsonAccessLogFormat, "Format of per-request access logs: json (via the application log), combined (Apache combined log format on stdout) or none")
+	flagSet.StringVar(&auditLogTarget, "audit-log", "", "Where to record hash-chained audit records of authentication, authorization and exchange decisions: stdout, syslog or a file path (disabled if empty)")
+	flagSet.StringVar(&auditLogKeyFile, "audit-log-key-file", "", "Path to the key the audit-log chain is keyed with as HMAC-SHA256 (required with audit-log)")
+	flagSet.StringVar(&dryRunMode, "dry-run", proxy.DryRunOff, "Shadow mode for validating behavior on existing traffic: verify (verify tokens and simulate the exchange) or exchange (also perform the exchange) and log what would be rejected or replaced, but forward every request unchanged; off to enforce")
+	flagSet.StringVar(&configFile, "config", "", "Path to a JSON file of option names to values, used for options given neither as flag nor as TOKEN_RP_* environment variable")
+	flagSet.StringVar(&configSecretName, "config-secret", "", "Name of a Secret in the namespace of the pod whose keys are option names, e.g. client-id, read from the Kubernetes API before config-map and config and watched for changes (disabled if empty)")
+	flagSet.StringVar(&configMapName, "config-map", "", "Name of a ConfigMap in the namespace of the pod whose keys are option names, e.g. issuer-url, or ca-bundle holding PEM root certificates, read from the Kubernetes API before config and watched for changes (disabled if empty)")
+	flagSet.StringVar(&vaultAddr, "vault-addr", "", "URL of a HashiCorp Vault server that vault-secret and tls-vault-secret are read from, e.g. https://vault:8200")
+	flagSet.StringVar(&vaultCACert, "vault-ca-cert", "", "Path to PEM root certificates trusted for vault-addr in addition to the system roots")
+	flagSet.StringVar(&vaultAuthMethod, "vault-auth-method", "", "How to log in to Vault: kubernetes (with the service account token of the pod and vault-role) or approle (with vault-role-id and vault-secret-id-file); kubernetes if empty")
+	flagSet.StringVar(&vaultAuthMount, "vault-auth-mount", "", "Path the Vault auth method is mounted at (the name of vault-auth-method if empty)")
+	flagSet.StringVar(&vaultRole, "vault-role", "", "Vault role to log in as with vault-auth-method kubernetes")
+	flagSet.StringVar(&vaultRoleID, "vault-role-id", "", "AppRole role ID to log in to Vault with")
+	flagSet.StringVar(&vaultSecretIDFile, "vault-secret-id-file", "", "Path to the AppRole secret ID to log in to Vault with, read again for every login")
+	flagSet.StringVar(&vaultSecretPath, "vault-secret", "", "Path of a Vault secret, e.g. secret/data/token-rp, whose keys are option names, e.g. client-id, or ca-bundle holding PEM root certificates, read before config-secret and watched for changes (disabled if empty)")
+	flagSet.StringVar(&verifyMode, "verify-mode", verify.JWTMode, "How to validate incoming tokens: jwt (local signature verification), userinfo (call the provider's UserInfo endpoint), introspection (call the provider's token introspection endpoint, authenticated with client-secret or client-key) or tokenreview (accept Kubernetes service account tokens validated with the TokenReview API of the cluster the proxy runs in)")
+	flagSet.Var(&tokenDecryptionKeysFlag, "token-decryption-key", "Path to a JWKS document or PEM file of RSA or ECDSA private keys that encrypted (JWE) tokens are decrypted with before their signature is verified, reloaded when it changes (requires verify-mode jwt)")
+	flagSet.Var(&tokenReviewAudiencesFlag, "tokenreview-audience", "Audience(s) that service account tokens must be issued for with verify-mode tokenreview (the API server's if unset)")
 }
 
-func main() {
-	if err := flagSet.Parse(os.Args[1:]); err != nil {
+// serve runs the proxy until it is signalled to stop.
+func serve(args []string) int {
+	if err := flagSet.Parse(args); err != nil {
+		return 2
+	}
+	if len(configFile) == 0 {
+		configFile = os.Getenv(config.EnvName("config"))
+	}
+	if err := applyConfig(flagSet, configFile); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
 		os.Exit(2)
 	}
 
 	if versionFlag {
-		fmt.Printf("%s %s (%s)\n", filepath.Base(os.Args[0]), version.AppVersion, version.BuildDate)
-		os.Exit(0)
+		return runVersion(nil)
 	}
 
 	prodConfig := zap.NewProductionConfig()
 	prodConfig.EncoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
-	prodLogger, _ := prodConfig.Build()
+	prodConfig.Level.SetLevel(logLevel)
+	var logEncoder zapcore.Encoder
+	switch logFormat {
+	case "json":
+		logEncoder = zapcore.NewJSONEncoder(prodConfig.EncoderConfig)
+	case "console":
+		logEncoder = zapcore.NewConsoleEncoder(prodConfig.EncoderConfig)
+	default:
+		fmt.Fprint(os.Stderr, "-log-format must be json or console\n")
+		os.Exit(2)
+	}
+	logWriter, err := openLogOutput(logOutput, logMaxSize*1024*1024, logMaxAge, logMaxBackups)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to open log output: %v\n", err)
+		os.Exit(1)
+	}
+	// Build the core by hand so every log line passes through redaction.
+	logCore := zapcore.NewCore(
+		logEncoder,
+		zapcore.AddSync(&redactingWriter{w: logWriter}),
+		prodConfig.Level,
+	)
+	logCore = zapcore.NewSampler(logCore, time.Second, prodConfig.Sampling.Initial, prodConfig.Sampling.Thereafter)
+	prodLogger := zap.New(logCore, zap.AddCaller(), zap.AddStacktrace(zapcore.ErrorLevel))
 	defer prodLogger.Sync() // flushes buffer, if any
 	logger := prodLogger.Sugar()
+	logrus.SetOutput(&redactingWriter{w: logWriter})
+	if logLevel == zapcore.DebugLevel {
+		logrus.SetLevel(logrus.DebugLevel)
+	}
 
-	if idpType != openshiftIDPType && idpType != githubIDPType {
+	if err := exchange.ValidateProviderType(idpType); err != nil {
 		logger.Fatalw(
 			"Unknown provider-type",
 			"providerType", idpType,
+			"error", err,
+		)
+	}
+	if verifyMode != verify.JWTMode && verifyMode != verify.UserInfoMode && verifyMode != verify.IntrospectionMode && verifyMode != verify.TokenReviewMode {
+		logger.Fatalw(
+			"Unknown verify-mode",
+			"verifyMode", verifyMode,
+		)
+	}
+	clientCreds, err := loadClientCredentials()
+	if err != nil {
+		logger.Fatalw(
+			"Invalid client credentials",
+			"error", err,
+		)
+	}
+	var decrypter *tokenDecrypter
+	if len(tokenDecryptionKeysFlag) > 0 {
+		if verifyMode != verify.JWTMode {
+			logger.Fatalw(
+				"token-decryption-key requires verify-mode jwt",
+				"verifyMode", verifyMode,
+			)
+		}
+		if decrypter, err = newTokenDecrypter(tokenDecryptionKeysFlag); err != nil {
+			logger.Fatalw(
+				"Failed to load token decryption keys",
+				"error", err,
+			)
+		}
+	}
+
+	initialConfig, err := newHandlerConfig(&reloadable, configFile)
+	if err != nil {
+		logger.Fatalw(
+			"Invalid configuration",
+			"error", err,
 		)
 	}
-	proxyTargetTokenType := "Bearer"
-	if idpType == githubIDPType {
-		proxyTargetTokenType = "token"
+	var currentConfig atomic.Value // *proxy.Config
+	currentConfig.Store(initialConfig)
+
+	if err := proxy.ValidateDryRunMode(dryRunMode); err != nil {
+		logger.Fatalw(
+			"Invalid dry-run",
+			"error", err,
+		)
+	}
+
+	algs := strings.Split(allowedAlgs, ",")
+	if err := verify.ValidateAlgs(algs); err != nil {
+		logger.Fatalw(
+			"Invalid allowed-algs",
+			"error", err,
+		)
 	}
 
 	if len(serverCertFile) > 0 && len(serverKeyFile) == 0 {
@@ -124,247 +420,891 @@ func main() {
 		os.Exit(2)
 	}
 
-	caCertPool, err := x509.SystemCertPool()
+	if (len(upstreamClientCertFile) > 0) != (len(upstreamClientKeyFile) > 0) {
+		fmt.Fprint(os.Stderr, "upstream-client-cert and upstream-client-key must be specified together\n")
+		os.Exit(2)
+	}
+	if len(upstreamClientCertFile) > 0 {
+		if _, err := tls.LoadX509KeyPair(upstreamClientCertFile, upstreamClientKeyFile); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid upstream-client-cert: %v\n", err)
+			os.Exit(2)
+		}
+	}
+
+	if len(decoratorPlugin) > 0 && len(decoratorWASM) > 0 {
+		fmt.Fprint(os.Stderr, "decorator-plugin can't be combined with decorator-wasm\n")
+		os.Exit(2)
+	}
+
+	if len(tlsSecretName) > 0 && len(serverCertFile) > 0 {
+		fmt.Fprint(os.Stderr, "tls-secret can't be combined with tls-cert\n")
+		os.Exit(2)
+	}
+	if len(tlsVaultSecret) > 0 && (len(serverCertFile) > 0 || len(tlsSecretName) > 0) {
+		fmt.Fprint(os.Stderr, "tls-vault-secret can't be combined with tls-cert or tls-secret\n")
+		os.Exit(2)
+	}
+	if len(tlsVaultSecret) > 0 {
+		if err := initVaultClient(); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid tls-vault-secret: %v\n", err)
+			os.Exit(2)
+		}
+	}
+	if len(tlsSecretName) > 0 {
+		if _, _, err := splitSecretName(tlsSecretName); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(2)
+		}
+	}
+	if len(acmeDomainsFlag) > 0 && hasServerCertificate() {
+		fmt.Fprint(os.Stderr, "acme-domain can't be combined with tls-cert, tls-secret or tls-vault-secret\n")
+		os.Exit(2)
+	}
+	if len(acmeDomainsFlag) > 0 && len(acmeCacheDir) == 0 {
+		fmt.Fprint(os.Stderr, "acme-domain requires acme-cache-dir\n")
+		os.Exit(2)
+	}
+
+	if len(sniCertsFlag) > 0 && !hasServerCertificate() {
+		fmt.Fprint(os.Stderr, "tls-sni-cert specified with no tls-cert, tls-secret or tls-vault-secret\n")
+		os.Exit(2)
+	}
+	if len(http3ListenAddr) > 0 && !servesTLS() {
+		fmt.Fprint(os.Stderr, "http3-listen specified with no tls-cert, tls-secret or spiffe-endpoint-socket\n")
+		os.Exit(2)
+	}
+
+	tlsSettings, err := parseTLSSettings()
+	if err == nil && enableHTTP2 && servesTLS() {
+		err = tlsSettings.checkHTTP2()
+	}
+	if err == nil && len(http3ListenAddr) > 0 {
+		err = tlsSettings.checkHTTP3()
+	}
 	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(2)
+	}
+
+	if len(clientCAFile) > 0 && !servesTLS() {
+		fmt.Fprint(os.Stderr, "client-ca specified with no tls-cert, tls-secret or spiffe-endpoint-socket\n")
+		os.Exit(2)
+	}
+	if len(clientCRLFile) > 0 && len(clientCAFile) == 0 {
+		fmt.Fprint(os.Stderr, "client-crl specified with no client-ca\n")
+		os.Exit(2)
+	}
+	if len(clientCAFile) > 0 {
+		if _, err := newClientVerifier(clientCAFile, clientCRLFile); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid client-ca: %v\n", err)
+			os.Exit(2)
+		}
+	}
+
+	if enablePprof && len(adminListenAddr) == 0 {
+		fmt.Fprint(os.Stderr, "enable-pprof specified with no admin-listen\n")
+		os.Exit(2)
+	}
+
+	if err := validateHTTP2Options(); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(2)
+	}
+
+	if err := exchange.ValidateTokenExpiration(kubeTokenExpiration); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid kubernetes-token-expiration: %v\n", err)
+		os.Exit(2)
+	}
+	if err := exchange.ValidateAWSSessionDuration(awsSessionDuration); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid aws-session-duration: %v\n", err)
+		os.Exit(2)
+	}
+
+	activated, err := activationListeners()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to use activation sockets: %v\n", err)
+		os.Exit(2)
+	}
+	if len(listenAddrsFlag) == 0 && len(activated) == 0 {
+		listenAddrsFlag = config.StringSliceFlag{defaultListenAddr}
+	}
+	var listenAddrs []listenAddr
+	for _, addr := range listenAddrsFlag {
+		la, err := parseListenAddr(addr, servesTLS())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(2)
+		}
+		if la.tls && !servesTLS() {
+			fmt.Fprintf(os.Stderr, "listen address %s requires tls-cert and tls-key, tls-secret or spiffe-endpoint-socket\n", addr)
+			os.Exit(2)
+		}
+		listenAddrs = append(listenAddrs, la)
+	}
+
+	metrics := newProxyMetrics()
+	health := &healthChecker{
+		endpoints: func() []url.URL {
+			return upstreamEndpoints(currentConfig.Load().(*proxy.Config))
+		},
+		path: upstreamHealthPath,
+		onResult: func(endpoint url.URL, healthy bool) {
+			var v float64
+			if healthy {
+				v = 1
+			}
+			metrics.upstreamHealthy.WithLabelValues(endpoint.String()).Set(v)
+		},
+	}
+	if len(adminListenAddr) > 0 {
+		la, err := parseListenAddr(adminListenAddr, false)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(2)
+		}
+		l, err := la.listen(false)
+		if err != nil {
+			logger.Fatalw(
+				"Failed to listen",
+				"address", la.String(),
+				"error", err,
+			)
+		}
+
+		adminMux := http.NewServeMux()
+		health.Register(adminMux)
+		adminMux.Handle("/metrics", metrics.handler())
+		adminMux.Handle("/log-level", prodConfig.Level)
+		metrics.publishExpvars()
+		adminMux.Handle("/debug/vars", expvar.Handler())
+		if enablePprof {
+			adminMux.HandleFunc("/debug/pprof/", pprof.Index)
+			adminMux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+			adminMux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+			adminMux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+			adminMux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+		}
+		adminServer := &http.Server{
+			Handler:           adminMux,
+			ReadHeaderTimeout: readHeaderTimeout,
+			IdleTimeout:       idleTimeout,
+			ErrorLog:          log.New(&nopWriter{}, "", log.LstdFlags),
+		}
+		go func() {
+			if err := adminServer.Serve(l); err != nil {
+				logger.Errorw(
+					"Admin server failed",
+					"error", err,
+				)
+			}
+		}()
+	}
+
+	if err = startWorkloadIdentity(logger); err != nil {
+		logger.Fatalw(
+			"Failed to fetch SVID from the Workload API",
+			"error", err,
+		)
+	}
+
+	trs := &destinationTransports{}
+	if err = trs.Store(initialConfig); err != nil {
 		logger.Fatalw(
-			"Failed to create cert pool",
+			"Failed to create transport",
 			"error", err,
 		)
 	}
+	hc := &http.Client{
+		Transport: &trs.issuer,
+	}
+
+	if upstreamHealthInterval > 0 {
+		health.client = &http.Client{Transport: &trs.upstream, Timeout: upstreamDialTimeout}
+		go health.watchUpstreams(upstreamHealthInterval)
+	}
 
-	for _, cert := range caCerts {
-		certBytes, err := ioutil.ReadFile(cert)
+	if len(issuerURLsFlag) == 0 {
+		fmt.Fprint(os.Stderr, "no issuer-url specified\n")
+		os.Exit(2)
+	}
+
+	var policy *proxy.Policy
+	if len(policyBundle) > 0 {
+		policy, err = proxy.LoadPolicy(context.Background(), policyBundle, policyQuery)
 		if err != nil {
 			logger.Fatalw(
-				"Failed to read CA certificate",
-				"file", cert,
+				"Failed to load policy bundle",
+				"path", policyBundle,
 				"error", err,
 			)
 		}
-		caCertPool.AppendCertsFromPEM(certBytes)
 	}
 
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{
-			InsecureSkipVerify: insecureSkipVerify,
-			RootCAs:            caCertPool,
-		},
-	}
-	hc := &http.Client{
-		Transport: tr,
+	issuers := loadTrustedIssuers(hc, algs, clientCreds, logger)
+
+	health.SetProviderConfigLoaded()
+
+	var webhook *proxy.Webhook
+	if len(authzWebhookURLFlag.Host) > 0 {
+		if err := proxy.ValidateWebhookFormat(authzWebhookFormat); err != nil {
+			logger.Fatalw(
+				"Invalid authz-webhook-format",
+				"error", err,
+			)
+		}
+		webhook = proxy.NewWebhook(
+			&http.Client{Transport: &trs.generic, Timeout: authzWebhookTimeout},
+			authzWebhookURLFlag.String(),
+			authzWebhookFormat,
+			authzWebhookCacheTTL,
+		)
 	}
 
-	issuerURL := strings.TrimSuffix(strings.TrimSuffix(issuerURLFlag.String(), discoveryPath), "/")
-	var providerConfig oidc.ProviderConfig
-	currentAttempt := 0
-	for providerConfig.Issuer == nil {
-		providerConfig, err = oidc.FetchProviderConfig(hc, issuerURL)
+	var decorate proxy.Decorator
+	if len(decoratorPlugin) > 0 {
+		decorate, err = proxy.LoadDecoratorPlugin(decoratorPlugin)
 		if err != nil {
-			if 0 <= providerConfigRetryMax && providerConfigRetryMax <= currentAttempt {
-				logger.Fatalw(
-					"Provider config unavailable",
-					"error", err,
-					"issuerURL", issuerURL,
-				)
-			}
-			logger.Warnw(
-				"Provider config unavailable (retrying)",
+			logger.Fatalw(
+				"Failed to load decorator plugin",
+				"path", decoratorPlugin,
+				"error", err,
+			)
+		}
+	} else if len(decoratorWASM) > 0 {
+		decorate, err = proxy.LoadDecoratorWASM(context.Background(), decoratorWASM, decoratorWASMTimeout, decoratorWASMMaxMemory*1024*1024)
+		if err != nil {
+			logger.Fatalw(
+				"Failed to load decorator module",
+				"path", decoratorWASM,
 				"error", err,
-				"issuerURL", issuerURL,
 			)
-			currentAttempt++
-			<-time.After(providerConfigRetryInterval)
 		}
 	}
 
-	oidcClient, err := oidc.NewClient(oidc.ClientConfig{
-		HTTPClient:     hc,
-		ProviderConfig: providerConfig,
-		Credentials: oidc.ClientCredentials{
-			ID: clientID,
-		},
-	})
+	accessLog, err := newAccessLogger(accessLogFormat, logger, &redactingWriter{w: os.Stdout})
+	if err != nil {
+		logger.Fatalw(
+			"Invalid access-log-format",
+			"error", err,
+		)
+	}
+
+	audit, err := newAuditLog(auditLogTarget, auditLogKeyFile, logger, metrics.auditFailures)
 	if err != nil {
 		logger.Fatalw(
-			"Failed to create new OIDC client",
+			"Failed to open audit log",
 			"error", err,
 		)
 	}
 
-	syncStop := oidcClient.SyncProviderConfig(issuerURL)
-	defer close(syncStop)
+	propagation, err := parseTracePropagation(tracePropagationFlag)
+	if err != nil {
+		logger.Fatalw(
+			"Invalid trace-propagation",
+			"error", err,
+		)
+	}
 
-	fwd, err := forward.New(forward.RoundTripper(tr))
+	tracer, err := newTracerFromEnv(&http.Client{Transport: &trs.generic}, logger)
 	if err != nil {
 		logger.Fatalw(
-			"Failed to create new proxy handler",
+			"Invalid tracing configuration",
 			"error", err,
 		)
 	}
+	defer tracer.Shutdown()
 
-	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-		isGitRequest := gitRequestRegexp.MatchString(req.URL.Path)
+	trustedProxies, err := proxy.ParseCIDRs(trustedProxiesFlag)
+	if err != nil {
+		logger.Fatalw(
+			"Invalid trusted-proxy",
+			"error", err,
+		)
+	}
 
-		var token string
+	trusted := &proxy.TrustedProxies{CIDRs: trustedProxies, ParseForwarded: parseForwarded}
+	for name, mode := range map[string]string{"forwarded": forwardedMode, "x-forwarded": xForwardedMode} {
+		if err := proxy.ValidateForwardedMode(mode); err != nil {
+			logger.Fatalw(
+				"Invalid "+name,
+				"error", err,
+			)
+		}
+	}
+	forwardedHeaders := &proxy.ForwardedHeaders{
+		Forwarded:  forwardedMode,
+		XForwarded: xForwardedMode,
+	}
+	forwardedHeaders.Server, _ = os.Hostname()
 
-		if isGitRequest {
-			_, token, _ = req.BasicAuth()
-		} else {
-			tokenFromHeader, err := jwtmiddleware.FromFirst(
-				tokenFromAuthHeaderWithPrefix("bearer"),
-				tokenFromAuthHeaderWithPrefix("token"),
-			)(req)
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusUnauthorized)
-				return
-			}
-			token = tokenFromHeader
+	newBreakers := func(target string) *proxy.Breakers {
+		return &proxy.Breakers{
+			Threshold: breakerThreshold,
+			OpenFor:   breakerOpenDuration,
+			OnStateChange: func(host, state string) {
+				metrics.setBreakerState(target, host, state)
+				logger.Warnw(
+					"Circuit breaker changed state",
+					"target", target,
+					"host", host,
+					"state", state,
+				)
+			},
 		}
+	}
+	upstreamBreakers := newBreakers("upstream")
+	brokerClient := &http.Client{
+		Transport: newBreakers("broker").RoundTripper(&trs.issuer),
+	}
 
-		if len(token) > 0 {
-			jwt, err := jose.ParseJWT(token)
+	retryStatus, err := proxy.ParseStatusCodes(upstreamRetryStatus)
+	if err != nil {
+		logger.Fatalw(
+			"Invalid upstream-retry-status",
+			"error", err,
+		)
+	}
+	retry := &proxy.Retry{
+		Attempts:    upstreamRetries,
+		Backoff:     upstreamRetryBackoff,
+		StatusCodes: retryStatus,
+		OnRetry: func(req *http.Request, n int, err error, status int) {
+			metrics.upstreamRetries.Inc()
+			kv := []interface{}{"upstream", req.URL.Host, "path", req.URL.Path, "retry", n}
 			if err != nil {
-				http.Error(w, err.Error(), http.StatusUnauthorized)
-				return
+				kv = append(kv, "error", err)
+			} else {
+				kv = append(kv, "status", status)
 			}
+			logger.Infow("Retrying upstream request", kv...)
+		},
+	}
 
-			err = oidcClient.VerifyJWT(jwt)
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusUnauthorized)
-				return
-			}
+	// Registry tokens are requested from the realm with the CA
+	// certificates of upstreams; requests sent again after a registry
+	// challenge are signed anew.
+	registryTr := proxy.RegistryTransport(exchange.SignAWSRequests(proxy.HMACTransport(proxy.TimeoutTransport(&upstreamTransport{
+		plain:         &trs.upstream,
+		proxyProtocol: &trs.proxyProtocol,
+		h2c:           &trs.h2c,
+	}))), &http.Client{Transport: &trs.upstream, Timeout: 30 * time.Second})
+	// Every retry passes the circuit breaker and is signed anew.
+	upstreamTr := retry.RoundTripper(upstreamBreakers.RoundTripper(registryTr))
+	upstreamError := func(w http.ResponseWriter, req *http.Request, err error) {
+		if err == proxy.ErrBreakerOpen {
+			httpError(w, "upstream unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			httpError(w, "request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		utils.DefaultHandler.ServeHTTP(w, req, err)
+	}
 
-			retrievedToken, err := retrieveTargetToken(issuerURL, idpAlias, idpType, token, hc)
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusUnauthorized)
-				return
-			}
+	// The Host header is set by forwardUpstream.
+	fwd, err := forward.New(
+		forward.RoundTripper(upstreamTr),
+		forward.PassHostHeader(true),
+		forward.Rewriter(hopHeaderRewriter{}),
+		forward.ErrorHandler(utils.ErrorHandlerFunc(upstreamError)),
+	)
+	if err != nil {
+		logger.Fatalw(
+			"Failed to create new proxy handler",
+			"error", err,
+		)
+	}
 
-			if isGitRequest {
-				if len(retrievedToken) > 0 {
-					if idpType == githubIDPType {
-						ctx := context.Background()
-						ts := oauth2.StaticTokenSource(
-							&oauth2.Token{AccessToken: retrievedToken},
-						)
-						tc := oauth2.NewClient(ctx, ts)
-
-						client := github.NewClient(tc)
-						if len(identityServerFlag.Host) > 0 {
-							identityServerURL := (url.URL)(identityServerFlag)
-							client.BaseURL = &identityServerURL
-						}
-
-						// list all repositories for the authenticated user
-						user, _, err := client.Users.Get(ctx, "")
-						if err != nil {
-							fmt.Printf("%v\n", err)
-							http.Error(w, err.Error(), http.StatusUnauthorized)
-							return
-						}
-
-						req.SetBasicAuth(user.GetLogin(), retrievedToken)
-					}
+	// gRPC calls are passed through by a reverse proxy, as the forwarder
+	// neither streams both directions at once nor passes trailers on.
+	grpcProxy := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			// Keep the headers set by forwardedHeaders.
+			for _, h := range []string{"X-Forwarded-For", "X-Forwarded-Host", "X-Forwarded-Proto"} {
+				if v, ok := pr.In.Header[h]; ok {
+					pr.Out.Header[h] = v
 				}
-			} else {
-				req.Header.Set("Authorization", proxyTargetTokenType+" "+retrievedToken)
 			}
+		},
+		Transport:     upstreamTr,
+		FlushInterval: -1,
+		ErrorLog:      log.New(&nopWriter{}, "", log.LstdFlags),
+		ErrorHandler:  upstreamError,
+	}
+
+	forwardUpstream := func(w http.ResponseWriter, req *http.Request, cfg *proxy.Config) {
+		endpoint, done := cfg.PickUpstream()
+		defer done()
+		proxyURL := cfg.UpstreamURL(endpoint, req.URL)
+		forwardedHeaders.Apply(req)
+		req.URL = proxyURL
+		// The forwarder sends the request URI as is.
+		req.RequestURI = proxyURL.RequestURI()
+		req.Host = cfg.UpstreamHost(req, proxyURL)
+		requestInfoFromContext(req.Context()).upstream = proxyURL.Host
+
+		if len(cfg.ProxyProtocol) > 0 {
+			req = req.WithContext(proxy.ContextWithProxyProtocol(req, cfg.ProxyProtocol))
 		}
+		if cfg.H2C {
+			req = req.WithContext(proxy.ContextWithH2C(req.Context()))
+		}
+		if cfg.HMACSigner != nil {
+			req = req.WithContext(proxy.ContextWithHMACSigner(req.Context(), cfg.HMACSigner))
+		}
+		ctx, cancel := cfg.Timeouts.WithContext(req.Context())
+		defer cancel()
+		ctx, span := tracer.Start(ctx, "upstream", spanKindClient)
+		defer span.End()
+		span.SetAttribute("server.address", proxyURL.Host)
+		req = req.WithContext(ctx)
+		propagation.inject(ctx, req.Header)
 
-		proxyURL := (url.URL)(proxyURLFlag)
-		req.URL = &proxyURL
-		fwd.ServeHTTP(w, req)
-	})
+		// Git bodies are streamed in both directions, never held in memory.
+		isGitRequest := exchange.IsGitRequest(req)
+		gitBody := &countingReader{ReadCloser: req.Body}
+		if isGitRequest && req.Body != http.NoBody {
+			req.Body = gitBody
+		}
+		rec := &statusRecorder{ResponseWriter: w}
+		fw := proxy.NewFlushWriter(rec, cfg.FlushInterval)
+		defer fw.Stop()
+		if proxy.IsGRPCRequest(req) {
+			grpcProxy.ServeHTTP(fw, req)
+		} else {
+			fwd.ServeHTTP(fw, req)
+		}
+		metrics.upstreamResponses.WithLabelValues(strconv.Itoa(rec.Status())).Inc()
+		if isGitRequest {
+			metrics.gitBytes.WithLabelValues("upload").Add(float64(gitBody.n.Load()))
+			metrics.gitBytes.WithLabelValues("download").Add(float64(rec.Bytes()))
+		}
+		span.SetAttribute("http.response.status_code", rec.Status())
+	}
 
-	s := &http.Server{
-		Addr:    ":8080",
-		Handler: handler,
-		TLSConfig: &tls.Config{
-			MinVersion: tls.VersionTLS12,
-		},
-		ErrorLog: log.New(&nopWriter{}, "", log.LstdFlags),
+	var identityServerURL *url.URL
+	if len(identityServerFlag.Host) > 0 {
+		identityServerURL = (*url.URL)(&identityServerFlag)
 	}
 
-	if len(serverCertFile) > 0 {
-		err = s.ListenAndServeTLS(serverCertFile, serverKeyFile)
-	} else {
-		err = s.ListenAndServe()
+	// Routes may use any provider type.
+	retrievers := map[string]exchange.TokenRetriever{}
+	for _, t := range exchange.ProviderTypes() {
+		t := t
+		retrievers[t], err = exchange.New(t, exchange.Options{
+			Client:               brokerClient,
+			IdentityServerURL:    identityServerURL,
+			IdentityServerClient: &http.Client{Transport: &trs.identityServer},
+			LoginCacheTTL:        loginCacheTTL,
+			TokenAudiences:       kubeTokenAudiencesFlag,
+			TokenExpiration:      kubeTokenExpiration,
+			AWSRegion:            awsRegion,
+			AWSService:           awsService,
+			AWSCredentialsFile:   awsCredentialsFile,
+			AWSSessionDuration:   awsSessionDuration,
+			OnRateLimit: func(limit, remaining int, reset time.Time) {
+				metrics.providerRateLimit.WithLabelValues(t, "limit").Set(float64(limit))
+				metrics.providerRateLimit.WithLabelValues(t, "remaining").Set(float64(remaining))
+				metrics.providerRateLimit.WithLabelValues(t, "reset").Set(float64(reset.Unix()))
+			},
+		})
+		if err != nil {
+			logger.Fatalw(
+				"Failed to create token retriever",
+				"providerType", t,
+				"error", err,
+			)
+		}
 	}
 
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Server failed: %v", err)
+	var rateLimiter *proxy.RateLimiter
+	if rateLimit > 0 {
+		rateLimiter = proxy.NewRateLimiter(rateLimit, rateLimitBurst)
 	}
-}
 
-type jsonBrokerToken struct {
-	AccessToken string `json:"access_token"`
-}
+	exchangeQuota := proxy.NewExchangeQuota(exchangeQuotaHourly, exchangeQuotaDaily)
+	if exchangeQuota != nil {
+		exchangeQuota.OnUsage = func(window string, top int) {
+			metrics.exchangeQuotaUsage.WithLabelValues(window).Set(float64(top))
+		}
+	}
 
-func retrieveTargetToken(issuerURL, idpAlias, idpType, token string, hc *http.Client) (string, error) {
-	tokenURL := issuerURL + "/broker/" + idpAlias + "/token"
-	tokenReq, err := http.NewRequest("GET", tokenURL, nil)
-	if err != nil {
-		return "", err
+	var notLinked *proxy.NotLinkedCache
+	if notLinkedCacheTTL > 0 {
+		notLinked = &proxy.NotLinkedCache{TTL: notLinkedCacheTTL}
 	}
-	tokenReq.Header.Set("Authorization", "Bearer "+token)
-	tokenResp, err := hc.Do(tokenReq)
-	if err != nil {
-		return "", err
+
+	var lockout *proxy.Lockout
+	if lockoutThreshold > 0 {
+		lockout = &proxy.Lockout{
+			Threshold: lockoutThreshold,
+			Window:    lockoutWindow,
+			Duration:  lockoutDuration,
+		}
 	}
-	defer func() { _ = tokenResp.Body.Close() }()
 
-	if tokenResp.StatusCode != 200 {
-		return "", fmt.Errorf("unable to retrieve broker token: %s", tokenResp.Status)
+	proxyHandler := &proxy.Handler{
+		Config: func() *proxy.Config {
+			return currentConfig.Load().(*proxy.Config)
+		},
+		Issuers:        issuers,
+		Retriever:      retrievers[idpType],
+		Retrievers:     retrievers,
+		Webhook:        webhook,
+		Policy:         policy,
+		Decorate:       decorate,
+		DryRun:         dryRunMode,
+		MaxHeaderCount: maxHeaderCount,
+		CertBinding:    len(clientCAFile) > 0 || workloadID != nil,
+		RateLimiter:    rateLimiter,
+		ExchangeQuota:  exchangeQuota,
+		NotLinked:      notLinked,
+		Lockout:        lockout,
+		Forward:        forwardUpstream,
+		Error:          httpError,
+		Logger:         logger,
+		Hooks: proxy.Hooks{
+			Rejected: func(req *http.Request, event, reason, msg string) {
+				metrics.verificationFailures.WithLabelValues(reason).Inc()
+				audit.Record(req, event, rejectAuditOutcome, reason, msg)
+			},
+			Authenticated: func(req *http.Request, subject, providerAlias string) {
+				info := requestInfoFromContext(req.Context())
+				info.subject = subject
+				info.providerAlias = providerAlias
+				audit.Record(req, proxy.AuthenticationEvent, acceptAuditOutcome, "", "")
+			},
+			Exchanged: func(req *http.Request, providerAlias string, d time.Duration, err error) {
+				outcome := "success"
+				if err != nil {
+					outcome = "failure"
+					audit.Record(req, proxy.ExchangeEvent, rejectAuditOutcome, "exchange_failed", err.Error())
+				} else {
+					audit.Record(req, proxy.ExchangeEvent, acceptAuditOutcome, "", "")
+				}
+				providerAlias = currentConfig.Load().(*proxy.Config).MetricsProviderAlias(providerAlias)
+				metrics.exchanges.WithLabelValues(providerAlias, outcome).Inc()
+				metrics.exchangeDuration.WithLabelValues(providerAlias, outcome).Observe(d.Seconds())
+			},
+			StartSpan: func(ctx context.Context, name string, attrs ...interface{}) (context.Context, func(error)) {
+				ctx, span := tracer.Start(ctx, name, spanKindClient)
+				for i := 0; i+1 < len(attrs); i += 2 {
+					span.SetAttribute(attrs[i].(string), attrs[i+1])
+				}
+				return ctx, func(err error) {
+					span.SetError(err)
+					span.End()
+				}
+			},
+		},
+	}
+	if decrypter != nil {
+		proxyHandler.Decrypt = decrypter.Decrypt
 	}
 
-	b, err := ioutil.ReadAll(tokenResp.Body)
-	if err != nil {
-		return "", err
+	var concurrency *proxy.ConcurrencyLimiter
+	if maxConcurrentRequests > 0 {
+		concurrency = proxy.NewConcurrencyLimiter(maxConcurrentRequests, maxQueuedRequests, queueTimeout)
+	}
+	serveLimited := func(w http.ResponseWriter, req *http.Request) {
+		if concurrency != nil {
+			release, err := concurrency.Acquire(req.Context())
+			if err != nil {
+				metrics.overloadRejections.Inc()
+				w.Header().Set("Retry-After", "1")
+				httpError(w, err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+			defer release()
+		}
+		proxyHandler.ServeHTTP(w, req)
 	}
 
-	if idpType == openshiftIDPType {
-		var brokerToken jsonBrokerToken
-		if err = json.Unmarshal(b, &brokerToken); err != nil {
-			return "", err
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		metrics.inFlight.Inc()
+		defer metrics.inFlight.Dec()
+
+		ctx := propagation.extract(req.Context(), req.Header)
+		if propagation.enabled() && tracer == nil && !trace.SpanContextFromContext(ctx).IsValid() {
+			ctx = contextWithRootSpan(ctx)
 		}
-		if len(brokerToken.AccessToken) > 0 {
-			return brokerToken.AccessToken, nil
+		ctx, span := tracer.Start(ctx, req.Method, spanKindServer)
+		defer span.End()
+		span.SetAttribute("http.request.method", req.Method)
+		span.SetAttribute("url.path", req.URL.Path)
+		clientIP, fromTrusted := trusted.ClientIP(req)
+		if fromTrusted {
+			ctx = proxy.ContextWithTrustedProxy(ctx)
+		} else {
+			proxy.StripForwardedHeaders(req.Header)
 		}
+		ctx = proxy.ContextWithClientIP(ctx, clientIP)
+		info := &requestInfo{path: req.URL.Path, clientIP: clientIP}
+		req = req.WithContext(contextWithRequestInfo(ctx, info))
 
-		return "", fmt.Errorf("missing access token in broker token")
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		serveLimited(rec, req)
+		accessLog.Log(req, rec, start, info)
+		metrics.requests.WithLabelValues(req.Method, strconv.Itoa(rec.Status())).Inc()
+		metrics.requestDuration.WithLabelValues(req.Method).Observe(time.Since(start).Seconds())
+		span.SetAttribute("http.response.status_code", rec.Status())
+	})
+
+	s := &http.Server{
+		Handler:           handler,
+		TLSConfig:         &tls.Config{},
+		ReadTimeout:       readTimeout,
+		ReadHeaderTimeout: readHeaderTimeout,
+		WriteTimeout:      writeTimeout,
+		IdleTimeout:       idleTimeout,
+		MaxHeaderBytes:    maxHeaderBytes,
+		ErrorLog:          log.New(&nopWriter{}, "", log.LstdFlags),
+	}
+	s.Protocols = new(http.Protocols)
+	s.Protocols.SetHTTP1(true)
+	s.Protocols.SetHTTP2(enableHTTP2)
+	s.Protocols.SetUnencryptedHTTP2(h2c)
+	s.HTTP2 = newHTTP2Config()
+	s.HTTP2.MaxConcurrentStreams = http2MaxConcurrentStreams
+	tlsSettings.apply(s.TLSConfig)
+	if hasServerCertificate() {
+		certs, version, err := loadServerCertificates()
+		if err != nil {
+			logger.Fatalw(
+				"Failed to load TLS certificates",
+				"error", err,
+			)
+		}
+		serverCerts := newServerCertificates(certs)
+		s.TLSConfig.GetCertificate = serverCerts.GetCertificate
+		go serverCerts.watch(version, logger)
+	} else if len(acmeDomainsFlag) > 0 {
+		acmeManager := newACMEManager()
+		s.TLSConfig.GetCertificate = acmeManager.GetCertificate
+		s.TLSConfig.NextProtos = []string{acme.ALPNProto}
+		s.Handler = serveACMEChallenges(acmeManager, s.Handler)
+	} else if workloadID != nil {
+		s.TLSConfig.GetCertificate = workloadID.GetCertificate
+	}
+	if len(clientCAFile) > 0 || workloadID != nil {
+		verifier, err := newClientVerifier(clientCAFile, clientCRLFile)
+		if err != nil {
+			logger.Fatalw(
+				"Failed to load client CA",
+				"error", err,
+			)
+		}
+		// Verify client certificates ourselves to pick up changes to the
+		// CA and revocation lists without a restart.
+		s.TLSConfig.ClientAuth = tls.RequestClientCert
+		s.TLSConfig.VerifyConnection = verifier.VerifyConnection
 	}
 
-	if idpType == githubIDPType {
-		query, err := url.ParseQuery(string(b))
+	serveErrs := make(chan error, len(listenAddrs)+len(activated)+1)
+	var h3 *http3Listener
+	if len(http3ListenAddr) > 0 {
+		h3, err = listenHTTP3(http3ListenAddr, handler, s.TLSConfig)
 		if err != nil {
-			return "", err
+			logger.Fatalw(
+				"Failed to listen",
+				"address", http3ListenAddr,
+				"error", err,
+			)
+		}
+		s.Handler = h3.AdvertiseTo(s.Handler)
+		go func() { serveErrs <- h3.Serve() }()
+	}
+	serve := func(l net.Listener, useTLS bool) {
+		if useTLS {
+			serveErrs <- s.ServeTLS(l, "", "")
+		} else {
+			serveErrs <- s.Serve(l)
 		}
+	}
+	for _, la := range listenAddrs {
+		l, err := la.listen(reusePort)
+		if err != nil {
+			logger.Fatalw(
+				"Failed to listen",
+				"address", la.String(),
+				"error", err,
+			)
+		}
+		go serve(l, la.tls)
+	}
+	for _, l := range activated {
+		go serve(l, servesTLS())
+	}
+
+	if err = sdNotify("READY=1"); err != nil {
+		logger.Warnw(
+			"Failed to notify service manager",
+			"error", err,
+		)
+	}
+
+	reloadConfig := func() {
+		_ = sdNotify("RELOADING=1")
+		defer func() { _ = sdNotify("READY=1") }()
 
-		accessToken := query.Get("access_token")
-		if len(accessToken) > 0 {
-			return accessToken, nil
+		o, err := parseReloadableOptions(args, configFile)
+		if err != nil {
+			logger.Errorw(
+				"Failed to reload configuration",
+				"error", err,
+			)
+			return
+		}
+		cfg, err := newHandlerConfig(o, configFile)
+		if err != nil {
+			logger.Errorw(
+				"Failed to reload configuration",
+				"error", err,
+			)
+			return
+		}
+		if err = trs.Store(cfg); err != nil {
+			logger.Errorw(
+				"Failed to reload configuration",
+				"error", err,
+			)
+			return
 		}
 
-		return "", fmt.Errorf("missing access token in broker token")
+		currentConfig.Store(cfg)
+		logger.Infow(
+			"Reloaded configuration",
+			"proxyURL", cfg.ProxyURL.String(),
+			"providerAlias", cfg.ProviderAlias,
+		)
 	}
 
-	return "", fmt.Errorf("broker token in unknown format")
-}
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	triggerReload := func() {
+		select {
+		case reload <- syscall.SIGHUP:
+		default:
+		}
+	}
+	go watchFiles(func() []string {
+		cfg := currentConfig.Load().(*proxy.Config)
+		files := concatCACerts(cfg.CACerts, cfg.UpstreamCACerts, cfg.IssuerCACerts, cfg.IdentityServerCACerts)
+		if len(configFile) > 0 {
+			files = append([]string{configFile}, files...)
+		}
+		return files
+	}, triggerReload)
+	go watchConfigSources(triggerReload, logger)
+	if workloadID != nil {
+		// Rebuild the transports to trust rotated bundles.
+		go func() {
+			for range workloadID.bundlesChanged {
+				triggerReload()
+			}
+		}()
+	}
+	go func() {
+		for range reload {
+			reloadConfig()
+		}
+	}()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
 
-func tokenFromAuthHeaderWithPrefix(prefix string) jwtmiddleware.TokenExtractor {
-	return func(r *http.Request) (string, error) {
-		authHeader := r.Header.Get("Authorization")
-		if authHeader == "" {
-			return "", nil // No error, just no token
+	select {
+	case err = <-serveErrs:
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Server failed: %v\n", err)
+			return 1
 		}
+	case sig := <-stop:
+		logger.Infow(
+			"Shutting down",
+			"signal", sig.String(),
+			"timeout", shutdownTimeout,
+		)
+		_ = sdNotify("STOPPING=1")
 
-		// TODO: Make this a bit more robust, parsing-wise
-		authHeaderParts := strings.Split(authHeader, " ")
-		if len(authHeaderParts) != 2 || strings.ToLower(authHeaderParts[0]) != prefix {
-			return "", nil // No error, just no token
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err = s.Shutdown(ctx); err != nil {
+			logger.Warnw(
+				"Graceful shutdown incomplete",
+				"error", err,
+			)
+		}
+		if h3 != nil {
+			if err = h3.Shutdown(ctx); err != nil {
+				logger.Warnw(
+					"Graceful HTTP/3 shutdown incomplete",
+					"error", err,
+				)
+			}
 		}
+	}
+	return 0
+}
+
+// hopHeaderRewriter removes the hop-by-hop headers of forwarded requests.
+// Unlike the forwarder's default rewriter, it leaves the forwarded headers to
+// proxy.ForwardedHeaders.
+type hopHeaderRewriter struct{}
+
+func (hopHeaderRewriter) Rewrite(req *http.Request) {
+	if !forward.IsWebsocketRequest(req) {
+		utils.RemoveHeaders(req.Header, forward.HopHeaders...)
+	}
+}
+
+// fetchProviderConfig retrieves the provider config of issuerURL, retrying
+// as configured while it is unavailable.
+func fetchProviderConfig(hc *http.Client, issuerURL string, logger *zap.SugaredLogger) oidc.ProviderConfig {
+	var providerConfig oidc.ProviderConfig
+	var err error
+	currentAttempt := 0
+	for providerConfig.Issuer == nil {
+		providerConfig, err = oidc.FetchProviderConfig(hc, issuerURL)
+		if err != nil {
+			if 0 <= providerConfigRetryMax && providerConfigRetryMax <= currentAttempt {
+				logger.Fatalw(
+					"Provider config unavailable",
+					"error", err,
+					"issuerURL", issuerURL,
+				)
+			}
+			logger.Warnw(
+				"Provider config unavailable (retrying)",
+				"error", err,
+				"issuerURL", issuerURL,
+			)
+			currentAttempt++
+			<-time.After(providerConfigRetryInterval)
+		}
+	}
+	return providerConfig
+}
+
+// validateHTTP2Options checks the HTTP/2 settings.
+func validateHTTP2Options() error {
+	if http2MaxConcurrentStreams < 1 {
+		return errors.New("http2-max-concurrent-streams must be positive")
+	}
+	if http2MaxReadFrameSize != 0 && (http2MaxReadFrameSize < 16<<10 || http2MaxReadFrameSize > 16<<20) {
+		return fmt.Errorf("http2-max-read-frame-size must be between %d and %d", 16<<10, 16<<20)
+	}
+	return nil
+}
 
-		return authHeaderParts[1], nil
+// newHTTP2Config returns the HTTP/2 settings shared by the server and the
+// upstream transports.
+func newHTTP2Config() *http.HTTP2Config {
+	return &http.HTTP2Config{
+		MaxReadFrameSize: http2MaxReadFrameSize,
 	}
 }
 
@@ -0,0 +1,230 @@
+//    Copyright 2017 Red Hat, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"expvar"
+	"io"
+	"net"
+	"net/http"
+	"runtime"
+	"strings"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/syndesisio/token-rp/pkg/proxy"
+	"github.com/syndesisio/token-rp/pkg/version"
+)
+
+// defaultBuckets are the histogram buckets, in seconds, used for latencies.
+var defaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60}
+
+// proxyMetrics are the metrics exported by the proxy.
+type proxyMetrics struct {
+	registry *prometheus.Registry
+
+	requests             *prometheus.CounterVec
+	requestDuration      *prometheus.HistogramVec
+	inFlight             prometheus.Gauge
+	verificationFailures *prometheus.CounterVec
+	exchanges            *prometheus.CounterVec
+	exchangeDuration     *prometheus.HistogramVec
+	upstreamResponses    *prometheus.CounterVec
+	upstreamHealthy      *prometheus.GaugeVec
+	breakerState         *prometheus.GaugeVec
+	upstreamRetries      prometheus.Counter
+	overloadRejections   prometheus.Counter
+	gitBytes             *prometheus.CounterVec
+	providerRateLimit    *prometheus.GaugeVec
+	exchangeQuotaUsage   *prometheus.GaugeVec
+	auditFailures        prometheus.Counter
+}
+
+func newProxyMetrics() *proxyMetrics {
+	m := &proxyMetrics{
+		registry:             prometheus.NewRegistry(),
+		requests:             prometheus.NewCounterVec(prometheus.CounterOpts{Name: "tokenrp_requests_total", Help: "Requests handled by the proxy."}, []string{"method", "code"}),
+		requestDuration:      prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "tokenrp_request_duration_seconds", Help: "Time taken to handle requests.", Buckets: defaultBuckets}, []string{"method"}),
+		inFlight:             prometheus.NewGauge(prometheus.GaugeOpts{Name: "tokenrp_in_flight_requests", Help: "Requests currently being handled."}),
+		verificationFailures: prometheus.NewCounterVec(prometheus.CounterOpts{Name: "tokenrp_verification_failures_total", Help: "Requests rejected during token verification or authorization."}, []string{"reason"}),
+		exchanges:            prometheus.NewCounterVec(prometheus.CounterOpts{Name: "tokenrp_broker_exchanges_total", Help: "Broker token exchanges."}, []string{"provider_alias", "outcome"}),
+		exchangeDuration:     prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "tokenrp_broker_exchange_duration_seconds", Help: "Time taken by broker token exchanges.", Buckets: defaultBuckets}, []string{"provider_alias", "outcome"}),
+		upstreamResponses:    prometheus.NewCounterVec(prometheus.CounterOpts{Name: "tokenrp_upstream_responses_total", Help: "Responses received from the upstream."}, []string{"code"}),
+		upstreamHealthy:      prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "tokenrp_upstream_healthy", Help: "Whether the last health check of an upstream endpoint succeeded."}, []string{"endpoint"}),
+		breakerState:         prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "tokenrp_circuit_breaker_state", Help: "Current state of the circuit breaker of an upstream endpoint or broker host (1 for the current state, 0 otherwise)."}, []string{"target", "host", "state"}),
+		upstreamRetries:      prometheus.NewCounter(prometheus.CounterOpts{Name: "tokenrp_upstream_retries_total", Help: "Upstream requests retried after a connection error or retryable status."}),
+		overloadRejections:   prometheus.NewCounter(prometheus.CounterOpts{Name: "tokenrp_overload_rejections_total", Help: "Requests rejected because the concurrency limit and its queue were exhausted."}),
+		gitBytes:             prometheus.NewCounterVec(prometheus.CounterOpts{Name: "tokenrp_git_bytes_total", Help: "Bytes of Git request and response bodies streamed through the proxy."}, []string{"direction"}),
+		providerRateLimit:    prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "tokenrp_provider_rate_limit", Help: "Rate limit last reported by a provider API (limit, remaining, or reset as a Unix timestamp)."}, []string{"provider_type", "value"}),
+		exchangeQuotaUsage:   prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "tokenrp_exchange_quota_top_usage", Help: "Most broker token exchanges of any subject in the current quota window."}, []string{"window"}),
+		auditFailures:        prometheus.NewCounter(prometheus.CounterOpts{Name: "tokenrp_audit_write_failures_total", Help: "Audit records that couldn't be written to the audit log."}),
+	}
+	m.registry.MustRegister(
+		m.requests,
+		m.requestDuration,
+		m.inFlight,
+		m.verificationFailures,
+		m.exchanges,
+		m.exchangeDuration,
+		m.upstreamResponses,
+		m.upstreamHealthy,
+		m.breakerState,
+		m.upstreamRetries,
+		m.overloadRejections,
+		m.gitBytes,
+		m.providerRateLimit,
+		m.exchangeQuotaUsage,
+		m.auditFailures,
+	)
+	return m
+}
+
+// handler serves the metrics to Prometheus.
+func (m *proxyMetrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// setBreakerState records the new state of the circuit breaker of host.
+func (m *proxyMetrics) setBreakerState(target, host, state string) {
+	for _, s := range []string{proxy.BreakerClosed, proxy.BreakerOpen, proxy.BreakerHalfOpen} {
+		var v float64
+		if s == state {
+			v = 1
+		}
+		m.breakerState.WithLabelValues(target, host, s).Set(v)
+	}
+}
+
+// snapshot returns the current values of the counters or gauges of c keyed
+// by their comma-separated values of labels.
+func snapshot(c prometheus.Collector, labels ...string) map[string]float64 {
+	ch := make(chan prometheus.Metric)
+	go func() {
+		c.Collect(ch)
+		close(ch)
+	}()
+
+	values := make(map[string]float64)
+	for metric := range ch {
+		var pb dto.Metric
+		if err := metric.Write(&pb); err != nil {
+			continue
+		}
+		byName := make(map[string]string, len(pb.GetLabel()))
+		for _, l := range pb.GetLabel() {
+			byName[l.GetName()] = l.GetValue()
+		}
+		key := make([]string, len(labels))
+		for i, l := range labels {
+			key[i] = byName[l]
+		}
+		values[strings.Join(key, ",")] = pb.GetCounter().GetValue() + pb.GetGauge().GetValue()
+	}
+	return values
+}
+
+// publishExpvars exports build information, Go runtime statistics and the
+// proxy's counters via expvar for environments without Prometheus.
+// memstats and cmdline are published by the expvar package itself.
+func (m *proxyMetrics) publishExpvars() {
+	expvar.Publish("build", expvar.Func(func() interface{} {
+		return map[string]string{
+			"version":   version.AppVersion,
+			"buildDate": version.BuildDate,
+			"goVersion": runtime.Version(),
+		}
+	}))
+	expvar.Publish("goroutines", expvar.Func(func() interface{} {
+		return runtime.NumGoroutine()
+	}))
+	expvar.Publish("tokenrp", expvar.Func(func() interface{} {
+		return map[string]interface{}{
+			"requests":             snapshot(m.requests, "method", "code"),
+			"inFlightRequests":     int64(snapshot(m.inFlight)[""]),
+			"verificationFailures": snapshot(m.verificationFailures, "reason"),
+			"brokerExchanges":      snapshot(m.exchanges, "provider_alias", "outcome"),
+			"upstreamResponses":    snapshot(m.upstreamResponses, "code"),
+		}
+	}))
+}
+
+// statusRecorder captures the status code and number of body bytes written
+// to a ResponseWriter.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	// Informational responses such as 100 Continue precede the final one.
+	if r.status == 0 && (status >= 200 || status == http.StatusSwitchingProtocols) {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += int64(n)
+	return n, err
+}
+
+// Flush implements http.Flusher so streamed responses aren't buffered.
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack implements http.Hijacker so websocket upgrades keep working.
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer does not support hijacking")
+	}
+	return h.Hijack()
+}
+
+func (r *statusRecorder) Bytes() int64 {
+	return r.bytes
+}
+
+// countingReader counts the bytes read from a request body. The transport
+// may still be reading it after the response was received.
+type countingReader struct {
+	io.ReadCloser
+	n atomic.Int64
+}
+
+func (r *countingReader) Read(b []byte) (int, error) {
+	n, err := r.ReadCloser.Read(b)
+	r.n.Add(int64(n))
+	return n, err
+}
+
+func (r *statusRecorder) Status() int {
+	if r.status == 0 {
+		return http.StatusOK
+	}
+	return r.status
+}
@@ -0,0 +1,278 @@
+//    Copyright 2017 Red Hat, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	jwtgo "github.com/dgrijalva/jwt-go"
+	"github.com/syndesisio/token-rp/pkg/exchange"
+	"github.com/syndesisio/token-rp/pkg/verify"
+)
+
+const mockIDPKeyID = "mock"
+
+// mockIDP is a minimal stand-in for a Keycloak realm: it serves discovery,
+// JWKS, UserInfo, token and introspection endpoints, and answers broker token requests with
+// fake provider tokens. Tokens are signed with a key generated on startup.
+type mockIDP struct {
+	issuer        string
+	providerType  string
+	tokenLifetime time.Duration
+	unlinked      map[string]bool
+	key           *rsa.PrivateKey
+}
+
+func runMockIDP(args []string) int {
+	fs := flag.NewFlagSet("token-rp mock-idp", flag.ContinueOnError)
+	listen := fs.String("listen", "127.0.0.1:8180", "Address to listen on as host:port")
+	realm := fs.String("realm", "syndesis", "Name of the realm, which determines the issuer URL")
+	providerType := fs.String("provider-type", exchange.OpenShift, "Format of broker token responses: openshift or github")
+	tokenLifetime := fs.Duration("token-lifetime", 5*time.Minute, "Lifetime of issued tokens")
+	unlinkedUsers := fs.String("unlinked-users", "", "Comma-separated usernames without linked identity, whose broker token requests are rejected")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *providerType != exchange.OpenShift && *providerType != exchange.GitHub {
+		fmt.Fprintf(os.Stderr, "unknown provider-type %q\n", *providerType)
+		return 2
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to generate signing key: %v\n", err)
+		return 1
+	}
+
+	m := &mockIDP{
+		issuer:        "http://" + *listen + "/auth/realms/" + *realm,
+		providerType:  *providerType,
+		tokenLifetime: *tokenLifetime,
+		unlinked:      make(map[string]bool),
+		key:           key,
+	}
+	for _, u := range strings.Split(*unlinkedUsers, ",") {
+		if u = strings.TrimSpace(u); len(u) > 0 {
+			m.unlinked[u] = true
+		}
+	}
+	prefix := "/auth/realms/" + *realm
+	mux := http.NewServeMux()
+	mux.HandleFunc(prefix+discoveryPath, m.discovery)
+	mux.HandleFunc(prefix+"/protocol/openid-connect/certs", m.certs)
+	mux.HandleFunc(prefix+"/protocol/openid-connect/token", m.token)
+	mux.HandleFunc(prefix+"/protocol/openid-connect/token/introspect", m.introspect)
+	mux.HandleFunc(prefix+"/protocol/openid-connect/userinfo", m.userInfo)
+	mux.HandleFunc(prefix+"/broker/", m.broker)
+
+	fmt.Fprintf(os.Stderr, "Mock IdP serving issuer %s\n", m.issuer)
+	fmt.Fprintf(os.Stderr, "Get a token with: curl -d username=developer -d roles=admin %s/protocol/openid-connect/token\n", m.issuer)
+	if err := http.ListenAndServe(*listen, mux); err != nil {
+		fmt.Fprintf(os.Stderr, "Mock IdP failed: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+func (m *mockIDP) writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func (m *mockIDP) discovery(w http.ResponseWriter, req *http.Request) {
+	m.writeJSON(w, map[string]interface{}{
+		"issuer":                                m.issuer,
+		"authorization_endpoint":                m.issuer + "/protocol/openid-connect/auth",
+		"token_endpoint":                        m.issuer + "/protocol/openid-connect/token",
+		"userinfo_endpoint":                     m.issuer + "/protocol/openid-connect/userinfo",
+		"introspection_endpoint":                m.issuer + "/protocol/openid-connect/token/introspect",
+		"jwks_uri":                              m.issuer + "/protocol/openid-connect/certs",
+		"response_types_supported":              []string{"code", "token", "id_token"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"grant_types_supported":                 []string{"password", "client_credentials"},
+	})
+}
+
+func (m *mockIDP) certs(w http.ResponseWriter, req *http.Request) {
+	pub := m.key.PublicKey
+	m.writeJSON(w, map[string]interface{}{
+		"keys": []verify.JSONWebKey{{
+			KeyID: mockIDPKeyID,
+			Type:  "RSA",
+			Use:   "sig",
+			N:     base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+			E:     base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		}},
+	})
+}
+
+// token issues a signed access token. The subject, audience, scope and realm
+// roles can be chosen with the username, client_id, scope and roles (comma
+// separated) form parameters, and dpop_jkt binds the token to the DPoP key
+// with that thumbprint.
+func (m *mockIDP) token(w http.ResponseWriter, req *http.Request) {
+	if err := req.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	formValue := func(name, def string) string {
+		if v := req.Form.Get(name); len(v) > 0 {
+			return v
+		}
+		return def
+	}
+
+	now := time.Now()
+	claims := jwtgo.MapClaims{
+		"iss":                m.issuer,
+		"sub":                formValue("username", "developer"),
+		"preferred_username": formValue("username", "developer"),
+		"aud":                formValue("client_id", "token-rp"),
+		"azp":                formValue("client_id", "token-rp"),
+		"iat":                now.Unix(),
+		"exp":                now.Add(m.tokenLifetime).Unix(),
+		"scope":              formValue("scope", "openid"),
+	}
+	if roles := formValue("roles", ""); len(roles) > 0 {
+		claims["realm_access"] = map[string]interface{}{"roles": strings.Split(roles, ",")}
+	}
+	tokenType := "bearer"
+	if jkt := formValue("dpop_jkt", ""); len(jkt) > 0 {
+		claims["cnf"] = map[string]interface{}{"jkt": jkt}
+		tokenType = "DPoP"
+	}
+
+	t := jwtgo.NewWithClaims(jwtgo.SigningMethodRS256, claims)
+	t.Header["kid"] = mockIDPKeyID
+	signed, err := t.SignedString(m.key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	m.writeJSON(w, map[string]interface{}{
+		"access_token": signed,
+		"token_type":   tokenType,
+		"expires_in":   int(m.tokenLifetime.Seconds()),
+	})
+}
+
+// verify returns the claims of the bearer token of req if it was issued by
+// m.
+func (m *mockIDP) verify(req *http.Request) (jwtgo.MapClaims, error) {
+	auth := req.Header.Get("Authorization")
+	if !strings.HasPrefix(strings.ToLower(auth), "bearer ") {
+		return nil, fmt.Errorf("missing bearer token")
+	}
+	t, err := jwtgo.Parse(auth[len("bearer "):], func(t *jwtgo.Token) (interface{}, error) {
+		if _, ok := t.Method.(*jwtgo.SigningMethodRSA); !ok {
+			return nil, fmt.Errorf("unexpected signing method %v", t.Header["alg"])
+		}
+		return &m.key.PublicKey, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return t.Claims.(jwtgo.MapClaims), nil
+}
+
+func (m *mockIDP) userInfo(w http.ResponseWriter, req *http.Request) {
+	claims, err := m.verify(req)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	m.writeJSON(w, claims)
+}
+
+// introspect answers token introspection requests of any authenticated
+// client, without checking its credentials.
+func (m *mockIDP) introspect(w http.ResponseWriter, req *http.Request) {
+	if err := req.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, _, ok := req.BasicAuth(); !ok && len(req.PostForm.Get("client_secret")) == 0 && len(req.PostForm.Get("client_assertion")) == 0 {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, `{"error":"invalid_client"}`)
+		return
+	}
+
+	introspected := &http.Request{Header: http.Header{"Authorization": {"Bearer " + req.PostForm.Get("token")}}}
+	claims, err := m.verify(introspected)
+	if err != nil {
+		m.writeJSON(w, map[string]interface{}{"active": false})
+		return
+	}
+	claims["active"] = true
+	m.writeJSON(w, claims)
+}
+
+// broker answers /broker/{alias}/token with a fake provider token for the
+// token's subject, in the format Keycloak uses for the provider type.
+func (m *mockIDP) broker(w http.ResponseWriter, req *http.Request) {
+	parts := strings.Split(req.URL.Path, "/")
+	if len(parts) < 2 || parts[len(parts)-1] != "token" {
+		http.NotFound(w, req)
+		return
+	}
+	alias := parts[len(parts)-2]
+
+	claims, err := m.verify(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	sub, _ := claims["sub"].(string)
+	if m.unlinked[sub] {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"errorMessage": "User [" + sub + "] is not associated with identity provider [" + alias + "].",
+		})
+		return
+	}
+	providerToken := "mock-" + alias + "-" + sub
+
+	if m.providerType == exchange.GitHub {
+		w.Header().Set("Content-Type", "application/x-www-form-urlencoded")
+		fmt.Fprint(w, url.Values{
+			"access_token": {providerToken},
+			"scope":        {"repo,user"},
+			"token_type":   {"bearer"},
+		}.Encode())
+		return
+	}
+
+	m.writeJSON(w, map[string]interface{}{
+		"access_token": providerToken,
+		"token_type":   "bearer",
+		"expires_in":   86400,
+	})
+}
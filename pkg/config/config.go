@@ -0,0 +1,224 @@
+//    Copyright 2017 Red Hat, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+// Package config loads token-rp's options from command line flags,
+// TOKEN_RP_* environment variables, further sources such as Kubernetes
+// ConfigMaps and a JSON config file.
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// EnvPrefix prefixes the environment variables options are read from.
+const EnvPrefix = "TOKEN_RP_"
+
+// EnvName returns the environment variable that configures the named flag,
+// e.g. TOKEN_RP_ISSUER_URL for -issuer-url.
+func EnvName(flagName string) string {
+	return EnvPrefix + strings.ToUpper(strings.Replace(flagName, "-", "_", -1))
+}
+
+// isRepeatable reports whether f may be given multiple times.
+func isRepeatable(f *flag.Flag) bool {
+	switch f.Value.(type) {
+	case *URLSliceFlag, *StringSliceFlag:
+		return true
+	}
+	return false
+}
+
+// Source holds option values read from somewhere else than the command line,
+// the environment or the config file, such as a Kubernetes ConfigMap.
+// Repeatable options take a newline-separated list.
+type Source struct {
+	// Name describes the source in errors.
+	Name   string
+	Values map[string]string
+}
+
+// RoutesKey is the config file key of the route table, see Routes.
+const RoutesKey = "routes"
+
+// readFile parses the JSON object of configFile.
+func readFile(configFile string) (map[string]interface{}, error) {
+	var file map[string]interface{}
+	b, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		return nil, err
+	}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	if err = d.Decode(&file); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", configFile, err)
+	}
+	if _, err = d.Token(); err != io.EOF {
+		return nil, fmt.Errorf("failed to parse %s: unexpected data after top-level object", configFile)
+	}
+	return file, nil
+}
+
+// Apply sets every flag not given on the command line from its
+// TOKEN_RP_* environment variable or, failing that, from the first of sources
+// holding it or from the JSON config file, so command line flags take
+// precedence over the environment, which takes precedence over sources and
+// the file. Repeatable flags take a newline-separated list from the environment
+// and sources and an array from the file.
+func Apply(fs *flag.FlagSet, configFile string, sources ...Source) error {
+	var file map[string]interface{}
+	if len(configFile) > 0 {
+		var err error
+		if file, err = readFile(configFile); err != nil {
+			return err
+		}
+		for name := range file {
+			if fs.Lookup(name) == nil && name != RoutesKey {
+				return fmt.Errorf("%s: unknown option %q", configFile, name)
+			}
+		}
+	}
+	for _, s := range sources {
+		for name := range s.Values {
+			if fs.Lookup(name) == nil {
+				return fmt.Errorf("%s: unknown option %q", s.Name, name)
+			}
+		}
+	}
+
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || set[f.Name] {
+			return
+		}
+
+		if val, ok := os.LookupEnv(EnvName(f.Name)); ok {
+			if setErr := setList(fs, f, val); setErr != nil {
+				err = fmt.Errorf("invalid %s: %v", EnvName(f.Name), setErr)
+			}
+			return
+		}
+
+		for _, s := range sources {
+			if val, ok := s.Values[f.Name]; ok {
+				if setErr := setList(fs, f, val); setErr != nil {
+					err = fmt.Errorf("%s: invalid %s: %v", s.Name, f.Name, setErr)
+				}
+				return
+			}
+		}
+
+		raw, ok := file[f.Name]
+		if !ok {
+			return
+		}
+		err = setValue(fs, f.Name, raw, configFile)
+	})
+
+	return err
+}
+
+// setList sets f from val, a newline-separated list for repeatable flags.
+// Commas can't separate values, as they occur in URLs, header values and
+// templates. Blank lines, such as the one ending a YAML block scalar, are
+// skipped.
+func setList(fs *flag.FlagSet, f *flag.Flag, val string) error {
+	if !isRepeatable(f) {
+		return fs.Set(f.Name, strings.TrimSpace(val))
+	}
+	for _, v := range strings.Split(val, "\n") {
+		if v = strings.TrimSpace(v); len(v) == 0 {
+			continue
+		}
+		if err := fs.Set(f.Name, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setValue sets the flag name from the config file value raw, which is an array
+// for repeatable flags.
+func setValue(fs *flag.FlagSet, name string, raw interface{}, source string) error {
+	vals := []interface{}{raw}
+	if arr, isArr := raw.([]interface{}); isArr && isRepeatable(fs.Lookup(name)) {
+		vals = arr
+	}
+	for _, v := range vals {
+		if err := fs.Set(name, fmt.Sprint(v)); err != nil {
+			return fmt.Errorf("%s: invalid %s: %v", source, name, err)
+		}
+	}
+	return nil
+}
+
+// Routes returns the entries of the route table of configFile, objects of
+// option names to values like the config file itself.
+func Routes(configFile string) ([]map[string]interface{}, error) {
+	if len(configFile) == 0 {
+		return nil, nil
+	}
+	file, err := readFile(configFile)
+	if err != nil {
+		return nil, err
+	}
+	raw, ok := file[RoutesKey]
+	if !ok {
+		return nil, nil
+	}
+	arr, ok := raw.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s: %s must be an array", configFile, RoutesKey)
+	}
+	routes := make([]map[string]interface{}, len(arr))
+	for i, r := range arr {
+		if routes[i], ok = r.(map[string]interface{}); !ok {
+			return nil, fmt.Errorf("%s: route %d must be an object", configFile, i)
+		}
+	}
+	return routes, nil
+}
+
+// ApplyRoute sets the flags of fs from the options of route, described by
+// source in errors. Repeatable flags are replaced rather than appended to,
+// so a route's values override those it inherited.
+func ApplyRoute(fs *flag.FlagSet, route map[string]interface{}, source string) error {
+	for name, raw := range route {
+		f := fs.Lookup(name)
+		if f == nil {
+			return fmt.Errorf("%s: unknown option %q", source, name)
+		}
+		switch v := f.Value.(type) {
+		case *StringSliceFlag:
+			*v = nil
+		case *URLSliceFlag:
+			*v = nil
+		}
+		if err := setValue(fs, name, raw, source); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+//    Copyright 2017 Red Hat, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package config
+
+import (
+	"flag"
+	"reflect"
+	"testing"
+)
+
+func TestApplyLists(t *testing.T) {
+	var headers StringSliceFlag
+	var cors string
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.Var(&headers, "header", "")
+	fs.StringVar(&cors, "cors-origin", "", "")
+
+	t.Setenv(EnvName("header"), "X-Forwarded-Roles: admin,dev\n\n  X-Tenant: a, b  \n")
+	t.Setenv(EnvName("cors-origin"), "https://a.example.com,https://b.example.com")
+	if err := Apply(fs, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := (StringSliceFlag{"X-Forwarded-Roles: admin,dev", "X-Tenant: a, b"}); !reflect.DeepEqual(headers, want) {
+		t.Errorf("header = %q, want %q", headers, want)
+	}
+	if want := "https://a.example.com,https://b.example.com"; cors != want {
+		t.Errorf("cors-origin = %q, want %q", cors, want)
+	}
+}
+
+func TestApplyPrecedence(t *testing.T) {
+	var urls URLSliceFlag
+	var alias, clientID string
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.Var(&urls, "issuer-url", "")
+	fs.StringVar(&alias, "provider-alias", "", "")
+	fs.StringVar(&clientID, "client-id", "", "")
+	if err := fs.Parse([]string{"-provider-alias", "flag"}); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv(EnvName("provider-alias"), "env")
+	t.Setenv(EnvName("issuer-url"), "https://a.example.com/auth\nhttps://b.example.com/auth?x=1,2")
+	err := Apply(fs, "", Source{Name: "configmap/test", Values: map[string]string{
+		"issuer-url": "https://c.example.com/auth",
+		"client-id":  "token-rp",
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if alias != "flag" {
+		t.Errorf("provider-alias = %q, want the flag", alias)
+	}
+	if len(urls) != 2 || urls[0].Host != "a.example.com" || urls[1].RawQuery != "x=1,2" {
+		t.Errorf("issuer-url = %v, want the two URLs of the environment", urls)
+	}
+	if clientID != "token-rp" {
+		t.Errorf("client-id = %q, want the source's", clientID)
+	}
+}
@@ -0,0 +1,89 @@
+//    Copyright 2017 Red Hat, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+)
+
+// URLFlag is a flag.Value holding an absolute URL.
+type URLFlag url.URL
+
+var _ flag.Value = &URLFlag{}
+
+func (uf *URLFlag) String() string {
+	return fmt.Sprintf("%v", (*url.URL)(uf))
+}
+
+func (uf *URLFlag) Set(val string) error {
+	if val == "" {
+		return errors.New("url is empty")
+	}
+
+	ur, err := url.Parse(val)
+	if err != nil {
+		return err
+	}
+
+	if ur.Scheme == "" {
+		return errors.New("url scheme is empty")
+	}
+
+	if ur.Host == "" {
+		return errors.New("url host is empty")
+	}
+
+	*uf = *(*URLFlag)(ur)
+
+	return nil
+}
+
+// URLSliceFlag is a flag.Value collecting absolute URLs of repeated flags.
+type URLSliceFlag []url.URL
+
+var _ flag.Value = &URLSliceFlag{}
+
+func (s *URLSliceFlag) String() string {
+	return fmt.Sprintf("%v", *s)
+}
+
+func (s *URLSliceFlag) Set(val string) error {
+	var uf URLFlag
+	if err := uf.Set(val); err != nil {
+		return err
+	}
+
+	*s = append(*s, (url.URL)(uf))
+
+	return nil
+}
+
+// StringSliceFlag is a flag.Value collecting the values of repeated flags.
+type StringSliceFlag []string
+
+var _ flag.Value = &StringSliceFlag{}
+
+func (s *StringSliceFlag) String() string {
+	return fmt.Sprintf("%v", *s)
+}
+
+// The second method is Set(value string) error
+func (s *StringSliceFlag) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
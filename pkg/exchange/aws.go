@@ -0,0 +1,561 @@
+//    Copyright 2017 Red Hat, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package exchange
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AWS exchanges tokens for AWS credentials, which sign forwarded requests
+// with Signature Version 4.
+const AWS = "aws"
+
+// The lifetime of assumed role credentials, as STS allows it.
+const (
+	defaultAWSSessionDuration = time.Hour
+	minAWSSessionDuration     = 15 * time.Minute
+	maxAWSSessionDuration     = 12 * time.Hour
+)
+
+// awsRenewBefore is how long before they expire assumed role credentials
+// are no longer used to sign requests.
+const awsRenewBefore = 5 * time.Minute
+
+// ValidateAWSSessionDuration checks the lifetime of assumed role
+// credentials.
+func ValidateAWSSessionDuration(d time.Duration) error {
+	if d < minAWSSessionDuration || d > maxAWSSessionDuration {
+		return fmt.Errorf("session duration must be between %v and %v", minAWSSessionDuration, maxAWSSessionDuration)
+	}
+	return nil
+}
+
+func init() {
+	Register(AWS, func(o Options) TokenRetriever {
+		duration := o.AWSSessionDuration
+		if duration <= 0 {
+			duration = defaultAWSSessionDuration
+		}
+		service := o.AWSService
+		if len(service) == 0 {
+			service = "execute-api"
+		}
+		return &awsRetriever{
+			client:          o.apiClient(),
+			stsURL:          o.IdentityServerURL,
+			region:          o.AWSRegion,
+			service:         service,
+			credentialsFile: o.AWSCredentialsFile,
+			duration:        duration,
+			assumed:         make(map[string]awsCredentials),
+			byKey:           make(map[string]awsCredentials),
+		}
+	})
+}
+
+type awsCredentials struct {
+	AccessKeyID     string `xml:"AccessKeyId"`
+	SecretAccessKey string
+	SessionToken    string
+	// Expiration is zero for long-term credentials.
+	Expiration time.Time
+}
+
+// awsRetriever exchanges the verified token for the credentials of the IAM
+// role named by the provider alias with STS AssumeRoleWithWebIdentity, or,
+// if the alias is no role ARN, takes the credentials of the profile it
+// names from a shared credentials file. The exchanged token is the access
+// key ID, so the secret never leaves the retriever; requests decorated with
+// it are signed by SignAWSRequests.
+type awsRetriever struct {
+	client          *http.Client
+	stsURL          *url.URL
+	region          string
+	service         string
+	credentialsFile string
+	duration        time.Duration
+
+	mu sync.Mutex
+	// assumed holds the role credentials by role and token, byKey all
+	// credentials handed out by access key ID.
+	assumed         map[string]awsCredentials
+	byKey           map[string]awsCredentials
+	profiles        map[string]awsCredentials
+	profilesModTime time.Time
+}
+
+func (r *awsRetriever) VerifyIncoming(req *http.Request) (string, error) {
+	return IncomingToken(req)
+}
+
+// ExchangeToken returns the access key ID of the credentials of alias, an
+// IAM role ARN or the name of a profile, for the user of token.
+func (r *awsRetriever) ExchangeToken(ctx context.Context, issuerURL, alias, token string) (string, error) {
+	if len(r.region) == 0 {
+		return "", fmt.Errorf("aws-region required by provider type %s", AWS)
+	}
+	var creds awsCredentials
+	var err error
+	if strings.HasPrefix(alias, "arn:") {
+		creds, err = r.assumeRole(ctx, alias, token)
+	} else {
+		creds, err = r.profile(alias)
+	}
+	if err != nil {
+		return "", err
+	}
+	return creds.AccessKeyID, nil
+}
+
+// assumeRole returns credentials of roleARN for the user of token, reusing
+// them until shortly before they expire.
+func (r *awsRetriever) assumeRole(ctx context.Context, roleARN, token string) (awsCredentials, error) {
+	sum := sha256.Sum256([]byte(roleARN + "\x00" + token))
+	key := hex.EncodeToString(sum[:])
+	r.mu.Lock()
+	creds, ok := r.assumed[key]
+	r.mu.Unlock()
+	if ok && time.Now().Add(awsRenewBefore).Before(creds.Expiration) {
+		return creds, nil
+	}
+
+	form := url.Values{
+		"Action":           {"AssumeRoleWithWebIdentity"},
+		"Version":          {"2011-06-15"},
+		"RoleArn":          {roleARN},
+		"RoleSessionName":  {awsSessionName(token)},
+		"WebIdentityToken": {token},
+		"DurationSeconds":  {strconv.Itoa(int(r.duration / time.Second))},
+	}
+	req, err := http.NewRequest("POST", r.stsEndpoint(), strings.NewReader(form.Encode()))
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := r.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("unable to assume role %s: %v", roleARN, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var stsErr struct {
+			Code    string `xml:"Error>Code"`
+			Message string `xml:"Error>Message"`
+		}
+		if err := xml.NewDecoder(resp.Body).Decode(&stsErr); err != nil || len(stsErr.Code) == 0 {
+			return awsCredentials{}, fmt.Errorf("unable to assume role %s: %s", roleARN, resp.Status)
+		}
+		return awsCredentials{}, fmt.Errorf("unable to assume role %s: %s: %s", roleARN, stsErr.Code, stsErr.Message)
+	}
+	var result struct {
+		Credentials awsCredentials `xml:"AssumeRoleWithWebIdentityResult>Credentials"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return awsCredentials{}, fmt.Errorf("invalid AssumeRoleWithWebIdentity response: %v", err)
+	}
+	creds = result.Credentials
+	if len(creds.AccessKeyID) == 0 || len(creds.SecretAccessKey) == 0 || creds.Expiration.IsZero() {
+		return awsCredentials{}, fmt.Errorf("missing credentials in AssumeRoleWithWebIdentity response")
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	for k, c := range r.assumed {
+		if !now.Before(c.Expiration) {
+			delete(r.assumed, k)
+			delete(r.byKey, c.AccessKeyID)
+		}
+	}
+	r.assumed[key] = creds
+	r.byKey[creds.AccessKeyID] = creds
+	return creds, nil
+}
+
+// stsEndpoint returns the URL of the regional STS endpoint, unless
+// overridden.
+func (r *awsRetriever) stsEndpoint() string {
+	if r.stsURL != nil {
+		return r.stsURL.String()
+	}
+	return "https://sts." + r.region + ".amazonaws.com/"
+}
+
+// profile returns the credentials of the profile name, "default" if empty,
+// in the credentials file, reading it again if it was modified.
+func (r *awsRetriever) profile(name string) (awsCredentials, error) {
+	if len(r.credentialsFile) == 0 {
+		return awsCredentials{}, fmt.Errorf("provider alias %q is no IAM role ARN and no aws-credentials-file is configured", name)
+	}
+	if len(name) == 0 {
+		name = "default"
+	}
+	fi, err := os.Stat(r.credentialsFile)
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("failed to read AWS credentials: %v", err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.profiles == nil || !fi.ModTime().Equal(r.profilesModTime) {
+		profiles, err := parseAWSCredentials(r.credentialsFile)
+		if err != nil {
+			return awsCredentials{}, fmt.Errorf("failed to read AWS credentials: %v", err)
+		}
+		for _, c := range r.profiles {
+			delete(r.byKey, c.AccessKeyID)
+		}
+		for _, c := range profiles {
+			r.byKey[c.AccessKeyID] = c
+		}
+		r.profiles, r.profilesModTime = profiles, fi.ModTime()
+	}
+	creds, ok := r.profiles[name]
+	if !ok {
+		return awsCredentials{}, fmt.Errorf("no profile %q in %s", name, r.credentialsFile)
+	}
+	return creds, nil
+}
+
+// parseAWSCredentials reads the profiles of a shared credentials file, as
+// written by the AWS CLI.
+func parseAWSCredentials(file string) (map[string]awsCredentials, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	profiles := make(map[string]awsCredentials)
+	var profile string
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		switch {
+		case len(line) == 0 || line[0] == '#' || line[0] == ';':
+		case line[0] == '[' && line[len(line)-1] == ']':
+			profile = strings.TrimPrefix(strings.TrimSpace(line[1:len(line)-1]), "profile ")
+		case strings.Contains(line, "=") && len(profile) > 0:
+			kv := strings.SplitN(line, "=", 2)
+			c := profiles[profile]
+			switch v := strings.TrimSpace(kv[1]); strings.TrimSpace(kv[0]) {
+			case "aws_access_key_id":
+				c.AccessKeyID = v
+			case "aws_secret_access_key":
+				c.SecretAccessKey = v
+			case "aws_session_token":
+				c.SessionToken = v
+			}
+			profiles[profile] = c
+		default:
+			return nil, fmt.Errorf("%s:%d: invalid line", file, n)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	for name, c := range profiles {
+		if len(c.AccessKeyID) == 0 || len(c.SecretAccessKey) == 0 {
+			return nil, fmt.Errorf("%s: profile %q lacks aws_access_key_id or aws_secret_access_key", file, name)
+		}
+	}
+	return profiles, nil
+}
+
+// awsSessionName returns the role session name recorded in CloudTrail for
+// the user of token: its preferred_username or sub claim, reduced to the
+// characters STS accepts.
+func awsSessionName(token string) string {
+	const fallback = "token-rp"
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return fallback
+	}
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return fallback
+	}
+	var claims struct {
+		PreferredUsername string `json:"preferred_username"`
+		Subject           string `json:"sub"`
+	}
+	if json.Unmarshal(b, &claims) != nil {
+		return fallback
+	}
+	name := claims.PreferredUsername
+	if len(name) == 0 {
+		name = claims.Subject
+	}
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', strings.ContainsRune("_+=,.@-", r):
+			return r
+		}
+		return '_'
+	}, name)
+	if len(name) < 2 {
+		return fallback
+	}
+	if len(name) > 64 {
+		name = name[:64]
+	}
+	return name
+}
+
+type awsSigningKey struct{}
+
+// awsSigning is put into the context of requests decorated by the
+// awsRetriever.
+type awsSigning struct {
+	creds   awsCredentials
+	region  string
+	service string
+}
+
+// DecorateRequest removes the Authorization of req and marks it for
+// signing with the credentials of the access key ID token. Requests are
+// signed by SignAWSRequests, once their upstream URL and headers are final.
+func (r *awsRetriever) DecorateRequest(ctx context.Context, req *http.Request, token string) error {
+	r.mu.Lock()
+	creds, ok := r.byKey[token]
+	r.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("no AWS credentials for access key %s", token)
+	}
+	req.Header.Del("Authorization")
+	*req = *req.WithContext(context.WithValue(req.Context(), awsSigningKey{}, &awsSigning{
+		creds:   creds,
+		region:  r.region,
+		service: r.service,
+	}))
+	return nil
+}
+
+// SignAWSRequests returns a RoundTripper signing the requests decorated by
+// the aws retriever before passing them to rt: Git requests, for
+// CodeCommit, with the basic auth of its Git credential helper, and others
+// with a Signature Version 4 Authorization header. Other requests are passed
+// on as they are.
+func SignAWSRequests(rt http.RoundTripper) http.RoundTripper {
+	return &awsSigner{rt: rt}
+}
+
+type awsSigner struct {
+	rt http.RoundTripper
+}
+
+func (s *awsSigner) RoundTrip(req *http.Request) (*http.Response, error) {
+	sig, ok := req.Context().Value(awsSigningKey{}).(*awsSigning)
+	if !ok {
+		return s.rt.RoundTrip(req)
+	}
+
+	// RoundTrippers must not modify the request.
+	out := req.Clone(req.Context())
+	if IsGitRequest(req) {
+		sig.signGit(out, time.Now())
+		return s.rt.RoundTrip(out)
+	}
+
+	// The signature covers the body, whose size is limited by the proxy.
+	var body []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		var err error
+		body, err = ioutil.ReadAll(req.Body)
+		_ = req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		out.Body = ioutil.NopCloser(bytes.NewReader(body))
+		out.ContentLength = int64(len(body))
+		out.TransferEncoding = nil
+	}
+	sig.sign(out, body, time.Now())
+	return s.rt.RoundTrip(out)
+}
+
+// sign adds the Signature Version 4 headers to req.
+func (s *awsSigning) sign(req *http.Request, body []byte, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	payloadHash := hexSHA256(body)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalHeaders := "host:" + requestHost(req) + "\n" +
+		"x-amz-content-sha256:" + payloadHash + "\n" +
+		"x-amz-date:" + amzDate + "\n"
+	if len(s.creds.SessionToken) > 0 {
+		req.Header.Set("X-Amz-Security-Token", s.creds.SessionToken)
+		signedHeaders += ";x-amz-security-token"
+		canonicalHeaders += "x-amz-security-token:" + s.creds.SessionToken + "\n"
+	}
+
+	u := sentURL(req.URL)
+	uri := u.EscapedPath()
+	if len(uri) == 0 {
+		uri = "/"
+	}
+	// All services but S3 expect the path to be encoded twice.
+	if s.service != "s3" {
+		uri = awsURIEncode(uri, false)
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		uri,
+		awsCanonicalQuery(u),
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := amzDate[:8] + "/" + s.region + "/" + s.service + "/aws4_request"
+	signature := s.signature(s.service, amzDate, scope, canonicalRequest)
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.creds.AccessKeyID+"/"+scope+", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+// signGit sets the basic auth CodeCommit expects of Git clients: the
+// access key ID, followed by the session token, as username and a signature
+// of the repository path as password.
+func (s *awsSigning) signGit(req *http.Request, now time.Time) {
+	timestamp := now.UTC().Format("20060102T150405")
+	canonicalRequest := "GIT\n" + gitRepositoryPath(sentURL(req.URL).Path) + "\n\nhost:" + requestHost(req) + "\n\nhost\n"
+	scope := timestamp[:8] + "/" + s.region + "/codecommit/aws4_request"
+	signature := s.signature("codecommit", timestamp, scope, canonicalRequest)
+
+	username := s.creds.AccessKeyID
+	if len(s.creds.SessionToken) > 0 {
+		username += "%" + s.creds.SessionToken
+	}
+	req.SetBasicAuth(username, timestamp+"Z"+signature)
+}
+
+// signature returns the hex encoded Signature Version 4 of canonicalRequest.
+func (s *awsSigning) signature(service, timestamp, scope, canonicalRequest string) string {
+	stringToSign := "AWS4-HMAC-SHA256\n" + timestamp + "\n" + scope + "\n" + hexSHA256([]byte(canonicalRequest))
+	key := []byte("AWS4" + s.creds.SecretAccessKey)
+	for _, part := range []string{timestamp[:8], s.region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+// gitRepositoryPath returns the path of the repository a Git request is
+// for.
+func gitRepositoryPath(p string) string {
+	// The first marker wins: objects/info/packs is below the repository.
+	end := -1
+	for _, marker := range []string{"/info/", "/objects/"} {
+		if i := strings.Index(p, marker); i >= 0 && (end < 0 || i < end) {
+			end = i
+		}
+	}
+	if end >= 0 {
+		return p[:end]
+	}
+	// git-upload-pack, git-receive-pack and HEAD.
+	return path.Dir(p)
+}
+
+// sentURL returns the URL with the path and query req is sent with: the
+// forwarder passes the request URI on as opaque URL.
+func sentURL(u *url.URL) *url.URL {
+	if len(u.Opaque) == 0 {
+		return u
+	}
+	if sent, err := url.ParseRequestURI(u.Opaque); err == nil {
+		return sent
+	}
+	return u
+}
+
+// requestHost returns the host req is sent to.
+func requestHost(req *http.Request) string {
+	if len(req.Host) > 0 {
+		return req.Host
+	}
+	return req.URL.Host
+}
+
+// awsCanonicalQuery returns the query of u sorted by name and value, with
+// both encoded as Signature Version 4 requires.
+func awsCanonicalQuery(u *url.URL) string {
+	var params [][2]string
+	for name, values := range u.Query() {
+		for _, v := range values {
+			params = append(params, [2]string{awsURIEncode(name, true), awsURIEncode(v, true)})
+		}
+	}
+	sort.Slice(params, func(i, j int) bool {
+		if params[i][0] != params[j][0] {
+			return params[i][0] < params[j][0]
+		}
+		return params[i][1] < params[j][1]
+	})
+	query := make([]string, len(params))
+	for i, p := range params {
+		query[i] = p[0] + "=" + p[1]
+	}
+	return strings.Join(query, "&")
+}
+
+// awsURIEncode percent-encodes all bytes of s but the unreserved
+// characters of RFC 3986 and, unless encodeSlash, '/'.
+func awsURIEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '.', c == '_', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hexSHA256(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(data))
+	return m.Sum(nil)
+}
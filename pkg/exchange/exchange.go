@@ -0,0 +1,68 @@
+//    Copyright 2017 Red Hat, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+// Package exchange retrieves identity provider tokens stored by Keycloak's
+// identity brokering for the user of an access token, mints upstream
+// tokens with the Kubernetes TokenRequest API or exchanges access tokens for
+// AWS credentials.
+package exchange
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// Built-in identity provider types, see TokenRetriever.
+const (
+	GitHub    = "github"
+	OpenShift = "openshift"
+)
+
+// TokenURL returns the broker token endpoint of the identity provider
+// alias at issuerURL.
+func TokenURL(issuerURL, alias string) string {
+	return issuerURL + "/broker/" + alias + "/token"
+}
+
+// brokerToken requests the stored identity provider token of alias for the
+// user of token. The caller must close the body of the returned response.
+func brokerToken(ctx context.Context, hc *http.Client, issuerURL, alias, token string) (*http.Response, error) {
+	tokenReq, err := http.NewRequest("GET", TokenURL(issuerURL, alias), nil)
+	if err != nil {
+		return nil, err
+	}
+	tokenReq.Header.Set("Authorization", "Bearer "+token)
+	tokenResp, err := hc.Do(tokenReq.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+
+	if tokenResp.StatusCode != 200 {
+		defer tokenResp.Body.Close()
+		if tokenResp.StatusCode == http.StatusBadRequest {
+			// Keycloak rejects users without a linked account with
+			// "User [id] is not associated with identity provider [alias]."
+			body, _ := ioutil.ReadAll(io.LimitReader(tokenResp.Body, 4096))
+			if strings.Contains(string(body), "not associated with identity provider") {
+				return nil, &NotLinkedError{Alias: alias}
+			}
+		}
+		return nil, fmt.Errorf("unable to retrieve broker token: %s", tokenResp.Status)
+	}
+	return tokenResp, nil
+}
@@ -0,0 +1,229 @@
+//    Copyright 2017 Red Hat, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package exchange
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Services of the Git smart HTTP protocol.
+const (
+	GitUploadPack  = "git-upload-pack"
+	GitReceivePack = "git-receive-pack"
+)
+
+// Basic auth fields the token of Git requests can be taken from.
+const (
+	GitTokenPassword = "password"
+	GitTokenUsername = "username"
+	// GitTokenEither takes the token from the password, or from the
+	// username if the password is empty or x-oauth-basic, as in GitHub's
+	// convention.
+	GitTokenEither = "either"
+)
+
+// ValidateGitTokenField checks that field is empty, GitTokenPassword,
+// GitTokenUsername or GitTokenEither.
+func ValidateGitTokenField(field string) error {
+	switch field {
+	case "", GitTokenPassword, GitTokenUsername, GitTokenEither:
+		return nil
+	}
+	return fmt.Errorf("unknown git token field %q", field)
+}
+
+// GitRules adapt the classification of Git requests and the extraction of
+// their tokens to the layout of an upstream.
+type GitRules struct {
+	// Disabled classifies no request as Git request, so that basic auth
+	// credentials are never taken for tokens.
+	Disabled bool
+	// Include classifies the requests whose path it matches as Git
+	// requests.
+	Include func(path string) bool
+	// Exclude classifies the requests whose path it matches as no Git
+	// requests, before Include and the built-in rules.
+	Exclude func(path string) bool
+	// TokenField is the basic auth field carrying the token,
+	// GitTokenPassword if empty.
+	TokenField string
+}
+
+type gitRulesKey struct{}
+
+// ContextWithGitRules returns a copy of ctx applying rules to the requests
+// it belongs to.
+func ContextWithGitRules(ctx context.Context, rules *GitRules) context.Context {
+	return context.WithValue(ctx, gitRulesKey{}, rules)
+}
+
+func gitRulesFromContext(ctx context.Context) *GitRules {
+	if rules, ok := ctx.Value(gitRulesKey{}).(*GitRules); ok {
+		return rules
+	}
+	return &GitRules{}
+}
+
+type gitUsernameKey struct{}
+
+// ContextWithGitUsername returns a copy of ctx naming the provider user of
+// the token of a Git request, so that retrievers don't have to look it up.
+func ContextWithGitUsername(ctx context.Context, username string) context.Context {
+	return context.WithValue(ctx, gitUsernameKey{}, username)
+}
+
+// GitUsernameFromContext returns the username set by ContextWithGitUsername,
+// reporting false if there is none.
+func GitUsernameFromContext(ctx context.Context) (string, bool) {
+	username, ok := ctx.Value(gitUsernameKey{}).(string)
+	return username, ok
+}
+
+// GitRequest describes a request of the Git smart or dumb HTTP protocol or
+// of the Git LFS API.
+type GitRequest struct {
+	// Service is GitUploadPack or GitReceivePack for smart HTTP requests
+	// and empty for dumb HTTP ones.
+	Service string
+	// RefAdvertisement is true for the info/refs request starting a fetch
+	// or push.
+	RefAdvertisement bool
+	// ProtocolVersion is the version requested by the Git-Protocol
+	// header, 0 if it is absent.
+	ProtocolVersion int
+	// LFS is true for requests of the Git LFS batch, transfer and locking
+	// APIs.
+	LFS bool
+	// LFSTransfer is true for Git LFS object uploads, downloads and
+	// verifications, which may carry credentials handed out by the
+	// upstream in its batch response.
+	LFSTransfer bool
+}
+
+// ClassifyGitRequest returns the Git request req is, reporting false if it
+// is none, following the GitRules of its context.
+func ClassifyGitRequest(req *http.Request) (GitRequest, bool) {
+	rules := gitRulesFromContext(req.Context())
+	if rules.Disabled || rules.Exclude != nil && rules.Exclude(req.URL.Path) {
+		return GitRequest{}, false
+	}
+	if g, ok := classifyGitRequest(req); ok {
+		return g, true
+	}
+	if rules.Include != nil && rules.Include(req.URL.Path) {
+		return GitRequest{ProtocolVersion: gitProtocolVersion(req.Header)}, true
+	}
+	return GitRequest{}, false
+}
+
+// classifyGitRequest implements the built-in rules of ClassifyGitRequest.
+func classifyGitRequest(req *http.Request) (GitRequest, bool) {
+	g := GitRequest{ProtocolVersion: gitProtocolVersion(req.Header)}
+	if !strings.HasPrefix(req.URL.Path, "/") || strings.HasSuffix(req.URL.Path, "/") {
+		return GitRequest{}, false
+	}
+	if i := strings.Index(req.URL.Path, "/info/lfs/"); i >= 0 {
+		api := req.URL.Path[i+len("/info/lfs/"):]
+		g.LFS = true
+		g.LFSTransfer = api == "verify" || strings.HasPrefix(api, "objects/") && api != "objects/batch"
+		return g, true
+	}
+
+	dir, name := path.Split(req.URL.Path)
+	dir = path.Clean(dir)
+	parent := path.Base(path.Dir(dir))
+
+	switch {
+	case name == GitUploadPack || name == GitReceivePack:
+		g.Service = name
+	case name == "HEAD":
+	case name == "refs" && path.Base(dir) == "info":
+		// Smart clients name the service, dumb ones fetch the refs file.
+		switch service := req.URL.Query().Get("service"); service {
+		case GitUploadPack, GitReceivePack:
+			g.Service = service
+			g.RefAdvertisement = true
+		}
+	case path.Base(dir) == "info" && parent == "objects":
+		// alternates, http-alternates, packs and others.
+	case path.Base(dir) == "pack" && parent == "objects":
+		ext := path.Ext(name)
+		if ext != ".pack" && ext != ".idx" || !strings.HasPrefix(name, "pack-") || !isObjectID(name[len("pack-"):len(name)-len(ext)]) {
+			return GitRequest{}, false
+		}
+	case parent == "objects" && len(path.Base(dir)) == 2:
+		// Loose objects are named by their ID split after two digits.
+		if !isObjectID(path.Base(dir) + name) {
+			return GitRequest{}, false
+		}
+	default:
+		return GitRequest{}, false
+	}
+	return g, true
+}
+
+// IsGitRequest reports whether req is a request of the Git smart or dumb
+// HTTP protocol or of the Git LFS API, which carries its token as basic auth
+// password.
+func IsGitRequest(req *http.Request) bool {
+	_, ok := ClassifyGitRequest(req)
+	return ok
+}
+
+// gitToken returns the token carried by the basic auth of a Git request,
+// reporting false if it has none.
+func gitToken(req *http.Request) (string, bool) {
+	username, password, ok := req.BasicAuth()
+	switch gitRulesFromContext(req.Context()).TokenField {
+	case GitTokenUsername:
+		return username, ok
+	case GitTokenEither:
+		if len(password) == 0 || password == "x-oauth-basic" {
+			return username, ok
+		}
+	}
+	return password, ok
+}
+
+// isObjectID reports whether s is a SHA-1 or SHA-256 object ID.
+func isObjectID(s string) bool {
+	if len(s) != 40 && len(s) != 64 {
+		return false
+	}
+	for _, c := range s {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// gitProtocolVersion returns the version requested by the colon-separated
+// key=value parameters of the Git-Protocol header of h, 0 if none.
+func gitProtocolVersion(h http.Header) int {
+	for _, param := range strings.Split(h.Get("Git-Protocol"), ":") {
+		if v := strings.TrimPrefix(param, "version="); len(v) < len(param) {
+			if n, err := strconv.Atoi(v); err == nil {
+				return n
+			}
+		}
+	}
+	return 0
+}
@@ -0,0 +1,124 @@
+//    Copyright 2017 Red Hat, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package exchange
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestClassifyGitRequest(t *testing.T) {
+	const (
+		sha1   = "0123456789abcdef0123456789abcdef01234567"
+		sha256 = sha1 + "0123456789abcdef01234567"
+	)
+	tests := []struct {
+		target   string
+		protocol string
+		want     GitRequest
+		ok       bool
+	}{
+		{target: "/repo.git/info/refs?service=git-upload-pack", want: GitRequest{Service: GitUploadPack, RefAdvertisement: true}, ok: true},
+		{target: "/repo.git/info/refs?service=git-receive-pack", want: GitRequest{Service: GitReceivePack, RefAdvertisement: true}, ok: true},
+		{target: "/repo.git/info/refs?service=git-upload-pack", protocol: "version=2", want: GitRequest{Service: GitUploadPack, RefAdvertisement: true, ProtocolVersion: 2}, ok: true},
+		{target: "/repo.git/info/refs", want: GitRequest{}, ok: true},
+		{target: "/repo.git/info/refs?service=other", want: GitRequest{}, ok: true},
+		{target: "/repo.git/git-upload-pack", want: GitRequest{Service: GitUploadPack}, ok: true},
+		{target: "/repo.git/git-receive-pack", protocol: "object-format=sha1:version=1", want: GitRequest{Service: GitReceivePack, ProtocolVersion: 1}, ok: true},
+		{target: "/group/repo/HEAD", ok: true},
+		{target: "/repo.git/objects/info/packs", ok: true},
+		{target: "/repo.git/objects/info/http-alternates", ok: true},
+		{target: "/repo.git/objects/pack/pack-" + sha1 + ".pack", ok: true},
+		{target: "/repo.git/objects/pack/pack-" + sha256 + ".idx", ok: true},
+		{target: "/repo.git/objects/" + sha1[:2] + "/" + sha1[2:], ok: true},
+		{target: "/repo.git/info/lfs/objects/batch", want: GitRequest{LFS: true}, ok: true},
+		{target: "/repo.git/info/lfs/locks", want: GitRequest{LFS: true}, ok: true},
+		{target: "/repo.git/info/lfs/objects/" + sha256, want: GitRequest{LFS: true, LFSTransfer: true}, ok: true},
+		{target: "/repo.git/info/lfs/verify", want: GitRequest{LFS: true, LFSTransfer: true}, ok: true},
+
+		{target: "/"},
+		{target: "/api/v1/users"},
+		{target: "/repo.git/git-upload-pack/"},
+		{target: "/repo.git/objects/pack/pack-" + sha1 + ".keep"},
+		{target: "/repo.git/objects/pack/pack-xyz.pack"},
+		{target: "/repo.git/objects/pack/" + sha1 + ".pack"},
+		{target: "/repo.git/objects/" + sha1[:2] + "/" + strings.ToUpper(sha1[2:])},
+		{target: "/repo.git/objects/" + sha1[:2] + "/" + sha1[2:10]},
+		{target: "/refs"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", tt.target, nil)
+		if len(tt.protocol) > 0 {
+			req.Header.Set("Git-Protocol", tt.protocol)
+		}
+		got, ok := ClassifyGitRequest(req)
+		if ok != tt.ok || got != tt.want {
+			t.Errorf("ClassifyGitRequest(%s) = %+v, %v, want %+v, %v", tt.target, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestClassifyGitRequestRules(t *testing.T) {
+	prefix := func(p string) func(string) bool {
+		return func(path string) bool { return strings.HasPrefix(path, p) }
+	}
+	tests := []struct {
+		name   string
+		rules  *GitRules
+		target string
+		ok     bool
+	}{
+		{"disabled", &GitRules{Disabled: true}, "/repo.git/git-upload-pack", false},
+		{"excluded", &GitRules{Exclude: prefix("/api/")}, "/api/repo.git/git-upload-pack", false},
+		{"not excluded", &GitRules{Exclude: prefix("/api/")}, "/repo.git/git-upload-pack", true},
+		{"included", &GitRules{Include: prefix("/scm/")}, "/scm/repo/archive.zip", true},
+		{"not included", &GitRules{Include: prefix("/scm/")}, "/api/repo/archive.zip", false},
+		{"exclusion before inclusion", &GitRules{Include: prefix("/scm/"), Exclude: prefix("/scm/private/")}, "/scm/private/repo/git-upload-pack", false},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", tt.target, nil)
+		req = req.WithContext(ContextWithGitRules(req.Context(), tt.rules))
+		if _, ok := ClassifyGitRequest(req); ok != tt.ok {
+			t.Errorf("%s: ClassifyGitRequest(%s) reported %v, want %v", tt.name, tt.target, ok, tt.ok)
+		}
+	}
+}
+
+func TestGitToken(t *testing.T) {
+	tests := []struct {
+		field, username, password, want string
+	}{
+		{"", "alice", "token", "token"},
+		{GitTokenPassword, "token", "", ""},
+		{GitTokenUsername, "token", "x-oauth-basic", "token"},
+		{GitTokenEither, "alice", "token", "token"},
+		{GitTokenEither, "token", "", "token"},
+		{GitTokenEither, "token", "x-oauth-basic", "token"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/repo.git/info/refs", nil)
+		req.SetBasicAuth(tt.username, tt.password)
+		req = req.WithContext(ContextWithGitRules(req.Context(), &GitRules{TokenField: tt.field}))
+		if got, ok := gitToken(req); !ok || got != tt.want {
+			t.Errorf("gitToken(%q, %q) with field %q = %q, %v, want %q", tt.username, tt.password, tt.field, got, ok, tt.want)
+		}
+	}
+
+	req := httptest.NewRequest("GET", "/repo.git/info/refs", nil)
+	if _, ok := gitToken(req); ok {
+		t.Error("gitToken reported a token without basic auth")
+	}
+}
@@ -0,0 +1,153 @@
+//    Copyright 2017 Red Hat, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package exchange
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/google/go-github/github"
+	"golang.org/x/oauth2"
+)
+
+func init() {
+	Register(GitHub, func(o Options) TokenRetriever {
+		return &gitHubRetriever{
+			client:    o.Client,
+			apiClient: o.apiClient(),
+			apiURL:    o.IdentityServerURL,
+			onRate:    o.OnRateLimit,
+			logins:    newLoginCache(o.LoginCacheTTL),
+		}
+	})
+}
+
+// abuseBackoff is how long user lookups of a token are suspended after
+// hitting GitHub's secondary rate limit without Retry-After.
+const abuseBackoff = time.Minute
+
+// gitHubRetriever reads form encoded broker tokens and sends them as "token"
+// Authorization, or for Git requests as basic auth of the token's user. The
+// user of a token is cached in logins, and not looked up until the rate
+// limit of the token resets once it is exhausted.
+type gitHubRetriever struct {
+	client    *http.Client
+	apiClient *http.Client
+	apiURL    *url.URL
+	onRate    func(limit, remaining int, reset time.Time)
+	logins    *loginCache
+}
+
+func (r *gitHubRetriever) VerifyIncoming(req *http.Request) (string, error) {
+	return IncomingToken(req)
+}
+
+func (r *gitHubRetriever) ExchangeToken(ctx context.Context, issuerURL, alias, token string) (string, error) {
+	resp, err := brokerToken(ctx, r.client, issuerURL, alias, token)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	query, err := url.ParseQuery(string(b))
+	if err != nil {
+		return "", err
+	}
+
+	accessToken := query.Get("access_token")
+	if len(accessToken) > 0 {
+		return accessToken, nil
+	}
+
+	return "", fmt.Errorf("missing access token in broker token")
+}
+
+func (r *gitHubRetriever) DecorateRequest(ctx context.Context, req *http.Request, token string) error {
+	if !IsGitRequest(req) {
+		req.Header.Set("Authorization", "token "+token)
+		return nil
+	}
+	if len(token) == 0 {
+		return nil
+	}
+
+	if login, ok := GitUsernameFromContext(ctx); ok {
+		req.SetBasicAuth(login, token)
+		return nil
+	}
+
+	key := sha256.Sum256([]byte(token))
+	if l, ok := r.logins.get(key); ok {
+		if l.rateLimited {
+			return &RateLimitError{Reset: l.expiresAt}
+		}
+		req.SetBasicAuth(l.login, token)
+		return nil
+	}
+
+	ts := oauth2.StaticTokenSource(
+		&oauth2.Token{AccessToken: token},
+	)
+	if r.apiClient != nil {
+		ctx = context.WithValue(ctx, oauth2.HTTPClient, r.apiClient)
+	}
+	tc := oauth2.NewClient(ctx, ts)
+
+	client := github.NewClient(tc)
+	if r.apiURL != nil {
+		client.BaseURL = r.apiURL
+	}
+
+	user, resp, err := client.Users.Get(ctx, "")
+	if resp != nil && resp.Rate.Limit > 0 && r.onRate != nil {
+		r.onRate(resp.Rate.Limit, resp.Rate.Remaining, resp.Rate.Reset.Time)
+	}
+	if err != nil {
+		var rateLimitErr *github.RateLimitError
+		var abuseErr *github.AbuseRateLimitError
+		switch {
+		case errors.As(err, &rateLimitErr):
+			return r.rateLimited(key, rateLimitErr.Rate.Reset.Time)
+		case errors.As(err, &abuseErr):
+			backoff := abuseBackoff
+			if abuseErr.RetryAfter != nil {
+				backoff = *abuseErr.RetryAfter
+			}
+			return r.rateLimited(key, time.Now().Add(backoff))
+		}
+		return fmt.Errorf("unable to look up GitHub user: %v", err)
+	}
+
+	r.logins.storeLogin(key, user.GetLogin())
+	req.SetBasicAuth(user.GetLogin(), token)
+	return nil
+}
+
+// rateLimited suspends user lookups of the token with key until reset.
+func (r *gitHubRetriever) rateLimited(key [sha256.Size]byte, reset time.Time) error {
+	r.logins.store(key, cachedLogin{rateLimited: true, expiresAt: reset})
+	return &RateLimitError{Reset: reset}
+}
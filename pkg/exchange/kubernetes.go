@@ -0,0 +1,156 @@
+//    Copyright 2017 Red Hat, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package exchange
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/syndesisio/token-rp/pkg/kube"
+)
+
+// Kubernetes mints upstream tokens with the TokenRequest API instead of
+// fetching them from Keycloak's broker.
+const Kubernetes = "kubernetes"
+
+// defaultTokenExpiration is the lifetime of minted tokens unless configured,
+// minTokenExpiration the shortest the API server accepts.
+const (
+	defaultTokenExpiration = time.Hour
+	minTokenExpiration     = 10 * time.Minute
+)
+
+// serviceAccountNameRegexp matches valid service account names, which become
+// part of the TokenRequest path.
+var serviceAccountNameRegexp = regexp.MustCompile(`^[a-z0-9]([-a-z0-9.]*[a-z0-9])?$`)
+
+// ValidateTokenExpiration checks the lifetime of minted tokens.
+func ValidateTokenExpiration(d time.Duration) error {
+	if d < minTokenExpiration {
+		return fmt.Errorf("token expiration must be at least %v", minTokenExpiration)
+	}
+	return nil
+}
+
+func init() {
+	Register(Kubernetes, func(o Options) TokenRetriever {
+		expiration := o.TokenExpiration
+		if expiration <= 0 {
+			expiration = defaultTokenExpiration
+		}
+		return &kubernetesRetriever{
+			audiences:  o.TokenAudiences,
+			expiration: expiration,
+			tokens:     make(map[string]mintedToken),
+		}
+	})
+}
+
+// kubernetesRetriever mints tokens of the service account named by the
+// provider alias, in the namespace of the proxy, and sends them as Bearer
+// Authorization. Tokens are reused until 80% of their lifetime has passed.
+type kubernetesRetriever struct {
+	audiences  []string
+	expiration time.Duration
+
+	clientOnce sync.Once
+	client     *kube.Client
+	clientErr  error
+
+	mu     sync.Mutex
+	tokens map[string]mintedToken
+}
+
+type mintedToken struct {
+	token     string
+	refreshAt time.Time
+}
+
+type tokenRequest struct {
+	APIVersion string             `json:"apiVersion"`
+	Kind       string             `json:"kind"`
+	Spec       tokenRequestSpec   `json:"spec"`
+	Status     tokenRequestStatus `json:"status"`
+}
+
+type tokenRequestSpec struct {
+	Audiences         []string `json:"audiences"`
+	ExpirationSeconds int64    `json:"expirationSeconds"`
+}
+
+type tokenRequestStatus struct {
+	Token               string    `json:"token"`
+	ExpirationTimestamp time.Time `json:"expirationTimestamp"`
+}
+
+func (r *kubernetesRetriever) VerifyIncoming(req *http.Request) (string, error) {
+	return IncomingToken(req)
+}
+
+// ExchangeToken ignores the verified token, whose user is authorized by the
+// proxy, and returns a token of the service account alias.
+func (r *kubernetesRetriever) ExchangeToken(ctx context.Context, issuerURL, alias, token string) (string, error) {
+	if !serviceAccountNameRegexp.MatchString(alias) {
+		return "", fmt.Errorf("provider alias %q is not a service account name", alias)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if t, ok := r.tokens[alias]; ok && time.Now().Before(t.refreshAt) {
+		return t.token, nil
+	}
+
+	r.clientOnce.Do(func() {
+		r.client, r.clientErr = kube.InCluster()
+	})
+	if r.clientErr != nil {
+		return "", r.clientErr
+	}
+
+	tr := tokenRequest{
+		APIVersion: "authentication.k8s.io/v1",
+		Kind:       "TokenRequest",
+		Spec: tokenRequestSpec{
+			Audiences:         r.audiences,
+			ExpirationSeconds: int64(r.expiration / time.Second),
+		},
+	}
+	path := "/api/v1/namespaces/" + r.client.Namespace + "/serviceaccounts/" + alias + "/token"
+	requested := time.Now()
+	if err := r.client.Create(ctx, path, tr, &tr); err != nil {
+		return "", fmt.Errorf("unable to request service account token: %v", err)
+	}
+	if len(tr.Status.Token) == 0 {
+		return "", fmt.Errorf("missing token in token request")
+	}
+
+	// The API server may shorten the requested lifetime.
+	lifetime := tr.Status.ExpirationTimestamp.Sub(requested)
+	r.tokens[alias] = mintedToken{
+		token:     tr.Status.Token,
+		refreshAt: requested.Add(lifetime * 4 / 5),
+	}
+	return tr.Status.Token, nil
+}
+
+func (r *kubernetesRetriever) DecorateRequest(ctx context.Context, req *http.Request, token string) error {
+	req.Header.Set("Authorization", "Bearer "+token)
+	return nil
+}
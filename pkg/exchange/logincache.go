@@ -0,0 +1,81 @@
+//    Copyright 2017 Red Hat, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package exchange
+
+import (
+	"crypto/sha256"
+	"sync"
+	"time"
+)
+
+// maxCachedLogins bounds the number of logins kept by a loginCache.
+const maxCachedLogins = 10000
+
+// cachedLogin is the login of a token, or if rateLimited the time until which
+// the token must not be used to look it up.
+type cachedLogin struct {
+	login       string
+	rateLimited bool
+	expiresAt   time.Time
+}
+
+// loginCache holds the provider users that exchanged tokens belong to, keyed
+// by the SHA-256 of the token, for ttl.
+type loginCache struct {
+	ttl time.Duration
+
+	mu     sync.Mutex
+	logins map[[sha256.Size]byte]cachedLogin
+}
+
+func newLoginCache(ttl time.Duration) *loginCache {
+	return &loginCache{ttl: ttl, logins: make(map[[sha256.Size]byte]cachedLogin)}
+}
+
+func (c *loginCache) get(key [sha256.Size]byte) (cachedLogin, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	l, ok := c.logins[key]
+	if !ok || time.Now().After(l.expiresAt) {
+		return cachedLogin{}, false
+	}
+	return l, true
+}
+
+// storeLogin caches login for the cache's ttl, unless caching is disabled.
+func (c *loginCache) storeLogin(key [sha256.Size]byte, login string) {
+	if c.ttl > 0 {
+		c.store(key, cachedLogin{login: login, expiresAt: time.Now().Add(c.ttl)})
+	}
+}
+
+func (c *loginCache) store(key [sha256.Size]byte, l cachedLogin) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if len(c.logins) >= maxCachedLogins {
+		for k, l := range c.logins {
+			if now.After(l.expiresAt) {
+				delete(c.logins, k)
+			}
+		}
+		if len(c.logins) >= maxCachedLogins {
+			return
+		}
+	}
+	c.logins[key] = l
+}
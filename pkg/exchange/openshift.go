@@ -0,0 +1,149 @@
+//    Copyright 2017 Red Hat, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package exchange
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+func init() {
+	Register(OpenShift, func(o Options) TokenRetriever {
+		return &openShiftRetriever{
+			client:    o.Client,
+			apiClient: o.apiClient(),
+			apiURL:    o.IdentityServerURL,
+			logins:    newLoginCache(o.LoginCacheTTL),
+		}
+	})
+}
+
+// openShiftUserPath is the path of the current user in the OpenShift API.
+const openShiftUserPath = "/apis/user.openshift.io/v1/users/~"
+
+// openShiftRetriever reads JSON broker tokens and sends them as Bearer
+// Authorization, or for Git requests as basic auth of the token's user. The
+// user is taken from the request context or looked up with the OpenShift API
+// at apiURL and cached in logins; without either, Git requests are forwarded
+// with their original credentials.
+type openShiftRetriever struct {
+	client    *http.Client
+	apiClient *http.Client
+	apiURL    *url.URL
+	logins    *loginCache
+}
+
+type jsonBrokerToken struct {
+	AccessToken string `json:"access_token"`
+}
+
+type openShiftUser struct {
+	Metadata struct {
+		Name string `json:"name"`
+	} `json:"metadata"`
+}
+
+func (r *openShiftRetriever) VerifyIncoming(req *http.Request) (string, error) {
+	return IncomingToken(req)
+}
+
+func (r *openShiftRetriever) ExchangeToken(ctx context.Context, issuerURL, alias, token string) (string, error) {
+	resp, err := brokerToken(ctx, r.client, issuerURL, alias, token)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	var brokerToken jsonBrokerToken
+	if err = json.NewDecoder(resp.Body).Decode(&brokerToken); err != nil {
+		return "", err
+	}
+	if len(brokerToken.AccessToken) > 0 {
+		return brokerToken.AccessToken, nil
+	}
+
+	return "", fmt.Errorf("missing access token in broker token")
+}
+
+func (r *openShiftRetriever) DecorateRequest(ctx context.Context, req *http.Request, token string) error {
+	if !IsGitRequest(req) {
+		req.Header.Set("Authorization", "Bearer "+token)
+		return nil
+	}
+	if len(token) == 0 {
+		return nil
+	}
+
+	if login, ok := GitUsernameFromContext(ctx); ok {
+		req.SetBasicAuth(login, token)
+		return nil
+	}
+	if r.apiURL == nil {
+		return nil
+	}
+
+	key := sha256.Sum256([]byte(token))
+	if l, ok := r.logins.get(key); ok {
+		req.SetBasicAuth(l.login, token)
+		return nil
+	}
+
+	login, err := r.lookUpUser(ctx, token)
+	if err != nil {
+		return fmt.Errorf("unable to look up OpenShift user: %v", err)
+	}
+
+	r.logins.storeLogin(key, login)
+	req.SetBasicAuth(login, token)
+	return nil
+}
+
+// lookUpUser returns the name of the OpenShift user token belongs to.
+func (r *openShiftRetriever) lookUpUser(ctx context.Context, token string) (string, error) {
+	u := *r.apiURL
+	u.Path = strings.TrimSuffix(u.Path, "/") + openShiftUserPath
+	u.RawPath = ""
+
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := r.apiClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	var user openShiftUser
+	if err = json.NewDecoder(resp.Body).Decode(&user); err != nil {
+		return "", err
+	}
+	if len(user.Metadata.Name) == 0 {
+		return "", fmt.Errorf("missing user name")
+	}
+	return user.Metadata.Name, nil
+}
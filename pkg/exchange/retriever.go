@@ -0,0 +1,188 @@
+//    Copyright 2017 Red Hat, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package exchange
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	jwtmiddleware "github.com/auth0/go-jwt-middleware"
+)
+
+// TokenRetriever implements the identity provider specific steps of
+// replacing the token of a request.
+type TokenRetriever interface {
+	// VerifyIncoming returns the Keycloak access token of an incoming
+	// request, or "" if it carries none.
+	VerifyIncoming(req *http.Request) (string, error)
+	// ExchangeToken exchanges token, issued by issuerURL, for the token of
+	// the identity provider alias.
+	ExchangeToken(ctx context.Context, issuerURL, alias, token string) (string, error)
+	// DecorateRequest puts the identity provider token into req.
+	DecorateRequest(ctx context.Context, req *http.Request, token string) error
+}
+
+// apiClient returns the client for calls to the provider's API.
+func (o Options) apiClient() *http.Client {
+	if o.IdentityServerClient != nil {
+		return o.IdentityServerClient
+	}
+	return o.Client
+}
+
+// Options configure a TokenRetriever created by New.
+type Options struct {
+	// Client is used for broker token exchanges.
+	Client *http.Client
+	// IdentityServerURL overrides the URL of the provider's API.
+	IdentityServerURL *url.URL
+	// IdentityServerClient is used for calls to the provider's API, Client
+	// if nil.
+	IdentityServerClient *http.Client
+	// LoginCacheTTL is how long the user a provider token belongs to is
+	// cached, if the retriever looks it up. 0 disables caching.
+	LoginCacheTTL time.Duration
+	// OnRateLimit, if set, is called with the rate limit reported by the
+	// provider's API whenever the retriever calls it.
+	OnRateLimit func(limit, remaining int, reset time.Time)
+	// TokenAudiences and TokenExpiration are the audiences and lifetime of
+	// tokens minted by the retriever, if it mints them.
+	TokenAudiences  []string
+	TokenExpiration time.Duration
+	// AWSRegion and AWSService scope the signatures of the aws retriever,
+	// whose roles are assumed for AWSSessionDuration; AWSCredentialsFile
+	// holds the profiles of provider aliases that are no role ARNs.
+	AWSRegion          string
+	AWSService         string
+	AWSCredentialsFile string
+	AWSSessionDuration time.Duration
+}
+
+// RateLimitError is returned by DecorateRequest when the rate limit of the
+// provider's API is exhausted until Reset.
+type RateLimitError struct {
+	Reset time.Time
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("provider API rate limit exceeded until %s", e.Reset.UTC().Format(time.RFC3339))
+}
+
+// NotLinkedError is returned by ExchangeToken when the user has not linked
+// an account of the identity provider Alias.
+type NotLinkedError struct {
+	Alias string
+}
+
+func (e *NotLinkedError) Error() string {
+	return fmt.Sprintf("user has no linked identity of identity provider %s", e.Alias)
+}
+
+// Factory creates a TokenRetriever.
+type Factory func(o Options) TokenRetriever
+
+var (
+	retrieversMu sync.RWMutex
+	retrievers   = make(map[string]Factory)
+)
+
+// Register makes a TokenRetriever available for providerType. It panics if
+// providerType is registered twice.
+func Register(providerType string, f Factory) {
+	retrieversMu.Lock()
+	defer retrieversMu.Unlock()
+	if _, dup := retrievers[providerType]; dup {
+		panic("exchange: Register called twice for provider type " + providerType)
+	}
+	retrievers[providerType] = f
+}
+
+// ProviderTypes returns the sorted registered provider types.
+func ProviderTypes() []string {
+	retrieversMu.RLock()
+	defer retrieversMu.RUnlock()
+	types := make([]string, 0, len(retrievers))
+	for t := range retrievers {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// ValidateProviderType checks that a TokenRetriever is registered for
+// providerType.
+func ValidateProviderType(providerType string) error {
+	retrieversMu.RLock()
+	_, ok := retrievers[providerType]
+	retrieversMu.RUnlock()
+	if !ok {
+		return fmt.Errorf("unknown provider-type %q, must be one of %s", providerType, strings.Join(ProviderTypes(), ", "))
+	}
+	return nil
+}
+
+// New returns the TokenRetriever registered for providerType.
+func New(providerType string, o Options) (TokenRetriever, error) {
+	if err := ValidateProviderType(providerType); err != nil {
+		return nil, err
+	}
+	retrieversMu.RLock()
+	f := retrievers[providerType]
+	retrieversMu.RUnlock()
+	if o.Client == nil {
+		o.Client = http.DefaultClient
+	}
+	return f(o), nil
+}
+
+// IncomingToken returns the token of req, taken from the basic auth password
+// of Git requests, or the field chosen by their GitRules, and from a Bearer,
+// token or DPoP Authorization header otherwise. Git LFS clients may send either.
+// It is the VerifyIncoming of the built-in retrievers.
+func IncomingToken(req *http.Request) (string, error) {
+	if g, ok := ClassifyGitRequest(req); ok {
+		if token, basic := gitToken(req); basic || !g.LFS {
+			return token, nil
+		}
+	}
+	return jwtmiddleware.FromFirst(
+		tokenFromAuthHeaderWithPrefix("bearer"),
+		tokenFromAuthHeaderWithPrefix("token"),
+		tokenFromAuthHeaderWithPrefix("dpop"),
+	)(req)
+}
+
+func tokenFromAuthHeaderWithPrefix(prefix string) jwtmiddleware.TokenExtractor {
+	return func(r *http.Request) (string, error) {
+		authHeader := r.Header.Get("Authorization")
+		if authHeader == "" {
+			return "", nil // No error, just no token
+		}
+
+		// TODO: Make this a bit more robust, parsing-wise
+		authHeaderParts := strings.Split(authHeader, " ")
+		if len(authHeaderParts) != 2 || strings.ToLower(authHeaderParts[0]) != prefix {
+			return "", nil // No error, just no token
+		}
+
+		return authHeaderParts[1], nil
+	}
+}
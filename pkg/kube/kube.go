@@ -0,0 +1,169 @@
+//    Copyright 2017 Red Hat, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+// Package kube calls the API server of the Kubernetes cluster the proxy runs
+// in, authenticated as the pod's service account.
+package kube
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Files of the in-cluster configuration mounted into every pod.
+const (
+	TokenFile     = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	CAFile        = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+	NamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+)
+
+// Client calls the API server.
+type Client struct {
+	HTTP *http.Client
+	// URL is the base URL of the API server.
+	URL string
+	// TokenFile holds the token requests are authenticated with. It is read
+	// for every request, as projected tokens are rotated.
+	TokenFile string
+	// Namespace is the namespace of the pod.
+	Namespace string
+}
+
+// InCluster returns a Client for the cluster the proxy runs in.
+func InCluster() (*Client, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if len(host) == 0 || len(port) == 0 {
+		return nil, errors.New("not running in a Kubernetes cluster, KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT are unset")
+	}
+	if _, err := os.Stat(TokenFile); err != nil {
+		return nil, fmt.Errorf("unable to read service account token: %v", err)
+	}
+
+	caCert, err := ioutil.ReadFile(CAFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read cluster CA certificate: %v", err)
+	}
+	caCertPool := x509.NewCertPool()
+	if !caCertPool.AppendCertsFromPEM(caCert) {
+		return nil, fmt.Errorf("no certificates in %s", CAFile)
+	}
+
+	namespace, err := ioutil.ReadFile(NamespaceFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read namespace: %v", err)
+	}
+
+	return &Client{
+		HTTP: &http.Client{
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: &tls.Config{RootCAs: caCertPool},
+			},
+			Timeout: 10 * time.Second,
+		},
+		URL:       "https://" + net.JoinHostPort(host, port),
+		TokenFile: TokenFile,
+		Namespace: strings.TrimSpace(string(namespace)),
+	}, nil
+}
+
+// Get decodes the object at path into out.
+func (c *Client) Get(ctx context.Context, path string, out interface{}) error {
+	return c.do(ctx, "GET", path, nil, out)
+}
+
+// Create posts the object in to the resource at path, decoding the created
+// object into out.
+func (c *Client) Create(ctx context.Context, path string, in, out interface{}) error {
+	b, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	return c.do(ctx, "POST", path, b, out)
+}
+
+func (c *Client) do(ctx context.Context, method, path string, body []byte, out interface{}) error {
+	token, err := ioutil.ReadFile(c.TokenFile)
+	if err != nil {
+		return fmt.Errorf("unable to read service account token: %v", err)
+	}
+
+	req, err := http.NewRequest(method, c.URL+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := c.HTTP.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s %s rejected: %s", method, path, resp.Status)
+	}
+	if err = json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("unable to decode response of %s: %v", path, err)
+	}
+	return nil
+}
+
+type objectMeta struct {
+	ResourceVersion string `json:"resourceVersion"`
+}
+
+// ConfigMap returns the data and resource version of the ConfigMap name in
+// the pod's namespace.
+func (c *Client) ConfigMap(ctx context.Context, name string) (map[string]string, string, error) {
+	var cm struct {
+		Metadata objectMeta        `json:"metadata"`
+		Data     map[string]string `json:"data"`
+	}
+	if err := c.Get(ctx, "/api/v1/namespaces/"+c.Namespace+"/configmaps/"+name, &cm); err != nil {
+		return nil, "", err
+	}
+	return cm.Data, cm.Metadata.ResourceVersion, nil
+}
+
+// Secret returns the decoded data and resource version of the Secret name in
+// namespace.
+func (c *Client) Secret(ctx context.Context, namespace, name string) (map[string]string, string, error) {
+	var secret struct {
+		Metadata objectMeta        `json:"metadata"`
+		Data     map[string][]byte `json:"data"`
+	}
+	if err := c.Get(ctx, "/api/v1/namespaces/"+namespace+"/secrets/"+name, &secret); err != nil {
+		return nil, "", err
+	}
+	data := make(map[string]string, len(secret.Data))
+	for k, v := range secret.Data {
+		data[k] = string(v)
+	}
+	return data, secret.Metadata.ResourceVersion, nil
+}
@@ -0,0 +1,68 @@
+//    Copyright 2017 Red Hat, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package proxy
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/coreos/go-oidc/jose"
+)
+
+// providerAliasRegexp restricts per-request aliases, which become part of the
+// broker token URL.
+var providerAliasRegexp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]*$`)
+
+// OtherProviderAlias is the metrics label of provider aliases that are not
+// configured, see MetricsProviderAlias.
+const OtherProviderAlias = "other"
+
+// providerAlias returns the identity provider alias of a request: the value
+// of ProviderAliasHeader if a trusted proxy sent one, else the ProviderAliasClaim
+// of the verified token if present, else ProviderAlias.
+func (cfg *Config) providerAlias(fromHeader string, claims jose.Claims) (string, error) {
+	alias := fromHeader
+	if len(alias) == 0 && len(cfg.ProviderAliasClaim) > 0 {
+		switch v := claims[cfg.ProviderAliasClaim].(type) {
+		case nil:
+		case string:
+			alias = v
+		default:
+			return "", fmt.Errorf("claim %s is not a string", cfg.ProviderAliasClaim)
+		}
+	}
+	if len(alias) == 0 {
+		return cfg.ProviderAlias, nil
+	}
+	if !providerAliasRegexp.MatchString(alias) {
+		return "", fmt.Errorf("invalid provider alias %q", alias)
+	}
+	return alias, nil
+}
+
+// MetricsProviderAlias returns alias if it is the ProviderAlias of cfg or of
+// one of its Routes, else OtherProviderAlias, so that aliases chosen per
+// request don't grow the number of metrics without bound.
+func (cfg *Config) MetricsProviderAlias(alias string) string {
+	if alias == cfg.ProviderAlias {
+		return alias
+	}
+	for _, r := range cfg.Routes {
+		if alias == r.Config.ProviderAlias {
+			return alias
+		}
+	}
+	return OtherProviderAlias
+}
@@ -0,0 +1,71 @@
+//    Copyright 2017 Red Hat, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package proxy
+
+import (
+	"testing"
+
+	"github.com/coreos/go-oidc/jose"
+)
+
+func TestProviderAlias(t *testing.T) {
+	cfg := &Config{ProviderAlias: "github", ProviderAliasClaim: "idp"}
+
+	tests := []struct {
+		fromHeader string
+		claims     jose.Claims
+		want       string
+		wantErr    bool
+	}{
+		{"", jose.Claims{}, "github", false},
+		{"", jose.Claims{"idp": "gitlab"}, "gitlab", false},
+		{"openshift-v3", jose.Claims{"idp": "gitlab"}, "openshift-v3", false},
+		{"", jose.Claims{"idp": 1}, "", true},
+		{"Git_Lab-2", jose.Claims{}, "Git_Lab-2", false},
+		{"..", jose.Claims{}, "", true},
+		{".hidden", jose.Claims{}, "", true},
+		{"-x", jose.Claims{}, "", true},
+		{"_x", jose.Claims{}, "", true},
+		{"a.b", jose.Claims{}, "", true},
+		{"a/b", jose.Claims{}, "", true},
+		{"", jose.Claims{"idp": "../admin"}, "", true},
+	}
+	for _, tt := range tests {
+		got, err := cfg.providerAlias(tt.fromHeader, tt.claims)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("providerAlias(%q, %v) = %q, %v, want %q (error %v)", tt.fromHeader, tt.claims, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestMetricsProviderAlias(t *testing.T) {
+	cfg := &Config{
+		ProviderAlias: "github",
+		Routes: []Route{
+			{PathPrefix: "/gitlab", Config: &Config{ProviderAlias: "gitlab"}},
+		},
+	}
+
+	for alias, want := range map[string]string{
+		"github":    "github",
+		"gitlab":    "gitlab",
+		"bitbucket": OtherProviderAlias,
+		"":          OtherProviderAlias,
+	} {
+		if got := cfg.MetricsProviderAlias(alias); got != want {
+			t.Errorf("MetricsProviderAlias(%q) = %q, want %q", alias, got, want)
+		}
+	}
+}
@@ -0,0 +1,32 @@
+//    Copyright 2017 Red Hat, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package proxy
+
+import (
+	"github.com/coreos/go-oidc/jose"
+)
+
+// artifactUsername returns the basic auth username sent to an artifact
+// repository for the user of claims: ArtifactUsername, or else their
+// ArtifactUsernameClaim, or "token-rp" if they lack it.
+func (cfg *Config) artifactUsername(claims jose.Claims) string {
+	if len(cfg.ArtifactUsername) > 0 {
+		return cfg.ArtifactUsername
+	}
+	if username, _ := claims[cfg.ArtifactUsernameClaim].(string); len(username) > 0 {
+		return username
+	}
+	return "token-rp"
+}
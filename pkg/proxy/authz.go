@@ -0,0 +1,80 @@
+//    Copyright 2017 Red Hat, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package proxy
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/coreos/go-oidc/jose"
+)
+
+// Requirements lists the roles and scopes a verified token must carry
+// before it is exchanged and forwarded.
+type Requirements struct {
+	// Roles are realm roles, or client roles in the form client:role.
+	Roles  []string
+	Scopes []string
+}
+
+// Check returns an error naming the first requirement claims don't meet.
+func (r Requirements) Check(claims jose.Claims) error {
+	for _, role := range r.Roles {
+		if !hasRole(claims, role) {
+			return fmt.Errorf("missing required role %q", role)
+		}
+	}
+
+	if len(r.Scopes) > 0 {
+		scope, _, _ := claims.StringClaim("scope")
+		granted := strings.Fields(scope)
+		for _, s := range r.Scopes {
+			if !containsString(granted, s) {
+				return fmt.Errorf("missing required scope %q", s)
+			}
+		}
+	}
+
+	return nil
+}
+
+// hasRole looks role up in Keycloak's realm_access and resource_access
+// claims.
+func hasRole(claims jose.Claims, role string) bool {
+	access, _ := claims["realm_access"].(map[string]interface{})
+	if i := strings.Index(role, ":"); i >= 0 {
+		resourceAccess, _ := claims["resource_access"].(map[string]interface{})
+		access, _ = resourceAccess[role[:i]].(map[string]interface{})
+		role = role[i+1:]
+	}
+
+	roles, _ := access["roles"].([]interface{})
+	for _, r := range roles {
+		if r == role {
+			return true
+		}
+	}
+
+	return false
+}
+
+func containsString(haystack []string, needle string) bool {
+	for _, s := range haystack {
+		if s == needle {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,141 @@
+//    Copyright 2017 Red Hat, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"sync"
+	"sync/atomic"
+)
+
+// Load balancing policies.
+const (
+	RoundRobin       = "round-robin"
+	LeastConnections = "least-connections"
+)
+
+// endpointState is the state of an upstream endpoint. It is shared by the
+// balancers of successive configurations, so reloading neither forgets about
+// requests still in flight nor about failed health checks.
+type endpointState struct {
+	conns     int64 // accessed atomically
+	unhealthy int32 // accessed atomically
+}
+
+var endpointStates sync.Map
+
+func stateOf(endpoint url.URL) *endpointState {
+	s, _ := endpointStates.LoadOrStore(endpoint.String(), &endpointState{})
+	return s.(*endpointState)
+}
+
+// SetEndpointHealthy records the result of a health check of endpoint.
+// Balancers only pick unhealthy endpoints if none are healthy.
+func SetEndpointHealthy(endpoint url.URL, healthy bool) {
+	var unhealthy int32
+	if !healthy {
+		unhealthy = 1
+	}
+	atomic.StoreInt32(&stateOf(endpoint).unhealthy, unhealthy)
+}
+
+// Balancer distributes requests across upstream endpoints, failing over to
+// fallback endpoints when all endpoints are unhealthy.
+type Balancer struct {
+	policy    string
+	endpoints []url.URL
+	states    []*endpointState
+	primaries int
+	next      uint32
+}
+
+// NewBalancer returns a Balancer distributing requests across endpoints with
+// policy, RoundRobin or LeastConnections, and across fallbacks while all
+// endpoints are unhealthy.
+func NewBalancer(policy string, endpoints, fallbacks []url.URL) (*Balancer, error) {
+	if policy != RoundRobin && policy != LeastConnections {
+		return nil, fmt.Errorf("unknown lb-policy %q", policy)
+	}
+	if len(endpoints) == 0 {
+		return nil, errors.New("no upstream endpoints")
+	}
+	b := &Balancer{policy: policy, primaries: len(endpoints)}
+	b.endpoints = append(append(b.endpoints, endpoints...), fallbacks...)
+	for _, e := range b.endpoints {
+		b.states = append(b.states, stateOf(e))
+	}
+	return b, nil
+}
+
+// Endpoints returns the endpoints of b followed by its fallbacks.
+func (b *Balancer) Endpoints() []url.URL {
+	return b.endpoints
+}
+
+// healthy returns the indices of the healthy endpoints in [from, to).
+func (b *Balancer) healthy(from, to int) []int {
+	var idx []int
+	for i := from; i < to; i++ {
+		if atomic.LoadInt32(&b.states[i].unhealthy) == 0 {
+			idx = append(idx, i)
+		}
+	}
+	return idx
+}
+
+// Pick returns the endpoint for the next request and a function to call
+// once the request is done.
+func (b *Balancer) Pick() (*url.URL, func()) {
+	candidates := b.healthy(0, b.primaries)
+	if len(candidates) == 0 {
+		candidates = b.healthy(b.primaries, len(b.endpoints))
+	}
+	if len(candidates) == 0 {
+		// Everything is down, keep trying the primaries.
+		for i := 0; i < b.primaries; i++ {
+			candidates = append(candidates, i)
+		}
+	}
+
+	start := int(atomic.AddUint32(&b.next, 1)-1) % len(candidates)
+	i := candidates[start]
+	if b.policy == LeastConnections {
+		// Start at the round robin position so ties are spread evenly.
+		for n := 1; n < len(candidates); n++ {
+			j := candidates[(start+n)%len(candidates)]
+			if atomic.LoadInt64(&b.states[j].conns) < atomic.LoadInt64(&b.states[i].conns) {
+				i = j
+			}
+		}
+	}
+
+	state := b.states[i]
+	atomic.AddInt64(&state.conns, 1)
+	u := b.endpoints[i]
+	return &u, func() { atomic.AddInt64(&state.conns, -1) }
+}
+
+// PickUpstream returns the endpoint of Upstreams, or ProxyURL if there are
+// none, to forward the next request to, and a function to call once the
+// request is done.
+func (cfg *Config) PickUpstream() (*url.URL, func()) {
+	if cfg.Upstreams == nil {
+		u := cfg.ProxyURL
+		return &u, func() {}
+	}
+	return cfg.Upstreams.Pick()
+}
@@ -0,0 +1,42 @@
+//    Copyright 2017 Red Hat, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package proxy
+
+import (
+	"net/http"
+
+	"github.com/syndesisio/token-rp/pkg/exchange"
+)
+
+// limitBody limits reading the body of req to the MaxBodySize, for Git
+// requests the MaxGitBodySize and for deploys to an artifact repository the
+// MaxArtifactBodySize, of cfg. It reports false if the body is known to
+// exceed the limit.
+func (cfg *Config) limitBody(w http.ResponseWriter, req *http.Request) bool {
+	limit := cfg.MaxBodySize
+	if exchange.IsGitRequest(req) {
+		limit = cfg.MaxGitBodySize
+	} else if cfg.ArtifactRepository && req.Method == "PUT" {
+		limit = cfg.MaxArtifactBodySize
+	}
+	if limit <= 0 || req.Body == nil {
+		return true
+	}
+	if req.ContentLength > limit {
+		return false
+	}
+	req.Body = http.MaxBytesReader(w, req.Body, limit)
+	return true
+}
@@ -0,0 +1,69 @@
+//    Copyright 2017 Red Hat, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package proxy
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestLimitBody(t *testing.T) {
+	cfg := &Config{MaxBodySize: 4}
+
+	tests := []struct {
+		name          string
+		body          string
+		contentLength int64
+		wantOK        bool
+		wantTooLarge  bool
+	}{
+		{"within the limit", "abcd", 4, true, false},
+		{"announced too large", "abcde", 5, false, false},
+		{"chunked within the limit", "abcd", -1, true, false},
+		{"chunked too large", "abcde", -1, true, true},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("POST", "/", strings.NewReader(tt.body))
+		req.ContentLength = tt.contentLength
+		if ok := cfg.limitBody(httptest.NewRecorder(), req); ok != tt.wantOK {
+			t.Errorf("%s: limitBody() = %v, want %v", tt.name, ok, tt.wantOK)
+		}
+		if !tt.wantOK {
+			continue
+		}
+		// The error must reach the forwarder's error handler unchanged to be
+		// answered with 413.
+		_, err := ioutil.ReadAll(req.Body)
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) != tt.wantTooLarge {
+			t.Errorf("%s: reading the body failed with %v", tt.name, err)
+		}
+	}
+}
+
+func TestLimitBodyUnlimitedByDefault(t *testing.T) {
+	req := httptest.NewRequest("POST", "/", strings.NewReader(strings.Repeat("a", 1<<20)))
+	req.ContentLength = -1
+	if ok := (&Config{}).limitBody(httptest.NewRecorder(), req); !ok {
+		t.Fatal("limitBody() rejected a body without a limit")
+	}
+	if b, err := ioutil.ReadAll(req.Body); err != nil || len(b) != 1<<20 {
+		t.Errorf("read %d bytes with error %v, want the whole body", len(b), err)
+	}
+}
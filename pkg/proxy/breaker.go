@@ -0,0 +1,149 @@
+//    Copyright 2017 Red Hat, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// States of a circuit breaker.
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half-open"
+)
+
+// ErrBreakerOpen is returned for requests to a host whose circuit breaker is
+// open.
+var ErrBreakerOpen = errors.New("circuit breaker open")
+
+// Breakers are circuit breakers per host. After Threshold consecutive
+// failures, requests to a host fail immediately for OpenFor. Then a single
+// probe request is let through, closing the breaker if it succeeds and
+// opening it again otherwise.
+type Breakers struct {
+	Threshold int
+	OpenFor   time.Duration
+	// OnStateChange is called with every new state of the breaker of host.
+	OnStateChange func(host, state string)
+
+	mu    sync.Mutex
+	hosts map[string]*breaker
+}
+
+type breaker struct {
+	state    string
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+// RoundTripper returns rt guarded by b, or rt itself if b is disabled.
+// Transport errors and 5xx responses count as failures.
+func (b *Breakers) RoundTripper(rt http.RoundTripper) http.RoundTripper {
+	if b == nil || b.Threshold <= 0 {
+		return rt
+	}
+	return &breakerTransport{breakers: b, rt: rt}
+}
+
+func (b *Breakers) setState(host string, br *breaker, state string) {
+	br.state = state
+	if b.OnStateChange != nil {
+		b.OnStateChange(host, state)
+	}
+}
+
+// allow reports whether a request to host may be sent and whether it is the
+// probe of a half-open breaker.
+func (b *Breakers) allow(host string) (allowed, probe bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.hosts == nil {
+		b.hosts = make(map[string]*breaker)
+	}
+	br, ok := b.hosts[host]
+	if !ok {
+		br = &breaker{state: BreakerClosed}
+		b.hosts[host] = br
+	}
+
+	switch br.state {
+	case BreakerOpen:
+		if time.Since(br.openedAt) < b.OpenFor {
+			return false, false
+		}
+		b.setState(host, br, BreakerHalfOpen)
+		fallthrough
+	case BreakerHalfOpen:
+		if br.probing {
+			return false, false
+		}
+		br.probing = true
+		return true, true
+	}
+	return true, false
+}
+
+// record updates the breaker of host with the outcome of an allowed request.
+// Requests canceled by the client are not counted.
+func (b *Breakers) record(host string, probe, failed, canceled bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	br := b.hosts[host]
+	if probe {
+		br.probing = false
+	}
+	switch {
+	case canceled:
+	case !failed:
+		br.failures = 0
+		if br.state != BreakerClosed {
+			b.setState(host, br, BreakerClosed)
+		}
+	case probe:
+		br.openedAt = time.Now()
+		b.setState(host, br, BreakerOpen)
+	default:
+		br.failures++
+		if br.failures >= b.Threshold && br.state == BreakerClosed {
+			br.openedAt = time.Now()
+			b.setState(host, br, BreakerOpen)
+		}
+	}
+}
+
+type breakerTransport struct {
+	breakers *Breakers
+	rt       http.RoundTripper
+}
+
+func (t *breakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := req.URL.Host
+	allowed, probe := t.breakers.allow(host)
+	if !allowed {
+		return nil, ErrBreakerOpen
+	}
+	resp, err := t.rt.RoundTrip(req)
+	canceled := err != nil && req.Context().Err() == context.Canceled
+	t.breakers.record(host, probe, err != nil || resp.StatusCode >= 500, canceled)
+	return resp, err
+}
@@ -0,0 +1,71 @@
+//    Copyright 2017 Red Hat, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// CIDRs is a list of IP networks.
+type CIDRs []*net.IPNet
+
+// ParseCIDRs parses networks in CIDR notation, or single IP addresses.
+func ParseCIDRs(list []string) (CIDRs, error) {
+	var cidrs CIDRs
+	for _, s := range list {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %q", s)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			cidrs = append(cidrs, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		cidrs = append(cidrs, n)
+	}
+	return cidrs, nil
+}
+
+// Contains reports whether ip is in any of c.
+func (c CIDRs) Contains(ip net.IP) bool {
+	for _, n := range c {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ipAllowed reports whether requests from ip pass the AllowedCIDRs and
+// DeniedCIDRs of cfg. Denied networks take precedence.
+func (cfg *Config) ipAllowed(ip net.IP) bool {
+	if ip == nil {
+		return len(cfg.AllowedCIDRs) == 0 && len(cfg.DeniedCIDRs) == 0
+	}
+	if cfg.DeniedCIDRs.Contains(ip) {
+		return false
+	}
+	return len(cfg.AllowedCIDRs) == 0 || cfg.AllowedCIDRs.Contains(ip)
+}
@@ -0,0 +1,93 @@
+//    Copyright 2017 Red Hat, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package proxy
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseCIDRs(t *testing.T) {
+	tests := []struct {
+		list    []string
+		wantErr bool
+		in, out []string
+	}{
+		{
+			list: []string{"10.0.0.0/8", "192.168.1.1"},
+			in:   []string{"10.1.2.3", "192.168.1.1", "::ffff:10.0.0.1"},
+			out:  []string{"11.0.0.1", "192.168.1.2", "::1"},
+		},
+		{
+			list: []string{"fd00::/8", "2001:db8::1"},
+			in:   []string{"fd12::1", "2001:db8::1"},
+			out:  []string{"2001:db8::2", "10.0.0.1"},
+		},
+		{list: nil, out: []string{"10.0.0.1", "::1"}},
+		{list: []string{"10.0.0.0/33"}, wantErr: true},
+		{list: []string{"10.0.0"}, wantErr: true},
+		{list: []string{"example.com"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		cidrs, err := ParseCIDRs(tt.list)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseCIDRs(%q) error = %v, want error %v", tt.list, err, tt.wantErr)
+			continue
+		}
+		for _, ip := range tt.in {
+			if !cidrs.Contains(net.ParseIP(ip)) {
+				t.Errorf("ParseCIDRs(%q) doesn't contain %s", tt.list, ip)
+			}
+		}
+		for _, ip := range tt.out {
+			if cidrs.Contains(net.ParseIP(ip)) {
+				t.Errorf("ParseCIDRs(%q) contains %s", tt.list, ip)
+			}
+		}
+	}
+}
+
+func TestIPAllowed(t *testing.T) {
+	mustParse := func(list ...string) CIDRs {
+		cidrs, err := ParseCIDRs(list)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cidrs
+	}
+
+	tests := []struct {
+		name    string
+		allowed CIDRs
+		denied  CIDRs
+		ip      net.IP
+		want    bool
+	}{
+		{"no lists", nil, nil, net.ParseIP("203.0.113.1"), true},
+		{"no lists, unknown IP", nil, nil, nil, true},
+		{"allowed", mustParse("10.0.0.0/8"), nil, net.ParseIP("10.0.0.1"), true},
+		{"not allowed", mustParse("10.0.0.0/8"), nil, net.ParseIP("11.0.0.1"), false},
+		{"denied", nil, mustParse("10.0.0.0/8"), net.ParseIP("10.0.0.1"), false},
+		{"not denied", nil, mustParse("10.0.0.0/8"), net.ParseIP("11.0.0.1"), true},
+		{"denied takes precedence", mustParse("10.0.0.0/8"), mustParse("10.1.0.0/16"), net.ParseIP("10.1.0.1"), false},
+		{"unknown IP with lists", mustParse("10.0.0.0/8"), nil, nil, false},
+	}
+	for _, tt := range tests {
+		cfg := &Config{AllowedCIDRs: tt.allowed, DeniedCIDRs: tt.denied}
+		if got := cfg.ipAllowed(tt.ip); got != tt.want {
+			t.Errorf("%s: ipAllowed(%v) = %v, want %v", tt.name, tt.ip, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+//    Copyright 2017 Red Hat, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/coreos/go-oidc/jose"
+)
+
+// claimHeader maps a claim of the verified token to an upstream request
+// header.
+type claimHeader struct {
+	claim  string
+	header string
+}
+
+// ClaimHeaders pass claims of verified tokens upstream as request headers.
+type ClaimHeaders []claimHeader
+
+// ParseClaimHeaders parses mappings of the form claim=Header.
+func ParseClaimHeaders(mappings []string) (ClaimHeaders, error) {
+	var ch ClaimHeaders
+	for _, m := range mappings {
+		parts := strings.SplitN(m, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid claim header mapping %q, expected claim=Header", m)
+		}
+		ch = append(ch, claimHeader{claim: parts[0], header: http.CanonicalHeaderKey(parts[1])})
+	}
+	return ch, nil
+}
+
+// Strip removes the mapped headers from h so clients can't spoof them.
+func (ch ClaimHeaders) Strip(h http.Header) {
+	for _, m := range ch {
+		h.Del(m.header)
+	}
+}
+
+// Apply sets the mapped headers on h from claims. Array claims are joined
+// with commas.
+func (ch ClaimHeaders) Apply(h http.Header, claims jose.Claims) {
+	for _, m := range ch {
+		switch v := claims[m.claim].(type) {
+		case nil:
+		case string:
+			h.Set(m.header, v)
+		case []interface{}:
+			values := make([]string, 0, len(v))
+			for _, e := range v {
+				values = append(values, fmt.Sprintf("%v", e))
+			}
+			h.Set(m.header, strings.Join(values, ","))
+		default:
+			h.Set(m.header, fmt.Sprintf("%v", v))
+		}
+	}
+}
@@ -0,0 +1,110 @@
+//    Copyright 2017 Red Hat, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package proxy
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/coreos/go-oidc/jose"
+)
+
+// How client certificates verified by the listener authenticate requests.
+const (
+	// ClientCertOff ignores client certificates.
+	ClientCertOff = "off"
+	// ClientCertAlternative authenticates requests without token by their
+	// client certificate.
+	ClientCertAlternative = "alternative"
+	// ClientCertRequired rejects requests without client certificate, in
+	// addition to verifying their token.
+	ClientCertRequired = "required"
+)
+
+// ValidateClientCertAuth checks the client certificate authentication mode.
+func ValidateClientCertAuth(mode string) error {
+	switch mode {
+	case ClientCertOff, ClientCertAlternative, ClientCertRequired:
+		return nil
+	}
+	return fmt.Errorf("unknown mode %q", mode)
+}
+
+// clientCertificate returns the leaf of the certificate chain presented by
+// the client of req, which the listener verified during the handshake, or
+// nil.
+func clientCertificate(req *http.Request) *x509.Certificate {
+	if req.TLS == nil || len(req.TLS.PeerCertificates) == 0 {
+		return nil
+	}
+	return req.TLS.PeerCertificates[0]
+}
+
+// CertificateClaims maps the subject of a client certificate to the claims
+// of a verified token, as Kubernetes does: the common name is the user and
+// the organizations are the groups. The SPIFFE ID of an SVID takes
+// precedence over the common name, and without either the distinguished
+// name is the subject.
+func CertificateClaims(cert *x509.Certificate) jose.Claims {
+	subject := cert.Subject.CommonName
+	for _, u := range cert.URIs {
+		if u.Scheme == "spiffe" {
+			subject = u.String()
+			break
+		}
+	}
+	if len(subject) == 0 {
+		subject = cert.Subject.String()
+	}
+	groups := make([]interface{}, len(cert.Subject.Organization))
+	for i, o := range cert.Subject.Organization {
+		groups[i] = o
+	}
+	claims := jose.Claims{
+		"sub":                subject,
+		"preferred_username": subject,
+		"groups":             groups,
+		"x509_subject":       cert.Subject.String(),
+	}
+	if len(cert.EmailAddresses) > 0 {
+		claims["email"] = cert.EmailAddresses[0]
+	}
+	return claims
+}
+
+// checkCertificateBinding checks that a token bound to a client certificate
+// by the x5t#S256 confirmation of its claims (RFC 8705) is presented over a
+// connection authenticated by that certificate, so it can't be replayed
+// by others. Unbound tokens are accepted.
+func checkCertificateBinding(claims jose.Claims, cert *x509.Certificate) error {
+	cnf, _ := claims["cnf"].(map[string]interface{})
+	thumbprint, _ := cnf["x5t#S256"].(string)
+	if len(thumbprint) == 0 {
+		return nil
+	}
+	if cert == nil {
+		return errors.New("certificate-bound token presented without client certificate")
+	}
+	sum := sha256.Sum256(cert.Raw)
+	if base64.RawURLEncoding.EncodeToString(sum[:]) != strings.TrimRight(thumbprint, "=") {
+		return errors.New("token is bound to a different client certificate")
+	}
+	return nil
+}
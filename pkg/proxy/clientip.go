@@ -0,0 +1,123 @@
+//    Copyright 2017 Red Hat, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// forwardedHeaders describe the original request to the upstream. They are
+// only accepted from trusted proxies.
+var forwardedHeaders = []string{
+	"Forwarded",
+	"X-Forwarded-For",
+	"X-Forwarded-Host",
+	"X-Forwarded-Proto",
+	"X-Real-Ip",
+}
+
+type clientIPKey struct{}
+
+type trustedProxyKey struct{}
+
+// ContextWithClientIP returns a copy of ctx carrying the client IP of its
+// request, see ClientIP.
+func ContextWithClientIP(ctx context.Context, ip string) context.Context {
+	return context.WithValue(ctx, clientIPKey{}, ip)
+}
+
+// ClientIP returns the IP of the client of req as determined by
+// TrustedProxies.ClientIP, or the remote address of req.
+func ClientIP(req *http.Request) string {
+	if ip, ok := req.Context().Value(clientIPKey{}).(string); ok {
+		return ip
+	}
+	return remoteIP(req)
+}
+
+// ContextWithTrustedProxy returns a copy of ctx marking its request as
+// received from a trusted proxy, see FromTrustedProxy.
+func ContextWithTrustedProxy(ctx context.Context) context.Context {
+	return context.WithValue(ctx, trustedProxyKey{}, true)
+}
+
+// FromTrustedProxy reports whether req was received from a trusted proxy, as
+// marked by ContextWithTrustedProxy.
+func FromTrustedProxy(req *http.Request) bool {
+	trusted, _ := req.Context().Value(trustedProxyKey{}).(bool)
+	return trusted
+}
+
+func remoteIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// TrustedProxies are the proxies whose forwarded headers are honored.
+type TrustedProxies struct {
+	CIDRs CIDRs
+	// ParseForwarded takes the client IP from the RFC 7239 Forwarded
+	// header rather than X-Forwarded-For.
+	ParseForwarded bool
+}
+
+// ClientIP returns the IP of the client of req and whether req was received
+// from a trusted proxy. The client IP of requests from trusted proxies is
+// the rightmost forwarded address that is not a trusted proxy itself, or
+// X-Real-IP.
+func (t *TrustedProxies) ClientIP(req *http.Request) (string, bool) {
+	ip := remoteIP(req)
+	if !t.CIDRs.Contains(net.ParseIP(ip)) {
+		return ip, false
+	}
+
+	var hops []string
+	if t.ParseForwarded {
+		hops = forwardedFor(req.Header)
+	} else if xff := req.Header["X-Forwarded-For"]; len(xff) > 0 {
+		hops = strings.Split(strings.Join(xff, ","), ",")
+	}
+	if len(hops) > 0 {
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := net.ParseIP(strings.TrimSpace(hops[i]))
+			if hop == nil {
+				break
+			}
+			ip = hop.String()
+			if !t.CIDRs.Contains(hop) {
+				break
+			}
+		}
+		return ip, true
+	}
+	if realIP := net.ParseIP(strings.TrimSpace(req.Header.Get("X-Real-Ip"))); realIP != nil {
+		return realIP.String(), true
+	}
+	return ip, true
+}
+
+// StripForwardedHeaders removes the forwarded headers, such as
+// X-Forwarded-For, of h.
+func StripForwardedHeaders(h http.Header) {
+	for _, name := range forwardedHeaders {
+		h.Del(name)
+	}
+}
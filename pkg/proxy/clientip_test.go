@@ -0,0 +1,165 @@
+//    Copyright 2017 Red Hat, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTrustedProxiesClientIP(t *testing.T) {
+	cidrs, err := ParseCIDRs([]string{"10.0.0.0/8", "fd00::/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name           string
+		remoteAddr     string
+		parseForwarded bool
+		header         http.Header
+		wantIP         string
+		wantTrusted    bool
+	}{
+		{
+			name:       "untrusted remote",
+			remoteAddr: "203.0.113.1:1234",
+			header:     http.Header{"X-Forwarded-For": {"198.51.100.1"}, "X-Real-Ip": {"198.51.100.2"}},
+			wantIP:     "203.0.113.1",
+		},
+		{
+			name:        "trusted remote without headers",
+			remoteAddr:  "10.0.0.1:1234",
+			wantIP:      "10.0.0.1",
+			wantTrusted: true,
+		},
+		{
+			name:        "rightmost untrusted hop",
+			remoteAddr:  "10.0.0.1:1234",
+			header:      http.Header{"X-Forwarded-For": {"198.51.100.9, 198.51.100.1, 10.0.0.2"}},
+			wantIP:      "198.51.100.1",
+			wantTrusted: true,
+		},
+		{
+			name:        "several headers",
+			remoteAddr:  "10.0.0.1:1234",
+			header:      http.Header{"X-Forwarded-For": {"198.51.100.9", "198.51.100.1,10.0.0.2"}},
+			wantIP:      "198.51.100.1",
+			wantTrusted: true,
+		},
+		{
+			name:        "only trusted hops",
+			remoteAddr:  "10.0.0.1:1234",
+			header:      http.Header{"X-Forwarded-For": {"10.0.0.3, 10.0.0.2"}},
+			wantIP:      "10.0.0.3",
+			wantTrusted: true,
+		},
+		{
+			name:        "invalid hop stops the walk",
+			remoteAddr:  "10.0.0.1:1234",
+			header:      http.Header{"X-Forwarded-For": {"198.51.100.1, unknown, 10.0.0.2"}},
+			wantIP:      "10.0.0.2",
+			wantTrusted: true,
+		},
+		{
+			name:        "X-Real-IP",
+			remoteAddr:  "10.0.0.1:1234",
+			header:      http.Header{"X-Real-Ip": {"198.51.100.1"}},
+			wantIP:      "198.51.100.1",
+			wantTrusted: true,
+		},
+		{
+			name:        "X-Forwarded-For takes precedence over X-Real-IP",
+			remoteAddr:  "10.0.0.1:1234",
+			header:      http.Header{"X-Forwarded-For": {"198.51.100.1"}, "X-Real-Ip": {"198.51.100.2"}},
+			wantIP:      "198.51.100.1",
+			wantTrusted: true,
+		},
+		{
+			name:        "X-Forwarded-For ignored when parsing Forwarded",
+			remoteAddr:  "10.0.0.1:1234",
+			header:      http.Header{"X-Forwarded-For": {"198.51.100.1"}},
+			wantIP:      "10.0.0.1",
+			wantTrusted: true,
+
+			parseForwarded: true,
+		},
+		{
+			name:        "Forwarded",
+			remoteAddr:  "10.0.0.1:1234",
+			header:      http.Header{"Forwarded": {`for=198.51.100.9, for="198.51.100.1:4711";proto=https, for=10.0.0.2`}},
+			wantIP:      "198.51.100.1",
+			wantTrusted: true,
+
+			parseForwarded: true,
+		},
+		{
+			name:        "Forwarded IPv6",
+			remoteAddr:  "[fd00::1]:1234",
+			header:      http.Header{"Forwarded": {`For="[2001:db8::1]:4711", for="[fd00::2]"`}},
+			wantIP:      "2001:db8::1",
+			wantTrusted: true,
+
+			parseForwarded: true,
+		},
+		{
+			name:        "Forwarded obfuscated node",
+			remoteAddr:  "10.0.0.1:1234",
+			header:      http.Header{"Forwarded": {`for=_hidden, for=10.0.0.2`}},
+			wantIP:      "10.0.0.2",
+			wantTrusted: true,
+
+			parseForwarded: true,
+		},
+	}
+	for _, tt := range tests {
+		tp := &TrustedProxies{CIDRs: cidrs, ParseForwarded: tt.parseForwarded}
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = tt.remoteAddr
+		for name, values := range tt.header {
+			req.Header[name] = values
+		}
+		ip, trusted := tp.ClientIP(req)
+		if ip != tt.wantIP || trusted != tt.wantTrusted {
+			t.Errorf("%s: ClientIP() = %s, %v, want %s, %v", tt.name, ip, trusted, tt.wantIP, tt.wantTrusted)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	if ip := ClientIP(req); ip != "10.0.0.1" {
+		t.Errorf("ClientIP() = %s, want the remote address 10.0.0.1", ip)
+	}
+
+	req = req.WithContext(ContextWithClientIP(req.Context(), "198.51.100.1"))
+	if ip := ClientIP(req); ip != "198.51.100.1" {
+		t.Errorf("ClientIP() = %s, want the client IP of the context 198.51.100.1", ip)
+	}
+}
+
+func TestFromTrustedProxy(t *testing.T) {
+	req := httptest.NewRequest("GET", "/", nil)
+	if FromTrustedProxy(req) {
+		t.Error("FromTrustedProxy() = true for an unmarked request")
+	}
+
+	req = req.WithContext(ContextWithTrustedProxy(req.Context()))
+	if !FromTrustedProxy(req) {
+		t.Error("FromTrustedProxy() = false for a request marked by ContextWithTrustedProxy")
+	}
+}
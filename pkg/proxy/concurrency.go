@@ -0,0 +1,77 @@
+//    Copyright 2017 Red Hat, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package proxy
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrOverloaded is returned by ConcurrencyLimiter.Acquire if neither a slot
+// nor a place in the queue is available in time.
+var ErrOverloaded = errors.New("too many concurrent requests")
+
+// ConcurrencyLimiter caps the number of requests handled concurrently.
+// Further requests wait in a bounded queue for a free slot.
+type ConcurrencyLimiter struct {
+	slots   chan struct{}
+	queue   chan struct{}
+	timeout time.Duration
+}
+
+// NewConcurrencyLimiter returns a ConcurrencyLimiter with max slots, letting
+// up to queued requests wait for at most timeout for a slot.
+func NewConcurrencyLimiter(max, queued int, timeout time.Duration) *ConcurrencyLimiter {
+	return &ConcurrencyLimiter{
+		slots:   make(chan struct{}, max),
+		queue:   make(chan struct{}, queued),
+		timeout: timeout,
+	}
+}
+
+// Acquire takes a slot, waiting in the queue if none is free, and returns a
+// function releasing it.
+func (l *ConcurrencyLimiter) Acquire(ctx context.Context) (func(), error) {
+	release := func() { <-l.slots }
+	select {
+	case l.slots <- struct{}{}:
+		return release, nil
+	default:
+	}
+
+	select {
+	case l.queue <- struct{}{}:
+		defer func() { <-l.queue }()
+	default:
+		return nil, ErrOverloaded
+	}
+
+	timer := time.NewTimer(l.timeout)
+	defer timer.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		return release, nil
+	case <-timer.C:
+		return nil, ErrOverloaded
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Queued returns the number of requests waiting for a slot.
+func (l *ConcurrencyLimiter) Queued() int {
+	return len(l.queue)
+}
@@ -0,0 +1,143 @@
+//    Copyright 2017 Red Hat, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/jose"
+	"github.com/syndesisio/token-rp/pkg/verify"
+)
+
+// How DPoP proofs (RFC 9449) sent along with tokens are checked.
+const (
+	// DPoPOff ignores DPoP proofs, accepting DPoP-bound tokens like bearer
+	// tokens.
+	DPoPOff = "off"
+	// DPoPAllowed verifies the proof of tokens sent with the DPoP scheme and
+	// rejects DPoP-bound tokens sent as bearer tokens.
+	DPoPAllowed = "allowed"
+	// DPoPRequired also rejects tokens that aren't DPoP-bound.
+	DPoPRequired = "required"
+)
+
+const (
+	// dpopProofMaxAge is how long after being issued DPoP proofs are
+	// accepted.
+	dpopProofMaxAge = time.Minute
+	// dpopClockSkew is the tolerated skew of the clocks of clients.
+	dpopClockSkew = 10 * time.Second
+)
+
+// ValidateDPoPMode checks the DPoP mode.
+func ValidateDPoPMode(mode string) error {
+	switch mode {
+	case DPoPOff, DPoPAllowed, DPoPRequired:
+		return nil
+	}
+	return fmt.Errorf("unknown mode %q", mode)
+}
+
+// checkDPoP checks that token, with the verified claims, is presented along
+// with a valid DPoP proof if it is bound to a key or mode requires it.
+// Proofs are single use, and removed from req as they are only valid for
+// token-rp.
+func (h *Handler) checkDPoP(req *http.Request, mode, token string, claims jose.Claims) error {
+	if mode == DPoPOff {
+		return nil
+	}
+	proofs := req.Header["Dpop"]
+	req.Header.Del("DPoP")
+	jkt := verify.ConfirmationThumbprint(claims)
+	if !strings.HasPrefix(strings.ToLower(req.Header.Get("Authorization")), "dpop ") {
+		if len(jkt) > 0 {
+			return errors.New("DPoP-bound token sent as bearer token")
+		}
+		if mode == DPoPRequired {
+			return errors.New("DPoP-bound token required")
+		}
+		return nil
+	}
+	if len(jkt) == 0 {
+		return errors.New("token sent with DPoP scheme is not DPoP-bound")
+	}
+
+	if len(proofs) != 1 {
+		return errors.New("exactly one DPoP proof required")
+	}
+	proof, err := verify.VerifyDPoPProof(proofs[0], req.Method, dpopTarget(req), token, dpopProofMaxAge, dpopClockSkew)
+	if err != nil {
+		return err
+	}
+	if proof.Thumbprint != jkt {
+		return errors.New("DPoP proof is signed by a key the token isn't bound to")
+	}
+	if !h.dpopProofs.add(proof.Thumbprint+" "+proof.ID, proof.IssuedAt.Add(dpopProofMaxAge+dpopClockSkew)) {
+		return errors.New("DPoP proof was already used")
+	}
+	return nil
+}
+
+// dpopTarget returns the URL req was sent to, taking the scheme from
+// X-Forwarded-Proto, which only trusted proxies may send, when req was
+// received without TLS, as DPoP proofs name the URL the client connected
+// to, e.g. at a TLS terminating router.
+func dpopTarget(req *http.Request) *url.URL {
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	} else if proto := strings.ToLower(req.Header.Get("X-Forwarded-Proto")); proto == "https" {
+		scheme = proto
+	}
+	return &url.URL{Scheme: scheme, Host: req.Host, Path: req.URL.Path, RawPath: req.URL.RawPath}
+}
+
+// dpopReplayCache remembers the DPoP proofs seen until they expire. The zero
+// value is ready to use.
+type dpopReplayCache struct {
+	mu        sync.Mutex
+	seen      map[string]time.Time
+	lastPrune time.Time
+}
+
+// add records the proof key until expiry, reporting whether it is new.
+func (c *dpopReplayCache) add(key string, expiry time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if c.seen == nil {
+		c.seen = map[string]time.Time{}
+	}
+	if now.Sub(c.lastPrune) > time.Second {
+		for k, exp := range c.seen {
+			if now.After(exp) {
+				delete(c.seen, k)
+			}
+		}
+		c.lastPrune = now
+	}
+	if exp, ok := c.seen[key]; ok && now.Before(exp) {
+		return false
+	}
+	c.seen[key] = expiry
+	return true
+}
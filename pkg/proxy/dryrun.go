@@ -0,0 +1,124 @@
+//    Copyright 2017 Red Hat, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Dry run modes.
+const (
+	// DryRunOff enforces decisions.
+	DryRunOff = "off"
+	// DryRunVerify verifies tokens but only simulates the exchange.
+	DryRunVerify = "verify"
+	// DryRunExchange verifies and exchanges tokens.
+	DryRunExchange = "exchange"
+)
+
+// simulatedToken stands in for the broker token when the exchange is only
+// simulated.
+const simulatedToken = "simulated-token"
+
+// ValidateDryRunMode checks that mode is a known dry run mode.
+func ValidateDryRunMode(mode string) error {
+	switch mode {
+	case DryRunOff, DryRunVerify, DryRunExchange:
+		return nil
+	}
+	return fmt.Errorf("unknown dry run mode %q", mode)
+}
+
+// dryRun collects what the proxy handler would have done with a request.
+type dryRun struct {
+	// simulateExchange skips the broker token exchange.
+	simulateExchange bool
+	// forwarded is set with the headers the request would have been
+	// forwarded with, if it would not have been rejected.
+	forwarded bool
+	header    http.Header
+}
+
+type dryRunKey struct{}
+
+func contextWithDryRun(ctx context.Context, dr *dryRun) context.Context {
+	return context.WithValue(ctx, dryRunKey{}, dr)
+}
+
+func dryRunFromContext(ctx context.Context) *dryRun {
+	dr, _ := ctx.Value(dryRunKey{}).(*dryRun)
+	return dr
+}
+
+// dryRunWriter captures the response the proxy handler would have sent
+// instead of sending it.
+type dryRunWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *dryRunWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *dryRunWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *dryRunWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if w.body.Len() < 512 {
+		w.body.Write(p)
+	}
+	return len(p), nil
+}
+
+func (w *dryRunWriter) message() string {
+	return strings.TrimSpace(w.body.String())
+}
+
+func cloneHeader(h http.Header) http.Header {
+	c := make(http.Header, len(h))
+	for k, v := range h {
+		c[k] = append([]string(nil), v...)
+	}
+	return c
+}
+
+// maskAuthorization masks the credentials of an Authorization header value.
+func maskAuthorization(v string) string {
+	if i := strings.IndexByte(v, ' '); i >= 0 {
+		return v[:i+1] + MaskToken(v[i+1:])
+	}
+	return MaskToken(v)
+}
+
+// MaskToken hides all but the first few characters of token, which is
+// enough to tell tokens apart without making them usable.
+func MaskToken(token string) string {
+	if len(token) <= 8 {
+		return fmt.Sprintf("[%d chars]", len(token))
+	}
+	return fmt.Sprintf("%s... [%d chars]", token[:4], len(token))
+}
@@ -0,0 +1,115 @@
+//    Copyright 2017 Red Hat, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"mime"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// FlushWriter flushes the response written to it to the client
+// periodically, so streamed responses don't stall in the server's buffer.
+// Event streams and responses of unknown length, such as chunked long polls,
+// are flushed after every write.
+type FlushWriter struct {
+	http.ResponseWriter
+	interval time.Duration
+
+	mu        sync.Mutex
+	immediate bool
+	timer     *time.Timer
+	pending   bool
+	stopped   bool
+}
+
+// NewFlushWriter returns a FlushWriter flushing w every interval, after
+// every write if interval is negative or never if it is zero. Stop must be
+// called once the response is written.
+func NewFlushWriter(w http.ResponseWriter, interval time.Duration) *FlushWriter {
+	return &FlushWriter{ResponseWriter: w, interval: interval}
+}
+
+// WriteHeader sends the response header, deciding from it whether to flush
+// after every write.
+func (f *FlushWriter) WriteHeader(code int) {
+	h := f.Header()
+	mediaType, _, _ := mime.ParseMediaType(h.Get("Content-Type"))
+	f.mu.Lock()
+	f.immediate = mediaType == "text/event-stream" || len(h.Get("Content-Length")) == 0
+	f.mu.Unlock()
+	f.ResponseWriter.WriteHeader(code)
+}
+
+func (f *FlushWriter) Write(b []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	n, err := f.ResponseWriter.Write(b)
+	switch {
+	case f.immediate || f.interval < 0:
+		f.flush()
+	case f.interval > 0 && !f.pending:
+		f.pending = true
+		f.timer = time.AfterFunc(f.interval, f.delayedFlush)
+	}
+	return n, err
+}
+
+func (f *FlushWriter) delayedFlush() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.pending && !f.stopped {
+		f.flush()
+	}
+	f.pending = false
+}
+
+func (f *FlushWriter) flush() {
+	if flusher, ok := f.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Flush sends any buffered data to the client.
+func (f *FlushWriter) Flush() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.flush()
+}
+
+// Hijack lets the forwarder take over websocket connections.
+func (f *FlushWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if hijacker, ok := f.ResponseWriter.(http.Hijacker); ok {
+		return hijacker.Hijack()
+	}
+	return nil, nil, errors.New("hijacking not supported")
+}
+
+// Stop stops flushing periodically.
+func (f *FlushWriter) Stop() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.stopped = true
+	if f.timer != nil {
+		f.timer.Stop()
+	}
+}
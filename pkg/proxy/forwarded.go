@@ -0,0 +1,161 @@
+//    Copyright 2017 Red Hat, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Modes of setting the RFC 7239 Forwarded and the legacy X-Forwarded-*
+// headers on forwarded requests.
+const (
+	// AppendForwarded adds this hop to the headers received from trusted
+	// proxies.
+	AppendForwarded = "append"
+	// SetForwarded replaces the headers with the client as determined by
+	// TrustedProxies.
+	SetForwarded = "set"
+	// StripForwarded removes the headers.
+	StripForwarded = "strip"
+)
+
+// ValidateForwardedMode checks that mode is AppendForwarded, SetForwarded or
+// StripForwarded.
+func ValidateForwardedMode(mode string) error {
+	switch mode {
+	case AppendForwarded, SetForwarded, StripForwarded:
+		return nil
+	}
+	return fmt.Errorf("unknown mode %q", mode)
+}
+
+// ForwardedHeaders describe the original request to the upstream.
+type ForwardedHeaders struct {
+	// Forwarded and XForwarded are the modes of the Forwarded and the
+	// X-Forwarded-* headers.
+	Forwarded  string
+	XForwarded string
+	// Server is sent as X-Forwarded-Server, unless empty.
+	Server string
+}
+
+// Apply sets the forwarded headers of req. It must be called before the
+// Host of req is changed for the upstream.
+func (f *ForwardedHeaders) Apply(req *http.Request) {
+	proto := "http"
+	if req.TLS != nil {
+		proto = "https"
+	}
+
+	switch f.Forwarded {
+	case AppendForwarded, SetForwarded:
+		forIP := remoteIP(req)
+		if f.Forwarded == SetForwarded {
+			forIP = ClientIP(req)
+			req.Header.Del("Forwarded")
+		}
+		element := "for=" + forwardedValue(forwardedNode(forIP)) +
+			";host=" + forwardedValue(req.Host) +
+			";proto=" + proto
+		if prior := req.Header.Get("Forwarded"); len(prior) > 0 {
+			element = prior + ", " + element
+		}
+		req.Header.Set("Forwarded", element)
+	case StripForwarded:
+		req.Header.Del("Forwarded")
+	}
+
+	switch f.XForwarded {
+	case AppendForwarded, SetForwarded:
+		xff := remoteIP(req)
+		if f.XForwarded == SetForwarded {
+			xff = ClientIP(req)
+			req.Header.Del("X-Forwarded-For")
+			req.Header.Del("X-Forwarded-Proto")
+			req.Header.Del("X-Forwarded-Host")
+		}
+		if prior := req.Header["X-Forwarded-For"]; len(prior) > 0 {
+			xff = strings.Join(prior, ", ") + ", " + xff
+		}
+		req.Header.Set("X-Forwarded-For", xff)
+		if isWebsocket(req) {
+			proto = strings.Replace(proto, "http", "ws", 1)
+		}
+		if len(req.Header.Get("X-Forwarded-Proto")) == 0 {
+			req.Header.Set("X-Forwarded-Proto", proto)
+		}
+		if len(req.Header.Get("X-Forwarded-Host")) == 0 {
+			req.Header.Set("X-Forwarded-Host", req.Host)
+		}
+		if len(f.Server) > 0 {
+			req.Header.Set("X-Forwarded-Server", f.Server)
+		}
+	case StripForwarded:
+		for _, name := range []string{"X-Forwarded-For", "X-Forwarded-Proto", "X-Forwarded-Host", "X-Forwarded-Server", "X-Real-Ip"} {
+			req.Header.Del(name)
+		}
+	}
+}
+
+// forwardedNode formats ip as node of a Forwarded header, enclosing IPv6
+// addresses in brackets.
+func forwardedNode(ip string) string {
+	if strings.Contains(ip, ":") {
+		return "[" + ip + "]"
+	}
+	return ip
+}
+
+// forwardedValue quotes v unless it is a token.
+func forwardedValue(v string) string {
+	for _, c := range v {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("!#$%&'*+-.^_`|~", c)) {
+			return fmt.Sprintf("%q", v)
+		}
+	}
+	return v
+}
+
+// forwardedFor returns the for parameters of the elements of the Forwarded
+// headers of h, without port.
+func forwardedFor(h http.Header) []string {
+	var hops []string
+	for _, element := range strings.Split(strings.Join(h["Forwarded"], ","), ",") {
+		for _, pair := range strings.Split(element, ";") {
+			kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+			if len(kv) != 2 || !strings.EqualFold(kv[0], "for") {
+				continue
+			}
+			node := strings.Trim(kv[1], `"`)
+			if host, _, err := net.SplitHostPort(node); err == nil {
+				node = host
+			}
+			hops = append(hops, strings.Trim(node, "[]"))
+		}
+	}
+	return hops
+}
+
+func isWebsocket(req *http.Request) bool {
+	for _, v := range strings.Split(req.Header.Get("Upgrade"), ",") {
+		if strings.EqualFold(strings.TrimSpace(v), "websocket") {
+			return true
+		}
+	}
+	return false
+}
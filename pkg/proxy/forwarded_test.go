@@ -0,0 +1,98 @@
+//    Copyright 2017 Red Hat, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestForwardedHeadersApply(t *testing.T) {
+	tests := []struct {
+		name       string
+		forwarded  string
+		xForwarded string
+		header     http.Header
+		want       http.Header
+	}{
+		{
+			name:       "append",
+			forwarded:  AppendForwarded,
+			xForwarded: AppendForwarded,
+			header: http.Header{
+				"Forwarded":         {"for=198.51.100.9"},
+				"X-Forwarded-For":   {"198.51.100.9"},
+				"X-Forwarded-Proto": {"https"},
+			},
+			want: http.Header{
+				"Forwarded":          {`for=198.51.100.9, for=10.0.0.1;host=example.com;proto=http`},
+				"X-Forwarded-For":    {"198.51.100.9, 10.0.0.1"},
+				"X-Forwarded-Proto":  {"https"},
+				"X-Forwarded-Host":   {"example.com"},
+				"X-Forwarded-Server": {"proxy"},
+			},
+		},
+		{
+			name:       "set",
+			forwarded:  SetForwarded,
+			xForwarded: SetForwarded,
+			header: http.Header{
+				"Forwarded":         {"for=198.51.100.9"},
+				"X-Forwarded-For":   {"198.51.100.9"},
+				"X-Forwarded-Proto": {"https"},
+				"X-Forwarded-Host":  {"evil.example"},
+			},
+			want: http.Header{
+				"Forwarded":          {`for="[2001:db8::1]";host=example.com;proto=http`},
+				"X-Forwarded-For":    {"2001:db8::1"},
+				"X-Forwarded-Proto":  {"http"},
+				"X-Forwarded-Host":   {"example.com"},
+				"X-Forwarded-Server": {"proxy"},
+			},
+		},
+		{
+			name:       "strip",
+			forwarded:  StripForwarded,
+			xForwarded: StripForwarded,
+			header: http.Header{
+				"Forwarded":          {"for=198.51.100.9"},
+				"X-Forwarded-For":    {"198.51.100.9"},
+				"X-Forwarded-Proto":  {"https"},
+				"X-Forwarded-Host":   {"evil.example"},
+				"X-Forwarded-Server": {"other"},
+				"X-Real-Ip":          {"198.51.100.9"},
+			},
+			want: http.Header{},
+		},
+	}
+	for _, tt := range tests {
+		f := &ForwardedHeaders{Forwarded: tt.forwarded, XForwarded: tt.xForwarded, Server: "proxy"}
+		req := httptest.NewRequest("GET", "http://example.com/", nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		req = req.WithContext(ContextWithClientIP(req.Context(), "2001:db8::1"))
+		req.Header = tt.header
+		f.Apply(req)
+		if len(req.Header) != len(tt.want) {
+			t.Errorf("%s: headers %v, want %v", tt.name, req.Header, tt.want)
+			continue
+		}
+		for name, want := range tt.want {
+			if got := req.Header.Get(name); got != want[0] {
+				t.Errorf("%s: %s = %q, want %q", tt.name, name, got, want[0])
+			}
+		}
+	}
+}
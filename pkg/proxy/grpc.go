@@ -0,0 +1,41 @@
+//    Copyright 2017 Red Hat, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+// IsGRPCRequest reports whether req is a gRPC call, which needs its
+// trailers and both directions of its stream passed through.
+func IsGRPCRequest(req *http.Request) bool {
+	return req.ProtoMajor == 2 && strings.HasPrefix(req.Header.Get("Content-Type"), "application/grpc")
+}
+
+type h2cKey struct{}
+
+// ContextWithH2C returns a copy of ctx requesting the upstream to be spoken
+// to over HTTP/2, without TLS (h2c) for http URLs.
+func ContextWithH2C(ctx context.Context) context.Context {
+	return context.WithValue(ctx, h2cKey{}, true)
+}
+
+// UsesH2C reports whether ctx was returned by ContextWithH2C.
+func UsesH2C(ctx context.Context) bool {
+	h2c, _ := ctx.Value(h2cKey{}).(bool)
+	return h2c
+}
@@ -0,0 +1,643 @@
+//    Copyright 2017 Red Hat, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+// Package proxy implements token-rp's request handling: verifying the token
+// of an incoming request, authorizing it, replacing the token with the one
+// retrieved from Keycloak's identity broker and forwarding the request.
+package proxy
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/coreos/go-oidc/jose"
+	"github.com/syndesisio/token-rp/pkg/exchange"
+	"github.com/syndesisio/token-rp/pkg/verify"
+	"go.uber.org/zap"
+)
+
+// Policies for requests without a token.
+const (
+	// RejectNoToken answers 401.
+	RejectNoToken = "reject"
+	// StripNoToken forwards the request without Authorization header.
+	StripNoToken = "strip"
+	// PassthroughNoToken forwards the request untouched.
+	PassthroughNoToken = "passthrough"
+)
+
+// Events passed to Hooks.Rejected, named after the step that rejected the
+// request.
+const (
+	AuthenticationEvent = "authentication"
+	AuthorizationEvent  = "authorization"
+	ExchangeEvent       = "exchange"
+)
+
+// Config is the part of the handler's configuration that can change while
+// it is serving.
+type Config struct {
+	// ProxyURL is the first of the upstream endpoints.
+	ProxyURL url.URL
+	// Upstreams balances requests across all upstream endpoints.
+	Upstreams *Balancer
+	// PreservePath forwards requests to the incoming path and query below
+	// the upstream endpoint rather than to the endpoint itself, see
+	// UpstreamURL.
+	PreservePath bool
+	// PathRewrites are applied to the incoming path with PreservePath.
+	PathRewrites PathRewrites
+	// MaxBodySize limits request bodies to as many bytes, unless zero.
+	MaxBodySize int64
+	// MaxGitBodySize replaces MaxBodySize for Git requests, whose pack
+	// uploads may be much larger.
+	MaxGitBodySize int64
+	// MaxArtifactBodySize replaces MaxBodySize for deploys to an
+	// ArtifactRepository.
+	MaxArtifactBodySize int64
+	// Timeouts bound upstream requests, see TimeoutTransport.
+	Timeouts Timeouts
+	// ExchangeTimeout bounds the broker token exchange, unless zero.
+	ExchangeTimeout time.Duration
+	// ProxyProtocol is the PROXY protocol version sent to the upstream, see
+	// ContextWithProxyProtocol, none if empty.
+	ProxyProtocol string
+	// H2C makes the upstream be spoken to over HTTP/2, see ContextWithH2C.
+	H2C bool
+	// FlushInterval is passed to NewFlushWriter for upstream responses.
+	FlushInterval time.Duration
+	// HostHeader is UpstreamHost, PreserveHost or a custom Host header.
+	HostHeader    string
+	ProviderAlias string
+	// ProviderAliasHeader names a header set by trusted proxies to select
+	// the provider alias per request, see FromTrustedProxy. It is removed
+	// from requests of other callers.
+	ProviderAliasHeader string
+	// ProviderAliasClaim names a claim of the verified token selecting the
+	// provider alias when no ProviderAliasHeader was sent.
+	ProviderAliasClaim string
+	// UpstreamCACerts, IssuerCACerts and IdentityServerCACerts are trusted
+	// in addition to CACerts when connecting to upstreams, to issuers and
+	// their broker and to the provider's API respectively.
+	UpstreamCACerts       []string
+	IssuerCACerts         []string
+	IdentityServerCACerts []string
+	// CACerts are the files of extra trusted root certificates.
+	CACerts      []string
+	Requirements Requirements
+	Headers      ClaimHeaders
+	// HeaderTemplates are applied after the token exchange.
+	HeaderTemplates HeaderTemplates
+	// TokenHeader is the canonical name of the header carrying the
+	// exchanged token of non-Git requests, Authorization if empty.
+	TokenHeader string
+	// TokenScheme prefixes the exchanged token, NoTokenScheme for none. If
+	// empty, Authorization uses the provider's scheme and other headers
+	// carry the raw token.
+	TokenScheme string
+	// OriginalAuthorization is one of ReplaceAuthorization,
+	// PreserveAuthorization, RemoveAuthorization or JWTAuthorization.
+	OriginalAuthorization string
+	// AllowedCIDRs, unless empty, are the only client networks whose
+	// requests are accepted. DeniedCIDRs are always rejected.
+	AllowedCIDRs   CIDRs
+	DeniedCIDRs    CIDRs
+	AnonymousPaths *PathMatcher
+	// LFSPassthrough forwards Git LFS object transfers carrying
+	// credentials issued by the upstream untouched.
+	LFSPassthrough bool
+	DeniedPaths    *PathMatcher
+	NoTokenPolicy  string
+	// ClientCertAuth is ClientCertOff, ClientCertAlternative or
+	// ClientCertRequired.
+	ClientCertAuth string
+	// DPoP is DPoPOff, DPoPAllowed or DPoPRequired.
+	DPoP string
+	// GitRules adapt the recognition of Git requests to the upstream.
+	GitRules exchange.GitRules
+	// GitUsernameClaim names a claim of the verified token holding the
+	// provider username of Git requests, see exchange.ContextWithGitUsername.
+	GitUsernameClaim string
+	// Impersonation, unless nil, replaces the token exchange.
+	Impersonation *Impersonation
+	// TokenMinter, unless nil, replaces the token exchange.
+	TokenMinter *TokenMinter
+	// HMACSigner, unless nil, signs forwarded requests. If it ReplaceToken,
+	// it replaces the token exchange.
+	HMACSigner *HMACSigner
+	// RegistryAuth fronts an OCI registry: clients send their token as
+	// basic auth password, and the registry's token authentication is
+	// followed with the exchanged token on their behalf, see
+	// RegistryTransport. RegistryUsernameClaim names the claim holding
+	// the username sent along.
+	RegistryAuth          bool
+	RegistryUsernameClaim string
+	// ArtifactRepository fronts a Maven or npm repository such as Nexus:
+	// clients may send their token as basic auth password, and requests
+	// are forwarded with the exchanged token as basic auth password of
+	// ArtifactUsername, or else the user in ArtifactUsernameClaim.
+	ArtifactRepository    bool
+	ArtifactUsername      string
+	ArtifactUsernameClaim string
+	// ProviderType selects the TokenRetriever from Handler.Retrievers
+	// instead of using Handler.Retriever.
+	ProviderType string
+	// Routes are configurations selected by host and path, see Route.
+	Routes []Route
+}
+
+// Hooks observe the decisions of a Handler. All hooks are optional.
+type Hooks struct {
+	// Rejected is called before a request is rejected, with the event and
+	// a short machine readable reason.
+	Rejected func(req *http.Request, event, reason, msg string)
+	// Authenticated is called once the token of a request is verified.
+	Authenticated func(req *http.Request, subject, providerAlias string)
+	// Exchanged is called after every broker token exchange.
+	Exchanged func(req *http.Request, providerAlias string, d time.Duration, err error)
+	// StartSpan starts a client span with attributes given as key-value
+	// pairs, returning a function that ends it.
+	StartSpan func(ctx context.Context, name string, attrs ...interface{}) (context.Context, func(error))
+}
+
+// Handler verifies and exchanges the tokens of requests before handing them
+// to Forward.
+type Handler struct {
+	// Config returns the current configuration.
+	Config  func() *Config
+	Issuers verify.Issuers
+	// Decrypt, unless nil, returns the nested JWT of encrypted tokens to
+	// verify, and other tokens unchanged.
+	Decrypt func(token string) (string, error)
+	// Retriever implements the identity provider specific steps, see
+	// exchange.New.
+	Retriever exchange.TokenRetriever
+	// Retrievers are used for configurations with a ProviderType.
+	Retrievers map[string]exchange.TokenRetriever
+	Webhook    *Webhook
+	// Policy is evaluated before the Webhook is asked.
+	Policy *Policy
+	// Decorate is called after the request has been decorated with the
+	// exchanged token, see LoadDecoratorPlugin.
+	Decorate Decorator
+	DryRun   string
+	// RateLimiter limits the requests per subject, or per client IP for
+	// requests without token, unless nil.
+	RateLimiter *RateLimiter
+	// ExchangeQuota limits the token exchanges per subject, unless nil.
+	ExchangeQuota *ExchangeQuota
+	// NotLinked remembers users without linked identity whose exchanges
+	// failed, unless nil.
+	NotLinked *NotLinkedCache
+	// Lockout rejects clients and subjects after repeated failed
+	// authentications or exchanges, unless nil.
+	Lockout *Lockout
+	// MaxHeaderCount rejects requests with more header fields, unless zero.
+	MaxHeaderCount int
+	// CertBinding rejects tokens bound to a client certificate (RFC 8705)
+	// unless presented with it. It is set when client certificates are
+	// verified.
+	CertBinding bool
+	// Forward sends the request upstream.
+	Forward func(w http.ResponseWriter, req *http.Request, cfg *Config)
+	// Error replies to rejected requests, http.Error if nil.
+	Error  func(w http.ResponseWriter, msg string, code int)
+	Hooks  Hooks
+	Logger *zap.SugaredLogger
+
+	dpopProofs dpopReplayCache
+}
+
+// ServeHTTP verifies, authorizes and exchanges the token of req and forwards
+// it, or in dry-run mode forwards req unchanged after logging the decision.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if h.DryRun == "" || h.DryRun == DryRunOff {
+		h.serve(w, req)
+		return
+	}
+
+	header := cloneHeader(req.Header)
+	dr := &dryRun{simulateExchange: h.DryRun == DryRunVerify}
+	dw := &dryRunWriter{header: http.Header{}}
+	h.serve(dw, req.WithContext(contextWithDryRun(req.Context(), dr)))
+
+	if dr.forwarded {
+		kv := []interface{}{"path", req.URL.Path}
+		if replaced := dr.header.Get("Authorization"); replaced != header.Get("Authorization") {
+			kv = append(kv, "authorization", maskAuthorization(replaced))
+		}
+		h.Logger.Infow("Dry run: would forward", kv...)
+	} else {
+		h.Logger.Infow(
+			"Dry run: would reject",
+			"path", req.URL.Path,
+			"status", dw.status,
+			"error", dw.message(),
+		)
+	}
+
+	req.Header = header
+	h.Forward(w, req, h.Config().Route(req))
+}
+
+func (h *Handler) forward(w http.ResponseWriter, req *http.Request, cfg *Config) {
+	if dr := dryRunFromContext(req.Context()); dr != nil {
+		dr.forwarded = true
+		dr.header = req.Header
+		return
+	}
+	h.Forward(w, req, cfg)
+}
+
+func (h *Handler) error(w http.ResponseWriter, msg string, code int) {
+	if h.Error != nil {
+		h.Error(w, msg, code)
+	} else {
+		http.Error(w, msg, code)
+	}
+}
+
+func (h *Handler) reject(w http.ResponseWriter, req *http.Request, event, reason, msg string, code int) {
+	if h.Hooks.Rejected != nil {
+		h.Hooks.Rejected(req, event, reason, msg)
+	}
+	h.error(w, msg, code)
+}
+
+func (h *Handler) startSpan(ctx context.Context, name string, attrs ...interface{}) (context.Context, func(error)) {
+	if h.Hooks.StartSpan == nil {
+		return ctx, func(error) {}
+	}
+	return h.Hooks.StartSpan(ctx, name, attrs...)
+}
+
+func (h *Handler) serve(w http.ResponseWriter, req *http.Request) {
+	// Routes, denied and anonymous paths match the path the upstream is
+	// sent, not one it resolves differently.
+	u := *req.URL
+	if !normalizePath(&u) {
+		h.reject(w, req, AuthorizationEvent, "invalid_path", "invalid request path", http.StatusBadRequest)
+		return
+	}
+	req.URL = &u
+
+	cfg := h.Config().Route(req)
+	req = req.WithContext(exchange.ContextWithGitRules(req.Context(), &cfg.GitRules))
+	retriever := h.Retriever
+	if len(cfg.ProviderType) > 0 {
+		var ok bool
+		if retriever, ok = h.Retrievers[cfg.ProviderType]; !ok {
+			h.error(w, "no token retriever for provider type "+cfg.ProviderType, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if !cfg.ipAllowed(net.ParseIP(ClientIP(req))) {
+		h.reject(w, req, AuthorizationEvent, "ip_denied", "forbidden", http.StatusForbidden)
+		return
+	}
+
+	if err := checkHeaders(req.Header, h.MaxHeaderCount); err != nil {
+		h.reject(w, req, AuthorizationEvent, "header_limit", err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !cfg.limitBody(w, req) {
+		h.error(w, "request body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	if cfg.DeniedPaths.Match(req.URL.Path) {
+		h.reject(w, req, AuthorizationEvent, "denied_path", "forbidden", http.StatusForbidden)
+		return
+	}
+
+	cfg.Headers.Strip(req.Header)
+	cfg.HeaderTemplates.Strip(req.Header)
+	cfg.stripTokenHeader(req.Header)
+	if cfg.Impersonation != nil {
+		cfg.Impersonation.Strip(req.Header)
+	}
+	if cfg.HMACSigner != nil {
+		cfg.HMACSigner.Strip(req.Header)
+	}
+
+	var aliasFromHeader string
+	if len(cfg.ProviderAliasHeader) > 0 {
+		if FromTrustedProxy(req) {
+			aliasFromHeader = req.Header.Get(cfg.ProviderAliasHeader)
+		}
+		req.Header.Del(cfg.ProviderAliasHeader)
+	}
+
+	if cfg.AnonymousPaths.Match(req.URL.Path) || cfg.LFSPassthrough && carriesUpstreamLFSAuth(req) {
+		if h.rateLimit(w, req, "ip:"+ClientIP(req)) {
+			h.forward(w, req, cfg)
+		}
+		return
+	}
+
+	git, isGitRequest := exchange.ClassifyGitRequest(req)
+
+	ipKey := "ip:" + ClientIP(req)
+	if h.lockedOut(w, req, ipKey) {
+		return
+	}
+
+	token, err := retriever.VerifyIncoming(req)
+	if err != nil {
+		h.attemptFailed(ipKey)
+		h.reject(w, req, AuthenticationEvent, "invalid_token", err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if len(token) == 0 && (cfg.RegistryAuth || cfg.ArtifactRepository) {
+		// docker login, Maven and npm store basic auth credentials.
+		_, token, _ = req.BasicAuth()
+	}
+
+	cert := clientCertificate(req)
+	if cert == nil && cfg.ClientCertAuth == ClientCertRequired {
+		h.reject(w, req, AuthenticationEvent, "missing_client_certificate", "client certificate required", http.StatusUnauthorized)
+		return
+	}
+	certAuth := len(token) == 0 && cert != nil && cfg.ClientCertAuth == ClientCertAlternative
+
+	if len(token) == 0 && !certAuth {
+		switch cfg.NoTokenPolicy {
+		case RejectNoToken:
+			if git.LFS {
+				w.Header().Set("LFS-Authenticate", `Basic realm="token-rp"`)
+			}
+			if isGitRequest || cfg.RegistryAuth || cfg.ArtifactRepository {
+				w.Header().Set("WWW-Authenticate", `Basic realm="token-rp"`)
+			} else {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+			}
+			h.reject(w, req, AuthenticationEvent, "missing_token", "missing token", http.StatusUnauthorized)
+			return
+		case StripNoToken:
+			req.Header.Del("Authorization")
+		}
+		if !h.rateLimit(w, req, ipKey) {
+			return
+		}
+	}
+
+	if len(token) > 0 || certAuth {
+		var issuerURL string
+		var claims jose.Claims
+		if certAuth {
+			claims = CertificateClaims(cert)
+		} else {
+			// Encrypted tokens are verified by their nested JWT, while
+			// the exchange presents the token as received.
+			verified := token
+			if h.Decrypt != nil {
+				if verified, err = h.Decrypt(token); err != nil {
+					h.attemptFailed(ipKey)
+					h.reject(w, req, AuthenticationEvent, "invalid_token", err.Error(), http.StatusUnauthorized)
+					return
+				}
+			}
+			issuer, err := h.Issuers.ForToken(verified)
+			if err != nil {
+				h.attemptFailed(ipKey)
+				h.reject(w, req, AuthenticationEvent, "untrusted_issuer", err.Error(), http.StatusUnauthorized)
+				return
+			}
+			issuerURL = issuer.URL
+
+			if claims, err = issuer.Verifier.Verify(verified); err != nil {
+				h.attemptFailed(ipKey)
+				h.reject(w, req, AuthenticationEvent, "invalid_token", err.Error(), http.StatusUnauthorized)
+				return
+			}
+			if err = h.checkDPoP(req, cfg.DPoP, token, claims); err != nil {
+				h.attemptFailed(ipKey)
+				w.Header().Set("WWW-Authenticate", `DPoP error="invalid_dpop_proof"`)
+				h.reject(w, req, AuthenticationEvent, "invalid_dpop_proof", err.Error(), http.StatusUnauthorized)
+				return
+			}
+			if h.CertBinding {
+				if err = checkCertificateBinding(claims, cert); err != nil {
+					h.attemptFailed(ipKey)
+					h.reject(w, req, AuthenticationEvent, "certificate_mismatch", err.Error(), http.StatusUnauthorized)
+					return
+				}
+			}
+		}
+
+		alias, err := cfg.providerAlias(aliasFromHeader, claims)
+		if err != nil {
+			h.reject(w, req, AuthorizationEvent, "invalid_provider_alias", err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		subject, _, _ := claims.StringClaim("sub")
+		subjectKey := "sub:" + subject
+		if h.lockedOut(w, req, subjectKey) {
+			return
+		}
+		if h.Hooks.Authenticated != nil {
+			h.Hooks.Authenticated(req, subject, alias)
+		}
+
+		if !h.rateLimit(w, req, subjectKey) {
+			return
+		}
+
+		if err = cfg.Requirements.Check(claims); err != nil {
+			h.reject(w, req, AuthorizationEvent, "insufficient_privileges", err.Error(), http.StatusForbidden)
+			return
+		}
+
+		if h.Policy != nil {
+			decision, err := h.Policy.Authorize(req, claims)
+			if err != nil {
+				h.Logger.Errorw(
+					"Authorization policy failed",
+					"error", err,
+				)
+				h.reject(w, req, AuthorizationEvent, "authz_failed", "authorization failed", http.StatusInternalServerError)
+				return
+			}
+			if !decision.Allowed {
+				msg := "forbidden"
+				if len(decision.Reason) > 0 {
+					msg += ": " + decision.Reason
+				}
+				h.reject(w, req, AuthorizationEvent, "authz_denied", msg, http.StatusForbidden)
+				return
+			}
+		}
+
+		if h.Webhook != nil {
+			decision, err := h.Webhook.Authorize(req, claims)
+			if err != nil {
+				h.Logger.Errorw(
+					"Authorization webhook unavailable",
+					"error", err,
+				)
+				h.reject(w, req, AuthorizationEvent, "authz_unavailable", "authorization unavailable", http.StatusServiceUnavailable)
+				return
+			}
+			if !decision.Allowed {
+				msg := "forbidden"
+				if len(decision.Reason) > 0 {
+					msg += ": " + decision.Reason
+				}
+				h.reject(w, req, AuthorizationEvent, "authz_denied", msg, http.StatusForbidden)
+				return
+			}
+		}
+
+		cfg.Headers.Apply(req.Header, claims)
+
+		var retrievedToken string
+		if cfg.Impersonation != nil {
+			retrievedToken, err = cfg.Impersonation.Apply(req.Header, claims)
+			if err != nil {
+				h.reject(w, req, AuthorizationEvent, "impersonation_failed", "forbidden: "+err.Error(), http.StatusForbidden)
+				return
+			}
+			h.attemptSucceeded(ipKey, subjectKey)
+		} else if cfg.TokenMinter != nil {
+			originalAuthorization := req.Header.Get("Authorization")
+			retrievedToken, err = cfg.TokenMinter.Apply(req.Header, claims)
+			if err != nil {
+				h.reject(w, req, AuthorizationEvent, "mint_failed", "forbidden: "+err.Error(), http.StatusForbidden)
+				return
+			}
+			h.attemptSucceeded(ipKey, subjectKey)
+			if !isGitRequest {
+				cfg.placeToken(req.Header, originalAuthorization, token, retrievedToken)
+			}
+		} else if cfg.HMACSigner != nil && cfg.HMACSigner.ReplaceToken {
+			// The signature added on the way upstream authenticates the
+			// request.
+			req.Header.Del("Authorization")
+			h.attemptSucceeded(ipKey, subjectKey)
+		} else {
+			dr := dryRunFromContext(req.Context())
+			if h.NotLinked != nil && h.NotLinked.Cached(notLinkedKey(issuerURL, alias, subject)) {
+				h.notLinked(w, req, issuerURL, alias)
+				return
+			}
+			if (dr == nil || !dr.simulateExchange) && !h.exchangeQuota(w, req, issuerURL, subject) {
+				return
+			}
+			_, endExchange := h.startSpan(req.Context(), "broker token exchange", "tokenrp.provider_alias", alias)
+			exchangeStart := time.Now()
+			if dr != nil && dr.simulateExchange {
+				retrievedToken = simulatedToken
+			} else {
+				ctx := req.Context()
+				if cfg.ExchangeTimeout > 0 {
+					var cancel context.CancelFunc
+					ctx, cancel = context.WithTimeout(ctx, cfg.ExchangeTimeout)
+					defer cancel()
+				}
+				retrievedToken, err = retriever.ExchangeToken(ctx, issuerURL, alias, token)
+			}
+			endExchange(err)
+			if h.Hooks.Exchanged != nil {
+				h.Hooks.Exchanged(req, alias, time.Since(exchangeStart), err)
+			}
+			var notLinkedErr *exchange.NotLinkedError
+			if errors.As(err, &notLinkedErr) {
+				// Not a failed authentication, so no reason for a lockout.
+				if h.NotLinked != nil {
+					h.NotLinked.Store(notLinkedKey(issuerURL, alias, subject))
+				}
+				h.notLinked(w, req, issuerURL, alias)
+				return
+			}
+			if err != nil {
+				h.attemptFailed(ipKey, subjectKey)
+				h.error(w, err.Error(), http.StatusUnauthorized)
+				return
+			}
+			h.attemptSucceeded(ipKey, subjectKey)
+
+			if isGitRequest && len(cfg.GitUsernameClaim) > 0 {
+				username, _ := claims[cfg.GitUsernameClaim].(string)
+				if len(username) == 0 {
+					h.reject(w, req, AuthorizationEvent, "missing_git_username", "forbidden: token lacks claim "+cfg.GitUsernameClaim, http.StatusForbidden)
+					return
+				}
+				req = req.WithContext(exchange.ContextWithGitUsername(req.Context(), username))
+			}
+
+			if dr != nil && dr.simulateExchange && isGitRequest {
+				// Decorating Git requests may call the provider's API, which
+				// would reject the simulated token.
+				req.SetBasicAuth("simulated-user", retrievedToken)
+			} else {
+				originalAuthorization := req.Header.Get("Authorization")
+				ctx, endDecorate := h.startSpan(req.Context(), "decorate request")
+				err = retriever.DecorateRequest(ctx, req, retrievedToken)
+				endDecorate(err)
+				if err != nil {
+					h.Logger.Warnw(
+						"Failed to apply provider token",
+						"error", err,
+					)
+					var rateLimitErr *exchange.RateLimitError
+					if errors.As(err, &rateLimitErr) {
+						retryAfter := math.Ceil(time.Until(rateLimitErr.Reset).Seconds())
+						w.Header().Set("Retry-After", strconv.Itoa(int(math.Max(retryAfter, 1))))
+						h.error(w, err.Error(), http.StatusTooManyRequests)
+						return
+					}
+					h.error(w, err.Error(), http.StatusUnauthorized)
+					return
+				}
+				if !isGitRequest {
+					cfg.placeToken(req.Header, originalAuthorization, token, retrievedToken)
+				}
+			}
+		}
+
+		if cfg.ArtifactRepository && len(retrievedToken) > 0 {
+			req.SetBasicAuth(cfg.artifactUsername(claims), retrievedToken)
+		}
+		if cfg.RegistryAuth {
+			username, _ := claims[cfg.RegistryUsernameClaim].(string)
+			if len(username) == 0 {
+				username = "token-rp"
+			}
+			req = req.WithContext(ContextWithRegistryCredentials(req.Context(), username, retrievedToken))
+		}
+
+		if err = cfg.HeaderTemplates.Apply(req.Header, claims, retrievedToken); err != nil {
+			h.reject(w, req, AuthorizationEvent, "header_template", "forbidden: "+err.Error(), http.StatusForbidden)
+			return
+		}
+
+		if h.Decorate != nil {
+			if err = h.Decorate(req, claims, retrievedToken); err != nil {
+				h.reject(w, req, AuthorizationEvent, "decorator_rejected", "forbidden: "+err.Error(), http.StatusForbidden)
+				return
+			}
+		}
+	}
+
+	h.forward(w, req, cfg)
+}
@@ -0,0 +1,285 @@
+//    Copyright 2017 Red Hat, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package proxy
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-oidc/jose"
+	"github.com/syndesisio/token-rp/pkg/exchange"
+	"github.com/syndesisio/token-rp/pkg/verify"
+	"go.uber.org/zap"
+)
+
+const testIssuer = "https://sso.example.com/auth/realms/syndesis"
+
+// unsignedToken returns a JWT with the given issuer and subject that only
+// staticVerifier accepts.
+func unsignedToken(iss, sub string) string {
+	enc := func(v interface{}) string {
+		b, _ := json.Marshal(v)
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	return enc(map[string]string{"alg": "none"}) + "." + enc(map[string]string{"iss": iss, "sub": sub}) + ".sig"
+}
+
+// staticVerifier accepts the tokens it holds claims for.
+type staticVerifier map[string]jose.Claims
+
+func (v staticVerifier) Verify(token string) (jose.Claims, error) {
+	claims, ok := v[token]
+	if !ok {
+		return nil, errors.New("invalid signature")
+	}
+	return claims, nil
+}
+
+// fakeRetriever takes bearer tokens and exchanges them for provider tokens
+// named after the alias, unless exchangeErr is set.
+type fakeRetriever struct {
+	exchangeErr error
+	exchanged   []string
+}
+
+func (r *fakeRetriever) VerifyIncoming(req *http.Request) (string, error) {
+	auth := req.Header.Get("Authorization")
+	if len(auth) == 0 {
+		return "", nil
+	}
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return "", errors.New("unsupported authorization scheme")
+	}
+	return strings.TrimPrefix(auth, "Bearer "), nil
+}
+
+func (r *fakeRetriever) ExchangeToken(ctx context.Context, issuerURL, alias, token string) (string, error) {
+	r.exchanged = append(r.exchanged, issuerURL+" "+alias)
+	if r.exchangeErr != nil {
+		return "", r.exchangeErr
+	}
+	return alias + "-token", nil
+}
+
+func (r *fakeRetriever) DecorateRequest(ctx context.Context, req *http.Request, token string) error {
+	req.Header.Set("Authorization", "token "+token)
+	return nil
+}
+
+// handlerTest records what a Handler forwards and rejects.
+type handlerTest struct {
+	handler       *Handler
+	retriever     *fakeRetriever
+	forwarded     *http.Request
+	reasons       []string
+	authenticated []string
+}
+
+func newHandlerTest(t *testing.T, cfg *Config) *handlerTest {
+	none, err := NewPathMatcher(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.AnonymousPaths == nil {
+		cfg.AnonymousPaths = none
+	}
+	if cfg.DeniedPaths == nil {
+		cfg.DeniedPaths = none
+	}
+	if len(cfg.ProviderAlias) == 0 {
+		cfg.ProviderAlias = "github"
+	}
+
+	ht := &handlerTest{retriever: &fakeRetriever{}}
+	ht.handler = &Handler{
+		Config: func() *Config { return cfg },
+		Issuers: verify.Issuers{{
+			URL: testIssuer,
+			ID:  testIssuer,
+			Verifier: staticVerifier{
+				unsignedToken(testIssuer, "alice"): {
+					"iss":          testIssuer,
+					"sub":          "alice",
+					"realm_access": map[string]interface{}{"roles": []interface{}{"developer"}},
+				},
+			},
+		}},
+		Retriever: ht.retriever,
+		Forward: func(w http.ResponseWriter, req *http.Request, cfg *Config) {
+			ht.forwarded = req
+			w.WriteHeader(http.StatusOK)
+		},
+		Hooks: Hooks{
+			Rejected: func(req *http.Request, event, reason, msg string) {
+				ht.reasons = append(ht.reasons, reason)
+			},
+			Authenticated: func(req *http.Request, subject, providerAlias string) {
+				ht.authenticated = append(ht.authenticated, subject+" "+providerAlias)
+			},
+		},
+		Logger: zap.NewNop().Sugar(),
+	}
+	return ht
+}
+
+// serve sends a request with the given Authorization header, if any.
+func (ht *handlerTest) serve(authorization string) *httptest.ResponseRecorder {
+	ht.forwarded, ht.reasons, ht.authenticated = nil, nil, nil
+	req := httptest.NewRequest("GET", "/repos", nil)
+	if len(authorization) > 0 {
+		req.Header.Set("Authorization", authorization)
+	}
+	w := httptest.NewRecorder()
+	ht.handler.ServeHTTP(w, req)
+	return w
+}
+
+func TestHandlerExchangesVerifiedTokens(t *testing.T) {
+	ht := newHandlerTest(t, &Config{})
+
+	w := ht.serve("Bearer " + unsignedToken(testIssuer, "alice"))
+	if w.Code != http.StatusOK || ht.forwarded == nil {
+		t.Fatalf("valid token answered %d (%v), want it forwarded", w.Code, ht.reasons)
+	}
+	if auth := ht.forwarded.Header.Get("Authorization"); auth != "token github-token" {
+		t.Errorf("forwarded Authorization = %q, want the exchanged token", auth)
+	}
+	if len(ht.retriever.exchanged) != 1 || ht.retriever.exchanged[0] != testIssuer+" github" {
+		t.Errorf("exchanges = %q, want one with the issuer for github", ht.retriever.exchanged)
+	}
+	if len(ht.authenticated) != 1 || ht.authenticated[0] != "alice github" {
+		t.Errorf("Authenticated hook calls = %q, want alice for github", ht.authenticated)
+	}
+}
+
+func TestHandlerRejections(t *testing.T) {
+	tests := []struct {
+		name          string
+		cfg           *Config
+		exchangeErr   error
+		authorization string
+		wantCode      int
+		wantReason    string
+	}{
+		{
+			name:          "invalid signature",
+			cfg:           &Config{},
+			authorization: "Bearer " + unsignedToken(testIssuer, "mallory"),
+			wantCode:      http.StatusUnauthorized,
+			wantReason:    "invalid_token",
+		},
+		{
+			name:          "untrusted issuer",
+			cfg:           &Config{},
+			authorization: "Bearer " + unsignedToken("https://evil.example.com", "alice"),
+			wantCode:      http.StatusUnauthorized,
+			wantReason:    "untrusted_issuer",
+		},
+		{
+			name:          "unsupported scheme",
+			cfg:           &Config{},
+			authorization: "Basic YWxpY2U6c2VjcmV0",
+			wantCode:      http.StatusUnauthorized,
+			wantReason:    "invalid_token",
+		},
+		{
+			name:       "missing token",
+			cfg:        &Config{NoTokenPolicy: RejectNoToken},
+			wantCode:   http.StatusUnauthorized,
+			wantReason: "missing_token",
+		},
+		{
+			name:          "missing role",
+			cfg:           &Config{Requirements: Requirements{Roles: []string{"admin"}}},
+			authorization: "Bearer " + unsignedToken(testIssuer, "alice"),
+			wantCode:      http.StatusForbidden,
+			wantReason:    "insufficient_privileges",
+		},
+		{
+			name:          "identity not linked",
+			cfg:           &Config{},
+			exchangeErr:   &exchange.NotLinkedError{Alias: "github"},
+			authorization: "Bearer " + unsignedToken(testIssuer, "alice"),
+			wantCode:      http.StatusForbidden,
+			wantReason:    "identity_not_linked",
+		},
+		{
+			name:          "exchange failure",
+			cfg:           &Config{},
+			exchangeErr:   errors.New("broker unavailable"),
+			authorization: "Bearer " + unsignedToken(testIssuer, "alice"),
+			wantCode:      http.StatusUnauthorized,
+		},
+	}
+	for _, tt := range tests {
+		ht := newHandlerTest(t, tt.cfg)
+		ht.retriever.exchangeErr = tt.exchangeErr
+
+		w := ht.serve(tt.authorization)
+		if w.Code != tt.wantCode {
+			t.Errorf("%s: answered %d, want %d", tt.name, w.Code, tt.wantCode)
+		}
+		if ht.forwarded != nil {
+			t.Errorf("%s: request was forwarded", tt.name)
+		}
+		if len(tt.wantReason) > 0 && (len(ht.reasons) != 1 || ht.reasons[0] != tt.wantReason) {
+			t.Errorf("%s: rejection reasons = %q, want %s", tt.name, ht.reasons, tt.wantReason)
+		}
+		if tt.exchangeErr == nil && len(ht.retriever.exchanged) > 0 {
+			t.Errorf("%s: rejected token was exchanged", tt.name)
+		}
+	}
+}
+
+func TestHandlerNoTokenPolicies(t *testing.T) {
+	for _, policy := range []string{StripNoToken, PassthroughNoToken} {
+		ht := newHandlerTest(t, &Config{NoTokenPolicy: policy})
+
+		w := ht.serve("")
+		if w.Code != http.StatusOK || ht.forwarded == nil {
+			t.Errorf("%s: answered %d (%v), want the request forwarded", policy, w.Code, ht.reasons)
+			continue
+		}
+		if len(ht.retriever.exchanged) > 0 || len(ht.authenticated) > 0 {
+			t.Errorf("%s: request without token was authenticated or exchanged", policy)
+		}
+	}
+}
+
+func TestHandlerLockout(t *testing.T) {
+	ht := newHandlerTest(t, &Config{})
+	ht.handler.Lockout = &Lockout{Threshold: 2, Window: time.Minute, Duration: time.Minute}
+
+	bad := "Bearer " + unsignedToken(testIssuer, "mallory")
+	for i := 0; i < 2; i++ {
+		if w := ht.serve(bad); w.Code != http.StatusUnauthorized {
+			t.Fatalf("invalid token %d answered %d, want 401", i+1, w.Code)
+		}
+	}
+	w := ht.serve("Bearer " + unsignedToken(testIssuer, "alice"))
+	if w.Code != http.StatusTooManyRequests || len(w.Header().Get("Retry-After")) == 0 {
+		t.Errorf("valid token after repeated failures answered %d, want 429 with Retry-After", w.Code)
+	}
+	if ht.forwarded != nil || len(ht.reasons) != 1 || ht.reasons[0] != "locked_out" {
+		t.Errorf("locked out client was forwarded or rejected for %q", ht.reasons)
+	}
+}
@@ -0,0 +1,41 @@
+//    Copyright 2017 Red Hat, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// checkHeaders rejects headers with more than maxCount fields, unless
+// maxCount is zero, and with several Authorization headers, which upstreams
+// may disagree on with the proxy.
+func checkHeaders(h http.Header, maxCount int) error {
+	if len(h["Authorization"]) > 1 {
+		return errors.New("multiple Authorization headers")
+	}
+	if maxCount <= 0 {
+		return nil
+	}
+	n := 0
+	for _, values := range h {
+		n += len(values)
+	}
+	if n > maxCount {
+		return fmt.Errorf("more than %d header fields", maxCount)
+	}
+	return nil
+}
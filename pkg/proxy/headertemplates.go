@@ -0,0 +1,88 @@
+//    Copyright 2017 Red Hat, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strings"
+	"text/template"
+
+	"github.com/coreos/go-oidc/jose"
+)
+
+// TemplateData is the data header templates are executed with.
+type TemplateData struct {
+	// Claims are the claims of the verified token.
+	Claims map[string]interface{}
+	// ExchangedToken is the token retrieved from the identity broker.
+	ExchangedToken string
+}
+
+// headerTemplate renders an upstream request header.
+type headerTemplate struct {
+	header string
+	tmpl   *template.Template
+}
+
+// HeaderTemplates set upstream request headers from text/template templates
+// executed with TemplateData, so credential formats can be produced without
+// code changes.
+type HeaderTemplates []headerTemplate
+
+// ParseHeaderTemplates parses templates of the form Header: template, e.g.
+// "X-Git-Committer: {{ .Claims.preferred_username }} <{{ .Claims.email }}>".
+func ParseHeaderTemplates(specs []string) (HeaderTemplates, error) {
+	var ht HeaderTemplates
+	for _, s := range specs {
+		parts := strings.SplitN(s, ":", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("invalid header template %q, expected Header: template", s)
+		}
+		header := http.CanonicalHeaderKey(strings.TrimSpace(parts[0]))
+		tmpl, err := template.New(header).Option("missingkey=error").Parse(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid header template %q: %v", s, err)
+		}
+		ht = append(ht, headerTemplate{header: header, tmpl: tmpl})
+	}
+	return ht, nil
+}
+
+// Strip removes the templated headers from h so clients can't spoof them.
+func (ht HeaderTemplates) Strip(h http.Header) {
+	for _, t := range ht {
+		h.Del(t.header)
+	}
+}
+
+// Apply sets the templated headers on h. It fails if a template refers to a
+// missing claim, leaving h unchanged.
+func (ht HeaderTemplates) Apply(h http.Header, claims jose.Claims, exchangedToken string) error {
+	data := TemplateData{Claims: claims, ExchangedToken: exchangedToken}
+	values := make([]string, len(ht))
+	for i, t := range ht {
+		var buf bytes.Buffer
+		if err := t.tmpl.Execute(&buf, data); err != nil {
+			return fmt.Errorf("unable to render header %s: %v", t.header, err)
+		}
+		values[i] = buf.String()
+	}
+	for i, t := range ht {
+		h.Set(t.header, values[i])
+	}
+	return nil
+}
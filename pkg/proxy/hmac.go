@@ -0,0 +1,284 @@
+//    Copyright 2017 Red Hat, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Components of forwarded requests an HMACSigner signs, besides
+// "header:<Name>" for the value of a header.
+const (
+	HMACMethod    = "method"
+	HMACPath      = "path"
+	HMACQuery     = "query"
+	HMACHost      = "host"
+	HMACTimestamp = "timestamp"
+	HMACBody      = "body"
+)
+
+// Encodings of HMAC signatures.
+const (
+	HexEncoding    = "hex"
+	Base64Encoding = "base64"
+)
+
+var hmacAlgorithms = map[string]func() hash.Hash{
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// HMACSigner adds a webhook-style HMAC signature to forwarded requests, for
+// upstreams that authenticate the proxy by a shared key. The signed string
+// is the values of Components, each followed by a newline; the body alone,
+// the default, is signed as is, as GitHub signs its webhooks.
+type HMACSigner struct {
+	// Header receives the signature, prefixed with Prefix and encoded
+	// with Encoding.
+	Header   string
+	Prefix   string
+	Encoding string
+	// Algorithm is sha1, sha256 or sha512.
+	Algorithm  string
+	Components []string
+	// TimestampHeader, unless empty, receives the Unix time of signing,
+	// the timestamp component.
+	TimestampHeader string
+	// KeyFile holds the key, without surrounding whitespace. It is re-read
+	// whenever it changes.
+	KeyFile string
+	// ReplaceToken forwards requests without exchanging their token, with
+	// the signature as their only credentials.
+	ReplaceToken bool
+
+	newHash func() hash.Hash
+
+	mu      sync.Mutex
+	key     []byte
+	modTime time.Time
+}
+
+// NewHMACSigner returns an HMACSigner setting header, checking the other
+// settings and that keyFile is readable.
+func NewHMACSigner(header, prefix, encoding, algorithm string, components []string, timestampHeader, keyFile string, replaceToken bool) (*HMACSigner, error) {
+	newHash, ok := hmacAlgorithms[algorithm]
+	if !ok {
+		return nil, fmt.Errorf("unknown algorithm %q, must be sha1, sha256 or sha512", algorithm)
+	}
+	if encoding != HexEncoding && encoding != Base64Encoding {
+		return nil, fmt.Errorf("unknown encoding %q, must be hex or base64", encoding)
+	}
+	if len(components) == 0 {
+		components = []string{HMACBody}
+	}
+	for _, c := range components {
+		switch c {
+		case HMACMethod, HMACPath, HMACQuery, HMACHost, HMACBody:
+		case HMACTimestamp:
+			if len(timestampHeader) == 0 {
+				return nil, fmt.Errorf("component %s requires a timestamp header", c)
+			}
+		default:
+			if !strings.HasPrefix(c, "header:") || len(c) == len("header:") {
+				return nil, fmt.Errorf("unknown component %q", c)
+			}
+		}
+	}
+	s := &HMACSigner{
+		Header:          http.CanonicalHeaderKey(header),
+		Prefix:          prefix,
+		Encoding:        encoding,
+		Algorithm:       algorithm,
+		Components:      components,
+		TimestampHeader: http.CanonicalHeaderKey(timestampHeader),
+		KeyFile:         keyFile,
+		ReplaceToken:    replaceToken,
+		newHash:         newHash,
+	}
+	if _, err := s.signingKey(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Strip removes the signature and timestamp headers from h so clients
+// can't forge them.
+func (s *HMACSigner) Strip(h http.Header) {
+	h.Del(s.Header)
+	if len(s.TimestampHeader) > 0 {
+		h.Del(s.TimestampHeader)
+	}
+}
+
+// Sign sets the signature of req, whose body is body, at now.
+func (s *HMACSigner) Sign(req *http.Request, body []byte, now time.Time) error {
+	key, err := s.signingKey()
+	if err != nil {
+		return err
+	}
+	if len(s.TimestampHeader) > 0 {
+		req.Header.Set(s.TimestampHeader, strconv.FormatInt(now.Unix(), 10))
+	}
+
+	mac := hmac.New(s.newHash, key)
+	if len(s.Components) == 1 && s.Components[0] == HMACBody {
+		mac.Write(body)
+	} else {
+		u := sentURL(req.URL)
+		for _, c := range s.Components {
+			switch c {
+			case HMACMethod:
+				mac.Write([]byte(req.Method))
+			case HMACPath:
+				mac.Write([]byte(u.EscapedPath()))
+			case HMACQuery:
+				mac.Write([]byte(u.RawQuery))
+			case HMACHost:
+				host := req.Host
+				if len(host) == 0 {
+					host = req.URL.Host
+				}
+				mac.Write([]byte(host))
+			case HMACTimestamp:
+				mac.Write([]byte(req.Header.Get(s.TimestampHeader)))
+			case HMACBody:
+				mac.Write(body)
+			default:
+				mac.Write([]byte(req.Header.Get(strings.TrimPrefix(c, "header:"))))
+			}
+			mac.Write([]byte("\n"))
+		}
+	}
+
+	sum := mac.Sum(nil)
+	signature := hex.EncodeToString(sum)
+	if s.Encoding == Base64Encoding {
+		signature = base64.StdEncoding.EncodeToString(sum)
+	}
+	req.Header.Set(s.Header, s.Prefix+signature)
+	return nil
+}
+
+// signsBody reports whether the body is a signed component.
+func (s *HMACSigner) signsBody() bool {
+	for _, c := range s.Components {
+		if c == HMACBody {
+			return true
+		}
+	}
+	return false
+}
+
+// signingKey returns the content of KeyFile, reading it again if it was
+// modified.
+func (s *HMACSigner) signingKey() ([]byte, error) {
+	fi, err := os.Stat(s.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read HMAC key: %v", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.key) > 0 && fi.ModTime().Equal(s.modTime) {
+		return s.key, nil
+	}
+	b, err := ioutil.ReadFile(s.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read HMAC key: %v", err)
+	}
+	key := bytes.TrimSpace(b)
+	if len(key) == 0 {
+		return nil, fmt.Errorf("HMAC key %s is empty", s.KeyFile)
+	}
+	s.key, s.modTime = key, fi.ModTime()
+	return s.key, nil
+}
+
+// sentURL returns the URL with the path and query req is sent with: the
+// forwarder passes the request URI on as opaque URL.
+func sentURL(u *url.URL) *url.URL {
+	if len(u.Opaque) == 0 {
+		return u
+	}
+	if sent, err := url.ParseRequestURI(u.Opaque); err == nil {
+		return sent
+	}
+	return u
+}
+
+type hmacSignerKey struct{}
+
+// ContextWithHMACSigner returns a copy of ctx whose requests are signed by
+// s on their way upstream, see HMACTransport.
+func ContextWithHMACSigner(ctx context.Context, s *HMACSigner) context.Context {
+	return context.WithValue(ctx, hmacSignerKey{}, s)
+}
+
+// HMACTransport returns a RoundTripper signing requests whose context
+// carries an HMACSigner before passing them to rt, once their upstream URL
+// and headers are final.
+func HMACTransport(rt http.RoundTripper) http.RoundTripper {
+	return &hmacTransport{rt: rt}
+}
+
+type hmacTransport struct {
+	rt http.RoundTripper
+}
+
+func (t *hmacTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	s, ok := req.Context().Value(hmacSignerKey{}).(*HMACSigner)
+	if !ok {
+		return t.rt.RoundTrip(req)
+	}
+
+	// RoundTrippers must not modify the request.
+	out := req.Clone(req.Context())
+	var body []byte
+	if s.signsBody() && req.Body != nil && req.Body != http.NoBody {
+		// The size of the body is limited by the proxy.
+		var err error
+		body, err = ioutil.ReadAll(req.Body)
+		_ = req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		out.Body = ioutil.NopCloser(bytes.NewReader(body))
+		out.ContentLength = int64(len(body))
+		out.TransferEncoding = nil
+	}
+	if err := s.Sign(out, body, time.Now()); err != nil {
+		return nil, err
+	}
+	return t.rt.RoundTrip(out)
+}
@@ -0,0 +1,160 @@
+//    Copyright 2017 Red Hat, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package proxy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/jose"
+)
+
+// Impersonation replaces the token exchange: requests are forwarded with the
+// proxy's own service account token and Impersonate-User and
+// Impersonate-Group headers naming the user of the verified token, as the
+// OpenShift and Kubernetes APIs understand. Users and groups in the system:
+// namespace, such as system:masters, are never impersonated.
+type Impersonation struct {
+	// TokenFile holds the service account token. It is re-read whenever it
+	// changes, as projected tokens are rotated.
+	TokenFile string
+	// UserClaim and GroupsClaim name the claims of the verified token
+	// holding the user and groups to impersonate.
+	UserClaim   string
+	GroupsClaim string
+	// UserPrefix and GroupsPrefix are prepended to the user and groups, like
+	// the --oidc-username-prefix and --oidc-groups-prefix of kube-apiserver,
+	// to keep them apart from those of other authenticators.
+	UserPrefix   string
+	GroupsPrefix string
+
+	mu      sync.Mutex
+	token   string
+	modTime time.Time
+}
+
+// systemPrefix starts the reserved names of Kubernetes users and groups.
+const systemPrefix = "system:"
+
+// NewImpersonation returns an Impersonation with the service account token
+// in tokenFile, which must be readable.
+func NewImpersonation(tokenFile, userClaim, groupsClaim, userPrefix, groupsPrefix string) (*Impersonation, error) {
+	if len(userClaim) == 0 {
+		return nil, fmt.Errorf("user claim required")
+	}
+	for _, prefix := range []string{userPrefix, groupsPrefix} {
+		if strings.HasPrefix(prefix, systemPrefix) {
+			return nil, fmt.Errorf("prefix %q is reserved", prefix)
+		}
+	}
+	i := &Impersonation{
+		TokenFile:    tokenFile,
+		UserClaim:    userClaim,
+		GroupsClaim:  groupsClaim,
+		UserPrefix:   userPrefix,
+		GroupsPrefix: groupsPrefix,
+	}
+	if _, err := i.serviceAccountToken(); err != nil {
+		return nil, err
+	}
+	return i, nil
+}
+
+// Strip removes the impersonation headers from h so clients can't choose
+// whom the service account impersonates.
+func (i *Impersonation) Strip(h http.Header) {
+	for k := range h {
+		if strings.HasPrefix(k, "Impersonate-") {
+			delete(h, k)
+		}
+	}
+}
+
+// Apply sets the service account token as Bearer Authorization of h and the
+// impersonation headers from claims, returning the token. It fails if the
+// user or one of the groups is in the system: namespace.
+func (i *Impersonation) Apply(h http.Header, claims jose.Claims) (string, error) {
+	user, _ := claims[i.UserClaim].(string)
+	if len(user) == 0 {
+		return "", fmt.Errorf("token lacks claim %s", i.UserClaim)
+	}
+	user = i.UserPrefix + user
+	if strings.HasPrefix(user, systemPrefix) {
+		return "", fmt.Errorf("user %s can't be impersonated", user)
+	}
+
+	var groups []string
+	if len(i.GroupsClaim) > 0 {
+		switch v := claims[i.GroupsClaim].(type) {
+		case string:
+			groups = append(groups, v)
+		case []interface{}:
+			for _, g := range v {
+				if s, ok := g.(string); ok && len(s) > 0 {
+					groups = append(groups, s)
+				}
+			}
+		}
+	}
+	for n, g := range groups {
+		groups[n] = i.GroupsPrefix + g
+		if strings.HasPrefix(groups[n], systemPrefix) {
+			return "", fmt.Errorf("group %s can't be impersonated", groups[n])
+		}
+	}
+
+	token, err := i.serviceAccountToken()
+	if err != nil {
+		return "", err
+	}
+
+	h.Set("Authorization", "Bearer "+token)
+	h.Set("Impersonate-User", user)
+	for _, g := range groups {
+		h.Add("Impersonate-Group", g)
+	}
+	return token, nil
+}
+
+// serviceAccountToken returns the content of TokenFile, reading it again if
+// it was modified.
+func (i *Impersonation) serviceAccountToken() (string, error) {
+	fi, err := os.Stat(i.TokenFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to read service account token: %v", err)
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if len(i.token) > 0 && fi.ModTime().Equal(i.modTime) {
+		return i.token, nil
+	}
+	b, err := ioutil.ReadFile(i.TokenFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to read service account token: %v", err)
+	}
+	token := strings.TrimSpace(string(b))
+	if len(token) == 0 {
+		return "", fmt.Errorf("service account token %s is empty", i.TokenFile)
+	}
+	i.token, i.modTime = token, fi.ModTime()
+	return i.token, nil
+}
@@ -0,0 +1,151 @@
+//    Copyright 2017 Red Hat, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package proxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/coreos/go-oidc/jose"
+)
+
+func writeServiceAccountToken(t *testing.T, token string) string {
+	dir, err := ioutil.TempDir("", "impersonate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+	path := filepath.Join(dir, "token")
+	if err = ioutil.WriteFile(path, []byte(token+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestImpersonationApply(t *testing.T) {
+	tokenFile := writeServiceAccountToken(t, "sa-token")
+
+	tests := []struct {
+		name                     string
+		userPrefix, groupsPrefix string
+		claims                   jose.Claims
+		wantUser                 string
+		wantGroups               []string
+		wantErr                  bool
+	}{
+		{
+			name:       "claims",
+			claims:     jose.Claims{"preferred_username": "alice", "groups": []interface{}{"dev", "ops"}},
+			wantUser:   "alice",
+			wantGroups: []string{"dev", "ops"},
+		},
+		{
+			name:       "single group",
+			claims:     jose.Claims{"preferred_username": "alice", "groups": "dev"},
+			wantUser:   "alice",
+			wantGroups: []string{"dev"},
+		},
+		{
+			name:         "prefixes",
+			userPrefix:   "keycloak:",
+			groupsPrefix: "keycloak:",
+			claims:       jose.Claims{"preferred_username": "alice", "groups": []interface{}{"dev"}},
+			wantUser:     "keycloak:alice",
+			wantGroups:   []string{"keycloak:dev"},
+		},
+		{
+			name:         "prefixed system names",
+			userPrefix:   "keycloak:",
+			groupsPrefix: "keycloak:",
+			claims:       jose.Claims{"preferred_username": "system:admin", "groups": []interface{}{"system:masters"}},
+			wantUser:     "keycloak:system:admin",
+			wantGroups:   []string{"keycloak:system:masters"},
+		},
+		{
+			name:    "system user",
+			claims:  jose.Claims{"preferred_username": "system:admin"},
+			wantErr: true,
+		},
+		{
+			name:    "system group",
+			claims:  jose.Claims{"preferred_username": "alice", "groups": []interface{}{"dev", "system:masters"}},
+			wantErr: true,
+		},
+		{
+			name:    "no user",
+			claims:  jose.Claims{"groups": []interface{}{"dev"}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		i, err := NewImpersonation(tokenFile, "preferred_username", "groups", tt.userPrefix, tt.groupsPrefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h := http.Header{"Authorization": {"Bearer user-token"}}
+		token, err := i.Apply(h, tt.claims)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: Apply() succeeded with user %q and groups %q", tt.name, h.Get("Impersonate-User"), h["Impersonate-Group"])
+			}
+			if h.Get("Authorization") != "Bearer user-token" || len(h.Get("Impersonate-User")) > 0 {
+				t.Errorf("%s: failed Apply() changed the headers to %v", tt.name, h)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: Apply() failed: %v", tt.name, err)
+			continue
+		}
+		if token != "sa-token" || h.Get("Authorization") != "Bearer sa-token" {
+			t.Errorf("%s: Apply() = %q with Authorization %q, want the service account token", tt.name, token, h.Get("Authorization"))
+		}
+		if user := h.Get("Impersonate-User"); user != tt.wantUser {
+			t.Errorf("%s: Impersonate-User = %q, want %q", tt.name, user, tt.wantUser)
+		}
+		if groups := h["Impersonate-Group"]; !reflect.DeepEqual(groups, tt.wantGroups) {
+			t.Errorf("%s: Impersonate-Group = %q, want %q", tt.name, groups, tt.wantGroups)
+		}
+	}
+}
+
+func TestNewImpersonationRejectsSystemPrefixes(t *testing.T) {
+	tokenFile := writeServiceAccountToken(t, "sa-token")
+
+	if _, err := NewImpersonation(tokenFile, "preferred_username", "groups", "system:", ""); err == nil {
+		t.Error("NewImpersonation() accepted the user prefix system:")
+	}
+	if _, err := NewImpersonation(tokenFile, "preferred_username", "groups", "", "system:serviceaccounts:"); err == nil {
+		t.Error("NewImpersonation() accepted the groups prefix system:serviceaccounts:")
+	}
+}
+
+func TestImpersonationStrip(t *testing.T) {
+	h := http.Header{
+		"Impersonate-User":          {"admin"},
+		"Impersonate-Group":         {"system:masters"},
+		"Impersonate-Extra-Scopes":  {"all"},
+		"Impersonate-Uid":           {"1"},
+		"X-Impersonate-Not-Special": {"kept"},
+	}
+	(&Impersonation{}).Strip(h)
+	if !reflect.DeepEqual(h, http.Header{"X-Impersonate-Not-Special": {"kept"}}) {
+		t.Errorf("Strip() left %v", h)
+	}
+}
@@ -0,0 +1,34 @@
+//    Copyright 2017 Red Hat, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package proxy
+
+import (
+	"net/http"
+
+	"github.com/syndesisio/token-rp/pkg/exchange"
+)
+
+// carriesUpstreamLFSAuth reports whether req is a Git LFS object transfer
+// authorized by credentials the upstream handed out in its batch response.
+// Clients authenticate to the proxy with basic auth, so any other
+// Authorization header was issued by the upstream.
+func carriesUpstreamLFSAuth(req *http.Request) bool {
+	g, ok := exchange.ClassifyGitRequest(req)
+	if !ok || !g.LFSTransfer || len(req.Header.Get("Authorization")) == 0 {
+		return false
+	}
+	_, _, basic := req.BasicAuth()
+	return !basic
+}
@@ -0,0 +1,138 @@
+//    Copyright 2017 Red Hat, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package proxy
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Lockout rejects attempts from a client IP or subject for Duration after
+// Threshold consecutive failed authentications or exchanges within Window.
+type Lockout struct {
+	Threshold int
+	Window    time.Duration
+	Duration  time.Duration
+
+	mu        sync.Mutex
+	entries   map[string]*lockoutEntry
+	lastSweep time.Time
+}
+
+type lockoutEntry struct {
+	failures    int
+	first       time.Time
+	lockedUntil time.Time
+}
+
+// Locked reports whether key is locked out and for how much longer.
+func (l *Lockout) Locked(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	e, ok := l.entries[key]
+	if !ok {
+		return false, 0
+	}
+	left := time.Until(e.lockedUntil)
+	return left > 0, left
+}
+
+// Failed records a failed attempt of key, locking it out once it reaches
+// the threshold.
+func (l *Lockout) Failed(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if l.entries == nil {
+		l.entries = make(map[string]*lockoutEntry)
+	}
+	if now.Sub(l.lastSweep) > l.Window {
+		l.sweep(now)
+	}
+
+	e, ok := l.entries[key]
+	if !ok || now.Sub(e.first) > l.Window {
+		e = &lockoutEntry{first: now}
+		l.entries[key] = e
+	}
+	e.failures++
+	if e.failures >= l.Threshold {
+		e.lockedUntil = now.Add(l.Duration)
+		e.failures = 0
+		e.first = now
+	}
+}
+
+// Succeeded resets the failures of key.
+func (l *Lockout) Succeeded(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if e, ok := l.entries[key]; ok && time.Now().After(e.lockedUntil) {
+		delete(l.entries, key)
+	}
+}
+
+// sweep forgets the entries that are neither locked out nor within the
+// window of their first failure.
+func (l *Lockout) sweep(now time.Time) {
+	for key, e := range l.entries {
+		if now.After(e.lockedUntil) && now.Sub(e.first) > l.Window {
+			delete(l.entries, key)
+		}
+	}
+	l.lastSweep = now
+}
+
+// lockedOut reports whether any of keys is locked out, rejecting req with
+// 429 if so.
+func (h *Handler) lockedOut(w http.ResponseWriter, req *http.Request, keys ...string) bool {
+	if h.Lockout == nil {
+		return false
+	}
+	for _, key := range keys {
+		if locked, left := h.Lockout.Locked(key); locked {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(left.Seconds()))))
+			h.reject(w, req, AuthenticationEvent, "locked_out", "too many failed attempts", http.StatusTooManyRequests)
+			return true
+		}
+	}
+	return false
+}
+
+// attemptFailed records a failed authentication or exchange of keys.
+func (h *Handler) attemptFailed(keys ...string) {
+	if h.Lockout == nil {
+		return
+	}
+	for _, key := range keys {
+		h.Lockout.Failed(key)
+	}
+}
+
+// attemptSucceeded resets the failed attempts of keys.
+func (h *Handler) attemptSucceeded(keys ...string) {
+	if h.Lockout == nil {
+		return
+	}
+	for _, key := range keys {
+		h.Lockout.Succeeded(key)
+	}
+}
@@ -0,0 +1,179 @@
+//    Copyright 2017 Red Hat, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package proxy
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/jose"
+	jwtgo "github.com/dgrijalva/jwt-go"
+	"github.com/syndesisio/token-rp/pkg/verify"
+)
+
+// TokenMinter replaces the token exchange: requests are forwarded with a
+// short-lived JWT signed by token-rp, carrying selected claims of the
+// verified token, so neither the client's nor the provider's tokens reach
+// the upstream, which only needs the public key to validate it.
+type TokenMinter struct {
+	// KeyFile holds the PEM encoded RSA or ECDSA private key signing the
+	// tokens. It is re-read whenever it changes, so keys can be rotated.
+	KeyFile string
+	// KeyID is sent as 'kid' header unless empty.
+	KeyID string
+	// Issuer and Audience are the 'iss' and 'aud' of the tokens; no 'aud'
+	// is set if Audience is empty.
+	Issuer   string
+	Audience string
+	Lifetime time.Duration
+	// Claims are copied from the verified token in addition to 'sub'.
+	Claims []string
+
+	mu      sync.Mutex
+	key     crypto.Signer
+	method  jwtgo.SigningMethod
+	modTime time.Time
+}
+
+// NewTokenMinter returns a TokenMinter signing with the key in keyFile,
+// which must be readable.
+func NewTokenMinter(keyFile, keyID, issuer, audience string, lifetime time.Duration, claims []string) (*TokenMinter, error) {
+	if len(issuer) == 0 {
+		return nil, fmt.Errorf("issuer required")
+	}
+	if lifetime <= 0 {
+		return nil, fmt.Errorf("lifetime must be positive")
+	}
+	m := &TokenMinter{
+		KeyFile:  keyFile,
+		KeyID:    keyID,
+		Issuer:   issuer,
+		Audience: audience,
+		Lifetime: lifetime,
+		Claims:   claims,
+	}
+	if _, _, err := m.signingKey(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Apply sets a token minted from claims as Bearer Authorization of h,
+// returning the token.
+func (m *TokenMinter) Apply(h http.Header, claims jose.Claims) (string, error) {
+	token, err := m.Mint(claims)
+	if err != nil {
+		return "", err
+	}
+	h.Set("Authorization", "Bearer "+token)
+	return token, nil
+}
+
+// Mint returns a token for the subject of claims, the verified token.
+func (m *TokenMinter) Mint(claims jose.Claims) (string, error) {
+	sub, _ := claims["sub"].(string)
+	if len(sub) == 0 {
+		return "", fmt.Errorf("token lacks claim sub")
+	}
+	key, method, err := m.signingKey()
+	if err != nil {
+		return "", err
+	}
+
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return "", err
+	}
+	now := time.Now()
+	minted := jwtgo.MapClaims{}
+	for _, c := range m.Claims {
+		if v, ok := claims[c]; ok {
+			minted[c] = v
+		}
+	}
+	// The registered claims can't be overridden by copied ones.
+	minted["iss"] = m.Issuer
+	minted["sub"] = sub
+	minted["jti"] = hex.EncodeToString(jti)
+	minted["iat"] = now.Unix()
+	minted["nbf"] = now.Unix()
+	minted["exp"] = now.Add(m.Lifetime).Unix()
+	if len(m.Audience) > 0 {
+		minted["aud"] = m.Audience
+	} else {
+		delete(minted, "aud")
+	}
+
+	t := jwtgo.NewWithClaims(method, minted)
+	if len(m.KeyID) > 0 {
+		t.Header["kid"] = m.KeyID
+	}
+	return t.SignedString(key)
+}
+
+// signingKey returns the key in KeyFile and its signing method, reading it
+// again if it was modified.
+func (m *TokenMinter) signingKey() (crypto.Signer, jwtgo.SigningMethod, error) {
+	fi, err := os.Stat(m.KeyFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read signing key: %v", err)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.key != nil && fi.ModTime().Equal(m.modTime) {
+		return m.key, m.method, nil
+	}
+	key, err := verify.LoadClientKey(m.KeyFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read signing key: %v", err)
+	}
+	method, err := signingMethod(key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %v", m.KeyFile, err)
+	}
+	m.key, m.method, m.modTime = key, method, fi.ModTime()
+	return m.key, m.method, nil
+}
+
+// signingMethod returns the method tokens are signed with by key: RS256 for
+// RSA keys and the ECDSA method matching the curve of EC keys.
+func signingMethod(key crypto.Signer) (jwtgo.SigningMethod, error) {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return jwtgo.SigningMethodRS256, nil
+	case *ecdsa.PrivateKey:
+		switch k.Curve {
+		case elliptic.P256():
+			return jwtgo.SigningMethodES256, nil
+		case elliptic.P384():
+			return jwtgo.SigningMethodES384, nil
+		case elliptic.P521():
+			return jwtgo.SigningMethodES512, nil
+		}
+		return nil, fmt.Errorf("unsupported elliptic curve")
+	}
+	return nil, fmt.Errorf("unsupported key type %T", key)
+}
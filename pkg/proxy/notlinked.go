@@ -0,0 +1,80 @@
+//    Copyright 2017 Red Hat, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package proxy
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// NotLinkedCache remembers for TTL that subjects have no linked identity of
+// an identity provider, so clients retrying in a loop don't ask the broker
+// again on every request.
+type NotLinkedCache struct {
+	TTL time.Duration
+
+	mu        sync.Mutex
+	entries   map[string]time.Time
+	lastSweep time.Time
+}
+
+// Cached reports whether key was found to have no linked identity within
+// the TTL.
+func (c *NotLinkedCache) Cached(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	expiresAt, ok := c.entries[key]
+	return ok && time.Now().Before(expiresAt)
+}
+
+// Store records that key has no linked identity.
+func (c *NotLinkedCache) Store(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if c.entries == nil {
+		c.entries = make(map[string]time.Time)
+	}
+	if now.Sub(c.lastSweep) > c.TTL {
+		for k, expiresAt := range c.entries {
+			if now.After(expiresAt) {
+				delete(c.entries, k)
+			}
+		}
+		c.lastSweep = now
+	}
+	c.entries[key] = now.Add(c.TTL)
+}
+
+// notLinkedKey identifies subject of issuerURL for identity provider alias.
+func notLinkedKey(issuerURL, alias, subject string) string {
+	return issuerURL + " " + alias + " " + subject
+}
+
+// notLinked rejects req of a user without linked identity of alias with
+// 403, pointing to the account console to link it.
+func (h *Handler) notLinked(w http.ResponseWriter, req *http.Request, issuerURL, alias string) {
+	provider := "the identity provider"
+	if len(alias) > 0 {
+		provider = "identity provider " + alias
+	}
+	w.Header().Set("WWW-Authenticate", `Bearer error="identity_not_linked"`)
+	h.reject(w, req, AuthorizationEvent, "identity_not_linked",
+		"user has no linked identity of "+provider+"; link your account at "+issuerURL+"/account",
+		http.StatusForbidden)
+}
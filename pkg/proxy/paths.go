@@ -0,0 +1,121 @@
+//    Copyright 2017 Red Hat, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package proxy
+
+import (
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// PathMatcher matches request paths against glob patterns, or regular
+// expressions when a pattern is prefixed with ~.
+type PathMatcher struct {
+	globs   []string
+	regexps []*regexp.Regexp
+}
+
+// NewPathMatcher compiles patterns.
+func NewPathMatcher(patterns []string) (*PathMatcher, error) {
+	m := &PathMatcher{}
+	for _, p := range patterns {
+		if strings.HasPrefix(p, "~") {
+			re, err := regexp.Compile(p[1:])
+			if err != nil {
+				return nil, err
+			}
+			m.regexps = append(m.regexps, re)
+			continue
+		}
+
+		// Validate the pattern up front, path.Match only reports
+		// ErrBadPattern when it gets to the malformed part.
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, err
+		}
+		m.globs = append(m.globs, p)
+	}
+	return m, nil
+}
+
+// Match reports whether p, cleaned like a request path, matches any of the
+// patterns.
+func (m *PathMatcher) Match(p string) bool {
+	p = cleanPath(p)
+	for _, g := range m.globs {
+		if ok, _ := path.Match(g, p); ok {
+			return true
+		}
+	}
+	for _, re := range m.regexps {
+		if re.MatchString(p) {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizePath cleans the path of u in place, so the proxy authorizes the
+// same path the upstream is sent. It reports false if the path contains
+// dot segments, plain or percent-encoded, also followed by ;parameters, which
+// the upstream could resolve to a path that doesn't match what the proxy
+// matched. Encoded slashes are kept, Path is the unescaped form of RawPath.
+func normalizePath(u *url.URL) bool {
+	if !strings.HasPrefix(u.Path, "/") {
+		// The asterisk of OPTIONS * or the authority of CONNECT.
+		return true
+	}
+	escaped := u.EscapedPath()
+	for _, seg := range strings.Split(escaped, "/") {
+		s, err := url.PathUnescape(seg)
+		if err != nil {
+			return false
+		}
+		// Encoded slashes and backslashes separate segments for some
+		// upstreams, and servlet containers drop ;parameters, so that
+		// ..;x is .. to them.
+		for _, name := range strings.FieldsFunc(s, func(r rune) bool { return r == '/' || r == '\\' }) {
+			if i := strings.IndexByte(name, ';'); i >= 0 {
+				name = name[:i]
+			}
+			if name == "." || name == ".." {
+				return false
+			}
+		}
+	}
+	escaped = cleanPath(escaped)
+	p, err := url.PathUnescape(escaped)
+	if err != nil {
+		return false
+	}
+	u.Path, u.RawPath = p, ""
+	if u.EscapedPath() != escaped {
+		u.RawPath = escaped
+	}
+	return true
+}
+
+// cleanPath is path.Clean keeping a trailing slash, like http.ServeMux.
+func cleanPath(p string) string {
+	if len(p) == 0 {
+		return "/"
+	}
+	cleaned := path.Clean(p)
+	if strings.HasSuffix(p, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	return cleaned
+}
@@ -0,0 +1,131 @@
+//    Copyright 2017 Red Hat, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package proxy
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestPathMatcher(t *testing.T) {
+	m, err := NewPathMatcher([]string{"/public/*", "/health", `~^/api/v[0-9]+/status$`})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{"/health", true},
+		{"/health/", false},
+		{"/healthz", false},
+		{"/public/index.html", true},
+		{"/public/css/site.css", false},
+		{"/public", false},
+		{"/api/v1/status", true},
+		{"/api/v12/status", true},
+		{"/api/v1/status/x", false},
+		{"/api/vx/status", false},
+		// Matched like the upstream resolves them.
+		{"/public/../private", false},
+		{"/private/../health", true},
+		{"//health", true},
+		{"/public/./a", true},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := m.Match(tt.path); got != tt.want {
+			t.Errorf("Match(%q) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestNewPathMatcherInvalid(t *testing.T) {
+	for _, pattern := range []string{"/[", "~(", "/a/[^"} {
+		if _, err := NewPathMatcher([]string{pattern}); err == nil {
+			t.Errorf("NewPathMatcher(%q) succeeded, want error", pattern)
+		}
+	}
+}
+
+func TestNormalizePath(t *testing.T) {
+	tests := []struct {
+		rawURL   string
+		ok       bool
+		wantPath string
+		wantRaw  string
+	}{
+		{"/a/b", true, "/a/b", ""},
+		{"/a//b/", true, "/a/b/", ""},
+		{"/a/%2Fb", true, "/a//b", "/a/%2Fb"},
+		{"/a//%2fb//", true, "/a//b/", "/a/%2fb/"},
+		{"/api/v4/projects/group%2Fproject", true, "/api/v4/projects/group/project", "/api/v4/projects/group%2Fproject"},
+		{"/a/b;c=1", true, "/a/b;c=1", ""},
+		{"/a%20b/c", true, "/a b/c", ""},
+		{"*", true, "*", ""},
+		{"/a/../b", false, "", ""},
+		{"/a/./b", false, "", ""},
+		{"/a/..", false, "", ""},
+		{"/a/%2e%2e/b", false, "", ""},
+		{"/a/%2E/b", false, "", ""},
+		{"/a/.%2e/b", false, "", ""},
+		{"/a/..%2fb", false, "", ""},
+		{"/a/..%5cb", false, "", ""},
+		{"/a/..;/b", false, "", ""},
+		{"/a/.;x/b", false, "", ""},
+		{"/a/%2e%2e;jsessionid=1/b", false, "", ""},
+		{"/a/..%3B/b", false, "", ""},
+		{"/a/..%252fb", true, "/a/..%2fb", ""},
+		{"/a/...", true, "/a/...", ""},
+		{"/a/.b/..c", true, "/a/.b/..c", ""},
+	}
+	for _, tt := range tests {
+		u, err := url.ParseRequestURI(tt.rawURL)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.rawURL, err)
+		}
+		ok := normalizePath(u)
+		if ok != tt.ok {
+			t.Errorf("normalizePath(%q) = %v, want %v", tt.rawURL, ok, tt.ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if u.Path != tt.wantPath || u.RawPath != tt.wantRaw {
+			t.Errorf("normalizePath(%q) left Path %q and RawPath %q, want %q and %q", tt.rawURL, u.Path, u.RawPath, tt.wantPath, tt.wantRaw)
+		}
+	}
+}
+
+func TestCleanPath(t *testing.T) {
+	tests := []struct {
+		path, want string
+	}{
+		{"", "/"},
+		{"/", "/"},
+		{"//", "/"},
+		{"/a/b/", "/a/b/"},
+		{"/a/b/../c", "/a/c"},
+		{"/a/b/../", "/a/"},
+		{"a/b", "a/b"},
+	}
+	for _, tt := range tests {
+		if got := cleanPath(tt.path); got != tt.want {
+			t.Errorf("cleanPath(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+//    Copyright 2017 Red Hat, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"plugin"
+)
+
+// DecorateSymbol is the name of the function a decorator plugin exports.
+const DecorateSymbol = "Decorate"
+
+// Decorator is called after the token exchange with the verified claims and
+// the exchanged token. It may change the headers of req, and rejects the
+// request by returning an error.
+//
+// Its signature only uses standard library types, so that plugins need not
+// be built against this package.
+type Decorator func(req *http.Request, claims map[string]interface{}, token string) error
+
+// LoadDecoratorPlugin opens the Go plugin at path and returns its exported
+// Decorate function, which must have the signature of Decorator.
+//
+// Plugins are only supported by cgo enabled builds on Linux and macOS and
+// must be built with the same Go version and vendored packages as token-rp.
+// LoadDecoratorWASM loads decorators working in any build instead.
+func LoadDecoratorPlugin(path string) (Decorator, error) {
+	p, err := plugin.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	sym, err := p.Lookup(DecorateSymbol)
+	if err != nil {
+		return nil, err
+	}
+	switch f := sym.(type) {
+	case func(*http.Request, map[string]interface{}, string) error:
+		return f, nil
+	case *Decorator:
+		return *f, nil
+	default:
+		return nil, fmt.Errorf("plugin %s: %s has type %T, want %T", path, DecorateSymbol, sym, Decorator(nil))
+	}
+}
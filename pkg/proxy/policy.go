@@ -0,0 +1,75 @@
+//    Copyright 2017 Red Hat, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/coreos/go-oidc/jose"
+	"github.com/open-policy-agent/opa/v1/rego"
+)
+
+// DefaultPolicyQuery is the document of a policy bundle deciding on
+// requests, the same one an OPA sidecar serves for the opa webhook format.
+const DefaultPolicyQuery = "data.tokenrp.authz"
+
+// Policy evaluates a Rego policy bundle in process, taking the same input
+// and giving the same results as policies behind an opa format Webhook.
+type Policy struct {
+	query rego.PreparedEvalQuery
+}
+
+// LoadPolicy compiles the bundle at path, a directory or a .tar.gz file,
+// for evaluating query.
+func LoadPolicy(ctx context.Context, path, query string) (*Policy, error) {
+	pq, err := rego.New(
+		rego.Query(query),
+		rego.LoadBundle(path),
+	).PrepareForEval(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &Policy{query: pq}, nil
+}
+
+// Authorize evaluates the policy for req, made with a token carrying claims.
+func (p *Policy) Authorize(req *http.Request, claims jose.Claims) (Decision, error) {
+	input := authzRequest{
+		Method: req.Method,
+		Host:   req.Host,
+		Path:   req.URL.Path,
+		Claims: claims,
+	}
+	rs, err := p.query.Eval(req.Context(), rego.EvalInput(input))
+	if err != nil {
+		return Decision{}, err
+	}
+	if len(rs) == 0 || len(rs[0].Expressions) == 0 {
+		return Decision{Reason: "policy result undefined"}, nil
+	}
+
+	result, err := json.Marshal(rs[0].Expressions[0].Value)
+	if err != nil {
+		return Decision{}, err
+	}
+	d, err := opaDecision(result)
+	if err != nil {
+		return Decision{}, fmt.Errorf("unexpected policy result %s", result)
+	}
+	return d, nil
+}
@@ -0,0 +1,108 @@
+//    Copyright 2017 Red Hat, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package proxy
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/coreos/go-oidc/jose"
+)
+
+const testPolicy = `package tokenrp.authz
+
+default allow := false
+
+allow if {
+	not endswith(input.path, "/git-receive-pack")
+}
+
+allow if {
+	"committers" in input.claims.groups
+}
+
+reason := "only committers may push" if {
+	not allow
+}
+`
+
+func writePolicy(t *testing.T, src string) string {
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "authz.rego"), []byte(src), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestPolicyAuthorize(t *testing.T) {
+	dir := writePolicy(t, testPolicy)
+
+	tests := []struct {
+		query  string
+		path   string
+		groups []interface{}
+		want   Decision
+	}{
+		{DefaultPolicyQuery, "/repo.git/info/refs", nil, Decision{Allowed: true}},
+		{DefaultPolicyQuery, "/repo.git/git-receive-pack", []interface{}{"developers"}, Decision{Reason: "only committers may push"}},
+		{DefaultPolicyQuery, "/repo.git/git-receive-pack", []interface{}{"committers"}, Decision{Allowed: true}},
+		{DefaultPolicyQuery + ".allow", "/repo.git/info/refs", nil, Decision{Allowed: true}},
+		{DefaultPolicyQuery + ".allow", "/repo.git/git-receive-pack", nil, Decision{}},
+		{"data.tokenrp.undefined", "/", nil, Decision{Reason: "policy result undefined"}},
+	}
+	for _, tt := range tests {
+		policy, err := LoadPolicy(context.Background(), dir, tt.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := httptest.NewRequest("POST", tt.path, nil)
+		claims := jose.Claims{"sub": "alice"}
+		if tt.groups != nil {
+			claims["groups"] = tt.groups
+		}
+		got, err := policy.Authorize(req, claims)
+		if err != nil {
+			t.Errorf("%s %s: %v", tt.query, tt.path, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s %s = %+v, want %+v", tt.query, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestPolicyUnexpectedResult(t *testing.T) {
+	dir := writePolicy(t, "package tokenrp.authz\n\nallow := 42\n")
+	policy, err := LoadPolicy(context.Background(), dir, DefaultPolicyQuery+".allow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := policy.Authorize(httptest.NewRequest("GET", "/", nil), jose.Claims{}); err == nil {
+		t.Error("Authorize accepted a number as decision")
+	}
+}
+
+func TestLoadPolicyInvalid(t *testing.T) {
+	dir := writePolicy(t, "package tokenrp.authz\n\nallow if {\n")
+	if _, err := LoadPolicy(context.Background(), dir, DefaultPolicyQuery); err == nil {
+		t.Error("LoadPolicy accepted a policy with a syntax error")
+	}
+	if _, err := LoadPolicy(context.Background(), filepath.Join(dir, "missing"), DefaultPolicyQuery); err == nil {
+		t.Error("LoadPolicy accepted a missing bundle")
+	}
+}
@@ -0,0 +1,133 @@
+//    Copyright 2017 Red Hat, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+)
+
+// Versions of the PROXY protocol header sent to upstreams.
+const (
+	ProxyProtocolV1 = "v1"
+	ProxyProtocolV2 = "v2"
+)
+
+// proxyProtocolV2Signature starts every PROXY protocol v2 header.
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// ValidateProxyProtocol checks that version is empty, ProxyProtocolV1 or
+// ProxyProtocolV2.
+func ValidateProxyProtocol(version string) error {
+	switch version {
+	case "", ProxyProtocolV1, ProxyProtocolV2:
+		return nil
+	}
+	return fmt.Errorf("unknown PROXY protocol version %q", version)
+}
+
+type proxyProtocolKey struct{}
+
+type proxyProtocolHeader struct {
+	version  string
+	src, dst *net.TCPAddr
+}
+
+// ContextWithProxyProtocol returns a copy of the context of req requesting
+// connections dialed by ProxyProtocolDialer to start with a PROXY protocol
+// header of version, carrying the client of req and the address it
+// connected to.
+func ContextWithProxyProtocol(req *http.Request, version string) context.Context {
+	h := &proxyProtocolHeader{version: version}
+	if local, ok := req.Context().Value(http.LocalAddrContextKey).(*net.TCPAddr); ok {
+		h.dst = local
+	}
+	if ip := net.ParseIP(ClientIP(req)); ip != nil {
+		h.src = &net.TCPAddr{IP: ip}
+		// The port is only known for direct clients.
+		if host, port, err := net.SplitHostPort(req.RemoteAddr); err == nil && net.ParseIP(host).Equal(ip) {
+			h.src.Port, _ = strconv.Atoi(port)
+		}
+	}
+	return context.WithValue(req.Context(), proxyProtocolKey{}, h)
+}
+
+// UsesProxyProtocol reports whether ctx requests a PROXY protocol header.
+func UsesProxyProtocol(ctx context.Context) bool {
+	_, ok := ctx.Value(proxyProtocolKey{}).(*proxyProtocolHeader)
+	return ok
+}
+
+// ProxyProtocolDialer returns dial sending the PROXY protocol header
+// requested by the context of the dial, see ContextWithProxyProtocol.
+// Connections sending a header belong to a single client and must not be
+// reused for others.
+func ProxyProtocolDialer(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		h, ok := ctx.Value(proxyProtocolKey{}).(*proxyProtocolHeader)
+		if !ok {
+			return conn, nil
+		}
+		if _, err = conn.Write(h.bytes()); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+}
+
+func (h *proxyProtocolHeader) bytes() []byte {
+	known := h.src != nil && h.dst != nil && (h.src.IP.To4() == nil) == (h.dst.IP.To4() == nil)
+
+	if h.version == ProxyProtocolV1 {
+		if !known {
+			return []byte("PROXY UNKNOWN\r\n")
+		}
+		family := "TCP6"
+		if h.src.IP.To4() != nil {
+			family = "TCP4"
+		}
+		return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", family, h.src.IP, h.dst.IP, h.src.Port, h.dst.Port))
+	}
+
+	var b bytes.Buffer
+	b.Write(proxyProtocolV2Signature)
+	if !known {
+		// LOCAL command without addresses.
+		b.Write([]byte{0x20, 0x00, 0x00, 0x00})
+		return b.Bytes()
+	}
+	var addrs []byte
+	if src4 := h.src.IP.To4(); src4 != nil {
+		b.Write([]byte{0x21, 0x11})
+		addrs = append(append(addrs, src4...), h.dst.IP.To4()...)
+	} else {
+		b.Write([]byte{0x21, 0x21})
+		addrs = append(append(addrs, h.src.IP.To16()...), h.dst.IP.To16()...)
+	}
+	addrs = append(addrs, byte(h.src.Port>>8), byte(h.src.Port), byte(h.dst.Port>>8), byte(h.dst.Port))
+	_ = binary.Write(&b, binary.BigEndian, uint16(len(addrs)))
+	b.Write(addrs)
+	return b.Bytes()
+}
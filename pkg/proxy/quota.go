@@ -0,0 +1,139 @@
+//    Copyright 2017 Red Hat, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package proxy
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Windows of an ExchangeQuota, starting at the full UTC hour and day.
+const (
+	HourlyQuota = "hourly"
+	DailyQuota  = "daily"
+)
+
+// ExchangeQuota limits the token exchanges per user within fixed hourly and
+// daily windows, protecting the broker from clients that exchange a
+// fresh token for every request.
+type ExchangeQuota struct {
+	// OnUsage, if set, is called after every counted exchange with the
+	// most exchanges of any user in the current window.
+	OnUsage func(window string, top int)
+
+	mu      sync.Mutex
+	windows []*quotaWindow
+}
+
+type quotaWindow struct {
+	name   string
+	length time.Duration
+	limit  int
+	start  time.Time
+	counts map[string]int
+	top    int
+}
+
+// NewExchangeQuota returns an ExchangeQuota allowing hourly and daily
+// exchanges per user, unlimited if zero, or nil if both are.
+func NewExchangeQuota(hourly, daily int) *ExchangeQuota {
+	q := &ExchangeQuota{}
+	for _, w := range []quotaWindow{
+		{name: HourlyQuota, length: time.Hour, limit: hourly},
+		{name: DailyQuota, length: 24 * time.Hour, limit: daily},
+	} {
+		if w.limit > 0 {
+			w := w
+			w.counts = make(map[string]int)
+			q.windows = append(q.windows, &w)
+		}
+	}
+	if len(q.windows) == 0 {
+		return nil
+	}
+	return q
+}
+
+// Take counts an exchange of the user identified by key. If it exhausted a
+// quota, Take reports false and how long until the window ends.
+func (q *ExchangeQuota) Take(key string) (bool, time.Duration) {
+	q.mu.Lock()
+	now := time.Now()
+	var wait time.Duration
+	for _, w := range q.windows {
+		if end := w.start.Add(w.length); !now.Before(end) {
+			// Forget the previous window with all its users.
+			w.start = now.Truncate(w.length)
+			w.counts = make(map[string]int)
+			w.top = 0
+		}
+		if w.counts[key] >= w.limit {
+			if d := w.start.Add(w.length).Sub(now); d > wait {
+				wait = d
+			}
+		}
+	}
+	if wait > 0 {
+		q.mu.Unlock()
+		return false, wait
+	}
+
+	type usage struct {
+		window string
+		top    int
+	}
+	usages := make([]usage, 0, len(q.windows))
+	for _, w := range q.windows {
+		w.counts[key]++
+		if w.counts[key] > w.top {
+			w.top = w.counts[key]
+		}
+		usages = append(usages, usage{w.name, w.top})
+	}
+	q.mu.Unlock()
+
+	if q.OnUsage != nil {
+		for _, u := range usages {
+			q.OnUsage(u.window, u.top)
+		}
+	}
+	return true, 0
+}
+
+// quotaKey identifies the user of an ExchangeQuota by subject and the
+// issuerURL it is unique for, or by client IP for tokens without subject.
+func quotaKey(req *http.Request, issuerURL, subject string) string {
+	if len(subject) == 0 {
+		return "ip:" + ClientIP(req)
+	}
+	return issuerURL + " " + subject
+}
+
+// exchangeQuota reports whether subject of issuerURL may exchange another
+// token, rejecting req with 429 otherwise.
+func (h *Handler) exchangeQuota(w http.ResponseWriter, req *http.Request, issuerURL, subject string) bool {
+	if h.ExchangeQuota == nil {
+		return true
+	}
+	ok, retryAfter := h.ExchangeQuota.Take(quotaKey(req, issuerURL, subject))
+	if !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		h.reject(w, req, AuthorizationEvent, "exchange_quota_exceeded", "token exchange quota exceeded", http.StatusTooManyRequests)
+	}
+	return ok
+}
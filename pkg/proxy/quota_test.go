@@ -0,0 +1,115 @@
+//    Copyright 2017 Red Hat, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package proxy
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestNewExchangeQuotaUnlimited(t *testing.T) {
+	if q := NewExchangeQuota(0, 0); q != nil {
+		t.Errorf("NewExchangeQuota(0, 0) = %v, want nil", q)
+	}
+}
+
+func TestExchangeQuotaTake(t *testing.T) {
+	tests := []struct {
+		name          string
+		hourly, daily int
+		takes         []string
+		want          []bool
+		maxWait       time.Duration
+	}{
+		{
+			name:    "hourly",
+			hourly:  2,
+			takes:   []string{"alice", "alice", "alice", "bob"},
+			want:    []bool{true, true, false, true},
+			maxWait: time.Hour,
+		},
+		{
+			name:    "daily",
+			daily:   1,
+			takes:   []string{"alice", "bob", "alice", "bob"},
+			want:    []bool{true, true, false, false},
+			maxWait: 24 * time.Hour,
+		},
+		{
+			name:    "daily below hourly",
+			hourly:  3,
+			daily:   2,
+			takes:   []string{"alice", "alice", "alice"},
+			want:    []bool{true, true, false},
+			maxWait: 24 * time.Hour,
+		},
+		{
+			name:    "hourly below daily",
+			hourly:  1,
+			daily:   5,
+			takes:   []string{"alice", "alice"},
+			want:    []bool{true, false},
+			maxWait: time.Hour,
+		},
+	}
+	for _, tt := range tests {
+		q := NewExchangeQuota(tt.hourly, tt.daily)
+		for i, key := range tt.takes {
+			ok, wait := q.Take(key)
+			if ok != tt.want[i] {
+				t.Errorf("%s: take %d by %s = %v, want %v", tt.name, i, key, ok, tt.want[i])
+			}
+			if ok && wait != 0 {
+				t.Errorf("%s: take %d by %s allowed with wait %v", tt.name, i, key, wait)
+			}
+			if !ok && (wait <= 0 || wait > tt.maxWait) {
+				t.Errorf("%s: take %d by %s denied with wait %v, want up to %v", tt.name, i, key, wait, tt.maxWait)
+			}
+		}
+	}
+}
+
+func TestExchangeQuotaOnUsage(t *testing.T) {
+	q := NewExchangeQuota(10, 20)
+	top := map[string]int{}
+	q.OnUsage = func(window string, n int) {
+		top[window] = n
+	}
+	for _, key := range []string{"alice", "bob", "alice", "carol", "alice"} {
+		q.Take(key)
+	}
+	if top[HourlyQuota] != 3 || top[DailyQuota] != 3 {
+		t.Errorf("OnUsage reported %v, want 3 for both windows", top)
+	}
+}
+
+func TestQuotaKey(t *testing.T) {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "198.51.100.1:1234"
+
+	tests := []struct {
+		issuerURL, subject, want string
+	}{
+		{"https://sso.example.com/auth/realms/a", "alice", "https://sso.example.com/auth/realms/a alice"},
+		{"https://sso.example.com/auth/realms/b", "alice", "https://sso.example.com/auth/realms/b alice"},
+		{"https://sso.example.com/auth/realms/a", "", "ip:198.51.100.1"},
+	}
+	for _, tt := range tests {
+		if got := quotaKey(req, tt.issuerURL, tt.subject); got != tt.want {
+			t.Errorf("quotaKey(%q, %q) = %q, want %q", tt.issuerURL, tt.subject, got, tt.want)
+		}
+	}
+}
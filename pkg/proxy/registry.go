@@ -0,0 +1,261 @@
+//    Copyright 2017 Red Hat, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultRegistryTokenLifetime is how long registry tokens are used whose
+// response lacks expires_in, as the distribution spec defines.
+const defaultRegistryTokenLifetime = time.Minute
+
+// registryRepositoryRegexp matches the paths of the OCI distribution API
+// concerning a repository, whose name is the first group.
+var registryRepositoryRegexp = regexp.MustCompile(`^/v2/(.+)/(manifests|blobs|tags|referrers)/`)
+
+type registryCredentialsKey struct{}
+
+type registryCredentials struct {
+	username, password string
+}
+
+// ContextWithRegistryCredentials returns a copy of ctx whose requests
+// obtain registry tokens with username and password, see
+// RegistryTransport.
+func ContextWithRegistryCredentials(ctx context.Context, username, password string) context.Context {
+	return context.WithValue(ctx, registryCredentialsKey{}, registryCredentials{username, password})
+}
+
+// RegistryTransport returns a RoundTripper following the token
+// authentication of OCI registries for requests whose context carries
+// registry credentials: when the registry challenges a request with
+// 'WWW-Authenticate: Bearer realm=...', a token is fetched from the realm
+// with client, authenticated by the credentials as basic auth, and the
+// request is sent again if it has no body. The realm is remembered for each
+// registry, so later requests, including uploads, carry a token for their
+// repository from the start. Tokens are reused until they expire.
+func RegistryTransport(rt http.RoundTripper, client *http.Client) http.RoundTripper {
+	return &registryTransport{
+		rt:         rt,
+		client:     client,
+		challenges: make(map[string]registryChallenge),
+		tokens:     make(map[string]registryToken),
+	}
+}
+
+type registryTransport struct {
+	rt     http.RoundTripper
+	client *http.Client
+
+	mu         sync.Mutex
+	challenges map[string]registryChallenge
+	tokens     map[string]registryToken
+}
+
+// registryChallenge is the realm and service of a Bearer challenge.
+type registryChallenge struct {
+	realm, service string
+}
+
+type registryToken struct {
+	token   string
+	expires time.Time
+}
+
+func (t *registryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	creds, ok := req.Context().Value(registryCredentialsKey{}).(registryCredentials)
+	if !ok {
+		return t.rt.RoundTrip(req)
+	}
+
+	host := req.Host
+	if len(host) == 0 {
+		host = req.URL.Host
+	}
+	t.mu.Lock()
+	c, known := t.challenges[host]
+	t.mu.Unlock()
+
+	// RoundTrippers must not modify the request.
+	out := req.Clone(req.Context())
+	if known {
+		token, err := t.token(req.Context(), c, registryScope(req), creds)
+		if err != nil {
+			return nil, err
+		}
+		out.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := t.rt.RoundTrip(out)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+
+	challenge, scope, ok := parseBearerChallenge(resp.Header.Get("WWW-Authenticate"))
+	if !ok || known && challenge == c && scope == registryScope(req) {
+		// Fetching the same token again won't help.
+		return resp, nil
+	}
+	t.mu.Lock()
+	t.challenges[host] = challenge
+	t.mu.Unlock()
+	if req.ContentLength != 0 {
+		return resp, nil
+	}
+
+	token, err := t.token(req.Context(), challenge, scope, creds)
+	if err != nil {
+		return nil, err
+	}
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	_ = resp.Body.Close()
+	out = req.Clone(req.Context())
+	out.Header.Set("Authorization", "Bearer "+token)
+	return t.rt.RoundTrip(out)
+}
+
+// token returns a token of c for scope, fetching it unless a cached one is
+// still valid.
+func (t *registryTransport) token(ctx context.Context, c registryChallenge, scope string, creds registryCredentials) (string, error) {
+	sum := sha256.Sum256([]byte(strings.Join([]string{c.realm, c.service, scope, creds.username, creds.password}, "\x00")))
+	key := hex.EncodeToString(sum[:])
+	t.mu.Lock()
+	cached, ok := t.tokens[key]
+	t.mu.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.token, nil
+	}
+
+	u, err := url.Parse(c.realm)
+	if err != nil {
+		return "", fmt.Errorf("invalid registry token realm %q: %v", c.realm, err)
+	}
+	q := u.Query()
+	if len(c.service) > 0 {
+		q.Set("service", c.service)
+	}
+	if len(scope) > 0 {
+		q.Set("scope", scope)
+	}
+	u.RawQuery = q.Encode()
+	tokenReq, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	tokenReq.SetBasicAuth(creds.username, creds.password)
+	resp, err := t.client.Do(tokenReq.WithContext(ctx))
+	if err != nil {
+		return "", fmt.Errorf("unable to fetch registry token: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unable to fetch registry token: %s", resp.Status)
+	}
+	var body struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("invalid registry token response: %v", err)
+	}
+	token := body.Token
+	if len(token) == 0 {
+		token = body.AccessToken
+	}
+	if len(token) == 0 {
+		return "", fmt.Errorf("missing token in registry token response")
+	}
+	lifetime := defaultRegistryTokenLifetime
+	if body.ExpiresIn > 0 {
+		lifetime = time.Duration(body.ExpiresIn) * time.Second
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	for k, cached := range t.tokens {
+		if !now.Before(cached.expires) {
+			delete(t.tokens, k)
+		}
+	}
+	// Leave time for the request to reach the registry.
+	t.tokens[key] = registryToken{token: token, expires: now.Add(lifetime * 9 / 10)}
+	return token, nil
+}
+
+// registryScope returns the scope a request of the distribution API needs:
+// pull access to its repository for reads, push access as well for writes,
+// and none for others such as the /v2/ version check.
+func registryScope(req *http.Request) string {
+	m := registryRepositoryRegexp.FindStringSubmatch(sentURL(req.URL).Path)
+	if m == nil {
+		return ""
+	}
+	if req.Method == "GET" || req.Method == "HEAD" {
+		return "repository:" + m[1] + ":pull"
+	}
+	return "repository:" + m[1] + ":pull,push"
+}
+
+// parseBearerChallenge returns the realm and service of a Bearer
+// WWW-Authenticate header and the scope it asks for, reporting false if it
+// is none.
+func parseBearerChallenge(header string) (registryChallenge, string, bool) {
+	if len(header) < len("Bearer ") || !strings.EqualFold(header[:len("Bearer ")], "Bearer ") {
+		return registryChallenge{}, "", false
+	}
+	params := map[string]string{}
+	rest := strings.TrimSpace(header[len("Bearer "):])
+	for len(rest) > 0 {
+		eq := strings.IndexByte(rest, '=')
+		if eq < 0 {
+			break
+		}
+		name := strings.ToLower(strings.TrimSpace(rest[:eq]))
+		rest = strings.TrimSpace(rest[eq+1:])
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.IndexByte(rest[1:], '"')
+			if end < 0 {
+				return registryChallenge{}, "", false
+			}
+			value, rest = rest[1:end+1], rest[end+2:]
+		} else if comma := strings.IndexByte(rest, ','); comma >= 0 {
+			value, rest = rest[:comma], rest[comma:]
+		} else {
+			value, rest = rest, ""
+		}
+		params[name] = value
+		rest = strings.TrimLeft(strings.TrimSpace(rest), ",")
+		rest = strings.TrimSpace(rest)
+	}
+	if len(params["realm"]) == 0 {
+		return registryChallenge{}, "", false
+	}
+	return registryChallenge{realm: params["realm"], service: params["service"]}, params["scope"], true
+}
@@ -0,0 +1,118 @@
+//    Copyright 2017 Red Hat, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Retry resends idempotent requests that failed with a transport error or a
+// retryable status. A request is retried only if it is a GET or HEAD without
+// body.
+type Retry struct {
+	// Attempts is the number of retries after the first attempt.
+	Attempts int
+	// Backoff is the delay before the first retry, doubled for each
+	// further retry.
+	Backoff     time.Duration
+	StatusCodes []int
+	// OnRetry is called before every retry with the number of the retry
+	// and the error or status of the failed attempt.
+	OnRetry func(req *http.Request, retry int, err error, status int)
+}
+
+// ParseStatusCodes parses a comma-separated list of HTTP status codes.
+func ParseStatusCodes(list string) ([]int, error) {
+	var codes []int
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if len(s) == 0 {
+			continue
+		}
+		code, err := strconv.Atoi(s)
+		if err != nil || code < 100 || code > 599 {
+			return nil, fmt.Errorf("invalid status code %q", s)
+		}
+		codes = append(codes, code)
+	}
+	return codes, nil
+}
+
+// RoundTripper returns rt retrying as configured by r, or rt itself if r is
+// disabled.
+func (r *Retry) RoundTripper(rt http.RoundTripper) http.RoundTripper {
+	if r == nil || r.Attempts <= 0 {
+		return rt
+	}
+	return &retryTransport{retry: r, rt: rt}
+}
+
+func (r *Retry) retryableStatus(code int) bool {
+	for _, c := range r.StatusCodes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+func idempotent(req *http.Request) bool {
+	return (req.Method == "GET" || req.Method == "HEAD") && req.ContentLength == 0
+}
+
+type retryTransport struct {
+	retry *Retry
+	rt    http.RoundTripper
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !idempotent(req) {
+		return t.rt.RoundTrip(req)
+	}
+
+	backoff := t.retry.Backoff
+	for n := 1; ; n++ {
+		resp, err := t.rt.RoundTrip(req)
+		if n > t.retry.Attempts || err == ErrBreakerOpen {
+			return resp, err
+		}
+		var status int
+		if err == nil {
+			if !t.retry.retryableStatus(resp.StatusCode) {
+				return resp, nil
+			}
+			status = resp.StatusCode
+			_, _ = io.Copy(ioutil.Discard, resp.Body)
+			_ = resp.Body.Close()
+		}
+
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+
+		if t.retry.OnRetry != nil {
+			t.retry.OnRetry(req, n, err, status)
+		}
+	}
+}
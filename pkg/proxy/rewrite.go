@@ -0,0 +1,85 @@
+//    Copyright 2017 Red Hat, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package proxy
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// pathRewrite is a single rewrite rule, see ParsePathRewrites.
+type pathRewrite struct {
+	stripPrefix string
+	addPrefix   string
+	re          *regexp.Regexp
+	replacement string
+}
+
+// PathRewrites rewrite request paths before they are forwarded, so the
+// upstream doesn't see the prefix an ingress routes on.
+type PathRewrites []pathRewrite
+
+// ParsePathRewrites parses rules of the forms strip-prefix:/prefix,
+// add-prefix:/prefix and regex:pattern replacement, where replacement may
+// refer to submatches as $1. Rules are applied in order to the escaped path.
+func ParsePathRewrites(rules []string) (PathRewrites, error) {
+	var rw PathRewrites
+	for _, r := range rules {
+		parts := strings.SplitN(r, ":", 2)
+		if len(parts) != 2 || len(parts[1]) == 0 {
+			return nil, fmt.Errorf("invalid path rewrite %q, expected strip-prefix:, add-prefix: or regex:", r)
+		}
+		switch parts[0] {
+		case "strip-prefix":
+			rw = append(rw, pathRewrite{stripPrefix: strings.TrimSuffix(parts[1], "/")})
+		case "add-prefix":
+			rw = append(rw, pathRewrite{addPrefix: strings.TrimSuffix(parts[1], "/")})
+		case "regex":
+			fields := strings.SplitN(parts[1], " ", 2)
+			if len(fields) != 2 {
+				return nil, fmt.Errorf("invalid path rewrite %q, expected regex:pattern replacement", r)
+			}
+			re, err := regexp.Compile(fields[0])
+			if err != nil {
+				return nil, fmt.Errorf("invalid path rewrite %q: %v", r, err)
+			}
+			rw = append(rw, pathRewrite{re: re, replacement: fields[1]})
+		default:
+			return nil, fmt.Errorf("invalid path rewrite %q, unknown rule %q", r, parts[0])
+		}
+	}
+	return rw, nil
+}
+
+// Apply returns p rewritten by all rules. A prefix is only stripped at a
+// path segment boundary.
+func (rw PathRewrites) Apply(p string) string {
+	for _, r := range rw {
+		switch {
+		case len(r.stripPrefix) > 0:
+			if p == r.stripPrefix {
+				p = "/"
+			} else if strings.HasPrefix(p, r.stripPrefix+"/") {
+				p = p[len(r.stripPrefix):]
+			}
+		case len(r.addPrefix) > 0:
+			p = r.addPrefix + p
+		case r.re != nil:
+			p = r.re.ReplaceAllString(p, r.replacement)
+		}
+	}
+	return p
+}
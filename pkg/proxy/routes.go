@@ -0,0 +1,76 @@
+//    Copyright 2017 Red Hat, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Route selects its own configuration for requests to Host and below
+// PathPrefix. Either may be empty to match any host or path. Host is matched
+// against the server name requested via SNI for TLS requests, and against
+// the Host header otherwise.
+type Route struct {
+	Host       string
+	PathPrefix string
+	Config     *Config
+}
+
+// Match reports whether req is routed by r.
+func (r *Route) Match(req *http.Request) bool {
+	if len(r.Host) > 0 && !matchHost(r.Host, requestHost(req)) {
+		return false
+	}
+	if len(r.PathPrefix) > 0 {
+		prefix := strings.TrimSuffix(r.PathPrefix, "/")
+		if req.URL.Path != prefix && !strings.HasPrefix(req.URL.Path, prefix+"/") {
+			return false
+		}
+	}
+	return true
+}
+
+// matchHost compares the host of a route with the Host of a request, ignoring
+// the port of the latter unless the route has one.
+func matchHost(routeHost, reqHost string) bool {
+	if !strings.Contains(routeHost, ":") {
+		if h, _, err := net.SplitHostPort(reqHost); err == nil {
+			reqHost = h
+		}
+	}
+	return strings.EqualFold(routeHost, reqHost)
+}
+
+// requestHost returns the SNI server name of TLS requests and the Host
+// header otherwise.
+func requestHost(req *http.Request) string {
+	if req.TLS != nil && len(req.TLS.ServerName) > 0 {
+		return req.TLS.ServerName
+	}
+	return req.Host
+}
+
+// Route returns the configuration of the first of cfg.Routes matching req,
+// or cfg itself if none does.
+func (cfg *Config) Route(req *http.Request) *Config {
+	for i := range cfg.Routes {
+		if cfg.Routes[i].Match(req) {
+			return cfg.Routes[i].Config
+		}
+	}
+	return cfg
+}
@@ -0,0 +1,143 @@
+//    Copyright 2017 Red Hat, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// Timeouts bound the phases of upstream requests. Zero disables a timeout.
+type Timeouts struct {
+	Dial           time.Duration
+	TLSHandshake   time.Duration
+	ResponseHeader time.Duration
+	// Total bounds the whole request, including reading the response body.
+	Total time.Duration
+}
+
+type timeoutsKey struct{}
+
+// WithContext returns a copy of ctx bounded by t.Total and carrying the
+// phase timeouts enforced by TimeoutTransport.
+func (t Timeouts) WithContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx = context.WithValue(ctx, timeoutsKey{}, t)
+	if t.Total > 0 {
+		return context.WithTimeout(ctx, t.Total)
+	}
+	return context.WithCancel(ctx)
+}
+
+// TimeoutTransport returns rt enforcing the phase timeouts of the Timeouts
+// in the context of each request, see Timeouts.WithContext.
+func TimeoutTransport(rt http.RoundTripper) http.RoundTripper {
+	return &timeoutTransport{rt: rt}
+}
+
+type timeoutTransport struct {
+	rt http.RoundTripper
+}
+
+// timeoutError is returned when a phase of a request times out. Like
+// net.Error timeouts, it is answered with 504 by the forwarder.
+type timeoutError struct {
+	phase string
+}
+
+func (e *timeoutError) Error() string   { return e.phase + " timeout" }
+func (e *timeoutError) Timeout() bool   { return true }
+func (e *timeoutError) Temporary() bool { return true }
+
+// phaseTimer cancels a request if the current phase takes too long.
+type phaseTimer struct {
+	cancel context.CancelFunc
+
+	mu      sync.Mutex
+	timer   *time.Timer
+	expired string
+}
+
+func (p *phaseTimer) start(phase string, d time.Duration) {
+	p.stop()
+	if d <= 0 {
+		return
+	}
+	p.mu.Lock()
+	p.timer = time.AfterFunc(d, func() {
+		p.mu.Lock()
+		p.expired = phase
+		p.mu.Unlock()
+		p.cancel()
+	})
+	p.mu.Unlock()
+}
+
+func (p *phaseTimer) stop() {
+	p.mu.Lock()
+	if p.timer != nil {
+		p.timer.Stop()
+		p.timer = nil
+	}
+	p.mu.Unlock()
+}
+
+func (t *timeoutTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	timeouts, ok := req.Context().Value(timeoutsKey{}).(Timeouts)
+	if !ok || (timeouts.Dial <= 0 && timeouts.TLSHandshake <= 0 && timeouts.ResponseHeader <= 0) {
+		return t.rt.RoundTrip(req)
+	}
+
+	// The context is only canceled if a phase times out, as the response
+	// body is read after RoundTrip returns.
+	ctx, cancel := context.WithCancel(req.Context())
+	p := &phaseTimer{cancel: cancel}
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		ConnectStart: func(network, addr string) {
+			p.start("dial", timeouts.Dial)
+		},
+		ConnectDone: func(network, addr string, err error) {
+			p.stop()
+		},
+		TLSHandshakeStart: func() {
+			p.start("TLS handshake", timeouts.TLSHandshake)
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			p.stop()
+		},
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			p.start("response header", timeouts.ResponseHeader)
+		},
+		GotFirstResponseByte: func() {
+			p.stop()
+		},
+	})
+
+	resp, err := t.rt.RoundTrip(req.WithContext(ctx))
+	p.stop()
+	if err != nil {
+		cancel()
+		p.mu.Lock()
+		phase := p.expired
+		p.mu.Unlock()
+		if len(phase) > 0 {
+			return nil, &timeoutError{phase: phase}
+		}
+	}
+	return resp, err
+}
@@ -0,0 +1,105 @@
+//    Copyright 2017 Red Hat, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// What happens to the client's Authorization header when the exchanged token
+// is sent in another header.
+const (
+	// ReplaceAuthorization also sends the exchanged token as Authorization.
+	ReplaceAuthorization = "replace"
+	// PreserveAuthorization forwards the client's Authorization unchanged.
+	PreserveAuthorization = "preserve"
+	// RemoveAuthorization forwards no Authorization header.
+	RemoveAuthorization = "remove"
+	// JWTAuthorization sends the verified Keycloak token as Bearer
+	// Authorization, whichever scheme the client used.
+	JWTAuthorization = "jwt"
+)
+
+// NoTokenScheme sends the exchanged token as raw header value.
+const NoTokenScheme = "none"
+
+// ValidateTokenHeader checks the header and scheme carrying the exchanged
+// token and the treatment of the original Authorization header.
+func ValidateTokenHeader(header, scheme, originalAuthorization string) error {
+	if strings.ContainsAny(scheme, " \t\r\n") {
+		return fmt.Errorf("invalid token-scheme %q", scheme)
+	}
+	switch originalAuthorization {
+	case ReplaceAuthorization:
+	case PreserveAuthorization, RemoveAuthorization, JWTAuthorization:
+		if len(header) == 0 || http.CanonicalHeaderKey(header) == "Authorization" {
+			return fmt.Errorf("original-authorization %q requires a token-header other than Authorization", originalAuthorization)
+		}
+	default:
+		return fmt.Errorf("unknown original-authorization %q", originalAuthorization)
+	}
+	return nil
+}
+
+// tokenValue returns the header value carrying token. Without TokenScheme
+// the token is sent raw.
+func (cfg *Config) tokenValue(token string) string {
+	if len(cfg.TokenScheme) == 0 || cfg.TokenScheme == NoTokenScheme {
+		return token
+	}
+	return cfg.TokenScheme + " " + token
+}
+
+// placeToken moves the exchanged token of a request decorated by the
+// TokenRetriever into cfg.TokenHeader with cfg.TokenScheme, and treats the
+// original Authorization header, which carried the verified jwt, according to
+// cfg.OriginalAuthorization.
+func (cfg *Config) placeToken(h http.Header, original, jwt, token string) {
+	if len(cfg.TokenHeader) > 0 && cfg.TokenHeader != "Authorization" {
+		h.Set(cfg.TokenHeader, cfg.tokenValue(token))
+	}
+	switch cfg.OriginalAuthorization {
+	case ReplaceAuthorization:
+		// Keep the provider's scheme unless overridden.
+		if len(cfg.TokenScheme) > 0 {
+			h.Set("Authorization", cfg.tokenValue(token))
+		}
+	case PreserveAuthorization:
+		if len(original) > 0 {
+			h.Set("Authorization", original)
+		} else {
+			h.Del("Authorization")
+		}
+	case RemoveAuthorization:
+		h.Del("Authorization")
+	case JWTAuthorization:
+		// Requests authenticated by client certificate carry no jwt.
+		if len(jwt) > 0 {
+			h.Set("Authorization", "Bearer "+jwt)
+		} else {
+			h.Del("Authorization")
+		}
+	}
+}
+
+// stripTokenHeader removes a client supplied token header so it can't be
+// spoofed on requests forwarded without exchange.
+func (cfg *Config) stripTokenHeader(h http.Header) {
+	if len(cfg.TokenHeader) > 0 && cfg.TokenHeader != "Authorization" {
+		h.Del(cfg.TokenHeader)
+	}
+}
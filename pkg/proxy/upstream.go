@@ -0,0 +1,93 @@
+//    Copyright 2017 Red Hat, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package proxy
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Values of Config.HostHeader besides a custom host.
+const (
+	// UpstreamHost sends the host of the upstream URL.
+	UpstreamHost = "upstream"
+	// PreserveHost sends the Host header of the client.
+	PreserveHost = "preserve"
+)
+
+// UpstreamURL returns the URL of a request for in forwarded to endpoint,
+// see PickUpstream. With PreservePath the incoming path, rewritten by
+// PathRewrites, is appended to the path of endpoint and the incoming query
+// to its query, like a reverse proxy; otherwise every request goes to
+// endpoint.
+func (cfg *Config) UpstreamURL(endpoint, in *url.URL) *url.URL {
+	u := *endpoint
+	if !cfg.PreservePath {
+		return &u
+	}
+
+	if len(cfg.PathRewrites) > 0 {
+		rawPath := cfg.PathRewrites.Apply(in.EscapedPath())
+		p, err := url.PathUnescape(rawPath)
+		if err != nil {
+			// The rules produced an invalid escape, leave it to the
+			// upstream to reject.
+			p = rawPath
+		}
+		in = &url.URL{Path: p, RawPath: rawPath, RawQuery: in.RawQuery}
+	}
+	u.Path, u.RawPath = joinURLPath(endpoint, in)
+	switch {
+	case len(u.RawQuery) == 0:
+		u.RawQuery = in.RawQuery
+	case len(in.RawQuery) > 0:
+		u.RawQuery += "&" + in.RawQuery
+	}
+	return &u
+}
+
+// UpstreamHost returns the Host header to forward req, going to u, with.
+func (cfg *Config) UpstreamHost(req *http.Request, u *url.URL) string {
+	switch cfg.HostHeader {
+	case "", UpstreamHost:
+		return u.Host
+	case PreserveHost:
+		return req.Host
+	default:
+		return cfg.HostHeader
+	}
+}
+
+// joinURLPath joins the paths of a and b with a single slash, keeping their
+// escaping.
+func joinURLPath(a, b *url.URL) (path, rawPath string) {
+	if len(a.RawPath) == 0 && len(b.RawPath) == 0 {
+		return singleJoiningSlash(a.Path, b.Path), ""
+	}
+	return singleJoiningSlash(a.Path, b.Path), singleJoiningSlash(a.EscapedPath(), b.EscapedPath())
+}
+
+func singleJoiningSlash(a, b string) string {
+	aslash := strings.HasSuffix(a, "/")
+	bslash := strings.HasPrefix(b, "/")
+	switch {
+	case aslash && bslash:
+		return a + b[1:]
+	case !aslash && !bslash && len(b) > 0:
+		return a + "/" + b
+	}
+	return a + b
+}
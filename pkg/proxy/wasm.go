@@ -0,0 +1,217 @@
+//    Copyright 2017 Red Hat, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"reflect"
+	"time"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+)
+
+// Functions a WebAssembly decorator module exports besides its memory.
+const (
+	// WASMAllocFunction reserves size bytes in the memory of the module,
+	// returning their offset: alloc(size i32) i32.
+	WASMAllocFunction = "alloc"
+	// WASMDecorateFunction decorates the request whose JSON encoded
+	// wasmDecorateInput alloc returned the memory for, returning the offset
+	// and length of its JSON encoded wasmDecorateOutput in the upper and
+	// lower half of the result: decorate(ptr, len i32) i64.
+	WASMDecorateFunction = "decorate"
+)
+
+// wasmPageSize is the size of a WebAssembly memory page.
+const wasmPageSize = 64 * 1024
+
+type wasmDecorateInput struct {
+	Method  string                 `json:"method"`
+	Host    string                 `json:"host"`
+	Path    string                 `json:"path"`
+	Headers http.Header            `json:"headers"`
+	Claims  map[string]interface{} `json:"claims"`
+	Token   string                 `json:"token"`
+}
+
+// wasmDecorateOutput replaces the request headers named in Headers, removing
+// those without values, unless Reject gives a reason to reject the request.
+type wasmDecorateOutput struct {
+	Headers http.Header `json:"headers"`
+	Reject  string      `json:"reject"`
+}
+
+// wasmDecorator instantiates a compiled module afresh for every request, so
+// that no request sees the memory of another.
+type wasmDecorator struct {
+	runtime  wazero.Runtime
+	compiled wazero.CompiledModule
+	config   wazero.ModuleConfig
+	timeout  time.Duration
+}
+
+// LoadDecoratorWASM compiles the WebAssembly module at path and returns a
+// Decorator calling its decorate function. Unlike Go plugins, modules run
+// sandboxed in any build and may be written in any language targeting WASI
+// reactors, e.g. Go with GOOS=wasip1 and -buildmode=c-shared, TinyGo or Rust.
+// A call is aborted after timeout, and the memory of the module can't grow
+// beyond maxMemory bytes.
+func LoadDecoratorWASM(ctx context.Context, path string, timeout time.Duration, maxMemory int64) (Decorator, error) {
+	if timeout <= 0 {
+		return nil, errors.New("timeout must be positive")
+	}
+	pages := maxMemory / wasmPageSize
+	if pages < 1 || pages > 65536 {
+		return nil, fmt.Errorf("memory limit must be between %d bytes and 4 GiB", wasmPageSize)
+	}
+	bin, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	r := wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().
+		WithCloseOnContextDone(true).
+		WithMemoryLimitPages(uint32(pages)))
+	if _, err = wasi_snapshot_preview1.Instantiate(ctx, r); err != nil {
+		_ = r.Close(ctx)
+		return nil, err
+	}
+	compiled, err := r.CompileModule(ctx, bin)
+	if err == nil {
+		err = checkWASMExports(compiled)
+	}
+	if err != nil {
+		_ = r.Close(ctx)
+		return nil, fmt.Errorf("module %s: %v", path, err)
+	}
+
+	d := &wasmDecorator{
+		runtime:  r,
+		compiled: compiled,
+		config: wazero.NewModuleConfig().
+			WithName("").
+			WithStartFunctions("_initialize").
+			WithStderr(os.Stderr),
+		timeout: timeout,
+	}
+	// Instantiate once to fail early on modules that can't be.
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	m, err := r.InstantiateModule(ctx, compiled, d.config)
+	if err != nil {
+		_ = r.Close(ctx)
+		return nil, fmt.Errorf("module %s: %v", path, err)
+	}
+	_ = m.Close(ctx)
+	return d.Decorate, nil
+}
+
+// checkWASMExports checks that the module exports memory, alloc and decorate
+// with the expected signatures.
+func checkWASMExports(compiled wazero.CompiledModule) error {
+	if len(compiled.ExportedMemories()) == 0 {
+		return errors.New("no memory exported")
+	}
+	want := map[string][2][]api.ValueType{
+		WASMAllocFunction:    {{api.ValueTypeI32}, {api.ValueTypeI32}},
+		WASMDecorateFunction: {{api.ValueTypeI32, api.ValueTypeI32}, {api.ValueTypeI64}},
+	}
+	exported := compiled.ExportedFunctions()
+	for name, sig := range want {
+		f, ok := exported[name]
+		if !ok {
+			return fmt.Errorf("function %s not exported", name)
+		}
+		if !reflect.DeepEqual(f.ParamTypes(), sig[0]) || !reflect.DeepEqual(f.ResultTypes(), sig[1]) {
+			return fmt.Errorf("function %s has the wrong signature", name)
+		}
+	}
+	return nil
+}
+
+// Decorate passes the request, claims and token to the module and applies
+// its output to the headers of req.
+func (d *wasmDecorator) Decorate(req *http.Request, claims map[string]interface{}, token string) error {
+	in, err := json.Marshal(wasmDecorateInput{
+		Method:  req.Method,
+		Host:    req.Host,
+		Path:    req.URL.Path,
+		Headers: req.Header,
+		Claims:  claims,
+		Token:   token,
+	})
+	if err != nil {
+		return err
+	}
+
+	// The module is closed, ending a call in progress, once the timeout
+	// expires or the client goes away.
+	ctx, cancel := context.WithTimeout(req.Context(), d.timeout)
+	defer cancel()
+	m, err := d.runtime.InstantiateModule(ctx, d.compiled, d.config)
+	if err != nil {
+		return fmt.Errorf("decorator module failed: %v", err)
+	}
+	out, err := d.call(ctx, m, in)
+	_ = m.Close(context.Background())
+	if err != nil {
+		return fmt.Errorf("decorator module failed: %v", err)
+	}
+
+	var o wasmDecorateOutput
+	if err = json.Unmarshal(out, &o); err != nil {
+		return fmt.Errorf("decorator module returned invalid output: %v", err)
+	}
+	if len(o.Reject) > 0 {
+		return errors.New(o.Reject)
+	}
+	for name, values := range o.Headers {
+		name = http.CanonicalHeaderKey(name)
+		if len(values) == 0 {
+			req.Header.Del(name)
+		} else {
+			req.Header[name] = values
+		}
+	}
+	return nil
+}
+
+func (d *wasmDecorator) call(ctx context.Context, m api.Module, in []byte) ([]byte, error) {
+	res, err := m.ExportedFunction(WASMAllocFunction).Call(ctx, uint64(len(in)))
+	if err != nil {
+		return nil, err
+	}
+	ptr := uint32(res[0])
+	if !m.Memory().Write(ptr, in) {
+		return nil, errors.New("input out of memory range")
+	}
+	res, err = m.ExportedFunction(WASMDecorateFunction).Call(ctx, uint64(ptr), uint64(len(in)))
+	if err != nil {
+		return nil, err
+	}
+	out, ok := m.Memory().Read(uint32(res[0]>>32), uint32(res[0]))
+	if !ok {
+		return nil, errors.New("output out of memory range")
+	}
+	// Copy the output, as the memory goes away with the instance.
+	return append([]byte(nil), out...), nil
+}
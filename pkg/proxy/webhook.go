@@ -0,0 +1,215 @@
+//    Copyright 2017 Red Hat, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package proxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/jose"
+)
+
+// maxCachedDecisions bounds the number of decisions kept by a Webhook.
+const maxCachedDecisions = 10000
+
+// Webhook protocols.
+const (
+	DefaultWebhookFormat = "default"
+	// OPAWebhookFormat speaks the Open Policy Agent Data API, so Rego
+	// policies can be evaluated by an OPA sidecar.
+	OPAWebhookFormat = "opa"
+)
+
+type authzRequest struct {
+	Method string      `json:"method"`
+	Host   string      `json:"host"`
+	Path   string      `json:"path"`
+	Claims jose.Claims `json:"claims"`
+}
+
+// Decision is the answer of an authorization webhook.
+type Decision struct {
+	Allowed bool   `json:"allowed"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+type opaRequest struct {
+	Input authzRequest `json:"input"`
+}
+
+// opaResponse is the result of querying a policy document, which is either a
+// plain boolean or an object carrying allow and reason.
+type opaResponse struct {
+	Result json.RawMessage `json:"result"`
+}
+
+type opaResult struct {
+	Allow  bool   `json:"allow"`
+	Reason string `json:"reason"`
+}
+
+type cachedDecision struct {
+	Decision
+	expiresAt time.Time
+}
+
+// Webhook delegates authorization of verified requests to an external
+// service, caching its decisions for cacheTTL.
+type Webhook struct {
+	hc       *http.Client
+	url      string
+	format   string
+	cacheTTL time.Duration
+
+	mu    sync.Mutex
+	cache map[[sha256.Size]byte]cachedDecision
+}
+
+// NewWebhook returns a webhook posting to url in the given format.
+func NewWebhook(hc *http.Client, url, format string, cacheTTL time.Duration) *Webhook {
+	return &Webhook{
+		hc:       hc,
+		url:      url,
+		format:   format,
+		cacheTTL: cacheTTL,
+		cache:    make(map[[sha256.Size]byte]cachedDecision),
+	}
+}
+
+// Authorize asks the webhook whether req, made with a token carrying claims,
+// may proceed.
+func (a *Webhook) Authorize(req *http.Request, claims jose.Claims) (Decision, error) {
+	ar := authzRequest{
+		Method: req.Method,
+		Host:   req.Host,
+		Path:   req.URL.Path,
+		Claims: claims,
+	}
+	var body []byte
+	var err error
+	if a.format == OPAWebhookFormat {
+		body, err = json.Marshal(opaRequest{Input: ar})
+	} else {
+		body, err = json.Marshal(ar)
+	}
+	if err != nil {
+		return Decision{}, err
+	}
+
+	key := sha256.Sum256(body)
+	if d, ok := a.cached(key); ok {
+		return d, nil
+	}
+
+	resp, err := a.hc.Post(a.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return Decision{}, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != 200 {
+		return Decision{}, fmt.Errorf("authorization webhook failed: %s", resp.Status)
+	}
+
+	var d Decision
+	if a.format == OPAWebhookFormat {
+		d, err = decodeOPADecision(resp.Body)
+	} else {
+		err = json.NewDecoder(resp.Body).Decode(&d)
+	}
+	if err != nil {
+		return Decision{}, fmt.Errorf("unable to decode authorization webhook response: %v", err)
+	}
+
+	a.store(key, d)
+
+	return d, nil
+}
+
+// decodeOPADecision decodes an OPA Data API response. An undefined result
+// denies the request.
+func decodeOPADecision(r io.Reader) (Decision, error) {
+	var resp opaResponse
+	if err := json.NewDecoder(r).Decode(&resp); err != nil {
+		return Decision{}, err
+	}
+
+	if len(resp.Result) == 0 {
+		return Decision{Reason: "policy result undefined"}, nil
+	}
+	return opaDecision(resp.Result)
+}
+
+// opaDecision converts the result of a policy, a boolean or an object with
+// allow and reason, to a decision.
+func opaDecision(result json.RawMessage) (Decision, error) {
+	var allow bool
+	if err := json.Unmarshal(result, &allow); err == nil {
+		return Decision{Allowed: allow}, nil
+	}
+
+	var r opaResult
+	if err := json.Unmarshal(result, &r); err != nil {
+		return Decision{}, err
+	}
+	return Decision{Allowed: r.Allow, Reason: r.Reason}, nil
+}
+
+// ValidateWebhookFormat checks that format is a supported webhook protocol.
+func ValidateWebhookFormat(format string) error {
+	if format != DefaultWebhookFormat && format != OPAWebhookFormat {
+		return fmt.Errorf("unknown authz webhook format %q", format)
+	}
+	return nil
+}
+
+func (a *Webhook) cached(key [sha256.Size]byte) (Decision, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	d, ok := a.cache[key]
+	if !ok || time.Now().After(d.expiresAt) {
+		return Decision{}, false
+	}
+	return d.Decision, true
+}
+
+func (a *Webhook) store(key [sha256.Size]byte, d Decision) {
+	if a.cacheTTL <= 0 {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := time.Now()
+	if len(a.cache) >= maxCachedDecisions {
+		for k, cd := range a.cache {
+			if now.After(cd.expiresAt) {
+				delete(a.cache, k)
+			}
+		}
+		if len(a.cache) >= maxCachedDecisions {
+			return
+		}
+	}
+	a.cache[key] = cachedDecision{Decision: d, expiresAt: now.Add(a.cacheTTL)}
+}
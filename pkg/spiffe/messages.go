@@ -0,0 +1,42 @@
+//    Copyright 2017 Red Hat, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package spiffe
+
+import "github.com/golang/protobuf/proto"
+
+// The messages of the Workload API's FetchX509SVID method, as defined by
+// workload.proto of the SPIFFE specification.
+
+type x509SVIDResponse struct {
+	Svids            []*x509SVID       `protobuf:"bytes,1,rep,name=svids"`
+	Crl              [][]byte          `protobuf:"bytes,2,rep,name=crl"`
+	FederatedBundles map[string][]byte `protobuf:"bytes,3,rep,name=federated_bundles" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
+}
+
+func (m *x509SVIDResponse) Reset()         { *m = x509SVIDResponse{} }
+func (m *x509SVIDResponse) String() string { return proto.CompactTextString(m) }
+func (*x509SVIDResponse) ProtoMessage()    {}
+
+type x509SVID struct {
+	SpiffeId    string `protobuf:"bytes,1,opt,name=spiffe_id,proto3"`
+	X509Svid    []byte `protobuf:"bytes,2,opt,name=x509_svid,proto3"`
+	X509SvidKey []byte `protobuf:"bytes,3,opt,name=x509_svid_key,proto3"`
+	Bundle      []byte `protobuf:"bytes,4,opt,name=bundle,proto3"`
+	Hint        string `protobuf:"bytes,5,opt,name=hint,proto3"`
+}
+
+func (m *x509SVID) Reset()         { *m = x509SVID{} }
+func (m *x509SVID) String() string { return proto.CompactTextString(m) }
+func (*x509SVID) ProtoMessage()    {}
@@ -0,0 +1,270 @@
+//    Copyright 2017 Red Hat, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+// Package spiffe fetches X.509 SVIDs and trust bundles from the SPIFFE
+// Workload API, as served by the SPIRE agent.
+package spiffe
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// fetchX509SVIDPath is the gRPC method streaming X.509 SVIDs and bundles.
+const fetchX509SVIDPath = "/SpiffeWorkloadAPI/FetchX509SVID"
+
+// maxBackoff bounds the delay between reconnects to the Workload API.
+const maxBackoff = 30 * time.Second
+
+// SVID is an X.509 SVID of the workload.
+type SVID struct {
+	// ID is the SPIFFE ID, e.g. spiffe://example.org/token-rp.
+	ID string
+	// Certificates is the chain, leaf first.
+	Certificates []*x509.Certificate
+	PrivateKey   crypto.Signer
+}
+
+// TLSCertificate returns the SVID for use in a tls.Config.
+func (s *SVID) TLSCertificate() *tls.Certificate {
+	cert := &tls.Certificate{PrivateKey: s.PrivateKey, Leaf: s.Certificates[0]}
+	for _, c := range s.Certificates {
+		cert.Certificate = append(cert.Certificate, c.Raw)
+	}
+	return cert
+}
+
+// X509Context is an update of the Workload API.
+type X509Context struct {
+	// SVIDs are the identities of the workload, the default one first.
+	SVIDs []*SVID
+	// Bundles are the CA certificates of the workload's trust domain and of
+	// the trust domains federated with it, by trust domain name.
+	Bundles map[string][]*x509.Certificate
+}
+
+// Roots returns the CA certificates of all bundles.
+func (c *X509Context) Roots() []*x509.Certificate {
+	var roots []*x509.Certificate
+	for _, certs := range c.Bundles {
+		roots = append(roots, certs...)
+	}
+	return roots
+}
+
+// Client calls the Workload API.
+type Client struct {
+	hc *http.Client
+}
+
+// NewClient returns a client of the Workload API at addr, given as
+// unix:///path/to/socket or tcp://host:port.
+func NewClient(addr string) (*Client, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Workload API address: %v", err)
+	}
+	var network, address string
+	switch {
+	case u.Scheme == "unix" && len(u.Path) > 0:
+		network, address = "unix", u.Path
+	case u.Scheme == "tcp" && len(u.Host) > 0:
+		network, address = "tcp", u.Host
+	default:
+		return nil, fmt.Errorf("invalid Workload API address %q, expected unix:///path or tcp://host:port", addr)
+	}
+
+	// gRPC is spoken over HTTP/2 without TLS.
+	t := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, address)
+		},
+	}
+	t.Protocols = new(http.Protocols)
+	t.Protocols.SetUnencryptedHTTP2(true)
+	return &Client{hc: &http.Client{Transport: t}}, nil
+}
+
+// FetchX509Context returns the current SVIDs and bundles.
+func (c *Client) FetchX509Context(ctx context.Context) (*X509Context, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var first *X509Context
+	err := c.stream(ctx, func(x *X509Context) {
+		first = x
+		cancel()
+	})
+	if first != nil {
+		return first, nil
+	}
+	return nil, err
+}
+
+// Watch calls onUpdate with every update of the SVIDs and bundles until ctx
+// is done. After errors, which are passed to onError, the stream is opened
+// again with exponential backoff.
+func (c *Client) Watch(ctx context.Context, onUpdate func(*X509Context), onError func(error)) {
+	backoff := time.Second
+	for {
+		received := false
+		err := c.stream(ctx, func(x *X509Context) {
+			received = true
+			onUpdate(x)
+		})
+		if ctx.Err() != nil {
+			return
+		}
+		if received {
+			backoff = time.Second
+		}
+		onError(err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// stream calls FetchX509SVID and passes every response to onUpdate until
+// the stream ends.
+func (c *Client) stream(ctx context.Context, onUpdate func(*X509Context)) error {
+	// An empty X509SVIDRequest, uncompressed.
+	body := make([]byte, 5)
+	req, err := http.NewRequest(http.MethodPost, "http://localhost"+fetchX509SVIDPath, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("Te", "trailers")
+	req.Header.Set("Workload.spiffe.io", "true")
+
+	resp, err := c.hc.Do(req.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("failed to call Workload API: %v", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected Workload API status %s", resp.Status)
+	}
+	if err = grpcStatus(resp.Header); err != nil {
+		return err
+	}
+
+	prefix := make([]byte, 5)
+	for {
+		if _, err = io.ReadFull(resp.Body, prefix); err != nil {
+			if err == io.EOF {
+				if err = grpcStatus(resp.Trailer); err != nil {
+					return err
+				}
+				return errors.New("the Workload API closed the stream")
+			}
+			return fmt.Errorf("failed to read Workload API response: %v", err)
+		}
+		if prefix[0] != 0 {
+			return errors.New("compressed Workload API response")
+		}
+		msg := make([]byte, binary.BigEndian.Uint32(prefix[1:]))
+		if _, err = io.ReadFull(resp.Body, msg); err != nil {
+			return fmt.Errorf("failed to read Workload API response: %v", err)
+		}
+
+		var r x509SVIDResponse
+		if err = proto.Unmarshal(msg, &r); err != nil {
+			return fmt.Errorf("invalid Workload API response: %v", err)
+		}
+		x, err := r.parse()
+		if err != nil {
+			return fmt.Errorf("invalid Workload API response: %v", err)
+		}
+		onUpdate(x)
+	}
+}
+
+// grpcStatus returns the error of a non-OK grpc-status in h, if any.
+func grpcStatus(h http.Header) error {
+	status := h.Get("Grpc-Status")
+	if len(status) == 0 || status == "0" {
+		return nil
+	}
+	msg, _ := url.PathUnescape(h.Get("Grpc-Message"))
+	return fmt.Errorf("error %s from Workload API: %s", status, msg)
+}
+
+// parse decodes the DER-encoded certificates and keys of r.
+func (r *x509SVIDResponse) parse() (*X509Context, error) {
+	if len(r.Svids) == 0 {
+		return nil, errors.New("no SVIDs")
+	}
+	x := &X509Context{Bundles: make(map[string][]*x509.Certificate)}
+	for _, s := range r.Svids {
+		certs, err := x509.ParseCertificates(s.X509Svid)
+		if err != nil || len(certs) == 0 {
+			return nil, fmt.Errorf("invalid certificates of SVID %s: %v", s.SpiffeId, err)
+		}
+		key, err := x509.ParsePKCS8PrivateKey(s.X509SvidKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key of SVID %s: %v", s.SpiffeId, err)
+		}
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("invalid key of SVID %s", s.SpiffeId)
+		}
+		x.SVIDs = append(x.SVIDs, &SVID{ID: s.SpiffeId, Certificates: certs, PrivateKey: signer})
+
+		bundle, err := x509.ParseCertificates(s.Bundle)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bundle of SVID %s: %v", s.SpiffeId, err)
+		}
+		x.Bundles[trustDomain(s.SpiffeId)] = bundle
+	}
+	for td, b := range r.FederatedBundles {
+		bundle, err := x509.ParseCertificates(b)
+		if err != nil {
+			return nil, fmt.Errorf("invalid federated bundle of %s: %v", td, err)
+		}
+		x.Bundles[trustDomain(td)] = bundle
+	}
+	return x, nil
+}
+
+// trustDomain returns the trust domain name of a SPIFFE ID or trust domain
+// ID.
+func trustDomain(id string) string {
+	td := strings.TrimPrefix(id, "spiffe://")
+	if i := strings.Index(td, "/"); i >= 0 {
+		td = td[:i]
+	}
+	return td
+}
@@ -0,0 +1,284 @@
+//    Copyright 2017 Red Hat, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+// Package vault reads secrets from HashiCorp Vault, authenticated by
+// Kubernetes or AppRole login.
+package vault
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/syndesisio/token-rp/pkg/kube"
+)
+
+// Auth methods.
+const (
+	// KubernetesAuth logs in with the pod's service account token.
+	KubernetesAuth = "kubernetes"
+	// AppRoleAuth logs in with a role ID and secret ID.
+	AppRoleAuth = "approle"
+)
+
+// Config configures a Client.
+type Config struct {
+	// Address is the URL of Vault, e.g. https://vault:8200.
+	Address string
+	// CACert is a file of PEM root certificates trusted in addition to the
+	// system roots, unless empty.
+	CACert string
+	// AuthMethod is KubernetesAuth or AppRoleAuth, mounted at AuthMount or
+	// at its name if empty.
+	AuthMethod string
+	AuthMount  string
+	// Role is the role of Kubernetes auth.
+	Role string
+	// RoleID and SecretIDFile are the credentials of AppRole auth. The
+	// secret ID is read for every login, so it can be rotated.
+	RoleID       string
+	SecretIDFile string
+}
+
+// Client reads secrets, logging in on first use and renewing its token
+// before its lease runs out, or logging in again if it can't be renewed.
+type Client struct {
+	cfg Config
+	hc  *http.Client
+
+	mu        sync.Mutex
+	token     string
+	renewable bool
+	renewAt   time.Time
+	expiresAt time.Time
+}
+
+// NewClient returns a client for cfg.
+func NewClient(cfg Config) (*Client, error) {
+	if len(cfg.Address) == 0 {
+		return nil, errors.New("no Vault address")
+	}
+	switch cfg.AuthMethod {
+	case KubernetesAuth:
+		if len(cfg.Role) == 0 {
+			return nil, errors.New("kubernetes auth requires a role")
+		}
+	case AppRoleAuth:
+		if len(cfg.RoleID) == 0 || len(cfg.SecretIDFile) == 0 {
+			return nil, errors.New("approle auth requires a role ID and secret ID file")
+		}
+	default:
+		return nil, fmt.Errorf("unknown auth method %q", cfg.AuthMethod)
+	}
+	if len(cfg.AuthMount) == 0 {
+		cfg.AuthMount = cfg.AuthMethod
+	}
+
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cert pool: %v", err)
+	}
+	if len(cfg.CACert) > 0 {
+		b, err := ioutil.ReadFile(cfg.CACert)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read Vault CA certificate: %v", err)
+		}
+		pool.AppendCertsFromPEM(b)
+	}
+	return &Client{
+		cfg: cfg,
+		hc: &http.Client{
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: &tls.Config{RootCAs: pool},
+			},
+			Timeout: 10 * time.Second,
+		},
+	}, nil
+}
+
+// Read returns the values of the secret at path, e.g. secret/data/token-rp
+// for version 2 of the KV engine, along with a version that changes
+// whenever they do. Values that aren't strings are JSON encoded.
+func (c *Client) Read(ctx context.Context, path string) (map[string]string, string, error) {
+	token, err := c.authToken(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	var secret struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err = c.do(ctx, http.MethodGet, strings.TrimPrefix(path, "/"), token, nil, &secret); err != nil {
+		c.forget(token)
+		return nil, "", err
+	}
+
+	data := secret.Data
+	// KV version 2 nests the values below data, next to metadata.
+	if nested, ok := data["data"].(map[string]interface{}); ok {
+		if _, ok := data["metadata"]; ok {
+			data = nested
+		}
+	}
+	values := make(map[string]string, len(data))
+	for k, v := range data {
+		if s, ok := v.(string); ok {
+			values[k] = s
+			continue
+		}
+		b, err := json.Marshal(v)
+		if err != nil {
+			return nil, "", err
+		}
+		values[k] = string(b)
+	}
+	return values, valuesVersion(values), nil
+}
+
+// valuesVersion hashes values in key order.
+func valuesVersion(values map[string]string) string {
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	h := sha256.New()
+	for _, k := range keys {
+		fmt.Fprintf(h, "%q=%q\n", k, values[k])
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+type authResponse struct {
+	Auth struct {
+		ClientToken   string `json:"client_token"`
+		LeaseDuration int64  `json:"lease_duration"`
+		Renewable     bool   `json:"renewable"`
+	} `json:"auth"`
+}
+
+// authToken returns a valid token, renewing it once two thirds of its lease
+// have passed, or logging in if there is none or renewal fails.
+func (c *Client) authToken(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if len(c.token) > 0 && (c.renewAt.IsZero() || now.Before(c.renewAt)) {
+		return c.token, nil
+	}
+	if len(c.token) > 0 && c.renewable && now.Before(c.expiresAt) {
+		var resp authResponse
+		if err := c.do(ctx, http.MethodPost, "auth/token/renew-self", c.token, struct{}{}, &resp); err == nil && len(resp.Auth.ClientToken) > 0 {
+			c.store(resp, now)
+			return c.token, nil
+		}
+	}
+
+	var login interface{}
+	switch c.cfg.AuthMethod {
+	case KubernetesAuth:
+		jwt, err := ioutil.ReadFile(kube.TokenFile)
+		if err != nil {
+			return "", fmt.Errorf("unable to read service account token: %v", err)
+		}
+		login = map[string]string{"role": c.cfg.Role, "jwt": strings.TrimSpace(string(jwt))}
+	case AppRoleAuth:
+		secretID, err := ioutil.ReadFile(c.cfg.SecretIDFile)
+		if err != nil {
+			return "", fmt.Errorf("unable to read AppRole secret ID: %v", err)
+		}
+		login = map[string]string{"role_id": c.cfg.RoleID, "secret_id": strings.TrimSpace(string(secretID))}
+	}
+	var resp authResponse
+	if err := c.do(ctx, http.MethodPost, "auth/"+c.cfg.AuthMount+"/login", "", login, &resp); err != nil {
+		return "", fmt.Errorf("login to Vault failed: %v", err)
+	}
+	if len(resp.Auth.ClientToken) == 0 {
+		return "", errors.New("login to Vault returned no token")
+	}
+	c.store(resp, now)
+	return c.token, nil
+}
+
+// forget drops token after a failed request, in case it was revoked, so the
+// next request logs in again.
+func (c *Client) forget(token string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.token == token {
+		c.token = ""
+	}
+}
+
+// store keeps the token of resp, issued at now.
+func (c *Client) store(resp authResponse, now time.Time) {
+	c.token, c.renewable = resp.Auth.ClientToken, resp.Auth.Renewable
+	c.renewAt, c.expiresAt = time.Time{}, time.Time{}
+	if lease := time.Duration(resp.Auth.LeaseDuration) * time.Second; lease > 0 {
+		c.renewAt = now.Add(lease * 2 / 3)
+		c.expiresAt = now.Add(lease)
+	}
+}
+
+func (c *Client) do(ctx context.Context, method, path, token string, in, out interface{}) error {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, strings.TrimSuffix(c.cfg.Address, "/")+"/v1/"+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if len(token) > 0 {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.hc.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		var errResp struct {
+			Errors []string `json:"errors"`
+		}
+		if json.NewDecoder(resp.Body).Decode(&errResp) == nil && len(errResp.Errors) > 0 {
+			return fmt.Errorf("%s %s rejected: %s: %s", method, path, resp.Status, strings.Join(errResp.Errors, "; "))
+		}
+		return fmt.Errorf("%s %s rejected: %s", method, path, resp.Status)
+	}
+	if err = json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("unable to decode response of %s: %v", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+//    Copyright 2017 Red Hat, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package verify
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	jwtgo "github.com/dgrijalva/jwt-go"
+)
+
+// Client authentication methods, as registered for OAuth 2.0.
+const (
+	// ClientSecretBasic sends the client secret with HTTP Basic
+	// authentication.
+	ClientSecretBasic = "client_secret_basic"
+	// ClientSecretPost sends the client secret as form parameter.
+	ClientSecretPost = "client_secret_post"
+	// PrivateKeyJWT sends a JWT signed with the client's private key, see
+	// RFC 7523.
+	PrivateKeyJWT = "private_key_jwt"
+)
+
+// assertionLifetime is how long client assertions are valid.
+const assertionLifetime = time.Minute
+
+// ClientCredentials authenticate token-rp as confidential client to the
+// endpoints of the provider that require it, such as token introspection.
+type ClientCredentials struct {
+	ClientID string
+	// Method is one of ClientSecretBasic, ClientSecretPost and
+	// PrivateKeyJWT.
+	Method string
+	Secret string
+	// Key signs the client assertions of PrivateKeyJWT, with KeyID as 'kid'
+	// header unless empty.
+	Key   crypto.Signer
+	KeyID string
+}
+
+// Authenticate adds the credentials to req, whose form is form. Client
+// assertions are issued for audience, the identifier of the provider.
+func (c *ClientCredentials) Authenticate(req *http.Request, form url.Values, audience string) error {
+	switch c.Method {
+	case ClientSecretBasic:
+		req.SetBasicAuth(url.QueryEscape(c.ClientID), url.QueryEscape(c.Secret))
+	case ClientSecretPost:
+		form.Set("client_id", c.ClientID)
+		form.Set("client_secret", c.Secret)
+	case PrivateKeyJWT:
+		assertion, err := c.assertion(audience)
+		if err != nil {
+			return fmt.Errorf("unable to sign client assertion: %v", err)
+		}
+		form.Set("client_id", c.ClientID)
+		form.Set("client_assertion_type", "urn:ietf:params:oauth:client-assertion-type:jwt-bearer")
+		form.Set("client_assertion", assertion)
+	default:
+		return fmt.Errorf("unknown client authentication method %q", c.Method)
+	}
+	return nil
+}
+
+// assertion returns a single-use JWT identifying the client to audience.
+func (c *ClientCredentials) assertion(audience string) (string, error) {
+	var method jwtgo.SigningMethod
+	switch k := c.Key.(type) {
+	case *rsa.PrivateKey:
+		method = jwtgo.SigningMethodRS256
+	case *ecdsa.PrivateKey:
+		switch k.Curve {
+		case elliptic.P256():
+			method = jwtgo.SigningMethodES256
+		case elliptic.P384():
+			method = jwtgo.SigningMethodES384
+		case elliptic.P521():
+			method = jwtgo.SigningMethodES512
+		default:
+			return "", errors.New("unsupported elliptic curve")
+		}
+	default:
+		return "", fmt.Errorf("unsupported key type %T", c.Key)
+	}
+
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return "", err
+	}
+	now := time.Now()
+	t := jwtgo.NewWithClaims(method, jwtgo.MapClaims{
+		"iss": c.ClientID,
+		"sub": c.ClientID,
+		"aud": audience,
+		"jti": hex.EncodeToString(jti),
+		"iat": now.Unix(),
+		"exp": now.Add(assertionLifetime).Unix(),
+	})
+	if len(c.KeyID) > 0 {
+		t.Header["kid"] = c.KeyID
+	}
+	return t.SignedString(c.Key)
+}
+
+// LoadClientKey reads a PEM encoded RSA or ECDSA private key, in PKCS #8,
+// PKCS #1 or SEC 1 form, from file.
+func LoadClientKey(file string) (crypto.Signer, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM encoded key found", file)
+	}
+	if key, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		switch key := key.(type) {
+		case *rsa.PrivateKey:
+			return key, nil
+		case *ecdsa.PrivateKey:
+			return key, nil
+		}
+		return nil, fmt.Errorf("%s: unsupported key type", file)
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	return nil, fmt.Errorf("%s: unable to parse private key", file)
+}
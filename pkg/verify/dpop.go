@@ -0,0 +1,173 @@
+//    Copyright 2017 Red Hat, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package verify
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-oidc/jose"
+	jwtgo "github.com/dgrijalva/jwt-go"
+)
+
+// dpopAlgs are the signature algorithms accepted for DPoP proofs, which must
+// be asymmetric.
+var dpopAlgs = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}
+
+// DPoPProof is a verified DPoP proof (RFC 9449).
+type DPoPProof struct {
+	// Thumbprint is the JWK SHA-256 thumbprint of the key the proof was
+	// signed with, which the access token must be bound to.
+	Thumbprint string
+	ID         string
+	IssuedAt   time.Time
+}
+
+// VerifyDPoPProof verifies that proof is signed by the key in its header and
+// was made for a request with method to target presenting accessToken,
+// issued no longer than maxAge ago, tolerating skew of the client's clock.
+func VerifyDPoPProof(proof, method string, target *url.URL, accessToken string, maxAge, skew time.Duration) (*DPoPProof, error) {
+	parts := strings.Split(proof, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("invalid DPoP proof: malformed JWT")
+	}
+	var header struct {
+		Type string                 `json:"typ"`
+		Alg  string                 `json:"alg"`
+		JWK  map[string]interface{} `json:"jwk"`
+	}
+	var claims map[string]interface{}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("invalid DPoP proof header: %v", err)
+	}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("invalid DPoP proof claims: %v", err)
+	}
+	if header.Type != "dpop+jwt" {
+		return nil, fmt.Errorf("unexpected DPoP proof typ %q", header.Type)
+	}
+	if !containsString(dpopAlgs, header.Alg) {
+		return nil, fmt.Errorf("DPoP proof signing algorithm %q not allowed", header.Alg)
+	}
+	if header.JWK == nil {
+		return nil, errors.New("DPoP proof lacks jwk header")
+	}
+	if _, private := header.JWK["d"]; private {
+		return nil, errors.New("DPoP proof jwk header holds a private key")
+	}
+	var jwk JSONWebKey
+	b, err := json.Marshal(header.JWK)
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(b, &jwk); err != nil {
+		return nil, fmt.Errorf("invalid DPoP proof jwk header: %v", err)
+	}
+	key, err := jwk.publicKey()
+	if err != nil {
+		return nil, fmt.Errorf("invalid DPoP proof jwk header: %v", err)
+	}
+	if err = jwtgo.GetSigningMethod(header.Alg).Verify(parts[0]+"."+parts[1], parts[2], key); err != nil {
+		return nil, fmt.Errorf("unable to verify DPoP proof signature: %v", err)
+	}
+
+	jti, _ := claims["jti"].(string)
+	if len(jti) == 0 {
+		return nil, errors.New("DPoP proof lacks jti")
+	}
+	if htm, _ := claims["htm"].(string); htm != method {
+		return nil, fmt.Errorf("DPoP proof is for method %q", htm)
+	}
+	htu, _ := claims["htu"].(string)
+	if !dpopTargetMatches(htu, target) {
+		return nil, fmt.Errorf("DPoP proof is for %q", htu)
+	}
+	iat, ok := claims["iat"].(float64)
+	if !ok {
+		return nil, errors.New("DPoP proof lacks iat")
+	}
+	issuedAt := time.Unix(int64(iat), 0)
+	if now := time.Now(); issuedAt.After(now.Add(skew)) || issuedAt.Before(now.Add(-maxAge-skew)) {
+		return nil, errors.New("DPoP proof is expired or not yet valid")
+	}
+	hash := sha256.Sum256([]byte(accessToken))
+	if ath, _ := claims["ath"].(string); ath != base64.RawURLEncoding.EncodeToString(hash[:]) {
+		return nil, errors.New("DPoP proof is for a different access token")
+	}
+
+	thumbprint, err := jwk.Thumbprint()
+	if err != nil {
+		return nil, err
+	}
+	return &DPoPProof{Thumbprint: thumbprint, ID: jti, IssuedAt: issuedAt}, nil
+}
+
+// decodeSegment decodes the base64url encoded JSON of a JWT segment into v.
+func decodeSegment(seg string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(seg, "="))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// dpopTargetMatches reports whether the htu claim of a DPoP proof names
+// target, ignoring its query and fragment, default ports and the case of
+// scheme and host.
+func dpopTargetMatches(htu string, target *url.URL) bool {
+	u, err := url.Parse(htu)
+	if err != nil {
+		return false
+	}
+	normalize := func(u *url.URL) string {
+		scheme, host := strings.ToLower(u.Scheme), strings.ToLower(u.Host)
+		host = strings.TrimSuffix(host, map[string]string{"http": ":80", "https": ":443"}[scheme])
+		path := u.EscapedPath()
+		if len(path) == 0 {
+			path = "/"
+		}
+		return scheme + "://" + host + path
+	}
+	return normalize(u) == normalize(target)
+}
+
+// Thumbprint returns the JWK SHA-256 thumbprint of k (RFC 7638).
+func (k *JSONWebKey) Thumbprint() (string, error) {
+	var members string
+	switch k.Type {
+	case "RSA":
+		members = fmt.Sprintf(`{"e":%q,"kty":"RSA","n":%q}`, k.E, k.N)
+	case "EC":
+		members = fmt.Sprintf(`{"crv":%q,"kty":"EC","x":%q,"y":%q}`, k.Curve, k.X, k.Y)
+	default:
+		return "", fmt.Errorf("unsupported key type %q", k.Type)
+	}
+	sum := sha256.Sum256([]byte(members))
+	return base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
+
+// ConfirmationThumbprint returns the JWK thumbprint the token of claims is
+// bound to by its cnf claim, or "" if it isn't DPoP-bound.
+func ConfirmationThumbprint(claims jose.Claims) string {
+	cnf, _ := claims["cnf"].(map[string]interface{})
+	jkt, _ := cnf["jkt"].(string)
+	return jkt
+}
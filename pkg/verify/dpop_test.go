@@ -0,0 +1,249 @@
+//    Copyright 2017 Red Hat, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package verify
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-oidc/jose"
+	jwtgo "github.com/dgrijalva/jwt-go"
+)
+
+// ecJWK returns the JWK of pub.
+func ecJWK(pub *ecdsa.PublicKey) JSONWebKey {
+	size := (pub.Curve.Params().BitSize + 7) / 8
+	return JSONWebKey{
+		Type:  "EC",
+		Curve: pub.Curve.Params().Name,
+		X:     base64.RawURLEncoding.EncodeToString(pub.X.FillBytes(make([]byte, size))),
+		Y:     base64.RawURLEncoding.EncodeToString(pub.Y.FillBytes(make([]byte, size))),
+	}
+}
+
+// signDPoPProof signs a proof with key, encoding header and claims as given.
+func signDPoPProof(t *testing.T, key *ecdsa.PrivateKey, header, claims map[string]interface{}) string {
+	t.Helper()
+	hb, err := json.Marshal(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cb, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signingString := base64.RawURLEncoding.EncodeToString(hb) + "." + base64.RawURLEncoding.EncodeToString(cb)
+	sig, err := jwtgo.SigningMethodES256.Sign(signingString, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signingString + "." + sig
+}
+
+func TestVerifyDPoPProof(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwk := ecJWK(&key.PublicKey)
+	thumbprint, err := jwk.Thumbprint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	const accessToken = "eyJhbGciOiJSUzI1NiJ9.eyJzdWIiOiJhbGljZSJ9.c2ln"
+	ath := sha256.Sum256([]byte(accessToken))
+	target, _ := url.Parse("https://git.example.com/repo.git/info/refs?service=git-upload-pack")
+	now := time.Now()
+
+	validHeader := func() map[string]interface{} {
+		var jwkMap map[string]interface{}
+		b, _ := json.Marshal(jwk)
+		_ = json.Unmarshal(b, &jwkMap)
+		return map[string]interface{}{"typ": "dpop+jwt", "alg": "ES256", "jwk": jwkMap}
+	}
+	validClaims := func() map[string]interface{} {
+		return map[string]interface{}{
+			"jti": "e1j3V_bKic8-LAEB",
+			"htm": "GET",
+			"htu": "https://git.example.com/repo.git/info/refs",
+			"iat": now.Unix(),
+			"ath": base64.RawURLEncoding.EncodeToString(ath[:]),
+		}
+	}
+
+	tests := []struct {
+		name    string
+		header  func(h map[string]interface{})
+		claims  func(c map[string]interface{})
+		signer  *ecdsa.PrivateKey
+		wantErr string
+	}{
+		{name: "valid"},
+		{
+			name:   "htu with default port and other case",
+			claims: func(c map[string]interface{}) { c["htu"] = "HTTPS://Git.Example.com:443/repo.git/info/refs" },
+		},
+		{
+			name:   "issued within skew",
+			claims: func(c map[string]interface{}) { c["iat"] = now.Add(5 * time.Second).Unix() },
+		},
+		{
+			name:    "wrong typ",
+			header:  func(h map[string]interface{}) { h["typ"] = "JWT" },
+			wantErr: "unexpected DPoP proof typ",
+		},
+		{
+			name:    "symmetric alg",
+			header:  func(h map[string]interface{}) { h["alg"] = "HS256" },
+			wantErr: "not allowed",
+		},
+		{
+			name:    "no jwk",
+			header:  func(h map[string]interface{}) { delete(h, "jwk") },
+			wantErr: "lacks jwk",
+		},
+		{
+			name:    "private jwk",
+			header:  func(h map[string]interface{}) { h["jwk"].(map[string]interface{})["d"] = "AQAB" },
+			wantErr: "private key",
+		},
+		{
+			name:    "signed with another key",
+			signer:  otherKey,
+			wantErr: "signature",
+		},
+		{
+			name:    "no jti",
+			claims:  func(c map[string]interface{}) { delete(c, "jti") },
+			wantErr: "lacks jti",
+		},
+		{
+			name:    "other method",
+			claims:  func(c map[string]interface{}) { c["htm"] = "POST" },
+			wantErr: "for method",
+		},
+		{
+			name:    "other target",
+			claims:  func(c map[string]interface{}) { c["htu"] = "https://git.example.com/other.git/info/refs" },
+			wantErr: "is for",
+		},
+		{
+			name:    "other host",
+			claims:  func(c map[string]interface{}) { c["htu"] = "https://evil.example.com/repo.git/info/refs" },
+			wantErr: "is for",
+		},
+		{
+			name:    "no iat",
+			claims:  func(c map[string]interface{}) { delete(c, "iat") },
+			wantErr: "lacks iat",
+		},
+		{
+			name:    "expired",
+			claims:  func(c map[string]interface{}) { c["iat"] = now.Add(-2 * time.Minute).Unix() },
+			wantErr: "expired",
+		},
+		{
+			name:    "issued in the future",
+			claims:  func(c map[string]interface{}) { c["iat"] = now.Add(time.Minute).Unix() },
+			wantErr: "not yet valid",
+		},
+		{
+			name:    "other access token",
+			claims:  func(c map[string]interface{}) { c["ath"] = "x" },
+			wantErr: "different access token",
+		},
+	}
+	for _, tt := range tests {
+		header, claims := validHeader(), validClaims()
+		if tt.header != nil {
+			tt.header(header)
+		}
+		if tt.claims != nil {
+			tt.claims(claims)
+		}
+		signer := key
+		if tt.signer != nil {
+			signer = tt.signer
+		}
+		proof := signDPoPProof(t, signer, header, claims)
+
+		p, err := VerifyDPoPProof(proof, "GET", target, accessToken, time.Minute, 10*time.Second)
+		if len(tt.wantErr) > 0 {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%s: VerifyDPoPProof() error = %v, want %q", tt.name, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: VerifyDPoPProof() failed: %v", tt.name, err)
+			continue
+		}
+		if p.Thumbprint != thumbprint || p.ID != "e1j3V_bKic8-LAEB" {
+			t.Errorf("%s: VerifyDPoPProof() = %+v, want thumbprint %s", tt.name, p, thumbprint)
+		}
+	}
+
+	if _, err = VerifyDPoPProof("a.b", "GET", target, accessToken, time.Minute, 0); err == nil {
+		t.Error("VerifyDPoPProof() of a malformed proof succeeded")
+	}
+}
+
+func TestThumbprint(t *testing.T) {
+	// RFC 7638, section 3.1.
+	k := JSONWebKey{
+		Type: "RSA",
+		N:    "0vx7agoebGcQSuuPiLJXZptN9nndrQmbXEps2aiAFbWhM78LhWx4cbbfAAtVT86zwu1RK7aPFFxuhDR1L6tSoc_BJECPebWKRXjBZCiFV4n3oknjhMstn64tZ_2W-5JsGY4Hc5n9yBXArwl93lqt7_RN5w6Cf0h4QyQ5v-65YGjQR0_FDW2QvzqY368QQMicAtaSqzs8KJZgnYb9c7d0zgdAZHzu6qMQvRL5hajrn1n91CbOpbISD08qNLyrdkt-bFTWhAI4vMQFh6WeZu0fM4lFd2NcRwr3XPksINHaQ-G_xBniIqbw0Ls1jF44-csFCur-kEgU8awapJzKnqDKgw",
+		E:    "AQAB",
+	}
+	got, err := k.Thumbprint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs"; got != want {
+		t.Errorf("Thumbprint() = %s, want %s", got, want)
+	}
+
+	if _, err = (&JSONWebKey{Type: "oct"}).Thumbprint(); err == nil {
+		t.Error("Thumbprint() of a symmetric key succeeded")
+	}
+}
+
+func TestConfirmationThumbprint(t *testing.T) {
+	tests := []struct {
+		claims jose.Claims
+		want   string
+	}{
+		{jose.Claims{"cnf": map[string]interface{}{"jkt": "0ZcOCORZNYy-DWpqq30jZyJGHTN0d2HglBV3uiguA4I"}}, "0ZcOCORZNYy-DWpqq30jZyJGHTN0d2HglBV3uiguA4I"},
+		{jose.Claims{"cnf": map[string]interface{}{"x5t#S256": "bwcK0esc3ACC3DB2Y5_lESsXE8o9ltc05O89jdN-dg2"}}, ""},
+		{jose.Claims{"sub": "alice"}, ""},
+	}
+	for _, tt := range tests {
+		if got := ConfirmationThumbprint(tt.claims); got != tt.want {
+			t.Errorf("ConfirmationThumbprint(%v) = %q, want %q", tt.claims, got, tt.want)
+		}
+	}
+}
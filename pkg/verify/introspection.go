@@ -0,0 +1,102 @@
+//    Copyright 2017 Red Hat, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package verify
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/coreos/go-oidc/jose"
+)
+
+// IntrospectionMode presents tokens to the provider's token introspection
+// endpoint, see RFC 7662.
+const IntrospectionMode = "introspection"
+
+// IntrospectionVerifier verifies tokens by asking the provider's
+// introspection endpoint whether they are active, authenticated with the
+// client credentials of token-rp. Unlike local verification, this rejects
+// tokens revoked before they expire, e.g. by logging out.
+type IntrospectionVerifier struct {
+	Client           *http.Client
+	IntrospectionURL string
+	// Issuer is the identifier of the provider, the audience of client
+	// assertions.
+	Issuer      string
+	Credentials *ClientCredentials
+}
+
+func (v *IntrospectionVerifier) Verify(token string) (jose.Claims, error) {
+	form := url.Values{"token": {token}, "token_type_hint": {"access_token"}}
+	req, err := http.NewRequest("POST", v.IntrospectionURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err = v.Credentials.Authenticate(req, form, v.Issuer); err != nil {
+		return nil, err
+	}
+	body := form.Encode()
+	req.Body = ioutil.NopCloser(strings.NewReader(body))
+	req.ContentLength = int64(len(body))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := v.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("introspection request rejected: %s", resp.Status)
+	}
+
+	var claims jose.Claims
+	if err = json.NewDecoder(resp.Body).Decode(&claims); err != nil {
+		return nil, fmt.Errorf("unable to decode introspection response: %v", err)
+	}
+	if active, _ := claims["active"].(bool); !active {
+		return nil, errors.New("token is not active")
+	}
+	delete(claims, "active")
+	return claims, nil
+}
+
+// IntrospectionEndpoint returns the introspection endpoint advertised by the
+// discovery document of issuerURL, falling back to the location of
+// Keycloak's below tokenEndpoint.
+func IntrospectionEndpoint(hc *http.Client, issuerURL, tokenEndpoint string) (string, error) {
+	resp, err := hc.Get(issuerURL + "/.well-known/openid-configuration")
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != 200 {
+		return "", fmt.Errorf("discovery request rejected: %s", resp.Status)
+	}
+	var doc struct {
+		IntrospectionEndpoint string `json:"introspection_endpoint"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return "", fmt.Errorf("unable to decode discovery document: %v", err)
+	}
+	if len(doc.IntrospectionEndpoint) > 0 {
+		return doc.IntrospectionEndpoint, nil
+	}
+	return tokenEndpoint + "/introspect", nil
+}
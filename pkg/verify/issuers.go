@@ -0,0 +1,81 @@
+//    Copyright 2017 Red Hat, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package verify
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/coreos/go-oidc/jose"
+)
+
+// Issuer is a provider whose tokens are accepted by the proxy and whose
+// broker endpoint is used to exchange them.
+type Issuer struct {
+	// URL is the configured issuer URL that broker URLs are built from.
+	URL string
+	// ID is the issuer identifier as it appears in the 'iss' claim.
+	ID       string
+	Verifier Verifier
+	// AnyIssuer makes the issuer take tokens of issuers that aren't
+	// trusted themselves, such as the Kubernetes service account tokens
+	// accepted by a TokenReviewVerifier.
+	AnyIssuer bool
+}
+
+// Issuers are the trusted issuers.
+type Issuers []*Issuer
+
+// ForToken selects the issuer of token based on its (not yet verified) 'iss'
+// claim, or the first issuer with AnyIssuer if none matches. Tokens without a
+// readable 'iss' claim, such as opaque tokens in userinfo mode, are only
+// accepted when a single issuer is configured.
+func (t Issuers) ForToken(token string) (*Issuer, error) {
+	jwt, err := jose.ParseJWT(token)
+	if err != nil {
+		if len(t) == 1 {
+			return t[0], nil
+		}
+		return nil, err
+	}
+
+	claims, err := jwt.Claims()
+	if err != nil {
+		return nil, err
+	}
+	iss, ok, err := claims.StringClaim("iss")
+	if err != nil {
+		return nil, err
+	} else if !ok {
+		if len(t) == 1 {
+			return t[0], nil
+		}
+		return nil, errors.New("missing claim: 'iss'")
+	}
+
+	for _, ti := range t {
+		if strings.TrimSuffix(ti.ID, "/") == strings.TrimSuffix(iss, "/") {
+			return ti, nil
+		}
+	}
+	for _, ti := range t {
+		if ti.AnyIssuer {
+			return ti, nil
+		}
+	}
+
+	return nil, fmt.Errorf("untrusted issuer: %s", iss)
+}
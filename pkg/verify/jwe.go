@@ -0,0 +1,398 @@
+//    Copyright 2017 Red Hat, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package verify
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"strings"
+)
+
+// DecryptionKey is a private key that tokens are encrypted for.
+type DecryptionKey struct {
+	// ID is the 'kid' of the key, empty for keys read from PEM files.
+	ID  string
+	Key crypto.PrivateKey // *rsa.PrivateKey or *ecdsa.PrivateKey
+}
+
+// privateJSONWebKey is a JSONWebKey with its private members.
+type privateJSONWebKey struct {
+	JSONWebKey
+	D string `json:"d"`
+	P string `json:"p"`
+	Q string `json:"q"`
+}
+
+// LoadDecryptionKeys reads the RSA and ECDSA private keys of file, either a
+// JWKS document or PEM blocks in PKCS #8, PKCS #1 or SEC 1 form.
+func LoadDecryptionKeys(file string) ([]DecryptionKey, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []DecryptionKey
+	if trimmed := bytes.TrimSpace(b); len(trimmed) > 0 && trimmed[0] == '{' {
+		var jwks struct {
+			Keys []privateJSONWebKey `json:"keys"`
+		}
+		if err = json.Unmarshal(trimmed, &jwks); err != nil {
+			return nil, fmt.Errorf("%s: invalid JWKS: %v", file, err)
+		}
+		for _, k := range jwks.Keys {
+			if k.Use == "sig" {
+				continue
+			}
+			key, err := k.privateKey()
+			if err != nil {
+				return nil, fmt.Errorf("%s: key %q: %v", file, k.KeyID, err)
+			}
+			keys = append(keys, DecryptionKey{ID: k.KeyID, Key: key})
+		}
+	} else {
+		for block, rest := pem.Decode(b); block != nil; block, rest = pem.Decode(rest) {
+			key, err := parsePrivateKey(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", file, err)
+			}
+			keys = append(keys, DecryptionKey{Key: key})
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s: no decryption keys found", file)
+	}
+	return keys, nil
+}
+
+func parsePrivateKey(der []byte) (crypto.PrivateKey, error) {
+	if key, err := x509.ParsePKCS8PrivateKey(der); err == nil {
+		switch key := key.(type) {
+		case *rsa.PrivateKey, *ecdsa.PrivateKey:
+			return key, nil
+		}
+		return nil, errors.New("unsupported key type")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(der); err == nil {
+		return key, nil
+	}
+	return nil, errors.New("unable to parse private key")
+}
+
+func (k *privateJSONWebKey) privateKey() (crypto.PrivateKey, error) {
+	pub, err := k.publicKey()
+	if err != nil {
+		return nil, err
+	}
+	d, err := decodeBigInt(k.D)
+	if err != nil || d.Sign() == 0 {
+		return nil, errors.New("missing private key")
+	}
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		p, err := decodeBigInt(k.P)
+		if err != nil {
+			return nil, err
+		}
+		q, err := decodeBigInt(k.Q)
+		if err != nil {
+			return nil, err
+		}
+		key := &rsa.PrivateKey{PublicKey: *pub, D: d}
+		if p.Sign() > 0 && q.Sign() > 0 {
+			key.Primes = append(key.Primes, p, q)
+			key.Precompute()
+		}
+		return key, nil
+	case *ecdsa.PublicKey:
+		return &ecdsa.PrivateKey{PublicKey: *pub, D: d}, nil
+	}
+	return nil, errors.New("unsupported key type")
+}
+
+// IsEncrypted reports whether token is a JWE in compact serialization,
+// which has five segments rather than the three of a JWS.
+func IsEncrypted(token string) bool {
+	return strings.Count(token, ".") == 4
+}
+
+type jweHeader struct {
+	Alg   string      `json:"alg"`
+	Enc   string      `json:"enc"`
+	Zip   string      `json:"zip"`
+	KeyID string      `json:"kid"`
+	EPK   *JSONWebKey `json:"epk"`
+	APU   string      `json:"apu"`
+	APV   string      `json:"apv"`
+}
+
+// Decrypt decrypts token, a JWE in compact serialization such as a nested
+// JWT, with the first of keys that matches its 'kid' header, or that it can
+// be decrypted with. Supported are the key management algorithms RSA-OAEP,
+// RSA-OAEP-256, ECDH-ES and ECDH-ES with AES key wrap, and AES GCM and AES
+// CBC with HMAC SHA-2 content encryption.
+func Decrypt(token string, keys []DecryptionKey) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 5 {
+		return "", errors.New("malformed JWE")
+	}
+	var header jweHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return "", fmt.Errorf("invalid JWE header: %v", err)
+	}
+	if len(header.Zip) > 0 {
+		return "", fmt.Errorf("unsupported JWE compression %q", header.Zip)
+	}
+	var segs [4][]byte
+	for i, p := range parts[1:] {
+		var err error
+		if segs[i], err = base64.RawURLEncoding.DecodeString(p); err != nil {
+			return "", fmt.Errorf("invalid JWE segment: %v", err)
+		}
+	}
+	encryptedKey, iv, ciphertext, tag := segs[0], segs[1], segs[2], segs[3]
+
+	keyLen, err := contentKeyLen(header.Enc)
+	if err != nil {
+		return "", err
+	}
+	err = errors.New("no decryption key")
+	for _, k := range keys {
+		if len(header.KeyID) > 0 && len(k.ID) > 0 && k.ID != header.KeyID {
+			continue
+		}
+		var cek []byte
+		if cek, err = header.contentKey(k.Key, encryptedKey, keyLen); err != nil {
+			continue
+		}
+		var plaintext []byte
+		if plaintext, err = decryptContent(header.Enc, cek, iv, ciphertext, tag, []byte(parts[0])); err != nil {
+			continue
+		}
+		return string(plaintext), nil
+	}
+	return "", fmt.Errorf("unable to decrypt JWE: %v", err)
+}
+
+// contentKeyLen returns the length in bytes of the content encryption key
+// of enc.
+func contentKeyLen(enc string) (int, error) {
+	switch enc {
+	case "A128GCM":
+		return 16, nil
+	case "A192GCM":
+		return 24, nil
+	case "A256GCM", "A128CBC-HS256":
+		return 32, nil
+	case "A192CBC-HS384":
+		return 48, nil
+	case "A256CBC-HS512":
+		return 64, nil
+	}
+	return 0, fmt.Errorf("unsupported JWE content encryption %q", enc)
+}
+
+// contentKey determines the content encryption key of keyLen bytes with
+// the private key.
+func (h *jweHeader) contentKey(key crypto.PrivateKey, encryptedKey []byte, keyLen int) ([]byte, error) {
+	switch h.Alg {
+	case "RSA-OAEP", "RSA-OAEP-256":
+		rsaKey, ok := key.(*rsa.PrivateKey)
+		if !ok {
+			return nil, errors.New("key is not an RSA key")
+		}
+		var hf hash.Hash = sha1.New()
+		if h.Alg == "RSA-OAEP-256" {
+			hf = sha256.New()
+		}
+		cek, err := rsa.DecryptOAEP(hf, rand.Reader, rsaKey, encryptedKey, nil)
+		if err != nil {
+			return nil, err
+		}
+		if len(cek) != keyLen {
+			return nil, errors.New("content key has wrong length")
+		}
+		return cek, nil
+	case "ECDH-ES", "ECDH-ES+A128KW", "ECDH-ES+A192KW", "ECDH-ES+A256KW":
+		ecKey, ok := key.(*ecdsa.PrivateKey)
+		if !ok {
+			return nil, errors.New("key is not an EC key")
+		}
+		if h.EPK == nil {
+			return nil, errors.New("missing epk header")
+		}
+		epk, err := h.EPK.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("invalid epk header: %v", err)
+		}
+		ecEPK, ok := epk.(*ecdsa.PublicKey)
+		if !ok || ecEPK.Curve != ecKey.Curve {
+			return nil, errors.New("epk header doesn't match the key")
+		}
+		priv, err := ecKey.ECDH()
+		if err != nil {
+			return nil, err
+		}
+		pub, err := ecEPK.ECDH()
+		if err != nil {
+			return nil, fmt.Errorf("invalid epk header: %v", err)
+		}
+		z, err := priv.ECDH(pub)
+		if err != nil {
+			return nil, err
+		}
+		apu, err := base64.RawURLEncoding.DecodeString(h.APU)
+		if err != nil {
+			return nil, fmt.Errorf("invalid apu header: %v", err)
+		}
+		apv, err := base64.RawURLEncoding.DecodeString(h.APV)
+		if err != nil {
+			return nil, fmt.Errorf("invalid apv header: %v", err)
+		}
+		if h.Alg == "ECDH-ES" {
+			if len(encryptedKey) > 0 {
+				return nil, errors.New("unexpected encrypted key")
+			}
+			return concatKDF(z, h.Enc, apu, apv, keyLen), nil
+		}
+		kekLen := map[string]int{"ECDH-ES+A128KW": 16, "ECDH-ES+A192KW": 24, "ECDH-ES+A256KW": 32}[h.Alg]
+		cek, err := aesKeyUnwrap(concatKDF(z, h.Alg, apu, apv, kekLen), encryptedKey)
+		if err != nil {
+			return nil, err
+		}
+		if len(cek) != keyLen {
+			return nil, errors.New("content key has wrong length")
+		}
+		return cek, nil
+	}
+	return nil, fmt.Errorf("unsupported JWE key management algorithm %q", h.Alg)
+}
+
+// concatKDF derives a key of keyLen bytes from the shared secret z as
+// specified for ECDH-ES by RFC 7518, section 4.6.2.
+func concatKDF(z []byte, alg string, apu, apv []byte, keyLen int) []byte {
+	var otherInfo []byte
+	for _, field := range [][]byte{[]byte(alg), apu, apv} {
+		otherInfo = binary.BigEndian.AppendUint32(otherInfo, uint32(len(field)))
+		otherInfo = append(otherInfo, field...)
+	}
+	otherInfo = binary.BigEndian.AppendUint32(otherInfo, uint32(keyLen*8))
+
+	var key []byte
+	for counter := uint32(1); len(key) < keyLen; counter++ {
+		h := sha256.New()
+		_ = binary.Write(h, binary.BigEndian, counter)
+		h.Write(z)
+		h.Write(otherInfo)
+		key = h.Sum(key)
+	}
+	return key[:keyLen]
+}
+
+// aesKeyUnwrap unwraps a key wrapped with kek (RFC 3394).
+func aesKeyUnwrap(kek, wrapped []byte) ([]byte, error) {
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped)%8 != 0 || len(wrapped) < 24 {
+		return nil, errors.New("invalid wrapped key")
+	}
+	n := len(wrapped)/8 - 1
+	a := make([]byte, 8)
+	copy(a, wrapped[:8])
+	r := make([]byte, n*8)
+	copy(r, wrapped[8:])
+	b := make([]byte, 16)
+	for j := 5; j >= 0; j-- {
+		for i := n; i >= 1; i-- {
+			t := uint64(n*j + i)
+			binary.BigEndian.PutUint64(b, binary.BigEndian.Uint64(a)^t)
+			copy(b[8:], r[(i-1)*8:i*8])
+			block.Decrypt(b, b)
+			copy(a, b[:8])
+			copy(r[(i-1)*8:], b[8:])
+		}
+	}
+	if subtle.ConstantTimeCompare(a, []byte{0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6}) != 1 {
+		return nil, errors.New("wrapped key integrity check failed")
+	}
+	return r, nil
+}
+
+// decryptContent authenticates and decrypts ciphertext with the content
+// encryption key cek.
+func decryptContent(enc string, cek, iv, ciphertext, tag, aad []byte) ([]byte, error) {
+	if strings.HasSuffix(enc, "GCM") {
+		block, err := aes.NewCipher(cek)
+		if err != nil {
+			return nil, err
+		}
+		gcm, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		if len(iv) != gcm.NonceSize() {
+			return nil, errors.New("invalid initialization vector")
+		}
+		return gcm.Open(nil, iv, append(ciphertext, tag...), aad)
+	}
+
+	hf := map[string]func() hash.Hash{"A128CBC-HS256": sha256.New, "A192CBC-HS384": sha512.New384, "A256CBC-HS512": sha512.New}[enc]
+	macKey, encKey := cek[:len(cek)/2], cek[len(cek)/2:]
+	mac := hmac.New(hf, macKey)
+	mac.Write(aad)
+	mac.Write(iv)
+	mac.Write(ciphertext)
+	_ = binary.Write(mac, binary.BigEndian, uint64(len(aad)*8))
+	if !hmac.Equal(mac.Sum(nil)[:len(macKey)], tag) {
+		return nil, errors.New("authentication tag mismatch")
+	}
+	block, err := aes.NewCipher(encKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(iv) != block.BlockSize() || len(ciphertext) == 0 || len(ciphertext)%block.BlockSize() != 0 {
+		return nil, errors.New("invalid ciphertext")
+	}
+	plaintext := make([]byte, len(ciphertext))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plaintext, ciphertext)
+	pad := int(plaintext[len(plaintext)-1])
+	if pad == 0 || pad > block.BlockSize() {
+		return nil, errors.New("invalid padding")
+	}
+	return plaintext[:len(plaintext)-pad], nil
+}
@@ -0,0 +1,263 @@
+//    Copyright 2017 Red Hat, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package verify
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"hash"
+	"strings"
+	"testing"
+)
+
+// encryptJWE encrypts plaintext for pub in compact serialization, the
+// inverse of Decrypt.
+func encryptJWE(t *testing.T, alg, enc, kid string, pub crypto.PublicKey, plaintext string) string {
+	t.Helper()
+	keyLen, err := contentKeyLen(enc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := jweHeader{Alg: alg, Enc: enc, KeyID: kid}
+	cek := make([]byte, keyLen)
+	_, _ = rand.Read(cek)
+	var encryptedKey []byte
+
+	switch alg {
+	case "RSA-OAEP", "RSA-OAEP-256":
+		var hf hash.Hash = sha1.New()
+		if alg == "RSA-OAEP-256" {
+			hf = sha256.New()
+		}
+		if encryptedKey, err = rsa.EncryptOAEP(hf, rand.Reader, pub.(*rsa.PublicKey), cek, nil); err != nil {
+			t.Fatal(err)
+		}
+	default:
+		ecPub := pub.(*ecdsa.PublicKey)
+		ephemeral, err := ecdsa.GenerateKey(ecPub.Curve, rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		epk := ecJWK(&ephemeral.PublicKey)
+		header.EPK = &epk
+		header.APU = base64.RawURLEncoding.EncodeToString([]byte("Alice"))
+		priv, _ := ephemeral.ECDH()
+		peer, _ := ecPub.ECDH()
+		z, err := priv.ECDH(peer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if alg == "ECDH-ES" {
+			cek = concatKDF(z, enc, []byte("Alice"), nil, keyLen)
+		} else {
+			kekLen := map[string]int{"ECDH-ES+A128KW": 16, "ECDH-ES+A192KW": 24, "ECDH-ES+A256KW": 32}[alg]
+			encryptedKey = aesKeyWrap(t, concatKDF(z, alg, []byte("Alice"), nil, kekLen), cek)
+		}
+	}
+
+	hb, err := json.Marshal(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	protected := base64.RawURLEncoding.EncodeToString(hb)
+	iv, ciphertext, tag := encryptContent(t, enc, cek, []byte(plaintext), []byte(protected))
+	return strings.Join([]string{
+		protected,
+		base64.RawURLEncoding.EncodeToString(encryptedKey),
+		base64.RawURLEncoding.EncodeToString(iv),
+		base64.RawURLEncoding.EncodeToString(ciphertext),
+		base64.RawURLEncoding.EncodeToString(tag),
+	}, ".")
+}
+
+func encryptContent(t *testing.T, enc string, cek, plaintext, aad []byte) (iv, ciphertext, tag []byte) {
+	if strings.HasSuffix(enc, "GCM") {
+		block, _ := aes.NewCipher(cek)
+		gcm, _ := cipher.NewGCM(block)
+		iv = make([]byte, gcm.NonceSize())
+		_, _ = rand.Read(iv)
+		sealed := gcm.Seal(nil, iv, plaintext, aad)
+		return iv, sealed[:len(sealed)-gcm.Overhead()], sealed[len(sealed)-gcm.Overhead():]
+	}
+
+	hf := map[string]func() hash.Hash{"A128CBC-HS256": sha256.New, "A192CBC-HS384": sha512.New384, "A256CBC-HS512": sha512.New}[enc]
+	macKey, encKey := cek[:len(cek)/2], cek[len(cek)/2:]
+	block, err := aes.NewCipher(encKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pad := block.BlockSize() - len(plaintext)%block.BlockSize()
+	padded := append(append([]byte(nil), plaintext...), bytes.Repeat([]byte{byte(pad)}, pad)...)
+	iv = make([]byte, block.BlockSize())
+	_, _ = rand.Read(iv)
+	ciphertext = make([]byte, len(padded))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(ciphertext, padded)
+	mac := hmac.New(hf, macKey)
+	mac.Write(aad)
+	mac.Write(iv)
+	mac.Write(ciphertext)
+	_ = binary.Write(mac, binary.BigEndian, uint64(len(aad)*8))
+	return iv, ciphertext, mac.Sum(nil)[:len(macKey)]
+}
+
+// aesKeyWrap wraps key with kek (RFC 3394).
+func aesKeyWrap(t *testing.T, kek, key []byte) []byte {
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := len(key) / 8
+	a := []byte{0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6}
+	r := append([]byte(nil), key...)
+	b := make([]byte, 16)
+	for j := 0; j <= 5; j++ {
+		for i := 1; i <= n; i++ {
+			copy(b, a)
+			copy(b[8:], r[(i-1)*8:i*8])
+			block.Encrypt(b, b)
+			binary.BigEndian.PutUint64(a, binary.BigEndian.Uint64(b[:8])^uint64(n*j+i))
+			copy(r[(i-1)*8:], b[8:])
+		}
+	}
+	return append(a, r...)
+}
+
+func TestDecrypt(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p256Key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p384Key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := []DecryptionKey{{ID: "rsa", Key: rsaKey}, {ID: "p256", Key: p256Key}, {Key: p384Key}}
+
+	tests := []struct {
+		alg, enc, kid string
+		pub           crypto.PublicKey
+	}{
+		{"RSA-OAEP", "A256GCM", "rsa", &rsaKey.PublicKey},
+		{"RSA-OAEP-256", "A128CBC-HS256", "rsa", &rsaKey.PublicKey},
+		{"RSA-OAEP-256", "A128GCM", "", &rsaKey.PublicKey},
+		{"ECDH-ES", "A128GCM", "p256", &p256Key.PublicKey},
+		{"ECDH-ES", "A256CBC-HS512", "", &p256Key.PublicKey},
+		{"ECDH-ES+A128KW", "A192GCM", "p256", &p256Key.PublicKey},
+		{"ECDH-ES+A256KW", "A192CBC-HS384", "", &p384Key.PublicKey},
+	}
+	for _, tt := range tests {
+		const plaintext = "eyJhbGciOiJSUzI1NiJ9.eyJzdWIiOiJhbGljZSJ9.c2ln"
+		token := encryptJWE(t, tt.alg, tt.enc, tt.kid, tt.pub, plaintext)
+		if !IsEncrypted(token) {
+			t.Errorf("%s %s: IsEncrypted() = false", tt.alg, tt.enc)
+		}
+		got, err := Decrypt(token, keys)
+		if err != nil {
+			t.Errorf("%s %s: Decrypt() failed: %v", tt.alg, tt.enc, err)
+		} else if got != plaintext {
+			t.Errorf("%s %s: Decrypt() = %q, want %q", tt.alg, tt.enc, got, plaintext)
+		}
+	}
+}
+
+func TestDecryptInvalid(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := []DecryptionKey{{ID: "rsa", Key: rsaKey}}
+	token := encryptJWE(t, "RSA-OAEP-256", "A128CBC-HS256", "rsa", &rsaKey.PublicKey, "payload")
+	parts := strings.Split(token, ".")
+	flip := func(seg string) string {
+		b, _ := base64.RawURLEncoding.DecodeString(seg)
+		b[len(b)-1] ^= 1
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	header := func(h string) string {
+		return base64.RawURLEncoding.EncodeToString([]byte(h))
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		keys  []DecryptionKey
+	}{
+		{"JWS", "a.b.c", keys},
+		{"wrong key", token, []DecryptionKey{{Key: otherKey}}},
+		{"other kid", token, []DecryptionKey{{ID: "other", Key: rsaKey}}},
+		{"tampered ciphertext", strings.Join([]string{parts[0], parts[1], parts[2], flip(parts[3]), parts[4]}, "."), keys},
+		{"tampered tag", strings.Join([]string{parts[0], parts[1], parts[2], parts[3], flip(parts[4])}, "."), keys},
+		{"tampered header", strings.Join([]string{header(`{"alg":"RSA-OAEP-256","enc":"A128CBC-HS256","kid":"rsa","x":1}`), parts[1], parts[2], parts[3], parts[4]}, "."), keys},
+		{"compressed", strings.Join([]string{header(`{"alg":"RSA-OAEP-256","enc":"A128CBC-HS256","zip":"DEF"}`), parts[1], parts[2], parts[3], parts[4]}, "."), keys},
+		{"unsupported enc", strings.Join([]string{header(`{"alg":"RSA-OAEP-256","enc":"A512GCM"}`), parts[1], parts[2], parts[3], parts[4]}, "."), keys},
+		{"unsupported alg", strings.Join([]string{header(`{"alg":"RSA1_5","enc":"A128CBC-HS256"}`), parts[1], parts[2], parts[3], parts[4]}, "."), keys},
+		{"invalid segment", strings.Join([]string{parts[0], "!", parts[2], parts[3], parts[4]}, "."), keys},
+	}
+	for _, tt := range tests {
+		if got, err := Decrypt(tt.token, tt.keys); err == nil {
+			t.Errorf("%s: Decrypt() = %q, want error", tt.name, got)
+		}
+	}
+}
+
+func TestAESKeyUnwrap(t *testing.T) {
+	// RFC 3394, section 4.1.
+	kek, _ := hex.DecodeString("000102030405060708090A0B0C0D0E0F")
+	wrapped, _ := hex.DecodeString("1FA68B0A8112B447AEF34BD8FB5A7B829D3E862371D2CFE5")
+	want, _ := hex.DecodeString("00112233445566778899AABBCCDDEEFF")
+
+	key, err := aesKeyUnwrap(kek, wrapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(key, want) {
+		t.Errorf("aesKeyUnwrap() = %x, want %x", key, want)
+	}
+	wrapped[0] ^= 1
+	if _, err = aesKeyUnwrap(kek, wrapped); err == nil {
+		t.Error("aesKeyUnwrap() of a tampered key succeeded")
+	}
+}
+
+func TestConcatKDF(t *testing.T) {
+	// RFC 7518, appendix C.
+	z := []byte{158, 86, 217, 29, 129, 113, 53, 211, 114, 131, 66, 131, 191, 132, 38, 156, 251, 49, 110, 163, 218, 128, 106, 72, 246, 218, 167, 121, 140, 254, 144, 196}
+	key := concatKDF(z, "A128GCM", []byte("Alice"), []byte("Bob"), 16)
+	if got := base64.RawURLEncoding.EncodeToString(key); got != "VqqN6vgjbSBcIijNcacQGg" {
+		t.Errorf("concatKDF() = %s, want VqqN6vgjbSBcIijNcacQGg", got)
+	}
+}
@@ -0,0 +1,242 @@
+//    Copyright 2017 Red Hat, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package verify
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// keySyncWindow is the minimum time between two key set refreshes triggered
+// by tokens signed with an unknown key or by expired keys.
+const keySyncWindow = 5 * time.Second
+
+// defaultKeyMaxAge is how long keys are used before the key set is refreshed
+// if the JWKS endpoint sends no Cache-Control max-age.
+const defaultKeyMaxAge = time.Hour
+
+// JSONWebKey is a key in a JWKS document (RFC 7517).
+type JSONWebKey struct {
+	KeyID string `json:"kid"`
+	Type  string `json:"kty"`
+	Use   string `json:"use,omitempty"`
+	N     string `json:"n,omitempty"`
+	E     string `json:"e,omitempty"`
+	Curve string `json:"crv,omitempty"`
+	X     string `json:"x,omitempty"`
+	Y     string `json:"y,omitempty"`
+}
+
+// PublicKey is a signing key published by a provider.
+type PublicKey struct {
+	ID  string
+	Key interface{} // *rsa.PublicKey or *ecdsa.PublicKey
+}
+
+// KeySet holds the signing keys published at a provider's JWKS endpoint.
+type KeySet struct {
+	hc      *http.Client
+	jwksURL string
+
+	syncMu   sync.Mutex // serializes refreshes
+	lastSync time.Time
+
+	mu     sync.RWMutex
+	keys   []PublicKey
+	expiry time.Time
+}
+
+// NewKeySet returns a key set loading keys from jwksURL on demand.
+func NewKeySet(hc *http.Client, jwksURL string) *KeySet {
+	return &KeySet{
+		hc:      hc,
+		jwksURL: jwksURL,
+	}
+}
+
+// Keys returns the keys matching kid, or all keys if kid is empty. If no key
+// matches or the keys have expired after the max-age of the JWKS response,
+// the key set is refreshed (at most once per keySyncWindow) and the lookup
+// retried. Expired keys are still returned while the refresh fails.
+func (s *KeySet) Keys(kid string) ([]PublicKey, error) {
+	keys, fresh := s.lookup(kid)
+	if len(keys) > 0 && fresh {
+		return keys, nil
+	}
+
+	if err := s.sync(); err != nil {
+		if len(keys) > 0 {
+			return keys, nil
+		}
+		return nil, err
+	}
+
+	keys, _ = s.lookup(kid)
+	return keys, nil
+}
+
+func (s *KeySet) lookup(kid string) ([]PublicKey, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	fresh := time.Now().Before(s.expiry)
+	if kid == "" {
+		return s.keys, fresh
+	}
+
+	for _, k := range s.keys {
+		if k.ID == kid {
+			return []PublicKey{k}, fresh
+		}
+	}
+
+	return nil, fresh
+}
+
+// sync fetches the key set without holding mu, so that lookups carry on
+// with the current keys meanwhile, and swaps it in.
+func (s *KeySet) sync() error {
+	s.syncMu.Lock()
+	defer s.syncMu.Unlock()
+
+	if time.Since(s.lastSync) < keySyncWindow {
+		return nil
+	}
+	s.lastSync = time.Now()
+
+	keys, maxAge, err := s.fetch()
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.keys = keys
+	s.expiry = time.Now().Add(maxAge)
+	s.mu.Unlock()
+
+	return nil
+}
+
+func (s *KeySet) fetch() ([]PublicKey, time.Duration, error) {
+	resp, err := s.hc.Get(s.jwksURL)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != 200 {
+		return nil, 0, fmt.Errorf("unable to retrieve key set: %s", resp.Status)
+	}
+
+	var jwks struct {
+		Keys []JSONWebKey `json:"keys"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&jwks); err != nil {
+		return nil, 0, fmt.Errorf("unable to decode key set: %v", err)
+	}
+
+	keys := make([]PublicKey, 0, len(jwks.Keys))
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			// Skip keys we can't use rather than failing the whole set.
+			continue
+		}
+		keys = append(keys, PublicKey{ID: jwk.KeyID, Key: key})
+	}
+
+	return keys, maxAge(resp.Header), nil
+}
+
+// maxAge returns the max-age of a Cache-Control header, zero for no-cache
+// and no-store, or defaultKeyMaxAge if the header doesn't say.
+func maxAge(h http.Header) time.Duration {
+	for _, directive := range strings.Split(h.Get("Cache-Control"), ",") {
+		kv := strings.SplitN(strings.TrimSpace(directive), "=", 2)
+		switch strings.ToLower(kv[0]) {
+		case "no-cache", "no-store":
+			return 0
+		case "max-age":
+			if len(kv) != 2 {
+				return defaultKeyMaxAge
+			}
+			seconds, err := strconv.ParseInt(strings.Trim(kv[1], `"`), 10, 64)
+			if err != nil || seconds < 0 {
+				return defaultKeyMaxAge
+			}
+			return time.Duration(seconds) * time.Second
+		}
+	}
+	return defaultKeyMaxAge
+}
+
+func (k *JSONWebKey) publicKey() (interface{}, error) {
+	switch k.Type {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Curve {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Curve)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported key type %q", k.Type)
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
@@ -0,0 +1,170 @@
+//    Copyright 2017 Red Hat, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package verify
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// jwksServer serves a JWKS document with one EC key of the current kid.
+type jwksServer struct {
+	mu           sync.Mutex
+	kid          string
+	cacheControl string
+	status       int
+	requests     int
+}
+
+func (j *jwksServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.requests++
+	if j.status != 0 {
+		w.WriteHeader(j.status)
+		return
+	}
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	if len(j.cacheControl) > 0 {
+		w.Header().Set("Cache-Control", j.cacheControl)
+	}
+	_ = json.NewEncoder(w).Encode(map[string][]JSONWebKey{"keys": {{
+		KeyID: j.kid,
+		Type:  "EC",
+		Curve: "P-256",
+		X:     base64.RawURLEncoding.EncodeToString(priv.X.Bytes()),
+		Y:     base64.RawURLEncoding.EncodeToString(priv.Y.Bytes()),
+	}}})
+}
+
+func (j *jwksServer) set(kid string, status int) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.kid, j.status = kid, status
+}
+
+func (j *jwksServer) count() int {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.requests
+}
+
+// expire makes ks look as if its keys expired and its last refresh was long
+// ago, without waiting for max-age and keySyncWindow.
+func expire(ks *KeySet) {
+	ks.syncMu.Lock()
+	ks.lastSync = time.Time{}
+	ks.syncMu.Unlock()
+	ks.mu.Lock()
+	ks.expiry = time.Now().Add(-time.Second)
+	ks.mu.Unlock()
+}
+
+func keyIDs(keys []PublicKey) []string {
+	ids := make([]string, 0, len(keys))
+	for _, k := range keys {
+		ids = append(ids, k.ID)
+	}
+	return ids
+}
+
+func TestKeySetRefreshesExpiredKeys(t *testing.T) {
+	j := &jwksServer{kid: "a", cacheControl: "public, max-age=60"}
+	srv := httptest.NewServer(j)
+	defer srv.Close()
+	ks := NewKeySet(srv.Client(), srv.URL)
+
+	keys, err := ks.Keys("a")
+	if err != nil || len(keys) != 1 {
+		t.Fatalf("Keys(a) = %v, %v, want key a", keyIDs(keys), err)
+	}
+	if _, err = ks.Keys("a"); err != nil || j.count() != 1 {
+		t.Fatalf("Keys(a) fetched the key set %d times within max-age, want once", j.count())
+	}
+
+	// The provider rotates its key and drops the old one.
+	j.set("b", 0)
+	expire(ks)
+	keys, err = ks.Keys("a")
+	if err != nil || len(keys) != 0 {
+		t.Errorf("Keys(a) after expiry = %v, %v, want no key", keyIDs(keys), err)
+	}
+	if j.count() != 2 {
+		t.Errorf("expired keys fetched the key set %d times, want 2", j.count())
+	}
+	if keys, _ = ks.Keys("b"); len(keys) != 1 {
+		t.Errorf("Keys(b) = %v, want key b", keyIDs(keys))
+	}
+}
+
+func TestKeySetKeepsExpiredKeysWhileUnavailable(t *testing.T) {
+	j := &jwksServer{kid: "a"}
+	srv := httptest.NewServer(j)
+	defer srv.Close()
+	ks := NewKeySet(srv.Client(), srv.URL)
+
+	if _, err := ks.Keys("a"); err != nil {
+		t.Fatal(err)
+	}
+
+	j.set("a", http.StatusServiceUnavailable)
+	expire(ks)
+	keys, err := ks.Keys("a")
+	if err != nil || len(keys) != 1 {
+		t.Errorf("Keys(a) while unavailable = %v, %v, want the expired key a", keyIDs(keys), err)
+	}
+	expire(ks)
+	if _, err = ks.Keys("c"); err == nil {
+		t.Errorf("Keys(c) of an unknown key while unavailable succeeded")
+	}
+}
+
+func TestMaxAge(t *testing.T) {
+	tests := []struct {
+		cacheControl string
+		want         time.Duration
+	}{
+		{"", defaultKeyMaxAge},
+		{"max-age=300", 5 * time.Minute},
+		{"public, max-age=86400, must-revalidate", 24 * time.Hour},
+		{`Max-Age="60"`, time.Minute},
+		{"no-cache", 0},
+		{"no-store, max-age=60", 0},
+		{"max-age=-1", defaultKeyMaxAge},
+		{"max-age", defaultKeyMaxAge},
+		{"private", defaultKeyMaxAge},
+	}
+	for _, tt := range tests {
+		h := http.Header{}
+		if len(tt.cacheControl) > 0 {
+			h.Set("Cache-Control", tt.cacheControl)
+		}
+		if got := maxAge(h); got != tt.want {
+			t.Errorf("maxAge(%q) = %v, want %v", tt.cacheControl, got, tt.want)
+		}
+	}
+}
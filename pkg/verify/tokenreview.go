@@ -0,0 +1,100 @@
+//    Copyright 2017 Red Hat, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package verify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/coreos/go-oidc/jose"
+	"github.com/syndesisio/token-rp/pkg/kube"
+)
+
+// TokenReviewMode presents tokens to the Kubernetes TokenReview API.
+const TokenReviewMode = "tokenreview"
+
+// tokenReviewPath is the tokenreviews resource of the API server.
+const tokenReviewPath = "/apis/authentication.k8s.io/v1/tokenreviews"
+
+// TokenReviewVerifier verifies Kubernetes service account tokens by creating
+// a TokenReview with the API server. The claims of accepted tokens are sub
+// and preferred_username set to the user name, uid and groups.
+type TokenReviewVerifier struct {
+	Client *kube.Client
+	// Audiences, unless empty, are the audiences tokens must be issued for.
+	Audiences []string
+}
+
+// NewInClusterTokenReviewVerifier returns a TokenReviewVerifier for the API
+// server of the cluster the proxy runs in.
+func NewInClusterTokenReviewVerifier(audiences []string) (*TokenReviewVerifier, error) {
+	c, err := kube.InCluster()
+	if err != nil {
+		return nil, err
+	}
+	return &TokenReviewVerifier{Client: c, Audiences: audiences}, nil
+}
+
+type tokenReview struct {
+	APIVersion string            `json:"apiVersion"`
+	Kind       string            `json:"kind"`
+	Spec       tokenReviewSpec   `json:"spec"`
+	Status     tokenReviewStatus `json:"status"`
+}
+
+type tokenReviewSpec struct {
+	Token     string   `json:"token"`
+	Audiences []string `json:"audiences,omitempty"`
+}
+
+type tokenReviewStatus struct {
+	Authenticated bool   `json:"authenticated"`
+	Error         string `json:"error"`
+	User          struct {
+		Username string   `json:"username"`
+		UID      string   `json:"uid"`
+		Groups   []string `json:"groups"`
+	} `json:"user"`
+}
+
+func (v *TokenReviewVerifier) Verify(token string) (jose.Claims, error) {
+	review := tokenReview{
+		APIVersion: "authentication.k8s.io/v1",
+		Kind:       "TokenReview",
+		Spec:       tokenReviewSpec{Token: token, Audiences: v.Audiences},
+	}
+	if err := v.Client.Create(context.Background(), tokenReviewPath, review, &review); err != nil {
+		return nil, fmt.Errorf("token review failed: %v", err)
+	}
+	if !review.Status.Authenticated {
+		if len(review.Status.Error) > 0 {
+			return nil, fmt.Errorf("token not authenticated: %s", review.Status.Error)
+		}
+		return nil, errors.New("token not authenticated")
+	}
+
+	user := review.Status.User
+	groups := make([]interface{}, 0, len(user.Groups))
+	for _, g := range user.Groups {
+		groups = append(groups, g)
+	}
+	return jose.Claims{
+		"sub":                user.Username,
+		"preferred_username": user.Username,
+		"uid":                user.UID,
+		"groups":             groups,
+	}, nil
+}
@@ -0,0 +1,220 @@
+//    Copyright 2017 Red Hat, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+// Package verify verifies OpenID Connect access tokens, either locally
+// against the signing keys of the issuer or through its UserInfo or token
+// introspection endpoint, and Kubernetes service account tokens through the
+// TokenReview API.
+package verify
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-oidc/jose"
+	jwtgo "github.com/dgrijalva/jwt-go"
+)
+
+// Verification modes.
+const (
+	// JWTMode verifies signed JWTs locally.
+	JWTMode = "jwt"
+	// UserInfoMode presents tokens to the provider's UserInfo endpoint.
+	UserInfoMode = "userinfo"
+)
+
+// Verifier validates an incoming token and returns the claims it carries.
+type Verifier interface {
+	Verify(token string) (jose.Claims, error)
+}
+
+// JWTVerifier verifies tokens locally against the provider's signing keys.
+type JWTVerifier struct {
+	// Issuer is the expected 'iss' claim.
+	Issuer string
+	// Audiences are accepted values of the 'aud' claim.
+	Audiences []string
+	// AllowedAZP are accepted values of the 'azp' claim for tokens whose
+	// audience is not accepted.
+	AllowedAZP  []string
+	Keys        *KeySet
+	AllowedAlgs []string
+	// Leeway is the tolerated clock skew for the time based claims.
+	Leeway time.Duration
+}
+
+func (v *JWTVerifier) Verify(token string) (jose.Claims, error) {
+	jwt, err := jose.ParseJWT(token)
+	if err != nil {
+		return nil, err
+	}
+
+	// Verify claims before the signature so obviously invalid tokens don't
+	// cost a signature check or trigger a key set refresh.
+	claims, err := jwt.Claims()
+	if err != nil {
+		return nil, err
+	}
+	if err = v.verifyClaims(claims, time.Now().UTC()); err != nil {
+		return nil, fmt.Errorf("JWT claims invalid: %v", err)
+	}
+
+	alg := jwt.Header[jose.HeaderKeyAlgorithm]
+	if !containsString(v.AllowedAlgs, alg) {
+		return nil, fmt.Errorf("JWT signing algorithm %q not allowed", alg)
+	}
+	method := jwtgo.GetSigningMethod(alg)
+	if method == nil {
+		return nil, fmt.Errorf("JWT signing algorithm %q not supported", alg)
+	}
+
+	keys, err := v.Keys.Keys(jwt.Header[jose.HeaderKeyID])
+	if err != nil {
+		return nil, fmt.Errorf("unable to retrieve signing keys: %v", err)
+	}
+
+	parts := strings.Split(token, ".")
+	signingString, signature := parts[0]+"."+parts[1], parts[2]
+	for _, k := range keys {
+		if method.Verify(signingString, signature, k.Key) == nil {
+			return claims, nil
+		}
+	}
+
+	return nil, errors.New("unable to verify JWT signature: no matching keys")
+}
+
+// verifyClaims validates the registered claims of a token, tolerating clock
+// skew of up to v.Leeway on the time based ones.
+func (v *JWTVerifier) verifyClaims(claims jose.Claims, now time.Time) error {
+	exp, ok, err := claims.TimeClaim("exp")
+	if err != nil {
+		return err
+	} else if !ok {
+		return errors.New("missing claim: 'exp'")
+	} else if !now.Add(-v.Leeway).Before(exp) {
+		return fmt.Errorf("token expired at %v", exp)
+	}
+
+	iat, ok, err := claims.TimeClaim("iat")
+	if err != nil {
+		return err
+	} else if !ok {
+		return errors.New("missing claim: 'iat'")
+	} else if iat.After(now.Add(v.Leeway)) {
+		return fmt.Errorf("token issued in the future at %v", iat)
+	}
+
+	nbf, ok, err := claims.TimeClaim("nbf")
+	if err != nil {
+		return err
+	} else if ok && nbf.After(now.Add(v.Leeway)) {
+		return fmt.Errorf("token not valid before %v", nbf)
+	}
+
+	iss, ok, err := claims.StringClaim("iss")
+	if err != nil {
+		return err
+	} else if !ok {
+		return errors.New("missing claim: 'iss'")
+	} else if strings.TrimSuffix(iss, "/") != strings.TrimSuffix(v.Issuer, "/") {
+		return fmt.Errorf("invalid claim value: 'iss'. expected=%s, found=%s", v.Issuer, iss)
+	}
+
+	aud, err := audiences(claims)
+	if err != nil {
+		return err
+	}
+	for _, a := range aud {
+		if containsString(v.Audiences, a) {
+			return nil
+		}
+	}
+
+	// Tokens minted for sibling clients are accepted based on the party they
+	// were issued to rather than their audience.
+	if azp, ok, _ := claims.StringClaim("azp"); ok && containsString(v.AllowedAZP, azp) {
+		return nil
+	}
+
+	return fmt.Errorf("invalid claims, no accepted audience in 'aud' claim, aud=%v, accepted=%v", aud, v.Audiences)
+}
+
+// audiences returns the 'aud' claim, which may be either a single string or
+// an array of strings.
+func audiences(claims jose.Claims) ([]string, error) {
+	if aud, ok, err := claims.StringClaim("aud"); err == nil && ok {
+		return []string{aud}, nil
+	} else if aud, ok, err := claims.StringsClaim("aud"); err == nil && ok {
+		return aud, nil
+	}
+	return nil, errors.New("invalid claim value: 'aud' is required, and should be either string or string array")
+}
+
+// ValidateAlgs checks that every algorithm is an asymmetric signing algorithm
+// we are able to verify.
+func ValidateAlgs(algs []string) error {
+	for _, alg := range algs {
+		switch jwtgo.GetSigningMethod(alg).(type) {
+		case *jwtgo.SigningMethodRSA, *jwtgo.SigningMethodRSAPSS, *jwtgo.SigningMethodECDSA:
+		default:
+			return fmt.Errorf("unsupported signing algorithm %q", alg)
+		}
+	}
+	return nil
+}
+
+func containsString(haystack []string, needle string) bool {
+	for _, s := range haystack {
+		if s == needle {
+			return true
+		}
+	}
+	return false
+}
+
+// UserInfoVerifier verifies tokens by presenting them to the provider's
+// UserInfo endpoint, accepting any token the provider accepts.
+type UserInfoVerifier struct {
+	Client      *http.Client
+	UserInfoURL string
+}
+
+func (v *UserInfoVerifier) Verify(token string) (jose.Claims, error) {
+	req, err := http.NewRequest("GET", v.UserInfoURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := v.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("userinfo request rejected: %s", resp.Status)
+	}
+
+	var claims jose.Claims
+	if err = json.NewDecoder(resp.Body).Decode(&claims); err != nil {
+		return nil, fmt.Errorf("unable to decode userinfo response: %v", err)
+	}
+
+	return claims, nil
+}
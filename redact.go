@@ -0,0 +1,77 @@
+//    Copyright 2017 Red Hat, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"io"
+	"net/http"
+	"regexp"
+)
+
+const redacted = "[REDACTED]"
+
+var redactions = []struct {
+	re   *regexp.Regexp
+	repl string
+}{
+	// JWTs, recognizable by their base64url encoded JSON header.
+	{regexp.MustCompile(`eyJ[A-Za-z0-9_-]*\.[A-Za-z0-9_-]*\.[A-Za-z0-9_-]*`), redacted},
+	// GitHub tokens.
+	{regexp.MustCompile(`\bgh[pousr]_[A-Za-z0-9]{20,}`), redacted},
+	// Authorization header values. The "token" scheme is too common a word
+	// to be redacted outside of an actual header.
+	{regexp.MustCompile(`(?i)\b(bearer|basic)(\s+)[A-Za-z0-9._~+/=-]{8,}`), "${1}${2}" + redacted},
+	{regexp.MustCompile(`(?i)(authorization:\s*token\s+)[A-Za-z0-9._~+/=-]+`), "${1}" + redacted},
+	// Tokens in query strings and form bodies.
+	{regexp.MustCompile(`(?i)\b(access_token|refresh_token|id_token|client_secret|password)=[^&\s"]+`), "${1}=" + redacted},
+	// Tokens in JSON documents.
+	{regexp.MustCompile(`(?i)("(?:access_token|refresh_token|id_token|client_secret)"\s*:\s*")[^"]*`), "${1}" + redacted},
+}
+
+// redact replaces anything that looks like a credential in s.
+func redact(s string) string {
+	for _, r := range redactions {
+		s = r.re.ReplaceAllString(s, r.repl)
+	}
+	return s
+}
+
+// redactingWriter redacts credentials from everything written through it.
+// Each Write is expected to carry complete log lines.
+type redactingWriter struct {
+	w io.Writer
+}
+
+func (r *redactingWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(r.w, redact(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (r *redactingWriter) Sync() error {
+	if s, ok := r.w.(interface {
+		Sync() error
+	}); ok {
+		return s.Sync()
+	}
+	return nil
+}
+
+// httpError replies with a redacted error message, so tokens that end up in
+// error strings are never echoed back to clients.
+func httpError(w http.ResponseWriter, msg string, code int) {
+	http.Error(w, redact(msg), code)
+}
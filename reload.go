@@ -0,0 +1,679 @@
+//    Copyright 2017 Red Hat, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/syndesisio/token-rp/pkg/config"
+	"github.com/syndesisio/token-rp/pkg/exchange"
+	"github.com/syndesisio/token-rp/pkg/proxy"
+)
+
+// configWatchInterval is how often the config and CA certificate files are
+// checked for changes.
+const configWatchInterval = 5 * time.Second
+
+// reloadableOptions are the options that can change without a restart.
+type reloadableOptions struct {
+	proxyURLs       config.URLSliceFlag
+	fallbackURLs    config.URLSliceFlag
+	lbPolicy        string
+	preservePath    bool
+	pathRewrites    config.StringSliceFlag
+	hostHeader      string
+	proxyProtocol   string
+	h2c             bool
+	flushInterval   time.Duration
+	timeouts        proxy.Timeouts
+	exchangeTimeout time.Duration
+	maxBodySize     int64
+	maxGitBodySize  int64
+	maxArtBodySize  int64
+	idpAlias        string
+	aliasHeader     string
+	aliasClaim      string
+	caCerts         config.StringSliceFlag
+	upstreamCACerts config.StringSliceFlag
+	issuerCACerts   config.StringSliceFlag
+	identityCACerts config.StringSliceFlag
+	requiredRoles   config.StringSliceFlag
+	requiredScopes  config.StringSliceFlag
+	claimHeaders    config.StringSliceFlag
+	headerTmpls     config.StringSliceFlag
+	tokenHeader     string
+	originalAuthz   string
+	tokenScheme     string
+	allowedCIDRs    config.StringSliceFlag
+	deniedCIDRs     config.StringSliceFlag
+	anonymousPaths  config.StringSliceFlag
+	lfsPassthrough  bool
+	deniedPaths     config.StringSliceFlag
+	noTokenPolicy   string
+	gitMode         bool
+	gitPaths        config.StringSliceFlag
+	nonGitPaths     config.StringSliceFlag
+	gitTokenField   string
+	gitUserClaim    string
+	impersonateFile string
+	impUserClaim    string
+	impGroupsClaim  string
+	impUserPrefix   string
+	impGroupsPrefix string
+	mintKey         string
+	mintKeyID       string
+	mintIssuer      string
+	mintAudience    string
+	mintLifetime    time.Duration
+	mintClaims      config.StringSliceFlag
+	hmacHeader      string
+	hmacPrefix      string
+	hmacEncoding    string
+	hmacAlgorithm   string
+	hmacComponents  config.StringSliceFlag
+	hmacTimestamp   string
+	hmacKeyFile     string
+	hmacReplace     bool
+	registryAuth    bool
+	registryUser    string
+	artifactRepo    bool
+	artifactUser    string
+	artifactClaim   string
+	clientCertAuth  string
+	dpop            string
+}
+
+func registerReloadableFlags(fs *flag.FlagSet, o *reloadableOptions) {
+	fs.Var(&o.proxyURLs, "proxy-url", "URL(s) to proxy requests to, balanced according to lb-policy")
+	fs.Var(&o.fallbackURLs, "fallback-proxy-url", "URL(s) to proxy requests to while every proxy-url fails its health checks")
+	fs.StringVar(&o.lbPolicy, "lb-policy", proxy.RoundRobin, "How to distribute requests across several proxy-urls: round-robin or least-connections")
+	fs.BoolVar(&o.preservePath, "preserve-path", true, "Forward requests to their path and query below proxy-url; if false, every request is forwarded to proxy-url itself")
+	fs.Var(&o.pathRewrites, "rewrite-path", "Rule rewriting request paths before they are forwarded, applied in order: strip-prefix:/prefix, add-prefix:/prefix or regex:pattern replacement (e.g. 'regex:^/repos/([^/]+) /r/$1')")
+	fs.StringVar(&o.proxyProtocol, "upstream-proxy-protocol", "", "PROXY protocol header version, v1 or v2, to send the client address to the upstream with at the start of each connection (disabled if empty; connections aren't reused then)")
+	fs.BoolVar(&o.h2c, "upstream-h2c", false, "Speak HTTP/2 to the upstream, without TLS (h2c) for http:// URLs, as gRPC backends require")
+	fs.DurationVar(&o.flushInterval, "flush-interval", 100*time.Millisecond, "Interval to flush upstream responses to the client at while they are streamed, or -1ns to flush after every write; event streams and responses of unknown length are always flushed after every write")
+	fs.StringVar(&o.hostHeader, "host-header", proxy.UpstreamHost, "Host header of forwarded requests: upstream (the host of proxy-url), preserve (the client's) or a custom host")
+	fs.DurationVar(&o.timeouts.Dial, "upstream-dial-timeout", 30*time.Second, "Timeout for connecting to the upstream (none if 0)")
+	fs.DurationVar(&o.timeouts.TLSHandshake, "upstream-tls-handshake-timeout", 10*time.Second, "Timeout for the TLS handshake with the upstream (none if 0)")
+	fs.DurationVar(&o.timeouts.ResponseHeader, "upstream-response-header-timeout", 0, "Timeout for the upstream's response headers after the request was sent (none if 0)")
+	fs.DurationVar(&o.timeouts.Total, "upstream-timeout", 0, "Timeout for the whole upstream request including the response body (none if 0)")
+	fs.DurationVar(&o.exchangeTimeout, "exchange-timeout", 30*time.Second, "Timeout for the broker token exchange (none if 0)")
+	fs.Int64Var(&o.maxBodySize, "max-body-size", 0, "Size in megabytes above which request bodies are rejected with 413 (unlimited if 0)")
+	fs.Int64Var(&o.maxGitBodySize, "max-git-body-size", 0, "Size in megabytes above which the request bodies of Git requests, such as pack uploads, are rejected with 413 (unlimited if 0)")
+	fs.Int64Var(&o.maxArtBodySize, "max-artifact-body-size", 0, "Size in megabytes above which deploys (PUT requests) to an artifact-repository are rejected with 413 (unlimited if 0)")
+	fs.StringVar(&o.idpAlias, "provider-alias", "", "Keycloak provider alias to replace authorization token with")
+	fs.StringVar(&o.aliasHeader, "provider-alias-header", "", "Header set by trusted-proxy callers to select the Keycloak provider alias per request, overriding provider-alias-claim and provider-alias (removed before forwarding, ignored from other callers)")
+	fs.StringVar(&o.aliasClaim, "provider-alias-claim", "", "Claim of the verified token selecting the Keycloak provider alias per request, overriding provider-alias")
+	fs.Var(&o.caCerts, "ca-cert", "Extra root certificate(s) that clients use when verifying server certificates")
+	fs.Var(&o.upstreamCACerts, "upstream-ca-cert", "Extra root certificate(s) trusted in addition to ca-cert when verifying the certificates of upstreams")
+	fs.Var(&o.issuerCACerts, "issuer-ca-cert", "Extra root certificate(s) trusted in addition to ca-cert when verifying the certificates of issuers and their token broker")
+	fs.Var(&o.identityCACerts, "identity-server-ca-cert", "Extra root certificate(s) trusted in addition to ca-cert when verifying the certificate of the identity-server-url or the provider's API")
+	fs.Var(&o.requiredRoles, "require-role", "Realm role, or client role as client:role, that incoming tokens must carry")
+	fs.Var(&o.requiredScopes, "require-scope", "Scope(s) that incoming tokens must carry")
+	fs.Var(&o.claimHeaders, "claim-header", "Claim of the verified token to pass upstream as a header, as claim=Header (e.g. preferred_username=X-Forwarded-User)")
+	fs.Var(&o.headerTmpls, "header-template", "Upstream header rendered after the token exchange, as Header: template with .Claims and .ExchangedToken (e.g. 'Private-Token: {{ .ExchangedToken }}')")
+	fs.StringVar(&o.tokenHeader, "token-header", "Authorization", "Header to send the exchanged token upstream in (e.g. X-Forwarded-Access-Token or Private-Token); Git requests always use Authorization")
+	fs.StringVar(&o.originalAuthz, "original-authorization", proxy.ReplaceAuthorization, "What to do with the client's Authorization header when token-header is another header: replace (with the exchanged token), preserve, remove or jwt (Bearer with the verified token)")
+	fs.StringVar(&o.tokenScheme, "token-scheme", "", "Scheme to prefix the exchanged token with (e.g. Bearer), or none for the raw token; defaults to the provider's scheme in Authorization and none in other token-headers")
+	fs.Var(&o.allowedCIDRs, "allow-cidr", "Client network(s), in CIDR notation or as single IP, whose requests are accepted; if set, requests from all other clients are rejected with 403")
+	fs.Var(&o.deniedCIDRs, "deny-cidr", "Client network(s), in CIDR notation or as single IP, whose requests are rejected with 403, even if allowed by allow-cidr")
+	fs.Var(&o.anonymousPaths, "anonymous-path", "Path(s) proxied without token verification or exchange, as glob pattern or regular expression prefixed with ~")
+	fs.BoolVar(&o.lfsPassthrough, "lfs-transfer-passthrough", false, "Forward Git LFS object transfers authorized by credentials the upstream handed out in its batch response, rather than by a token, untouched")
+	fs.Var(&o.deniedPaths, "deny-path", "Path(s) that are always rejected, as glob pattern or regular expression prefixed with ~")
+	fs.BoolVar(&o.gitMode, "git-mode", true, "Recognize Git requests and take their token from basic auth; disable for upstreams only serving APIs")
+	fs.Var(&o.gitPaths, "git-path", "Path(s) of Git requests the built-in rules don't recognize, e.g. of non-standard repository layouts, as glob pattern or regular expression prefixed with ~")
+	fs.Var(&o.nonGitPaths, "non-git-path", "Path(s) never handled as Git requests, even if they look like one, as glob pattern or regular expression prefixed with ~")
+	fs.StringVar(&o.gitTokenField, "git-token-field", exchange.GitTokenPassword, "Basic auth field Git clients send their token in: password, username or either (the username if the password is empty or x-oauth-basic)")
+	fs.StringVar(&o.gitUserClaim, "git-username-claim", "", "Claim of the verified token, e.g. preferred_username, holding the provider username sent with the token of Git requests, instead of looking it up with the provider's API")
+	fs.StringVar(&o.impersonateFile, "impersonation-token-file", "", "File holding a service account token, e.g. /var/run/secrets/kubernetes.io/serviceaccount/token, to forward requests with instead of exchanging tokens, impersonating the user of the verified token with Impersonate-User and Impersonate-Group headers (disabled if empty)")
+	fs.StringVar(&o.impUserClaim, "impersonate-user-claim", "preferred_username", "Claim of the verified token holding the user to impersonate")
+	fs.StringVar(&o.impGroupsClaim, "impersonate-groups-claim", "groups", "Claim of the verified token holding the groups to impersonate (none if empty)")
+	fs.StringVar(&o.impUserPrefix, "impersonate-user-prefix", "", "Prefix of the impersonated user, like kube-apiserver's --oidc-username-prefix, e.g. keycloak:")
+	fs.StringVar(&o.impGroupsPrefix, "impersonate-groups-prefix", "", "Prefix of the impersonated groups, like kube-apiserver's --oidc-groups-prefix, e.g. keycloak:")
+	fs.StringVar(&o.mintKey, "mint-token-key", "", "File holding a PEM encoded RSA or ECDSA private key to sign short-lived tokens with, which requests are forwarded with instead of exchanging tokens, carrying the sub and mint-token-claim claims of the verified token (disabled if empty)")
+	fs.StringVar(&o.mintKeyID, "mint-token-key-id", "", "Key ID sent as kid header of minted tokens (none if empty)")
+	fs.StringVar(&o.mintIssuer, "mint-token-issuer", "token-rp", "Issuer of minted tokens")
+	fs.StringVar(&o.mintAudience, "mint-token-audience", "", "Audience of minted tokens (none if empty)")
+	fs.DurationVar(&o.mintLifetime, "mint-token-lifetime", 5*time.Minute, "Lifetime of minted tokens")
+	fs.Var(&o.mintClaims, "mint-token-claim", "Claim(s) of the verified token copied into minted tokens, e.g. preferred_username, email or groups")
+	fs.StringVar(&o.hmacHeader, "hmac-signature-header", "", "Header, e.g. X-Hub-Signature-256, receiving an HMAC signature of forwarded requests with the key in hmac-key-file (disabled if empty)")
+	fs.StringVar(&o.hmacPrefix, "hmac-signature-prefix", "", "Prefix of HMAC signatures, e.g. sha256=")
+	fs.StringVar(&o.hmacEncoding, "hmac-signature-encoding", proxy.HexEncoding, "Encoding of HMAC signatures: hex or base64")
+	fs.StringVar(&o.hmacAlgorithm, "hmac-algorithm", "sha256", "Hash function of HMAC signatures: sha1, sha256 or sha512")
+	fs.Var(&o.hmacComponents, "hmac-signed-component", "Part(s) of forwarded requests signed, in order, each followed by a newline: method, path, query, host, timestamp, body or header:<Name>; the body alone, without newline, if unset")
+	fs.StringVar(&o.hmacTimestamp, "hmac-timestamp-header", "", "Header receiving the Unix time of signing, the timestamp component of HMAC signatures (none if empty)")
+	fs.StringVar(&o.hmacKeyFile, "hmac-key-file", "", "File holding the key of HMAC signatures, re-read when it changes")
+	fs.BoolVar(&o.hmacReplace, "hmac-replace-token", false, "Forward requests without exchanging their token and without Authorization header, authenticated by their HMAC signature alone")
+	fs.BoolVar(&o.registryAuth, "registry-auth", false, "Front an OCI registry: accept tokens as basic auth password, as docker login stores them, and fetch registry tokens from the realm of the registry's Bearer challenges with the exchanged token; requires no-token-policy reject")
+	fs.StringVar(&o.registryUser, "registry-username-claim", "preferred_username", "Claim of the verified token holding the username sent with the exchanged token to the registry's token realm (token-rp if absent)")
+	fs.BoolVar(&o.artifactRepo, "artifact-repository", false, "Front a Maven or npm repository such as Nexus: accept tokens as basic auth password and forward requests with the exchanged token as basic auth password of artifact-username instead of placing it according to token-header; Git requests aren't recognized")
+	fs.StringVar(&o.artifactUser, "artifact-username", "", "Username sent with the exchanged token to an artifact-repository (the artifact-username-claim if empty)")
+	fs.StringVar(&o.artifactClaim, "artifact-username-claim", "preferred_username", "Claim of the verified token holding the username sent to an artifact-repository unless artifact-username is set")
+	fs.StringVar(&o.clientCertAuth, "client-cert-auth", proxy.ClientCertOff, "How client certificates verified against client-ca authenticate requests: off, alternative (requests without token are authenticated by their certificate, whose common name becomes the user and organizations the groups; requires impersonation-token-file, mint-token-key, hmac-replace-token or the kubernetes provider-type) or required (requests need a certificate in addition to their token)")
+	fs.StringVar(&o.dpop, "dpop", proxy.DPoPOff, "How DPoP proofs (RFC 9449) of sender-constrained tokens are checked: off (DPoP-bound tokens are accepted like bearer tokens), allowed (tokens bound by their cnf claim need a valid proof and the DPoP scheme, other tokens are accepted as bearer tokens) or required (only DPoP-bound tokens are accepted)")
+	fs.StringVar(&o.noTokenPolicy, "no-token-policy", proxy.PassthroughNoToken, "What to do with requests without a token: reject (401), strip (forward without Authorization header) or passthrough (forward untouched)")
+}
+
+// ignoredFlag accepts and discards the value of a flag that is not reloaded.
+type ignoredFlag struct {
+	isBool bool
+}
+
+func (f ignoredFlag) String() string   { return "" }
+func (f ignoredFlag) Set(string) error { return nil }
+func (f ignoredFlag) IsBoolFlag() bool { return f.isBool }
+
+// parseReloadableOptions re-reads the reloadable options from args, the
+// environment and configFile with the same precedence as on startup.
+func parseReloadableOptions(args []string, configFile string) (*reloadableOptions, error) {
+	o := &reloadableOptions{}
+	fs := flag.NewFlagSet(flagSet.Name(), flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	registerReloadableFlags(fs, o)
+	flagSet.VisitAll(func(f *flag.Flag) {
+		if fs.Lookup(f.Name) == nil {
+			b, ok := f.Value.(interface {
+				IsBoolFlag() bool
+			})
+			fs.Var(ignoredFlag{isBool: ok && b.IsBoolFlag()}, f.Name, f.Usage)
+		}
+	})
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if err := applyConfig(fs, configFile); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// newHandlerConfig builds the proxy handler configuration from o and the
+// route table of configFile.
+func newHandlerConfig(o *reloadableOptions, configFile string) (*proxy.Config, error) {
+	cfg, err := newRouteConfig(o)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkClientCertAuth(cfg); err != nil {
+		return nil, err
+	}
+
+	routes, err := config.Routes(configFile)
+	if err != nil {
+		return nil, err
+	}
+	for i, r := range routes {
+		route, err := newRoute(o, r, fmt.Sprintf("%s: route %d", configFile, i))
+		if err != nil {
+			return nil, err
+		}
+		cfg.Routes = append(cfg.Routes, route)
+	}
+	return cfg, nil
+}
+
+// newRoute builds a route from the options of r, which override those of o.
+func newRoute(o *reloadableOptions, r map[string]interface{}, source string) (proxy.Route, error) {
+	for _, name := range []string{"ca-cert", "upstream-ca-cert", "issuer-ca-cert", "identity-server-ca-cert"} {
+		if _, ok := r[name]; ok {
+			return proxy.Route{}, fmt.Errorf("%s: %s can't be set per route", source, name)
+		}
+	}
+
+	ro := *o
+	var route proxy.Route
+	var providerType string
+	fs := flag.NewFlagSet(source, flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	registerReloadableFlags(fs, &ro)
+	fs.StringVar(&route.Host, "host", "", "")
+	fs.StringVar(&route.PathPrefix, "path-prefix", "", "")
+	fs.StringVar(&providerType, "provider-type", "", "")
+	if err := config.ApplyRoute(fs, r, source); err != nil {
+		return route, err
+	}
+	if len(route.Host) == 0 && len(route.PathPrefix) == 0 {
+		return route, fmt.Errorf("%s: host or path-prefix required", source)
+	}
+
+	cfg, err := newRouteConfig(&ro)
+	if err != nil {
+		return route, fmt.Errorf("%s: %v", source, err)
+	}
+	if len(providerType) > 0 {
+		if err = exchange.ValidateProviderType(providerType); err != nil {
+			return route, fmt.Errorf("%s: %v", source, err)
+		}
+		cfg.ProviderType = providerType
+	}
+	if err = checkClientCertAuth(cfg); err != nil {
+		return route, fmt.Errorf("%s: %v", source, err)
+	}
+	route.Config = cfg
+	return route, nil
+}
+
+// newRouteConfig builds the configuration of a route, or the default one,
+// from o.
+func newRouteConfig(o *reloadableOptions) (*proxy.Config, error) {
+	if o.noTokenPolicy != proxy.RejectNoToken && o.noTokenPolicy != proxy.StripNoToken && o.noTokenPolicy != proxy.PassthroughNoToken {
+		return nil, fmt.Errorf("unknown no-token-policy %q", o.noTokenPolicy)
+	}
+
+	if err := proxy.ValidateProxyProtocol(o.proxyProtocol); err != nil {
+		return nil, fmt.Errorf("invalid upstream-proxy-protocol: %v", err)
+	}
+	if o.h2c && len(o.proxyProtocol) > 0 {
+		return nil, fmt.Errorf("upstream-h2c can't be combined with upstream-proxy-protocol")
+	}
+	headers, err := proxy.ParseClaimHeaders(o.claimHeaders)
+	if err != nil {
+		return nil, fmt.Errorf("invalid claim-header: %v", err)
+	}
+	if err := proxy.ValidateTokenHeader(o.tokenHeader, o.tokenScheme, o.originalAuthz); err != nil {
+		return nil, err
+	}
+	pathRewrites, err := proxy.ParsePathRewrites(o.pathRewrites)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rewrite-path: %v", err)
+	}
+	headerTemplates, err := proxy.ParseHeaderTemplates(o.headerTmpls)
+	if err != nil {
+		return nil, fmt.Errorf("invalid header-template: %v", err)
+	}
+	allowedCIDRs, err := proxy.ParseCIDRs(o.allowedCIDRs)
+	if err != nil {
+		return nil, fmt.Errorf("invalid allow-cidr: %v", err)
+	}
+	deniedCIDRs, err := proxy.ParseCIDRs(o.deniedCIDRs)
+	if err != nil {
+		return nil, fmt.Errorf("invalid deny-cidr: %v", err)
+	}
+	anonymousPaths, err := proxy.NewPathMatcher(o.anonymousPaths)
+	if err != nil {
+		return nil, fmt.Errorf("invalid anonymous-path: %v", err)
+	}
+	deniedPaths, err := proxy.NewPathMatcher(o.deniedPaths)
+	if err != nil {
+		return nil, fmt.Errorf("invalid deny-path: %v", err)
+	}
+	gitPaths, err := proxy.NewPathMatcher(o.gitPaths)
+	if err != nil {
+		return nil, fmt.Errorf("invalid git-path: %v", err)
+	}
+	nonGitPaths, err := proxy.NewPathMatcher(o.nonGitPaths)
+	if err != nil {
+		return nil, fmt.Errorf("invalid non-git-path: %v", err)
+	}
+	if err := exchange.ValidateGitTokenField(o.gitTokenField); err != nil {
+		return nil, fmt.Errorf("invalid git-token-field: %v", err)
+	}
+	if len(o.aliasHeader) > 0 && len(trustedProxiesFlag) == 0 {
+		return nil, fmt.Errorf("provider-alias-header requires trusted-proxy")
+	}
+	if err := proxy.ValidateClientCertAuth(o.clientCertAuth); err != nil {
+		return nil, fmt.Errorf("invalid client-cert-auth: %v", err)
+	}
+	if o.clientCertAuth != proxy.ClientCertOff && len(clientCAFile) == 0 && len(spiffeEndpointSocket) == 0 {
+		return nil, fmt.Errorf("client-cert-auth %q requires client-ca or spiffe-endpoint-socket", o.clientCertAuth)
+	}
+	if err := proxy.ValidateDPoPMode(o.dpop); err != nil {
+		return nil, fmt.Errorf("invalid dpop: %v", err)
+	}
+
+	var impersonation *proxy.Impersonation
+	if len(o.impersonateFile) > 0 {
+		if impersonation, err = proxy.NewImpersonation(o.impersonateFile, o.impUserClaim, o.impGroupsClaim, o.impUserPrefix, o.impGroupsPrefix); err != nil {
+			return nil, fmt.Errorf("invalid impersonation-token-file: %v", err)
+		}
+	}
+	var minter *proxy.TokenMinter
+	if len(o.mintKey) > 0 {
+		if impersonation != nil {
+			return nil, fmt.Errorf("mint-token-key and impersonation-token-file are mutually exclusive")
+		}
+		if minter, err = proxy.NewTokenMinter(o.mintKey, o.mintKeyID, o.mintIssuer, o.mintAudience, o.mintLifetime, o.mintClaims); err != nil {
+			return nil, fmt.Errorf("invalid mint-token-key: %v", err)
+		}
+	}
+	if o.registryAuth && o.noTokenPolicy != proxy.RejectNoToken {
+		return nil, fmt.Errorf("registry-auth requires no-token-policy %s, so clients are asked for credentials", proxy.RejectNoToken)
+	}
+
+	if o.artifactRepo {
+		if o.registryAuth {
+			return nil, fmt.Errorf("artifact-repository and registry-auth are mutually exclusive")
+		}
+		if http.CanonicalHeaderKey(o.tokenHeader) != "Authorization" {
+			return nil, fmt.Errorf("artifact-repository sends the exchanged token in Authorization, not token-header %s", o.tokenHeader)
+		}
+	}
+
+	var hmacSigner *proxy.HMACSigner
+	if len(o.hmacHeader) > 0 {
+		if o.hmacReplace && (impersonation != nil || minter != nil) {
+			return nil, fmt.Errorf("hmac-replace-token excludes impersonation-token-file and mint-token-key")
+		}
+		if len(o.hmacKeyFile) == 0 {
+			return nil, fmt.Errorf("hmac-signature-header requires hmac-key-file")
+		}
+		if hmacSigner, err = proxy.NewHMACSigner(o.hmacHeader, o.hmacPrefix, o.hmacEncoding, o.hmacAlgorithm, o.hmacComponents, o.hmacTimestamp, o.hmacKeyFile, o.hmacReplace); err != nil {
+			return nil, fmt.Errorf("invalid hmac-signature-header: %v", err)
+		}
+	} else if o.hmacReplace {
+		return nil, fmt.Errorf("hmac-replace-token requires hmac-signature-header")
+	}
+
+	var proxyURL url.URL
+	var upstreams *proxy.Balancer
+	if len(o.proxyURLs) > 0 {
+		proxyURL = o.proxyURLs[0]
+		if upstreams, err = proxy.NewBalancer(o.lbPolicy, o.proxyURLs, o.fallbackURLs); err != nil {
+			return nil, err
+		}
+	}
+
+	return &proxy.Config{
+		ProxyURL:            proxyURL,
+		Upstreams:           upstreams,
+		PreservePath:        o.preservePath,
+		PathRewrites:        pathRewrites,
+		HostHeader:          o.hostHeader,
+		ProxyProtocol:       o.proxyProtocol,
+		H2C:                 o.h2c,
+		FlushInterval:       o.flushInterval,
+		Timeouts:            o.timeouts,
+		ExchangeTimeout:     o.exchangeTimeout,
+		MaxBodySize:         o.maxBodySize * 1024 * 1024,
+		MaxGitBodySize:      o.maxGitBodySize * 1024 * 1024,
+		MaxArtifactBodySize: o.maxArtBodySize * 1024 * 1024,
+		ProviderAlias:       o.idpAlias,
+		ProviderAliasHeader: http.CanonicalHeaderKey(o.aliasHeader),
+		ProviderAliasClaim:  o.aliasClaim,
+		CACerts:             o.caCerts,
+		Requirements: proxy.Requirements{
+			Roles:  o.requiredRoles,
+			Scopes: o.requiredScopes,
+		},
+		UpstreamCACerts:       o.upstreamCACerts,
+		IssuerCACerts:         o.issuerCACerts,
+		IdentityServerCACerts: o.identityCACerts,
+		Headers:               headers,
+		HeaderTemplates:       headerTemplates,
+		TokenHeader:           http.CanonicalHeaderKey(o.tokenHeader),
+		OriginalAuthorization: o.originalAuthz,
+		TokenScheme:           o.tokenScheme,
+		AllowedCIDRs:          allowedCIDRs,
+		DeniedCIDRs:           deniedCIDRs,
+		AnonymousPaths:        anonymousPaths,
+		LFSPassthrough:        o.lfsPassthrough,
+		DeniedPaths:           deniedPaths,
+		NoTokenPolicy:         o.noTokenPolicy,
+		ClientCertAuth:        o.clientCertAuth,
+		DPoP:                  o.dpop,
+		GitRules: exchange.GitRules{
+			Disabled:   !o.gitMode || o.artifactRepo,
+			Include:    gitPaths.Match,
+			Exclude:    nonGitPaths.Match,
+			TokenField: o.gitTokenField,
+		},
+		GitUsernameClaim:      o.gitUserClaim,
+		Impersonation:         impersonation,
+		TokenMinter:           minter,
+		HMACSigner:            hmacSigner,
+		RegistryAuth:          o.registryAuth,
+		RegistryUsernameClaim: o.registryUser,
+		ArtifactRepository:    o.artifactRepo,
+		ArtifactUsername:      o.artifactUser,
+		ArtifactUsernameClaim: o.artifactClaim,
+	}, nil
+}
+
+// checkClientCertAuth checks that requests authenticated by client
+// certificate alone can be forwarded: lacking a token, they can't be
+// exchanged with the broker, only impersonated, given a service account
+// token or a minted one, or signed.
+func checkClientCertAuth(cfg *proxy.Config) error {
+	if cfg.ClientCertAuth != proxy.ClientCertAlternative || cfg.Impersonation != nil || cfg.TokenMinter != nil ||
+		cfg.HMACSigner != nil && cfg.HMACSigner.ReplaceToken {
+		return nil
+	}
+	providerType := cfg.ProviderType
+	if len(providerType) == 0 {
+		providerType = idpType
+	}
+	if providerType != exchange.Kubernetes {
+		return fmt.Errorf("client-cert-auth %q requires impersonation-token-file, mint-token-key, hmac-replace-token or the %s provider-type", cfg.ClientCertAuth, exchange.Kubernetes)
+	}
+	return nil
+}
+
+// newTransport returns a transport trusting the system roots plus caCerts.
+func newTransport(caCerts []string, insecureSkipVerify bool) (*http.Transport, error) {
+	caCertPool, err := x509.SystemCertPool()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cert pool: %v", err)
+	}
+
+	for _, cert := range caCerts {
+		certBytes, err := ioutil.ReadFile(cert)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA certificate %s: %v", cert, err)
+		}
+		caCertPool.AppendCertsFromPEM(certBytes)
+	}
+
+	settings, err := parseTLSSettings()
+	if err != nil {
+		return nil, err
+	}
+
+	if workloadID != nil {
+		for _, root := range workloadID.Roots() {
+			caCertPool.AddCert(root)
+		}
+	}
+
+	t := &http.Transport{
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: insecureSkipVerify,
+			RootCAs:            caCertPool,
+		},
+		ForceAttemptHTTP2:     upstreamHTTP2,
+		ExpectContinueTimeout: expectContinueTimeout,
+		// Pass compressed pack data through as is instead of decoding it.
+		DisableCompression: true,
+		HTTP2:              newHTTP2Config(),
+	}
+	settings.apply(t.TLSClientConfig)
+	if c := upstreamClientCertificate(); c != nil {
+		t.TLSClientConfig.GetClientCertificate = c.GetClientCertificate
+	} else if workloadID != nil {
+		t.TLSClientConfig.GetClientCertificate = workloadID.GetClientCertificate
+	}
+	return t, nil
+}
+
+// newProxyProtocolTransport returns a transport like newTransport that
+// sends the PROXY protocol header requested by the context of a request.
+// Its connections aren't reused, as the header is specific to a client.
+func newProxyProtocolTransport(caCerts []string, insecureSkipVerify bool) (*http.Transport, error) {
+	t, err := newTransport(caCerts, insecureSkipVerify)
+	if err != nil {
+		return nil, err
+	}
+	t.DialContext = proxy.ProxyProtocolDialer((&net.Dialer{}).DialContext)
+	t.DisableKeepAlives = true
+	return t, nil
+}
+
+// newH2CTransport returns a transport like newTransport that only speaks
+// HTTP/2, without TLS (h2c) for http URLs.
+func newH2CTransport(caCerts []string, insecureSkipVerify bool) (*http.Transport, error) {
+	t, err := newTransport(caCerts, insecureSkipVerify)
+	if err != nil {
+		return nil, err
+	}
+	t.Protocols = new(http.Protocols)
+	t.Protocols.SetHTTP2(true)
+	t.Protocols.SetUnencryptedHTTP2(true)
+	return t, nil
+}
+
+// destinationTransports are the transports to each kind of destination,
+// trusting ca-cert plus the CA certificates of the destination. They are
+// replaced when the certificates change.
+type destinationTransports struct {
+	// generic is used for destinations without CA certificates of their
+	// own, such as the authorization webhook.
+	generic        swappableTransport
+	upstream       swappableTransport
+	proxyProtocol  swappableTransport
+	h2c            swappableTransport
+	issuer         swappableTransport
+	identityServer swappableTransport
+}
+
+// Store replaces the transports with ones for the CA certificates of cfg,
+// unless any of them can't be created.
+func (t *destinationTransports) Store(cfg *proxy.Config) error {
+	generic, err := newTransport(cfg.CACerts, insecureSkipVerify)
+	if err != nil {
+		return err
+	}
+	upstreamCACerts := concatCACerts(cfg.CACerts, cfg.UpstreamCACerts)
+	upstreamSkipVerify := insecureSkipVerify || upstreamInsecureSkipVerify
+	upstream, err := newTransport(upstreamCACerts, upstreamSkipVerify)
+	if err != nil {
+		return err
+	}
+	pp, err := newProxyProtocolTransport(upstreamCACerts, upstreamSkipVerify)
+	if err != nil {
+		return err
+	}
+	h2c, err := newH2CTransport(upstreamCACerts, upstreamSkipVerify)
+	if err != nil {
+		return err
+	}
+	issuer, err := newIssuerTransport(cfg)
+	if err != nil {
+		return err
+	}
+	identityServer, err := newTransport(concatCACerts(cfg.CACerts, cfg.IdentityServerCACerts), insecureSkipVerify || identityInsecureSkipVerify)
+	if err != nil {
+		return err
+	}
+
+	t.generic.Store(generic)
+	t.upstream.Store(upstream)
+	t.proxyProtocol.Store(pp)
+	t.h2c.Store(h2c)
+	t.issuer.Store(issuer)
+	t.identityServer.Store(identityServer)
+	return nil
+}
+
+// newIssuerTransport returns a transport to the issuers and their broker.
+func newIssuerTransport(cfg *proxy.Config) (*http.Transport, error) {
+	return newTransport(concatCACerts(cfg.CACerts, cfg.IssuerCACerts), insecureSkipVerify || issuerInsecureSkipVerify)
+}
+
+// concatCACerts returns the CA certificate files of all lists.
+func concatCACerts(lists ...[]string) []string {
+	var files []string
+	for _, l := range lists {
+		files = append(files, l...)
+	}
+	return files
+}
+
+// upstreamTransport sends requests using the PROXY protocol through
+// proxyProtocol, those using HTTP/2 through h2c and all others through
+// plain.
+type upstreamTransport struct {
+	plain         http.RoundTripper
+	proxyProtocol http.RoundTripper
+	h2c           http.RoundTripper
+}
+
+func (t *upstreamTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if proxy.UsesProxyProtocol(req.Context()) {
+		return t.proxyProtocol.RoundTrip(req)
+	}
+	if proxy.UsesH2C(req.Context()) {
+		return t.h2c.RoundTrip(req)
+	}
+	return t.plain.RoundTrip(req)
+}
+
+// swappableTransport delegates to a transport that can be replaced while
+// requests are in flight, e.g. when CA certificates change.
+type swappableTransport struct {
+	v atomic.Value // *http.Transport
+}
+
+func (t *swappableTransport) Store(tr *http.Transport) {
+	old, _ := t.v.Load().(*http.Transport)
+	t.v.Store(tr)
+	if old != nil {
+		old.CloseIdleConnections()
+	}
+}
+
+func (t *swappableTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.v.Load().(*http.Transport).RoundTrip(req)
+}
+
+// watchFiles calls onChange whenever the modification time or size of any
+// of the files returned by paths changes.
+func watchFiles(paths func() []string, onChange func()) {
+	stat := func() map[string]string {
+		m := map[string]string{}
+		for _, p := range paths() {
+			if fi, err := os.Stat(p); err == nil {
+				m[p] = fmt.Sprintf("%d/%d", fi.ModTime().UnixNano(), fi.Size())
+			} else {
+				m[p] = err.Error()
+			}
+		}
+		return m
+	}
+
+	last := stat()
+	for range time.Tick(configWatchInterval) {
+		cur := stat()
+		changed := len(cur) != len(last)
+		for p, s := range cur {
+			if last[p] != s {
+				changed = true
+			}
+		}
+		last = cur
+		if changed {
+			onChange()
+		}
+	}
+}
@@ -0,0 +1,141 @@
+//    Copyright 2017 Red Hat, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/syndesisio/token-rp/pkg/spiffe"
+	"go.uber.org/zap"
+)
+
+// workloadAPITimeout bounds the wait for the first SVID on startup.
+const workloadAPITimeout = 30 * time.Second
+
+// workloadIdentity holds the SVID and trust bundles last pushed by the
+// SPIFFE Workload API.
+type workloadIdentity struct {
+	cert  atomic.Value // *tls.Certificate
+	roots atomic.Value // []*x509.Certificate
+	// bundlesVersion is incremented whenever the bundles change, which is
+	// also signaled on bundlesChanged.
+	bundlesVersion atomic.Int64
+	bundlesChanged chan struct{}
+}
+
+// workloadID is set by startWorkloadIdentity if spiffe-endpoint-socket is.
+var workloadID *workloadIdentity
+
+// startWorkloadIdentity fetches the SVID and bundles from
+// spiffe-endpoint-socket, if set, and keeps them up to date.
+func startWorkloadIdentity(logger *zap.SugaredLogger) error {
+	if len(spiffeEndpointSocket) == 0 {
+		return nil
+	}
+	client, err := spiffe.NewClient(spiffeEndpointSocket)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), workloadAPITimeout)
+	defer cancel()
+	x, err := client.FetchX509Context(ctx)
+	if err != nil {
+		return err
+	}
+
+	w := &workloadIdentity{bundlesChanged: make(chan struct{}, 1)}
+	w.update(x, logger)
+	workloadID = w
+	go client.Watch(context.Background(), func(x *spiffe.X509Context) {
+		w.update(x, logger)
+	}, func(err error) {
+		logger.Warnw(
+			"Workload API stream failed",
+			"error", err,
+		)
+	})
+	return nil
+}
+
+// update stores the default SVID and the bundles of x.
+func (w *workloadIdentity) update(x *spiffe.X509Context, logger *zap.SugaredLogger) {
+	svid := x.SVIDs[0]
+	w.cert.Store(svid.TLSCertificate())
+	logger.Infow(
+		"Received SVID",
+		"spiffeID", svid.ID,
+		"notAfter", svid.Certificates[0].NotAfter,
+	)
+
+	roots := x.Roots()
+	if old, ok := w.roots.Load().([]*x509.Certificate); ok && sameCertificates(old, roots) {
+		return
+	}
+	w.roots.Store(roots)
+	w.bundlesVersion.Add(1)
+	select {
+	case w.bundlesChanged <- struct{}{}:
+	default:
+	}
+}
+
+// Roots returns the CA certificates of the trust domain and those federated
+// with it.
+func (w *workloadIdentity) Roots() []*x509.Certificate {
+	roots, _ := w.roots.Load().([]*x509.Certificate)
+	return roots
+}
+
+// GetCertificate serves the SVID.
+func (w *workloadIdentity) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return w.svid()
+}
+
+// GetClientCertificate presents the SVID to servers requesting a client
+// certificate.
+func (w *workloadIdentity) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return w.svid()
+}
+
+func (w *workloadIdentity) svid() (*tls.Certificate, error) {
+	cert, ok := w.cert.Load().(*tls.Certificate)
+	if !ok {
+		return nil, errors.New("no SVID")
+	}
+	return cert, nil
+}
+
+// sameCertificates reports whether a and b hold the same certificates,
+// regardless of their order.
+func sameCertificates(a, b []*x509.Certificate) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	seen := make(map[string]bool, len(a))
+	for _, c := range a {
+		seen[string(c.Raw)] = true
+	}
+	for _, c := range b {
+		if !seen[string(c.Raw)] {
+			return false
+		}
+	}
+	return true
+}
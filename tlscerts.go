@@ -0,0 +1,284 @@
+//    Copyright 2017 Red Hat, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// servesTLS reports whether a serving certificate is configured.
+func servesTLS() bool {
+	return hasServerCertificate() || len(acmeDomainsFlag) > 0 || len(spiffeEndpointSocket) > 0
+}
+
+// hasServerCertificate reports whether tls-cert, tls-secret or
+// tls-vault-secret is set, which take precedence over an SVID.
+func hasServerCertificate() bool {
+	return len(serverCertFile) > 0 || len(tlsSecretName) > 0 || len(tlsVaultSecret) > 0
+}
+
+// newACMEManager returns a manager obtaining certificates for the acme-domain
+// names from the CA at acme-directory-url, and renewing them before they
+// expire. Certificates and the account key are kept in acme-cache-dir so that
+// restarts don't run into the CA's rate limits.
+func newACMEManager() *autocert.Manager {
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(acmeCacheDir),
+		HostPolicy: autocert.HostWhitelist(acmeDomainsFlag...),
+		Client:     &acme.Client{DirectoryURL: acmeDirectoryURL},
+	}
+}
+
+// serveACMEChallenges answers the HTTP-01 challenges of m on the plain
+// listeners, passing everything else on to next.
+func serveACMEChallenges(m *autocert.Manager, next http.Handler) http.Handler {
+	challenges := m.HTTPHandler(next)
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.TLS == nil {
+			challenges.ServeHTTP(w, req)
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// splitSecretName splits a -tls-secret value of the form namespace/name, or
+// name in the namespace of the pod.
+func splitSecretName(s string) (namespace, name string, err error) {
+	parts := strings.Split(s, "/")
+	switch {
+	case len(parts) == 1 && len(parts[0]) > 0:
+		return "", parts[0], nil
+	case len(parts) == 2 && len(parts[0]) > 0 && len(parts[1]) > 0:
+		return parts[0], parts[1], nil
+	}
+	return "", "", fmt.Errorf("invalid tls-secret %q, expected namespace/name", s)
+}
+
+// splitCertKeyPair splits a -tls-sni-cert value of the form cert.pem:key.pem.
+func splitCertKeyPair(pair string) (certFile, keyFile string, err error) {
+	parts := strings.SplitN(pair, ":", 2)
+	if len(parts) != 2 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+		return "", "", fmt.Errorf("invalid tls-sni-cert %q, expected cert.pem:key.pem", pair)
+	}
+	return parts[0], parts[1], nil
+}
+
+// certificateFilesVersion returns the modification times and sizes of the
+// tls-cert, tls-key and tls-sni-cert files.
+func certificateFilesVersion() string {
+	var files []string
+	if len(serverCertFile) > 0 {
+		files = append(files, serverCertFile, serverKeyFile)
+	}
+	for _, pair := range sniCertsFlag {
+		if certFile, keyFile, err := splitCertKeyPair(pair); err == nil {
+			files = append(files, certFile, keyFile)
+		}
+	}
+
+	return filesVersion(files...)
+}
+
+// filesVersion returns the modification times and sizes of files.
+func filesVersion(files ...string) string {
+	var version string
+	for _, f := range files {
+		if fi, err := os.Stat(f); err == nil {
+			version += fmt.Sprintf("%d/%d ", fi.ModTime().UnixNano(), fi.Size())
+		} else {
+			version += err.Error() + " "
+		}
+	}
+	return version
+}
+
+// loadServerCertificates loads the tls-cert and tls-key pair, or the
+// certificate of tls-secret or tls-vault-secret, followed by the tls-sni-cert
+// pairs. The TLS handshake picks the certificate matching the server name
+// requested by the client, falling back to the first. The returned version
+// changes whenever one of the files or secrets does.
+func loadServerCertificates() ([]tls.Certificate, string, error) {
+	certs := make([]tls.Certificate, 0, 1+len(sniCertsFlag))
+	version := certificateFilesVersion()
+	var cert tls.Certificate
+	var err error
+	if len(tlsSecretName) > 0 {
+		var secretVersion string
+		cert, secretVersion, err = loadSecretCertificate(tlsSecretName)
+		version += "secret@" + secretVersion
+	} else if len(tlsVaultSecret) > 0 {
+		var secretVersion string
+		cert, secretVersion, err = loadVaultCertificate(tlsVaultSecret)
+		version += "vault@" + secretVersion
+	} else {
+		cert, err = tls.LoadX509KeyPair(serverCertFile, serverKeyFile)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	certs = append(certs, cert)
+
+	for _, pair := range sniCertsFlag {
+		certFile, keyFile, err := splitCertKeyPair(pair)
+		if err != nil {
+			return nil, "", err
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid tls-sni-cert %s: %v", pair, err)
+		}
+		certs = append(certs, cert)
+	}
+	return certs, version, nil
+}
+
+// loadSecretCertificate reads the certificate and key of the
+// kubernetes.io/tls Secret namespace/name from the Kubernetes API, returning
+// them with the resource version of the Secret.
+func loadSecretCertificate(secret string) (tls.Certificate, string, error) {
+	namespace, name, err := splitSecretName(secret)
+	if err != nil {
+		return tls.Certificate{}, "", err
+	}
+	if err = initClusterClient(); err != nil {
+		return tls.Certificate{}, "", err
+	}
+	if len(namespace) == 0 {
+		namespace = clusterClient.Namespace
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	data, version, err := clusterClient.Secret(ctx, namespace, name)
+	if err != nil {
+		return tls.Certificate{}, "", err
+	}
+	cert, err := tls.X509KeyPair([]byte(data["tls.crt"]), []byte(data["tls.key"]))
+	if err != nil {
+		return tls.Certificate{}, "", fmt.Errorf("invalid tls-secret %s: %v", secret, err)
+	}
+	return cert, version, nil
+}
+
+// serverCertificates are the certificates served over TLS, replaced when
+// their source changes.
+type serverCertificates struct {
+	v atomic.Value // []tls.Certificate
+}
+
+func newServerCertificates(certs []tls.Certificate) *serverCertificates {
+	c := &serverCertificates{}
+	c.v.Store(certs)
+	return c
+}
+
+// GetCertificate picks the first certificate supported by the client, like
+// tls.Config does for its Certificates, falling back to the first.
+func (c *serverCertificates) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	certs := c.v.Load().([]tls.Certificate)
+	for i := range certs {
+		if hello.SupportsCertificate(&certs[i]) == nil {
+			return &certs[i], nil
+		}
+	}
+	return &certs[0], nil
+}
+
+// watch reloads the certificates whenever the version returned by
+// loadServerCertificates changes from version, so renewed certificates are
+// served to new connections without a restart. Files are only read again
+// once they have changed.
+func (c *serverCertificates) watch(version string, logger *zap.SugaredLogger) {
+	for range time.Tick(configWatchInterval) {
+		if len(tlsSecretName) == 0 && len(tlsVaultSecret) == 0 && certificateFilesVersion() == version {
+			continue
+		}
+		certs, cur, err := loadServerCertificates()
+		if err != nil {
+			logger.Warnw(
+				"Failed to reload TLS certificates",
+				"error", err,
+			)
+			continue
+		}
+		if cur != version {
+			version = cur
+			c.v.Store(certs)
+			logger.Infow("Reloaded TLS certificates")
+		}
+	}
+}
+
+// clientCertificate is presented to servers that request a client
+// certificate. It is loaded again whenever its files change, while the
+// previous certificate is kept until the new pair is complete.
+type clientCertificate struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	version string
+}
+
+var (
+	upstreamClientCertOnce sync.Once
+	upstreamClientCert     *clientCertificate
+)
+
+// upstreamClientCertificate returns the upstream-client-cert shared by all
+// transports, or nil if none is configured.
+func upstreamClientCertificate() *clientCertificate {
+	upstreamClientCertOnce.Do(func() {
+		if len(upstreamClientCertFile) > 0 {
+			upstreamClientCert = &clientCertificate{certFile: upstreamClientCertFile, keyFile: upstreamClientKeyFile}
+		}
+	})
+	return upstreamClientCert
+}
+
+func (c *clientCertificate) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	version := filesVersion(c.certFile, c.keyFile)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.cert != nil && version == c.version {
+		return c.cert, nil
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		if c.cert != nil {
+			return c.cert, nil
+		}
+		return nil, fmt.Errorf("failed to load upstream client certificate: %v", err)
+	}
+	c.cert, c.version = &cert, version
+	return c.cert, nil
+}
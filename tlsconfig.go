@@ -0,0 +1,128 @@
+//    Copyright 2017 Red Hat, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// tlsVersions are the values of tls-min-version and tls-max-version.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tlsCurves are the values of tls-curve.
+var tlsCurves = map[string]tls.CurveID{
+	"X25519":         tls.X25519,
+	"X25519MLKEM768": tls.X25519MLKEM768,
+	"P256":           tls.CurveP256,
+	"P384":           tls.CurveP384,
+	"P521":           tls.CurveP521,
+}
+
+// tlsSettings are the protocol versions, cipher suites and curves allowed
+// by both the listener and the transports.
+type tlsSettings struct {
+	minVersion   uint16
+	maxVersion   uint16
+	cipherSuites []uint16
+	curves       []tls.CurveID
+}
+
+// parseTLSSettings parses tls-min-version, tls-max-version, tls-cipher-suite
+// and tls-curve.
+func parseTLSSettings() (*tlsSettings, error) {
+	s := &tlsSettings{}
+	var ok bool
+	if s.minVersion, ok = tlsVersions[tlsMinVersion]; !ok {
+		return nil, fmt.Errorf("unknown tls-min-version %q, expected one of %s", tlsMinVersion, tlsVersionNames())
+	}
+	if len(tlsMaxVersion) > 0 {
+		if s.maxVersion, ok = tlsVersions[tlsMaxVersion]; !ok {
+			return nil, fmt.Errorf("unknown tls-max-version %q, expected one of %s", tlsMaxVersion, tlsVersionNames())
+		}
+		if s.maxVersion < s.minVersion {
+			return nil, fmt.Errorf("tls-max-version %s is below tls-min-version %s", tlsMaxVersion, tlsMinVersion)
+		}
+	}
+
+	suites := map[string]uint16{}
+	for _, cs := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		suites[cs.Name] = cs.ID
+	}
+	for _, name := range tlsCipherSuitesFlag {
+		id, ok := suites[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown tls-cipher-suite %q", name)
+		}
+		s.cipherSuites = append(s.cipherSuites, id)
+	}
+
+	for _, name := range tlsCurvesFlag {
+		id, ok := tlsCurves[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown tls-curve %q", name)
+		}
+		s.curves = append(s.curves, id)
+	}
+	return s, nil
+}
+
+// checkHTTP2 checks that the cipher suites allow HTTP/2, which requires an
+// AES-128-GCM suite unless only TLS 1.3 is spoken.
+func (s *tlsSettings) checkHTTP2() error {
+	if len(s.cipherSuites) == 0 || s.minVersion >= tls.VersionTLS13 {
+		return nil
+	}
+	for _, id := range s.cipherSuites {
+		if id == tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 || id == tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 {
+			return nil
+		}
+	}
+	return errors.New("tls-cipher-suite must include TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 or TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 for http2")
+}
+
+// checkHTTP3 checks that TLS 1.3 is allowed, which QUIC requires.
+func (s *tlsSettings) checkHTTP3() error {
+	if s.maxVersion != 0 && s.maxVersion < tls.VersionTLS13 {
+		return errors.New("http3-listen requires tls-max-version 1.3")
+	}
+	return nil
+}
+
+func tlsVersionNames() string {
+	var names []string
+	for name := range tlsVersions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// apply restricts c to the settings. Cipher suites only apply up to TLS 1.2,
+// as TLS 1.3 suites aren't configurable.
+func (s *tlsSettings) apply(c *tls.Config) {
+	c.MinVersion = s.minVersion
+	c.MaxVersion = s.maxVersion
+	c.CipherSuites = s.cipherSuites
+	c.CurvePreferences = s.curves
+}
@@ -0,0 +1,81 @@
+//    Copyright 2017 Red Hat, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"sync"
+
+	"github.com/syndesisio/token-rp/pkg/verify"
+)
+
+// tokenDecrypter decrypts encrypted tokens with the keys of the
+// token-decryption-key files, re-reading them whenever they change so keys
+// can be rotated without a restart.
+type tokenDecrypter struct {
+	files []string
+
+	mu      sync.Mutex
+	keys    []verify.DecryptionKey
+	version string
+}
+
+// newTokenDecrypter returns a decrypter of the keys in files, which must be
+// readable.
+func newTokenDecrypter(files []string) (*tokenDecrypter, error) {
+	d := &tokenDecrypter{files: files}
+	if _, err := d.load(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// load returns the decryption keys, reading the files again if they were
+// modified. If they can't be read, the previous keys are kept.
+func (d *tokenDecrypter) load() ([]verify.DecryptionKey, error) {
+	version := filesVersion(d.files...)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.keys != nil && version == d.version {
+		return d.keys, nil
+	}
+	var keys []verify.DecryptionKey
+	for _, f := range d.files {
+		fileKeys, err := verify.LoadDecryptionKeys(f)
+		if err != nil {
+			if d.keys != nil {
+				return d.keys, nil
+			}
+			return nil, err
+		}
+		keys = append(keys, fileKeys...)
+	}
+	d.keys, d.version = keys, version
+	return keys, nil
+}
+
+// Decrypt returns the nested JWT of token if it is encrypted, and token
+// otherwise.
+func (d *tokenDecrypter) Decrypt(token string) (string, error) {
+	if !verify.IsEncrypted(token) {
+		return token, nil
+	}
+	keys, err := d.load()
+	if err != nil {
+		return "", err
+	}
+	return verify.Decrypt(token, keys)
+}
@@ -0,0 +1,278 @@
+//    Copyright 2017 Red Hat, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/contrib/propagators/b3"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+const (
+	spanKindServer = trace.SpanKindServer
+	spanKindClient = trace.SpanKindClient
+
+	spanShutdownTimeout = 10 * time.Second
+)
+
+// parseSampler parses the OTEL_TRACES_SAMPLER name and its
+// OTEL_TRACES_SAMPLER_ARG, defaulting to parentbased_always_on. Unlike the
+// SDK, which falls back to the default, invalid settings are refused.
+func parseSampler(name, arg string) (sdktrace.Sampler, error) {
+	var s sdktrace.Sampler
+	switch strings.TrimPrefix(name, "parentbased_") {
+	case "", "always_on":
+		s = sdktrace.AlwaysSample()
+	case "always_off":
+		s = sdktrace.NeverSample()
+	case "traceidratio":
+		ratio := 1.0
+		if len(arg) > 0 {
+			var err error
+			ratio, err = strconv.ParseFloat(arg, 64)
+			if err != nil || ratio < 0 || ratio > 1 {
+				return nil, fmt.Errorf("invalid OTEL_TRACES_SAMPLER_ARG %q, must be a ratio between 0 and 1", arg)
+			}
+		}
+		s = sdktrace.TraceIDRatioBased(ratio)
+	default:
+		return nil, fmt.Errorf("unsupported OTEL_TRACES_SAMPLER %q", name)
+	}
+	if name == "" || strings.HasPrefix(name, "parentbased_") {
+		s = sdktrace.ParentBased(s)
+	}
+	return s, nil
+}
+
+// tracingEnabledFromEnv reports whether span export is enabled, which it is
+// if OTEL_TRACES_EXPORTER is otlp or an OTLP endpoint is configured, unless
+// OTEL_TRACES_EXPORTER is none.
+func tracingEnabledFromEnv() bool {
+	exporter := os.Getenv("OTEL_TRACES_EXPORTER")
+	if exporter == "none" {
+		return false
+	}
+	return exporter == "otlp" || os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") != "" ||
+		os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != ""
+}
+
+// traceSettingsFromEnv checks the OTEL_* environment variables the SDK
+// doesn't validate, returning the configured sampler.
+func traceSettingsFromEnv() (sdktrace.Sampler, error) {
+	protocol := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_PROTOCOL")
+	if protocol == "" {
+		protocol = os.Getenv("OTEL_EXPORTER_OTLP_PROTOCOL")
+	}
+	if protocol != "" && protocol != "http/protobuf" {
+		return nil, fmt.Errorf("unsupported OTLP protocol %q, only http/protobuf is supported", protocol)
+	}
+	return parseSampler(os.Getenv("OTEL_TRACES_SAMPLER"), os.Getenv("OTEL_TRACES_SAMPLER_ARG"))
+}
+
+// span is an operation being traced.
+type span struct {
+	trace.Span
+}
+
+func (s span) SetAttribute(key string, value interface{}) {
+	var kv attribute.KeyValue
+	switch value := value.(type) {
+	case bool:
+		kv = attribute.Bool(key, value)
+	case int:
+		kv = attribute.Int(key, value)
+	case int64:
+		kv = attribute.Int64(key, value)
+	case float64:
+		kv = attribute.Float64(key, value)
+	default:
+		kv = attribute.String(key, fmt.Sprintf("%v", value))
+	}
+	s.SetAttributes(kv)
+}
+
+func (s span) SetError(err error) {
+	if err == nil {
+		return
+	}
+	s.RecordError(err)
+	s.SetStatus(codes.Error, err.Error())
+}
+
+// tracer records spans with the OpenTelemetry SDK and exports them with
+// OTLP over HTTP. A nil tracer records nothing, but its spans still carry
+// the trace context of their parent.
+type tracer struct {
+	provider *sdktrace.TracerProvider
+	tracer   trace.Tracer
+}
+
+// newTracerFromEnv configures a tracer from the standard OTEL_* environment
+// variables, which the exporter, the batch span processor and the resource
+// read as well. It returns nil, disabling tracing, unless span export is
+// enabled.
+func newTracerFromEnv(hc *http.Client, logger *zap.SugaredLogger) (*tracer, error) {
+	if !tracingEnabledFromEnv() {
+		return nil, nil
+	}
+
+	sampler, err := traceSettingsFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := context.Background()
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithHTTPClient(hc))
+	if err != nil {
+		return nil, err
+	}
+	// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES override the defaults.
+	res, err := resource.New(ctx,
+		resource.WithAttributes(semconv.ServiceName("token-rp")),
+		resource.WithTelemetrySDK(),
+		resource.WithFromEnv(),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	// Export failures are reported through the global error handler.
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		logger.Warnw(
+			"Failed to export spans",
+			"error", err,
+		)
+	}))
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sampler),
+	)
+	return &tracer{
+		provider: provider,
+		tracer:   provider.Tracer("token-rp"),
+	}, nil
+}
+
+// Start begins a span as a child of the span in ctx, or as the root of a new
+// trace. Spans the sampler drops aren't recorded, but their context is still
+// propagated as not sampled.
+func (t *tracer) Start(ctx context.Context, name string, kind trace.SpanKind) (context.Context, span) {
+	if t == nil {
+		return ctx, span{trace.SpanFromContext(ctx)}
+	}
+	ctx, s := t.tracer.Start(ctx, name, trace.WithSpanKind(kind))
+	return ctx, span{s}
+}
+
+// Shutdown exports all queued spans.
+func (t *tracer) Shutdown() {
+	if t == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), spanShutdownTimeout)
+	defer cancel()
+	_ = t.provider.Shutdown(ctx)
+}
+
+// tracePropagation lists the formats trace context is propagated in.
+type tracePropagation struct {
+	w3c     bool
+	b3      bool
+	b3Multi bool
+}
+
+func parseTracePropagation(formats string) (tracePropagation, error) {
+	var tp tracePropagation
+	for _, f := range strings.Split(formats, ",") {
+		switch strings.TrimSpace(f) {
+		case "", "none":
+		case "w3c":
+			tp.w3c = true
+		case "b3":
+			tp.b3 = true
+		case "b3multi":
+			tp.b3Multi = true
+		default:
+			return tp, fmt.Errorf("unknown trace propagation format %q", f)
+		}
+	}
+	return tp, nil
+}
+
+func (tp tracePropagation) enabled() bool {
+	return tp.w3c || tp.b3 || tp.b3Multi
+}
+
+// extract returns ctx with the trace context of an incoming request,
+// preferring W3C over B3 headers, as the composite propagator lets later
+// propagators override earlier ones.
+func (tp tracePropagation) extract(ctx context.Context, h http.Header) context.Context {
+	return propagation.NewCompositeTextMapPropagator(
+		b3.New(),
+		propagation.TraceContext{},
+	).Extract(ctx, propagation.HeaderCarrier(h))
+}
+
+// contextWithRootSpan starts a new, sampled trace for requests arriving
+// without one while spans aren't recorded.
+func contextWithRootSpan(ctx context.Context) context.Context {
+	var tid trace.TraceID
+	var sid trace.SpanID
+	_, _ = rand.Read(tid[:])
+	_, _ = rand.Read(sid[:])
+	return trace.ContextWithSpanContext(ctx, trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    tid,
+		SpanID:     sid,
+		TraceFlags: trace.FlagsSampled,
+	}))
+}
+
+// inject sets the trace context headers of an outgoing request from the
+// span in ctx.
+func (tp tracePropagation) inject(ctx context.Context, h http.Header) {
+	var propagators []propagation.TextMapPropagator
+	if tp.w3c {
+		propagators = append(propagators, propagation.TraceContext{})
+	}
+	if tp.b3 {
+		propagators = append(propagators, b3.New(b3.WithInjectEncoding(b3.B3SingleHeader)))
+	}
+	if tp.b3Multi {
+		// The B3 propagator doesn't replace the optional headers.
+		h.Del("X-B3-Parentspanid")
+		h.Del("X-B3-Flags")
+		propagators = append(propagators, b3.New(b3.WithInjectEncoding(b3.B3MultipleHeader)))
+	}
+	propagation.NewCompositeTextMapPropagator(propagators...).Inject(ctx, propagation.HeaderCarrier(h))
+}
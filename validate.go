@@ -0,0 +1,307 @@
+//    Copyright 2017 Red Hat, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-oidc/oidc"
+	"github.com/syndesisio/token-rp/pkg/config"
+	"github.com/syndesisio/token-rp/pkg/exchange"
+	"github.com/syndesisio/token-rp/pkg/proxy"
+	"github.com/syndesisio/token-rp/pkg/spiffe"
+	"github.com/syndesisio/token-rp/pkg/verify"
+)
+
+// validateTimeout bounds each request made while validating.
+const validateTimeout = 10 * time.Second
+
+// runValidate checks the configuration given by args, the environment and
+// config file without serving, printing one line per check. It returns the
+// process exit code: 0 if all checks passed, 1 otherwise.
+func runValidate(args []string) int {
+	if err := flagSet.Parse(args); err != nil {
+		return 2
+	}
+	if len(configFile) == 0 {
+		configFile = os.Getenv(config.EnvName("config"))
+	}
+
+	failed := false
+	check := func(name string, err error) {
+		if err != nil {
+			failed = true
+			fmt.Printf("[-]%s failed: %v\n", name, err)
+		} else {
+			fmt.Printf("[+]%s ok\n", name)
+		}
+	}
+
+	if err := applyConfig(flagSet, configFile); err != nil {
+		check("config", err)
+		return 1
+	}
+	check("config", nil)
+	check("options", validateOptions())
+
+	cfg, err := newHandlerConfig(&reloadable, configFile)
+	check("routing", err)
+
+	if len(serverCertFile) > 0 && len(serverKeyFile) > 0 {
+		_, _, err := loadServerCertificates()
+		check("tls-cert", err)
+	}
+	if len(tlsSecretName) > 0 {
+		_, _, err := loadServerCertificates()
+		check("tls-secret", err)
+	}
+	if len(tlsVaultSecret) > 0 {
+		_, _, err := loadServerCertificates()
+		check("tls-vault-secret", err)
+	}
+	if len(upstreamClientCertFile) > 0 && len(upstreamClientKeyFile) > 0 {
+		_, err := tls.LoadX509KeyPair(upstreamClientCertFile, upstreamClientKeyFile)
+		check("upstream-client-cert", err)
+	}
+	if len(tokenDecryptionKeysFlag) > 0 {
+		_, err := newTokenDecrypter(tokenDecryptionKeysFlag)
+		check("token-decryption-key", err)
+	}
+	if len(clientCAFile) > 0 {
+		_, err := newClientVerifier(clientCAFile, clientCRLFile)
+		check("client-ca", err)
+	}
+	if len(spiffeEndpointSocket) > 0 {
+		client, err := spiffe.NewClient(spiffeEndpointSocket)
+		if err == nil {
+			ctx, cancel := context.WithTimeout(context.Background(), validateTimeout)
+			_, err = client.FetchX509Context(ctx)
+			cancel()
+		}
+		check("spiffe-endpoint-socket", err)
+	}
+
+	if len(decoratorPlugin) > 0 {
+		_, err := proxy.LoadDecoratorPlugin(decoratorPlugin)
+		check("decorator-plugin", err)
+	}
+	if len(decoratorWASM) > 0 {
+		_, err := proxy.LoadDecoratorWASM(context.Background(), decoratorWASM, decoratorWASMTimeout, decoratorWASMMaxMemory*1024*1024)
+		check("decorator-wasm", err)
+	}
+
+	if cfg == nil {
+		return 1
+	}
+	trs := &destinationTransports{}
+	err = trs.Store(cfg)
+	check("ca-cert", err)
+	if err != nil {
+		return 1
+	}
+	hc := &http.Client{Transport: &trs.issuer, Timeout: validateTimeout}
+
+	if len(issuerURLsFlag) == 0 {
+		check("issuer-url", errors.New("no issuer-url specified"))
+	}
+	for _, u := range issuerURLsFlag {
+		issuerURL := strings.TrimSuffix(strings.TrimSuffix(u.String(), discoveryPath), "/")
+		providerConfig, err := oidc.FetchProviderConfig(hc, issuerURL)
+		if err == nil && verifyMode == verify.UserInfoMode && providerConfig.UserInfoEndpoint == nil {
+			err = errors.New("provider does not advertise a UserInfo endpoint")
+		}
+		if err == nil && verifyMode == verify.IntrospectionMode {
+			_, err = verify.IntrospectionEndpoint(hc, issuerURL, providerConfig.TokenEndpoint.String())
+		}
+		check("issuer "+issuerURL, err)
+	}
+	if verifyMode == verify.TokenReviewMode {
+		_, err := verify.NewInClusterTokenReviewVerifier(tokenReviewAudiencesFlag)
+		check("tokenreview", err)
+	}
+
+	if len(reloadable.proxyURLs) == 0 {
+		check("upstream", errors.New("no proxy-url specified"))
+	}
+	h := &healthChecker{client: hc, path: upstreamHealthPath}
+	for _, u := range append(reloadable.proxyURLs, reloadable.fallbackURLs...) {
+		check("upstream "+u.String(), h.checkEndpoint(u))
+	}
+
+	if failed {
+		return 1
+	}
+	return 0
+}
+
+// validateOptions checks the options that can be validated without network
+// access or touching the file system.
+func validateOptions() error {
+	var errs []string
+	fail := func(err error) {
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	if err := exchange.ValidateProviderType(idpType); err != nil {
+		fail(err)
+	}
+	if verifyMode != verify.JWTMode && verifyMode != verify.UserInfoMode && verifyMode != verify.IntrospectionMode && verifyMode != verify.TokenReviewMode {
+		fail(fmt.Errorf("unknown verify-mode %q", verifyMode))
+	}
+	if _, err := loadClientCredentials(); err != nil {
+		fail(err)
+	}
+	if len(tokenDecryptionKeysFlag) > 0 && verifyMode != verify.JWTMode {
+		fail(errors.New("token-decryption-key requires verify-mode jwt"))
+	}
+	if err := verify.ValidateAlgs(strings.Split(allowedAlgs, ",")); err != nil {
+		fail(fmt.Errorf("invalid allowed-algs: %v", err))
+	}
+	if _, err := proxy.ParseCIDRs(trustedProxiesFlag); err != nil {
+		fail(fmt.Errorf("invalid trusted-proxy: %v", err))
+	}
+	if err := proxy.ValidateForwardedMode(forwardedMode); err != nil {
+		fail(fmt.Errorf("invalid forwarded: %v", err))
+	}
+	if err := proxy.ValidateForwardedMode(xForwardedMode); err != nil {
+		fail(fmt.Errorf("invalid x-forwarded: %v", err))
+	}
+	if _, err := proxy.ParseStatusCodes(upstreamRetryStatus); err != nil {
+		fail(fmt.Errorf("invalid upstream-retry-status: %v", err))
+	}
+	if (len(serverCertFile) > 0) != (len(serverKeyFile) > 0) {
+		fail(errors.New("tls-cert and tls-key must be specified together"))
+	}
+	if (len(upstreamClientCertFile) > 0) != (len(upstreamClientKeyFile) > 0) {
+		fail(errors.New("upstream-client-cert and upstream-client-key must be specified together"))
+	}
+	if len(decoratorPlugin) > 0 && len(decoratorWASM) > 0 {
+		fail(errors.New("decorator-plugin can't be combined with decorator-wasm"))
+	}
+	if len(tlsSecretName) > 0 && len(serverCertFile) > 0 {
+		fail(errors.New("tls-secret can't be combined with tls-cert"))
+	}
+	if len(tlsVaultSecret) > 0 && (len(serverCertFile) > 0 || len(tlsSecretName) > 0) {
+		fail(errors.New("tls-vault-secret can't be combined with tls-cert or tls-secret"))
+	}
+	if len(tlsVaultSecret) > 0 {
+		fail(initVaultClient())
+	}
+	if len(tlsSecretName) > 0 {
+		_, _, err := splitSecretName(tlsSecretName)
+		fail(err)
+	}
+	if len(acmeDomainsFlag) > 0 && hasServerCertificate() {
+		fail(errors.New("acme-domain can't be combined with tls-cert, tls-secret or tls-vault-secret"))
+	}
+	if len(acmeDomainsFlag) > 0 && len(acmeCacheDir) == 0 {
+		fail(errors.New("acme-domain requires acme-cache-dir"))
+	}
+	if len(sniCertsFlag) > 0 && !hasServerCertificate() {
+		fail(errors.New("tls-sni-cert specified with no tls-cert, tls-secret or tls-vault-secret"))
+	}
+	if len(http3ListenAddr) > 0 && !servesTLS() {
+		fail(errors.New("http3-listen specified with no tls-cert, tls-secret or spiffe-endpoint-socket"))
+	}
+	for _, pair := range sniCertsFlag {
+		_, _, err := splitCertKeyPair(pair)
+		fail(err)
+	}
+	if settings, err := parseTLSSettings(); err != nil {
+		fail(err)
+	} else {
+		if enableHTTP2 && servesTLS() {
+			fail(settings.checkHTTP2())
+		}
+		if len(http3ListenAddr) > 0 {
+			fail(settings.checkHTTP3())
+		}
+	}
+	if len(spiffeEndpointSocket) > 0 {
+		_, err := spiffe.NewClient(spiffeEndpointSocket)
+		fail(err)
+	}
+	if len(clientCAFile) > 0 && !servesTLS() {
+		fail(errors.New("client-ca specified with no tls-cert, tls-secret or spiffe-endpoint-socket"))
+	}
+	if len(clientCRLFile) > 0 && len(clientCAFile) == 0 {
+		fail(errors.New("client-crl specified with no client-ca"))
+	}
+	if len(auditLogTarget) > 0 && len(auditLogKeyFile) == 0 {
+		fail(errors.New("audit-log requires audit-log-key-file"))
+	}
+	if enablePprof && len(adminListenAddr) == 0 {
+		fail(errors.New("enable-pprof specified with no admin-listen"))
+	}
+	fail(validateHTTP2Options())
+	if err := exchange.ValidateTokenExpiration(kubeTokenExpiration); err != nil {
+		fail(fmt.Errorf("invalid kubernetes-token-expiration: %v", err))
+	}
+	if err := exchange.ValidateAWSSessionDuration(awsSessionDuration); err != nil {
+		fail(fmt.Errorf("invalid aws-session-duration: %v", err))
+	}
+	for _, addr := range listenAddrsFlag {
+		la, err := parseListenAddr(addr, servesTLS())
+		fail(err)
+		if err == nil && la.tls && !servesTLS() {
+			fail(fmt.Errorf("listen address %s requires tls-cert and tls-key, tls-secret or spiffe-endpoint-socket", addr))
+		}
+	}
+	if len(adminListenAddr) > 0 {
+		_, err := parseListenAddr(adminListenAddr, false)
+		fail(err)
+	}
+	if len(authzWebhookURLFlag.Host) > 0 {
+		if err := proxy.ValidateWebhookFormat(authzWebhookFormat); err != nil {
+			fail(fmt.Errorf("invalid authz-webhook-format: %v", err))
+		}
+	}
+	if len(policyBundle) > 0 {
+		if _, err := proxy.LoadPolicy(context.Background(), policyBundle, policyQuery); err != nil {
+			fail(fmt.Errorf("invalid policy-bundle: %v", err))
+		}
+	}
+	if _, err := newAccessLogger(accessLogFormat, nil, nil); err != nil {
+		fail(fmt.Errorf("invalid access-log-format: %v", err))
+	}
+	if _, err := parseTracePropagation(tracePropagationFlag); err != nil {
+		fail(fmt.Errorf("invalid trace-propagation: %v", err))
+	}
+	if tracingEnabledFromEnv() {
+		if _, err := traceSettingsFromEnv(); err != nil {
+			fail(fmt.Errorf("invalid tracing configuration: %v", err))
+		}
+	}
+	if err := proxy.ValidateDryRunMode(dryRunMode); err != nil {
+		fail(fmt.Errorf("invalid dry-run: %v", err))
+	}
+	if logFormat != "json" && logFormat != "console" {
+		fail(errors.New("log-format must be json or console"))
+	}
+
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+//    Copyright 2017 Red Hat, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/syndesisio/token-rp/pkg/config"
+	"github.com/syndesisio/token-rp/pkg/vault"
+)
+
+var (
+	vaultOnce   sync.Once
+	vaultClient *vault.Client
+	vaultErr    error
+)
+
+// vaultSettings returns the configuration of the Vault client and the path
+// of the vault-secret, which may also be given by the environment as they
+// are needed before it is applied.
+func vaultSettings() (vault.Config, string) {
+	env := func(value, name string) string {
+		if len(value) > 0 {
+			return value
+		}
+		return os.Getenv(config.EnvName(name))
+	}
+	cfg := vault.Config{
+		Address:      env(vaultAddr, "vault-addr"),
+		CACert:       env(vaultCACert, "vault-ca-cert"),
+		AuthMethod:   env(vaultAuthMethod, "vault-auth-method"),
+		AuthMount:    env(vaultAuthMount, "vault-auth-mount"),
+		Role:         env(vaultRole, "vault-role"),
+		RoleID:       env(vaultRoleID, "vault-role-id"),
+		SecretIDFile: env(vaultSecretIDFile, "vault-secret-id-file"),
+	}
+	if len(cfg.AuthMethod) == 0 {
+		cfg.AuthMethod = vault.KubernetesAuth
+	}
+	return cfg, env(vaultSecretPath, "vault-secret")
+}
+
+// initVaultClient sets up vaultClient on first use.
+func initVaultClient() error {
+	vaultOnce.Do(func() {
+		cfg, _ := vaultSettings()
+		vaultClient, vaultErr = vault.NewClient(cfg)
+	})
+	return vaultErr
+}
+
+// readVaultSecret reads the secret at path from Vault.
+func readVaultSecret(path string) (map[string]string, string, error) {
+	if err := initVaultClient(); err != nil {
+		return nil, "", err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return vaultClient.Read(ctx, path)
+}
+
+// vaultConfigSources reads the vault-secret, returning it as a source along
+// with its version.
+func vaultConfigSources() ([]config.Source, string, error) {
+	_, path := vaultSettings()
+	if len(path) == 0 {
+		return nil, "", nil
+	}
+	values, version, err := readVaultSecret(path)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read vault-secret %s: %v", path, err)
+	}
+	name := "vault/" + path
+	if err = extractCABundle("vault/"+strings.Replace(path, "/", "_", -1), values); err != nil {
+		return nil, "", err
+	}
+	return []config.Source{{Name: name, Values: values}}, name + "@" + version + " ", nil
+}
+
+// loadVaultCertificate reads the certificate and key held by the tls.crt
+// and tls.key of the secret at path in Vault, returning them with its
+// version.
+func loadVaultCertificate(path string) (tls.Certificate, string, error) {
+	data, version, err := readVaultSecret(path)
+	if err != nil {
+		return tls.Certificate{}, "", err
+	}
+	cert, err := tls.X509KeyPair([]byte(data["tls.crt"]), []byte(data["tls.key"]))
+	if err != nil {
+		return tls.Certificate{}, "", fmt.Errorf("invalid tls-vault-secret %s: %v", path, err)
+	}
+	return cert, version, nil
+}